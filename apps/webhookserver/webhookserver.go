@@ -0,0 +1,377 @@
+package webhookserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v56/github"
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/ghactions"
+	"github.com/mumoshu/prenv/provisioner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// CommandApply and CommandDestroy are the slash commands
+	// that trigger prenv-apply and prenv-destroy when commented on a pull request.
+	// They can be followed by the names of the profiles, like `/prenv apply full`.
+	CommandApply   = "/prenv apply"
+	CommandDestroy = "/prenv destroy"
+
+	headerSignature256 = "X-Hub-Signature-256"
+)
+
+// Server is a webhook server that receives GitHub pull_request and issue_comment webhooks,
+// and runs prenv-apply or prenv-destroy for the pull request in-process.
+//
+// This is an alternative to running prenv on GitHub Actions,
+// useful for GitHub Enterprise Server without Actions runners, or when Actions minutes are tight.
+//
+// Webhooks are verified with the X-Hub-Signature-256 header, and deduplicated by the X-GitHub-Delivery header.
+// Verified webhooks are enqueued to a bounded work queue and processed one by one,
+// because provisioners chdir to the directories they render files to.
+type Server struct {
+	*config.WebhookServer
+
+	// run runs the job.
+	// It is replaced in tests.
+	run func(context.Context, job) error
+
+	queue chan job
+
+	mu         sync.Mutex
+	deliveries map[string]deliveryState
+	// deliveryIDs is the list of the remembered delivery IDs, oldest first.
+	deliveryIDs []string
+}
+
+type deliveryState int
+
+const (
+	deliveryQueued deliveryState = iota
+	deliveryDone
+)
+
+// job is a prenv run for a pull request, triggered by a webhook.
+type job struct {
+	deliveryID string
+	// action is either ghactions.EventTypeApply or ghactions.EventTypeDestroy.
+	action      string
+	pullRequest config.PullRequestEnvArgs
+	// profiles is the names of the profiles given to the slash command, if any.
+	profiles []string
+}
+
+func (j job) String() string {
+	return fmt.Sprintf("%s %s#%d (delivery %s)", j.action, j.pullRequest.Repository, j.pullRequest.Number, j.deliveryID)
+}
+
+func New(c *config.WebhookServer) *Server {
+	s := &Server{
+		WebhookServer: c,
+		deliveries:    map[string]deliveryState{},
+	}
+	s.run = s.runChain
+	return s
+}
+
+// Run starts the webhook server and the worker that processes the received webhooks.
+// This is a blocking call.
+// The server is stopped when the context is canceled.
+//
+// If the webhook secret is empty and the environment variable PRENV_WEBHOOK_SECRET is set,
+// the webhook secret is set to the value of the environment variable.
+func (s *Server) Run(ctx context.Context) error {
+	if e := os.Getenv(config.EnvWebhookSecret); e != "" {
+		if s.WebhookSecret != "" {
+			logrus.Warnf("%s is set but %s is also set. Using %s.", config.EnvWebhookSecret, config.FlagWebhookSecret, config.FlagWebhookSecret)
+		} else {
+			s.WebhookSecret = e
+		}
+	}
+
+	if err := s.Validate(); err != nil {
+		return errors.Wrap(err, "invalid configuration")
+	}
+
+	// Fail fast on a broken prenv.yaml, rather than on the first webhook.
+	if _, err := provisioner.ReadConfigFile(s.ConfigFile); err != nil {
+		return err
+	}
+
+	s.queue = make(chan job, s.QueueSize)
+
+	go s.work(ctx)
+
+	logrus.WithField("address", s.Address).Info("starting webhook server")
+	srv := http.Server{
+		Addr:    s.Address,
+		Handler: s,
+	}
+
+	go func() {
+		<-ctx.Done()
+		logrus.Info("stopping webhook server")
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logrus.WithError(err).Error("failed to stop webhook server")
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		logrus.WithError(err).Error("failed to read request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := github.ValidateSignature(r.Header.Get(headerSignature256), payload, []byte(s.WebhookSecret)); err != nil {
+		logrus.WithError(err).Warn("rejected webhook with invalid signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	deliveryID := github.DeliveryID(r)
+	if deliveryID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	j, err := s.parseJob(github.WebHookType(r), payload)
+	if err != nil {
+		logrus.WithError(err).Error("failed to parse webhook")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if j == nil {
+		// Events other than the ones that trigger prenv runs, like ping, are just acknowledged.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	j.deliveryID = deliveryID
+
+	if !s.markQueued(deliveryID) {
+		logrus.WithField("delivery", deliveryID).Info("ignoring duplicate delivery")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	select {
+	case s.queue <- *j:
+		logrus.Infof("enqueued %s", j)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s.forget(deliveryID)
+		logrus.Warnf("rejected %s: the work queue is full", j)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (s *Server) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-s.queue:
+			if err := s.run(ctx, j); err != nil {
+				logrus.WithError(err).Errorf("failed to run %s", j)
+				// Forget the delivery so that a redelivery of the webhook can retry the run.
+				s.forget(j.deliveryID)
+				continue
+			}
+
+			s.markDone(j.deliveryID)
+			logrus.Infof("finished %s", j)
+		}
+	}
+}
+
+// runChain runs the provisioner chain for the job within this process.
+// The prenv.yaml file is re-read on each run so that the server picks up changes without restarts.
+func (s *Server) runChain(ctx context.Context, j job) error {
+	cfg, err := provisioner.ReadConfigFile(s.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if j.pullRequest.HeadSHA == "" {
+		sha, err := getHeadSHA(ctx, j.pullRequest)
+		if err != nil {
+			return err
+		}
+
+		j.pullRequest.HeadSHA = sha
+	}
+
+	chains, err := provisioner.NewChains(&provisioner.Config{
+		Config:            cfg,
+		Action:            j.action,
+		PullRequest:       j.pullRequest,
+		RequestedProfiles: j.profiles,
+		InProcess:         !s.RepositoryDispatch,
+	})
+	if err != nil {
+		return err
+	}
+
+	return chains.Action(ctx)
+}
+
+// markQueued remembers the delivery ID and returns true if it is not seen before.
+// The oldest delivery IDs are forgotten once more than MaxDeliveries are remembered.
+func (s *Server) markQueued(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.deliveries[id]; ok {
+		return false
+	}
+
+	s.deliveries[id] = deliveryQueued
+	s.deliveryIDs = append(s.deliveryIDs, id)
+
+	for len(s.deliveryIDs) > s.MaxDeliveries {
+		oldest := s.deliveryIDs[0]
+		s.deliveryIDs = s.deliveryIDs[1:]
+		delete(s.deliveries, oldest)
+	}
+
+	return true
+}
+
+func (s *Server) markDone(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.deliveries[id]; ok {
+		s.deliveries[id] = deliveryDone
+	}
+}
+
+func (s *Server) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deliveries, id)
+
+	for i, v := range s.deliveryIDs {
+		if v == id {
+			s.deliveryIDs = append(s.deliveryIDs[:i], s.deliveryIDs[i+1:]...)
+			break
+		}
+	}
+}
+
+// parseJob parses the webhook payload and returns the job to run.
+// It returns nil without an error when the webhook does not trigger any prenv run,
+// including the slash commands commented by the ones not allowed to run them.
+func (s *Server) parseJob(eventType string, payload []byte) (*job, error) {
+	event, err := github.ParseWebHook(eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e := event.(type) {
+	case *github.PullRequestEvent:
+		var action string
+
+		switch e.GetAction() {
+		case "opened", "synchronize", "reopened":
+			action = ghactions.EventTypeApply
+		case "closed":
+			action = ghactions.EventTypeDestroy
+		default:
+			return nil, nil
+		}
+
+		return &job{
+			action: action,
+			pullRequest: config.PullRequestEnvArgs{
+				Number:     e.GetPullRequest().GetNumber(),
+				HeadSHA:    e.GetPullRequest().GetHead().GetSHA(),
+				Repository: e.GetRepo().GetFullName(),
+			},
+		}, nil
+	case *github.IssueCommentEvent:
+		if e.GetAction() != "created" || !e.GetIssue().IsPullRequest() {
+			return nil, nil
+		}
+
+		var action string
+
+		fields := strings.Fields(e.GetComment().GetBody())
+		if len(fields) < 2 {
+			return nil, nil
+		}
+
+		switch strings.Join(fields[:2], " ") {
+		case CommandApply:
+			action = ghactions.EventTypeApply
+		case CommandDestroy:
+			action = ghactions.EventTypeDestroy
+		default:
+			return nil, nil
+		}
+
+		if association := e.GetComment().GetAuthorAssociation(); !s.AllowsCommentAuthor(association) {
+			logrus.Warnf("ignoring %q commented on %s#%d by %s, whose author association %s is not allowed to run it",
+				strings.Join(fields[:2], " "), e.GetRepo().GetFullName(), e.GetIssue().GetNumber(), e.GetComment().GetUser().GetLogin(), association)
+			return nil, nil
+		}
+
+		var profiles []string
+		if len(fields) > 2 {
+			profiles = fields[2:]
+		}
+
+		// issue_comment webhooks do not contain the head SHA of the pull request.
+		// It is fetched from the GitHub API right before the run.
+		return &job{
+			action: action,
+			pullRequest: config.PullRequestEnvArgs{
+				Number:     e.GetIssue().GetNumber(),
+				Repository: e.GetRepo().GetFullName(),
+			},
+			profiles: profiles,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func getHeadSHA(ctx context.Context, pr config.PullRequestEnvArgs) (string, error) {
+	ownerRepo := strings.Split(pr.Repository, "/")
+	if len(ownerRepo) != 2 {
+		return "", fmt.Errorf("repository must be in the form of owner/repo: %s", pr.Repository)
+	}
+
+	client := config.NewGitHubClient()
+
+	p, _, err := client.PullRequests.Get(ctx, ownerRepo[0], ownerRepo[1], pr.Number)
+	if err != nil {
+		return "", fmt.Errorf("unable to get pull request %s#%d: %w", pr.Repository, pr.Number, err)
+	}
+
+	return p.GetHead().GetSHA(), nil
+}
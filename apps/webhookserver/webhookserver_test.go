@@ -0,0 +1,159 @@
+package webhookserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/ghactions"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "testsecret"
+
+func TestServeHTTP(t *testing.T) {
+	s := New(&config.WebhookServer{
+		WebhookSecret: testSecret,
+		QueueSize:     1,
+		MaxDeliveries: 10,
+	})
+	s.queue = make(chan job, s.QueueSize)
+
+	opened := `{"action":"opened","pull_request":{"number":123,"head":{"sha":"0123abc"}},"repository":{"full_name":"mumoshu/prenv-source"}}`
+
+	t.Run("invalid signature", func(t *testing.T) {
+		r := newRequest("pull_request", "1", opened, "invalid")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Len(t, s.queue, 0)
+	})
+
+	t.Run("pull_request opened", func(t *testing.T) {
+		r := newRequest("pull_request", "1", opened, testSecret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		require.Len(t, s.queue, 1)
+	})
+
+	t.Run("duplicate delivery", func(t *testing.T) {
+		r := newRequest("pull_request", "1", opened, testSecret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, s.queue, 1)
+	})
+
+	t.Run("issue_comment by non-collaborator", func(t *testing.T) {
+		comment := `{"action":"created","issue":{"number":123,"pull_request":{"url":"https://example.com"}},"comment":{"body":"/prenv destroy","author_association":"NONE"},"repository":{"full_name":"mumoshu/prenv-source"}}`
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, newRequest("issue_comment", "3", comment, testSecret))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, s.queue, 1, "the comment must not be enqueued")
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		r := newRequest("pull_request", "2", opened, testSecret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		// The rejected delivery is forgotten so that a redelivery is accepted once the queue has room.
+		<-s.queue
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, newRequest("pull_request", "2", opened, testSecret))
+		require.Equal(t, http.StatusAccepted, w.Code)
+	})
+}
+
+func TestParseJob(t *testing.T) {
+	testcases := []struct {
+		name      string
+		eventType string
+		payload   string
+		want      *job
+	}{
+		{
+			name:      "pull_request synchronize",
+			eventType: "pull_request",
+			payload:   `{"action":"synchronize","pull_request":{"number":1,"head":{"sha":"abc"}},"repository":{"full_name":"o/r"}}`,
+			want:      &job{action: ghactions.EventTypeApply, pullRequest: config.PullRequestEnvArgs{Number: 1, HeadSHA: "abc", Repository: "o/r"}},
+		},
+		{
+			name:      "pull_request closed",
+			eventType: "pull_request",
+			payload:   `{"action":"closed","pull_request":{"number":1,"head":{"sha":"abc"}},"repository":{"full_name":"o/r"}}`,
+			want:      &job{action: ghactions.EventTypeDestroy, pullRequest: config.PullRequestEnvArgs{Number: 1, HeadSHA: "abc", Repository: "o/r"}},
+		},
+		{
+			name:      "pull_request labeled",
+			eventType: "pull_request",
+			payload:   `{"action":"labeled","pull_request":{"number":1},"repository":{"full_name":"o/r"}}`,
+		},
+		{
+			name:      "issue_comment apply",
+			eventType: "issue_comment",
+			payload:   `{"action":"created","issue":{"number":2,"pull_request":{"url":"https://example.com"}},"comment":{"body":" /prenv apply\n","author_association":"MEMBER"},"repository":{"full_name":"o/r"}}`,
+			want:      &job{action: ghactions.EventTypeApply, pullRequest: config.PullRequestEnvArgs{Number: 2, Repository: "o/r"}},
+		},
+		{
+			name:      "issue_comment apply with profiles",
+			eventType: "issue_comment",
+			payload:   `{"action":"created","issue":{"number":2,"pull_request":{"url":"https://example.com"}},"comment":{"body":"/prenv apply minimal full","author_association":"COLLABORATOR"},"repository":{"full_name":"o/r"}}`,
+			want:      &job{action: ghactions.EventTypeApply, pullRequest: config.PullRequestEnvArgs{Number: 2, Repository: "o/r"}, profiles: []string{"minimal", "full"}},
+		},
+		{
+			name:      "issue_comment other command",
+			eventType: "issue_comment",
+			payload:   `{"action":"created","issue":{"number":2,"pull_request":{"url":"https://example.com"}},"comment":{"body":"/prenv applied","author_association":"OWNER"},"repository":{"full_name":"o/r"}}`,
+		},
+		{
+			name:      "issue_comment on issue",
+			eventType: "issue_comment",
+			payload:   `{"action":"created","issue":{"number":2},"comment":{"body":"/prenv apply","author_association":"OWNER"},"repository":{"full_name":"o/r"}}`,
+		},
+		{
+			name:      "issue_comment by non-collaborator",
+			eventType: "issue_comment",
+			payload:   `{"action":"created","issue":{"number":2,"pull_request":{"url":"https://example.com"}},"comment":{"body":"/prenv destroy","author_association":"NONE","user":{"login":"stranger"}},"repository":{"full_name":"o/r"}}`,
+		},
+		{
+			name:      "issue_comment by contributor",
+			eventType: "issue_comment",
+			payload:   `{"action":"created","issue":{"number":2,"pull_request":{"url":"https://example.com"}},"comment":{"body":"/prenv apply","author_association":"CONTRIBUTOR"},"repository":{"full_name":"o/r"}}`,
+		},
+		{
+			name:      "ping",
+			eventType: "ping",
+			payload:   `{"zen":"Keep it logically awesome."}`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := New(&config.WebhookServer{}).parseJob(tc.eventType, []byte(tc.payload))
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func newRequest(eventType, deliveryID, payload, secret string) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(payload))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", eventType)
+	r.Header.Set("X-GitHub-Delivery", deliveryID)
+	r.Header.Set(headerSignature256, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	return r
+}
@@ -2,30 +2,41 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 
 	"github.com/mumoshu/prenv/apps/outgoingwebhook"
 	"github.com/mumoshu/prenv/apps/sqsforwarder"
+	"github.com/mumoshu/prenv/apps/webhookserver"
 	"github.com/mumoshu/prenv/build"
 	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/ghactions"
 	"github.com/mumoshu/prenv/provisioner"
+	"github.com/mumoshu/prenv/secretref"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
 )
 
 func Main() error {
 	var rootCmd = &cobra.Command{
 		Use:     "prenv",
 		Version: build.Version(),
+		// Errors are printed by us so that the resolved secrets are redacted from them.
+		SilenceErrors: true,
 	}
 	rootCmd.AddCommand(NewCmdApply())
 	rootCmd.AddCommand(NewCmdDestroy())
 	rootCmd.AddCommand(NewCmdAction())
+	rootCmd.AddCommand(NewCmdValidate())
+	rootCmd.AddCommand(NewCmdConfig())
 	rootCmd.AddCommand(NewCmdSQSForwarder())
 	rootCmd.AddCommand(NewCmdOutgoingWebhook())
+	rootCmd.AddCommand(NewCmdServer())
 	ctx := newSignalContext()
 	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		rootCmd.PrintErrln("Error:", secretref.Redact(err.Error()))
 		return err
 	}
 	return nil
@@ -56,13 +67,49 @@ func runE(fn func(context.Context) error) func(cmd *cobra.Command, args []string
 	}
 }
 
+// inputsPrecedence describes how the command-line flags, the environment variables,
+// and the GitHub Actions event payload are combined.
+// It is appended to the long description of the commands that accept the flags added by addChainFlags.
+const inputsPrecedence = `
+
+Inputs are read from the command-line flags, the environment variables, and the GitHub Actions event payload,
+in that order of precedence:
+
+  --config   > PRENV_RAW_CONFIG > raw_config in the workflow_dispatch inputs or the repository_dispatch client_payload > ./prenv.yaml
+  --action   > action in the event payload at GITHUB_EVENT_PATH
+  --pr       > pull_request.number in the event payload at GITHUB_EVENT_PATH
+  --sha      > GITHUB_SHA
+  --repo     > GITHUB_REPOSITORY
+  --profile  > the labels of the pull request
+  --ref      > the ref in the delete event payload > GITHUB_REF
+
+Specify all of --pr, --sha, and --repo to run prenv outside of GitHub Actions, like on Jenkins, Buildkite, or your laptop.
+
+The environment is generated per pull request by default.
+Specify --env to deploy the environment with the given name, like a sandbox,
+or --ref to deploy the one for the branch or the tag matching the branches field of prenv.yaml,
+which is also the default on push and delete events.`
+
+func addChainFlags(cmd *cobra.Command, opts *provisioner.Options) {
+	cmd.Flags().StringVar(&opts.ConfigFile, "config", "", "The path to the prenv.yaml file.")
+	cmd.Flags().StringVar(&opts.Action, "action", "", "The action to run. Either \""+ghactions.EventTypeApply+"\" or \""+ghactions.EventTypeDestroy+"\".")
+	cmd.Flags().IntVar(&opts.PullRequest.Number, "pr", 0, "The number of the pull request to deploy.")
+	cmd.Flags().StringVar(&opts.PullRequest.HeadSHA, "sha", "", "The SHA of the head commit of the pull request to deploy.")
+	cmd.Flags().StringVar(&opts.PullRequest.Repository, "repo", "", "The repository that the pull request is made against, in the form of owner/repo.")
+	cmd.Flags().StringVar(&opts.EnvName, "env", "", "The name of the environment to deploy, like sandbox-alice, instead of the one for the pull request.")
+	cmd.Flags().StringVar(&opts.Ref, "ref", "", "The branch or the tag to deploy, like refs/heads/release/1.2 or refs/tags/v1.2, instead of the pull request.")
+	cmd.Flags().StringSliceVar(&opts.Profiles, "profile", nil, "The name of the profile to deploy. Can be specified multiple times. Defaults to the profiles selected by the labels of the pull request.")
+}
+
 func NewCmdApply() *cobra.Command {
+	var opts provisioner.Options
+
 	cmd := &cobra.Command{
 		Use:   "apply",
 		Short: "Apply prenv",
-		Long:  "deploys your application to the Per-Pull Request Environment.",
+		Long:  "deploys your application to the Per-Pull Request Environment." + inputsPrecedence,
 		RunE: runE(func(ctx context.Context) error {
-			cfg, err := provisioner.ChainFromEnv()
+			cfg, err := provisioner.ChainsFromEnv(opts)
 			if err != nil {
 				return err
 			}
@@ -71,16 +118,21 @@ func NewCmdApply() *cobra.Command {
 		}),
 	}
 
+	addChainFlags(cmd, &opts)
+	cmd.Flags().BoolVar(&opts.Resume, "resume", false, "Continue the failed apply recorded in the state store, skipping the provisioners that it has already applied.")
+
 	return cmd
 }
 
 func NewCmdDestroy() *cobra.Command {
+	var opts provisioner.Options
+
 	cmd := &cobra.Command{
 		Use:   "destroy",
 		Short: "Destroy prenv",
-		Long:  "undeploys your application from the Per-Pull Request Environment.",
+		Long:  "undeploys your application from the Per-Pull Request Environment." + inputsPrecedence,
 		RunE: runE(func(ctx context.Context) error {
-			cfg, err := provisioner.ChainFromEnv()
+			cfg, err := provisioner.ChainsFromEnv(opts)
 			if err != nil {
 				return err
 			}
@@ -89,16 +141,20 @@ func NewCmdDestroy() *cobra.Command {
 		}),
 	}
 
+	addChainFlags(cmd, &opts)
+
 	return cmd
 }
 
 func NewCmdAction() *cobra.Command {
+	var opts provisioner.Options
+
 	cmd := &cobra.Command{
 		Use:   "action",
 		Short: "prenv gh action",
-		Long:  "Runs either apply or destroy depending on the event type of the GitHub Actions repository_dispatch event sent by prenv.",
+		Long:  "Runs either apply or destroy depending on the event type of the GitHub Actions repository_dispatch event sent by prenv." + inputsPrecedence,
 		RunE: runE(func(ctx context.Context) error {
-			cfg, err := provisioner.ChainFromEnv()
+			cfg, err := provisioner.ChainsFromEnv(opts)
 			if err != nil {
 				return err
 			}
@@ -107,6 +163,86 @@ func NewCmdAction() *cobra.Command {
 		}),
 	}
 
+	addChainFlags(cmd, &opts)
+
+	return cmd
+}
+
+func NewCmdValidate() *cobra.Command {
+	var configFile string
+
+	cmd := &cobra.Command{
+		Use: "validate",
+		// Problems are not usage errors.
+		SilenceUsage: true,
+		Short:        "Validate prenv.yaml",
+		Long: "checks prenv.yaml against the JSON Schema, the syntax of the Go templates, the consistency of the delegations, " +
+			"and the references to the vars and the outputs, without running any provisioner.\n\n" +
+			"Each problem is printed as FILE:LINE: FIELD: MESSAGE, and the command fails when there is any.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems, err := provisioner.Validate(configFile)
+			if err != nil {
+				return err
+			}
+
+			for _, p := range problems {
+				cmd.Println(p.String())
+			}
+
+			if len(problems) > 0 {
+				return fmt.Errorf("found %d problem(s) in %s", len(problems), configFile)
+			}
+
+			cmd.Printf("%s is valid\n", configFile)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&configFile, "config", provisioner.ConfigFileName, "The path to the prenv.yaml file.")
+
+	return cmd
+}
+
+func NewCmdConfig() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect prenv.yaml",
+	}
+
+	cmd.AddCommand(NewCmdConfigView())
+
+	return cmd
+}
+
+func NewCmdConfigView() *cobra.Command {
+	var configFile string
+
+	cmd := &cobra.Command{
+		Use:          "view",
+		Short:        "Print the merged prenv.yaml",
+		SilenceUsage: true,
+		Long: "prints prenv.yaml merged with the files it imports, along with the template files loaded by the render provisioners.\n\n" +
+			"This is the config sent to the delegated runs via repository_dispatch.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := provisioner.ReadConfigFile(configFile)
+			if err != nil {
+				return err
+			}
+
+			data, err := yaml.Marshal(cfg)
+			if err != nil {
+				return err
+			}
+
+			cmd.Print(string(data))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&configFile, "config", provisioner.ConfigFileName, "The path to the prenv.yaml file.")
+
 	return cmd
 }
 
@@ -162,3 +298,29 @@ func NewCmdOutgoingWebhook() *cobra.Command {
 
 	return cmd
 }
+
+func NewCmdServer() *cobra.Command {
+	var c config.WebhookServer
+
+	cmd := &cobra.Command{
+		Use:   "server",
+		Short: "Webhook Server",
+		Long: "starts a web server that receives GitHub pull_request and issue_comment webhooks, and runs apply or destroy for the pull request in-process, without GitHub Actions.\n\n" +
+			"Pull requests are applied when opened, synchronized, or reopened, and destroyed when closed. " +
+			"Commenting \"" + webhookserver.CommandApply + "\" or \"" + webhookserver.CommandDestroy + "\" on a pull request triggers apply or destroy respectively, " +
+			"only when the commenter has one of the allowed author associations.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return webhookserver.New(&c).Run(cmd.Context())
+		},
+	}
+
+	cmd.Flags().StringVar(&c.Address, config.FlagAddress, ":8080", "The address the server listens on.")
+	cmd.Flags().StringVar(&c.WebhookSecret, config.FlagWebhookSecret, "", "The secret used to verify the X-Hub-Signature-256 header of the webhooks. Can also be set via "+config.EnvWebhookSecret+".")
+	cmd.Flags().StringVar(&c.ConfigFile, "config", provisioner.ConfigFileName, "The path to the prenv.yaml file.")
+	cmd.Flags().IntVar(&c.QueueSize, config.FlagQueueSize, 100, "The maximum number of webhooks waiting to be processed. Webhooks received while the queue is full are rejected so that GitHub can redeliver them.")
+	cmd.Flags().IntVar(&c.MaxDeliveries, config.FlagMaxDeliveries, 10000, "The maximum number of delivery IDs remembered to deduplicate webhook deliveries.")
+	cmd.Flags().BoolVar(&c.RepositoryDispatch, config.FlagRepositoryDispatch, false, "Send repository_dispatch events for provisioners with repositoryDispatch, instead of running them in-process.")
+	cmd.Flags().StringSliceVar(&c.CommentAuthorAssociations, config.FlagCommentAuthorAssociations, config.DefaultCommentAuthorAssociations, "The author associations of the commenters allowed to run the slash commands, like OWNER, MEMBER, COLLABORATOR, and CONTRIBUTOR. Comments from anyone else are ignored.")
+
+	return cmd
+}
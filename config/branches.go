@@ -0,0 +1,49 @@
+package config
+
+import "fmt"
+
+const (
+	RefTypeBranch = "branch"
+	RefTypeTag    = "tag"
+)
+
+// Branches configures the branch generator, which generates an environment per branch or tag matching the globs,
+// like a long-lived staging environment for each release branch.
+//
+// The branch generator is used when prenv is triggered by a push to, or a deletion of, a branch or a tag.
+type Branches struct {
+	// Include is the list of the globs of the branches, like `release/*`, that get environments.
+	Include []string `yaml:"include,omitempty"`
+
+	// Tags is the list of the globs of the tags, like `v*`, that get environments.
+	Tags []string `yaml:"tags,omitempty"`
+
+	// NameTemplate is the Go template used to generate the name of the environment.
+	// It is `prenv-{{ .Ref.Slug }}` by default.
+	NameTemplate string `yaml:"nameTemplate,omitempty"`
+}
+
+func (b *Branches) Validate() error {
+	for _, g := range append(append([]string{}, b.Include...), b.Tags...) {
+		if _, err := globRegexp(g); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", g, err)
+		}
+	}
+
+	return nil
+}
+
+// Match returns true if the branch or the tag matches the globs.
+func (b *Branches) Match(ref RefEnvArgs) (bool, error) {
+	globs := b.Include
+	if ref.Type == RefTypeTag {
+		globs = b.Tags
+	}
+
+	rs, err := globRegexps(globs)
+	if err != nil {
+		return false, err
+	}
+
+	return matchAnyRegexp(rs, ref.Name), nil
+}
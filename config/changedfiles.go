@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-github/v56/github"
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ChangedFiles returns the paths of the files changed by the pull request, relative to the root of the repository.
+//
+// They are read from the GitHub API when GITHUB_TOKEN is set.
+// Otherwise, or when the API fails, they are read via `git diff` between the base branch and the head commit
+// in the current working directory, which needs the history of both, like `fetch-depth: 0` of actions/checkout.
+func (a *PullRequestEnvArgs) ChangedFiles(ctx context.Context) ([]string, error) {
+	if os.Getenv(envvar.GitHubToken) != "" && a.Repository != "" && a.Number != 0 {
+		files, err := a.listChangedFiles(ctx)
+		if err == nil {
+			return files, nil
+		}
+
+		logrus.Warnf("unable to list the changed files of pull request #%d via the GitHub API, falling back to git diff: %v", a.Number, err)
+	}
+
+	return a.diffChangedFiles(ctx)
+}
+
+func (a *PullRequestEnvArgs) listChangedFiles(ctx context.Context) ([]string, error) {
+	owner, repo, ok := strings.Cut(a.Repository, "/")
+	if !ok {
+		return nil, fmt.Errorf("repository must be in the form of owner/repo")
+	}
+
+	client := NewGitHubClient()
+
+	var files []string
+
+	opts := &github.ListOptions{PerPage: 100}
+
+	for {
+		fs, resp, err := client.PullRequests.ListFiles(ctx, owner, repo, a.Number, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range fs {
+			files = append(files, f.GetFilename())
+
+			// A renamed file changes both the old and the new paths.
+			if f.GetPreviousFilename() != "" {
+				files = append(files, f.GetPreviousFilename())
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opts.Page = resp.NextPage
+	}
+
+	return files, nil
+}
+
+func (a *PullRequestEnvArgs) diffChangedFiles(ctx context.Context) ([]string, error) {
+	if a.BaseRef == "" {
+		return nil, fmt.Errorf("unable to diff the pull request without the base branch")
+	}
+
+	head := a.HeadSHA
+	if head == "" {
+		head = "HEAD"
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "diff", "--name-only", "origin/"+a.BaseRef+"..."+head)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logrus.Debugf("running %s", strings.Join(cmd.Args, " "))
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "git diff failed: %s", stderr.String())
+	}
+
+	var files []string
+	for _, l := range strings.Split(stdout.String(), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			files = append(files, l)
+		}
+	}
+
+	return files, nil
+}
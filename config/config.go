@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,6 +18,13 @@ import (
 //
 // See envvar/envvar.go for the list of the environment variables used by prenv for operational settings.
 type Config struct {
+	// Imports is the list of the paths to the YAML files, or the globs like `services/*/prenv.yaml`,
+	// that are deep-merged into this config.
+	// The paths are relative to the file that imports them, and so are the paths to the template files in the imported files.
+	// It is an error to define the same component, or a different value for the same field, in more than one file.
+	// prenv merges the imports when it reads prenv.yaml, so the config sent to the delegated runs has no imports.
+	Imports []string `yaml:"imports,omitempty"`
+
 	// EnvironmentNameTemplate is the Go template used to generate the name of the environment
 	// It is `{{ .Name }}-{{ .PullRequestNumber }}` by default,
 	// where the Name is the name of the ArgoCD application and the PullRequestNumber is the number of the pull request.
@@ -24,12 +33,39 @@ type Config struct {
 
 	NamePrefix string `yaml:"namePrefix,omitempty"`
 
+	// Vars is the user-defined variables available to the templates as `{{ .Vars.name }}`.
+	// Each value is a Go template rendered with the environment args, like `app-{{ .PullRequest.Number }}`,
+	// and can refer to the vars whose names come before it in alphabetical order.
+	// Components can override them via their own vars.
+	Vars map[string]string `yaml:"vars,omitempty"`
+
+	// Branches configures the environments generated per branch or tag, in addition to the ones per pull request.
+	Branches *Branches `yaml:"branches,omitempty"`
+
 	// Shared is the shared service that is shared by all the pull request environments.
 	Shared *Component `yaml:"shared,omitempty"`
 
 	// Dedicated is the service that is deployed to the Per-Pull Request Environment.
 	Dedicated *Component `yaml:"dedicated,omitempty"`
 
+	// Profiles is the named sets of the dedicated components, like `minimal` and `full`, keyed by the name of the profile.
+	// Each profile selected for a pull request, via a label or the `/prenv apply PROFILE` command,
+	// is deployed as an environment of its own whose name includes the name of the profile.
+	// All the components are deployed to a single environment per pull request when empty.
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
+
+	// OnFailure is what to do with the environment when a provisioner fails to apply.
+	// "keep" leaves the environment half-built, so that `prenv apply --resume` can continue the apply.
+	// "rollback" destroys the provisioners that the failed apply created,
+	// and re-applies the others with the config that the environment was last applied with successfully, in reverse order.
+	// "destroy" destroys the whole environment.
+	// Defaults to "keep".
+	OnFailure string `yaml:"onFailure,omitempty"`
+
+	// Policy is the set of rules that the files rendered by all the provisioners must satisfy
+	// before they are committed or applied.
+	Policy *Policy `yaml:"policy,omitempty"`
+
 	// EnvArgs is the set of arguments to be passed to the environment generator.
 	// This is populated when prenv is firstly invoked by GitHub Actions,
 	// and propagated to delegated prenv runs.
@@ -38,6 +74,38 @@ type Config struct {
 	EnvArgs *EnvArgs `yaml:"args,omitempty"`
 }
 
+// LoadRenderSources reads the template files referenced by all the render provisioners in the config.
+// dir is the directory containing prenv.yaml, which the paths to the template files are relative to.
+func (c *Config) LoadRenderSources(dir string) error {
+	for _, comp := range []*Component{c.Shared, c.Dedicated} {
+		if comp == nil {
+			continue
+		}
+
+		if err := comp.loadRenderSources(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Component) loadRenderSources(dir string) error {
+	if c.Render != nil {
+		if err := c.Render.LoadSources(dir); err != nil {
+			return err
+		}
+	}
+
+	for name, comp := range c.Components {
+		if err := comp.loadRenderSources(dir); err != nil {
+			return fmt.Errorf("component %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
 func (c Config) DeepCopy() Config {
 	data, err := yaml.Marshal(c)
 	if err != nil {
@@ -1,6 +1,16 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	RenderEngineText = "text"
+	RenderEngineHTML = "html"
+)
 
 type Component struct {
 	// NamePrefix is the base name of the Per-Pull Request Environment.
@@ -8,6 +18,18 @@ type Component struct {
 	// The generated environment name is then used to generate the name of the ArgoCD application.
 	NamePrefix string `yaml:"namePrefix,omitempty"`
 
+	// Vars overrides the vars for the provisioners of this component.
+	// The vars of a component in components are merged on top of the ones of its parent.
+	Vars map[string]string `yaml:"vars,omitempty"`
+
+	// Paths skips the provisioners of this component unless the pull request changes the files matching it.
+	// The components in components have their own paths, and are not affected by the paths of their parent.
+	Paths *Paths `yaml:"paths,omitempty"`
+
+	// Hooks is the commands run before and after the provisioners of this component are applied and destroyed.
+	// The components in components have their own hooks.
+	Hooks *Hooks `yaml:"hooks,omitempty"`
+
 	// AWSResources is the configuration for the AWS resources that are used by prenv.
 	// This includes the SQS queues that are used by the sqs-forwarder and by
 	// the pull-request environments.
@@ -20,6 +42,15 @@ type Component struct {
 
 	Render *Render `yaml:"render,omitempty"`
 
+	// Kustomize generates a kustomize overlay per environment.
+	Kustomize *Kustomize `yaml:"kustomize,omitempty"`
+
+	// Helm deploys a Helm chart per environment.
+	Helm *Helm `yaml:"helm,omitempty"`
+
+	// Terraform runs terraform per environment.
+	Terraform *Terraform `yaml:"terraform,omitempty"`
+
 	ArgoCD `yaml:"argocd,omitempty"`
 
 	// Components is a map of microservices that are deployed to the Per-Pull Request Environment.
@@ -32,13 +63,241 @@ type Component struct {
 type Render struct {
 	Delegate `yaml:",inline"`
 
+	// Engine is the template engine used to render the nameTemplate and the contentTemplate of the files.
+	// "text" renders the templates with text/template and the Sprig-compatible functions.
+	// "html" renders the templates with html/template, HTML-escaping the output, with only b64enc, split, and toJson available.
+	// It is for the configs written for older prenv that rely on the escaping.
+	// Defaults to "text".
+	Engine string `yaml:"engine,omitempty"`
+
 	Files []RenderedFile `yaml:"files,omitempty"`
+
+	// Partials is the list of paths to the files that define named templates via {{ define "name" }}.
+	// The named templates are available to all the files via {{ template "name" . }}.
+	// Files whose names start with "_" in any templateDir are partials, too.
+	// The paths are relative to the directory containing prenv.yaml.
+	Partials []string `yaml:"partials,omitempty"`
+
+	// Sources is the content of the template files referenced by templateFile, templateDir, and partials,
+	// keyed by the path relative to the directory containing prenv.yaml.
+	// prenv populates this when it reads prenv.yaml, so that the templates travel in the raw_config
+	// sent over repository_dispatch and the target repository does not need the source repository.
+	// You usually do not set this by yourself.
+	Sources map[string]string `yaml:"sources,omitempty"`
+}
+
+func (r *Render) Validate() error {
+	switch r.Engine {
+	case "", RenderEngineText, RenderEngineHTML:
+	default:
+		return fmt.Errorf("render.engine must be either %q or %q, but got %q", RenderEngineText, RenderEngineHTML, r.Engine)
+	}
+
+	for i, f := range r.Files {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("render.files[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// LoadSources reads the template files referenced by the files and the partials into Sources.
+// dir is the directory containing prenv.yaml, which the paths are relative to.
+func (r *Render) LoadSources(dir string) error {
+	var paths []string
+
+	for _, f := range r.Files {
+		if f.TemplateFile != "" {
+			paths = append(paths, f.TemplateFile)
+		}
+
+		if f.TemplateDir != "" {
+			root := filepath.Join(dir, f.TemplateDir)
+
+			if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if d.IsDir() {
+					return nil
+				}
+
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+
+				paths = append(paths, rel)
+
+				return nil
+			}); err != nil {
+				return fmt.Errorf("unable to read template dir %s: %w", f.TemplateDir, err)
+			}
+		}
+	}
+
+	paths = append(paths, r.Partials...)
+
+	for _, p := range paths {
+		b, err := os.ReadFile(filepath.Join(dir, p))
+		if err != nil {
+			return fmt.Errorf("unable to read template file %s: %w", p, err)
+		}
+
+		if r.Sources == nil {
+			r.Sources = map[string]string{}
+		}
+
+		r.Sources[filepath.ToSlash(filepath.Clean(p))] = string(b)
+	}
+
+	return nil
 }
 
 type RenderedFile struct {
-	Name            string `yaml:"name,omitempty"`
-	NameTemplate    string `yaml:"nameTemplate,omitempty"`
-	ContentTemplate string `yaml:"contentTemplate"`
+	// Name is the path to the rendered file.
+	// When TemplateDir is set, it is the directory the files are rendered to, defaulting to the current directory.
+	// When TemplateFile is set, it defaults to the base name of the template file.
+	Name string `yaml:"name,omitempty"`
+	// NameTemplate is the Go template used to generate the Name.
+	NameTemplate string `yaml:"nameTemplate,omitempty"`
+	// ContentTemplate is the Go template used to generate the content of the file.
+	ContentTemplate string `yaml:"contentTemplate,omitempty"`
+	// TemplateFile is the path to the file that contains the Go template used to generate the content of the file.
+	// The path is relative to the directory containing prenv.yaml.
+	TemplateFile string `yaml:"templateFile,omitempty"`
+	// TemplateDir is the path to the directory whose files are all rendered, preserving the directory tree.
+	// Each path segment can be a Go template, like {{ .PullRequest.Number }}/app.yaml.
+	// Files whose names start with "_" are partials and are not rendered.
+	// The path is relative to the directory containing prenv.yaml.
+	TemplateDir string `yaml:"templateDir,omitempty"`
+	// ForEach renders the file once per item in the list, with the item available as .Item and its index as .Index.
+	// It is either "pullRequests", which iterates over the numbers of all the open pull requests,
+	// or a Go template pipeline that evaluates to any list in the template data, like ".PullRequest.Numbers".
+	// NameTemplate, or the path segments of TemplateDir, must include .Item so that each item gets its own file.
+	//
+	// The files rendered via ForEach are shared among all the environments.
+	// A file is deleted once its item disappears from the list, like when the pull request is closed.
+	ForEach string `yaml:"forEach,omitempty"`
+	// Patch edits the existing file at Name in place, instead of rendering the whole file.
+	// It is for adding the entry for the environment to a file shared with humans and other tools,
+	// like values.yaml or kustomization.yaml, while preserving the rest of the file, including comments.
+	// The entry is added on apply and removed on destroy.
+	Patch *Patch `yaml:"patch,omitempty"`
+}
+
+// Patch is the set of edits to an existing YAML or JSON file.
+// The file is treated as JSON if its name ends with .json, or YAML otherwise.
+// It is created if missing, and deleted on destroy once the edits leave it empty.
+//
+// All the paths and values are Go templates rendered with the same data as contentTemplate.
+type Patch struct {
+	// MergePatch is the JSON Merge Patch (RFC 7386), written in YAML or JSON, to be merged into the file.
+	// On destroy, the keys that the patch sets are removed from the file.
+	MergePatch string `yaml:"mergePatch,omitempty"`
+	// Set sets the values at the paths.
+	// On destroy, the values are removed from the file.
+	Set []PatchSet `yaml:"set,omitempty"`
+	// Delete is the list of paths to the values to be deleted from the file, like `.a.b[0].c`.
+	// The deleted values are not restored on destroy.
+	Delete []string `yaml:"delete,omitempty"`
+	// Kustomize edits the images and the resources fields of kustomization.yaml.
+	Kustomize *KustomizePatch `yaml:"kustomize,omitempty"`
+}
+
+func (p *Patch) Validate() error {
+	if p.MergePatch == "" && len(p.Set) == 0 && len(p.Delete) == 0 && p.Kustomize == nil {
+		return fmt.Errorf("patch must have at least one of mergePatch, set, delete, and kustomize")
+	}
+
+	for i, s := range p.Set {
+		if s.Path == "" {
+			return fmt.Errorf("patch.set[%d]: path is required", i)
+		}
+	}
+
+	if p.Kustomize != nil {
+		for i, img := range p.Kustomize.Images {
+			if img.Name == "" {
+				return fmt.Errorf("patch.kustomize.images[%d]: name is required", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PatchSet sets the value at the path in the file.
+type PatchSet struct {
+	// Path is the yq-style or JSONPath-style path to the value, like `.a.b[0].c` or `$.a["b.c"]`.
+	// Missing mappings along the path are created.
+	Path string `yaml:"path"`
+	// Value is the value written in YAML or JSON, like `1`, `foo`, or `{"a": 1}`.
+	Value string `yaml:"value"`
+}
+
+// KustomizePatch is the set of edits to kustomization.yaml.
+type KustomizePatch struct {
+	// Images is the list of images to be added to or updated in the images field.
+	// On destroy, the images are removed by name.
+	Images []KustomizeImage `yaml:"images,omitempty"`
+	// Resources is the list of resources to be added to the resources field.
+	// On destroy, the resources are removed.
+	Resources []string `yaml:"resources,omitempty"`
+}
+
+// KustomizeImage is an entry in the images field of kustomization.yaml.
+type KustomizeImage struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName,omitempty"`
+	NewTag  string `yaml:"newTag,omitempty"`
+	Digest  string `yaml:"digest,omitempty"`
+}
+
+const (
+	// ForEachPullRequests is the ForEach value that iterates over the numbers of all the open pull requests.
+	ForEachPullRequests = "pullRequests"
+)
+
+func (f *RenderedFile) Validate() error {
+	if f.Patch != nil {
+		if f.ContentTemplate != "" || f.TemplateFile != "" || f.TemplateDir != "" {
+			return fmt.Errorf("patch cannot be used with contentTemplate, templateFile, or templateDir")
+		}
+
+		if f.Name == "" && f.NameTemplate == "" {
+			return fmt.Errorf("either name or nameTemplate must be set for patch")
+		}
+
+		if f.ForEach != "" {
+			return fmt.Errorf("patch cannot be used with forEach")
+		}
+
+		return f.Patch.Validate()
+	}
+
+	var n int
+	for _, v := range []string{f.ContentTemplate, f.TemplateFile, f.TemplateDir} {
+		if v != "" {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return fmt.Errorf("exactly one of contentTemplate, templateFile, templateDir, and patch must be set")
+	}
+
+	if f.ContentTemplate != "" && f.Name == "" && f.NameTemplate == "" {
+		return fmt.Errorf("either name or nameTemplate must be set for contentTemplate")
+	}
+
+	if f.ForEach != "" && f.TemplateDir == "" && f.NameTemplate == "" {
+		return fmt.Errorf("nameTemplate must be set for forEach so that each item gets its own file")
+	}
+
+	return nil
 }
 
 // ArgoCD is a set of configuration and apps for ArgoCD.
@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/google/go-github/v56/github"
 	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/render"
+	"github.com/mumoshu/prenv/secretref"
 )
 
 // EnvArgs is the parameters for the environment to be deployed per pull request.
@@ -18,16 +21,52 @@ type EnvArgs struct {
 	// It will be NameBase-PullRequestNumber by default.
 	Name string
 
+	// Profile is the name of the profile deployed to the environment, if any.
+	// It is a part of Name, like `prenv-1-full`.
+	Profile string `yaml:"profile,omitempty"`
+
 	// AppNameTemplate is the Go template used to generate the name of the ArgoCD application.
 	// It is `{{ .Environment.Name }}-{{ .Environment.PullRequestNumber }}` or `{{ .Environment.Name }}-{{ .Environment.PullRequestNumber }}-{{ .ShortName }} by default,
 	AppNameTemplate string
 
 	// The following fields are set by LoadEnvVars.
 	PullRequest *PullRequestEnvArgs `yaml:"pullRequest,omitempty"`
+
+	// Ref is the branch or the tag that the environment is generated for by the branch generator, if any.
+	Ref *RefEnvArgs `yaml:"ref,omitempty"`
+
+	// Outputs is the outputs of the provisioners that have already run for the environment,
+	// keyed by the name of the provisioner and then the name of the output,
+	// like `{{ .Outputs.aws.sqsDestinationQueueURL }}` or `{{ index .Outputs "pr-aws" "sqsDestinationQueueURL" }}`.
+	// prenv loads the outputs of the previous runs from the state store, and adds the outputs of each provisioner
+	// as it runs, so that later provisioners can use them.
+	Outputs map[string]map[string]interface{} `yaml:"outputs,omitempty"`
+
+	// Vars is the user-defined variables declared in the vars field of prenv.yaml, rendered for the environment.
+	// The vars of each component are merged on top of them, so that each provisioner sees the vars of its component.
+	Vars map[string]string `yaml:"vars,omitempty"`
+
+	// Inputs is the inputs of the workflow_dispatch event that triggered prenv, if any.
+	Inputs map[string]string `yaml:"inputs,omitempty"`
+
+	// Event is the payload of the GitHub Actions event that triggered prenv, if any.
+	Event map[string]interface{} `yaml:"event,omitempty"`
 }
 
 func (a *EnvArgs) LoadEnvVarsAndEvent() error {
-	pr := &PullRequestEnvArgs{}
+	pr := a.PullRequest
+	if pr == nil {
+		pr = &PullRequestEnvArgs{}
+	}
+
+	if err := a.LoadEvent(); err != nil {
+		return err
+	}
+
+	if p, ok := a.Event["pull_request"].(map[string]interface{}); ok {
+		pr.loadMetadataFromEvent(p)
+	}
+
 	if err := pr.LoadEnvVarsAndEvent(); err != nil {
 		return err
 	}
@@ -37,14 +76,139 @@ func (a *EnvArgs) LoadEnvVarsAndEvent() error {
 	return nil
 }
 
-func (a *EnvArgs) Validate() error {
-	if err := a.PullRequest.Validate(); err != nil {
+// LoadEvent loads the payload of the GitHub Actions event and the inputs of the workflow_dispatch event, if any.
+func (a *EnvArgs) LoadEvent() error {
+	if os.Getenv(envvar.GitHubEventPath) == "" {
+		return nil
+	}
+
+	payload, err := GetEventPayload()
+	if err != nil {
 		return err
 	}
 
+	a.Event = payload
+
+	if inputs, ok := payload["inputs"].(map[string]interface{}); ok {
+		a.Inputs = map[string]string{}
+		for k, v := range inputs {
+			a.Inputs[k] = fmt.Sprintf("%v", v)
+		}
+	}
+
 	return nil
 }
 
+// SourceRepository returns the repository that the environment is generated for, in the form of owner/repo,
+// like the one given via --repo.
+// It falls back to GITHUB_REPOSITORY when it is unknown.
+func (a EnvArgs) SourceRepository() string {
+	if a.PullRequest != nil && a.PullRequest.Repository != "" {
+		return a.PullRequest.Repository
+	}
+
+	if a.Ref != nil && a.Ref.Repository != "" {
+		return a.Ref.Repository
+	}
+
+	return os.Getenv(envvar.GitHubRepository)
+}
+
+// RenderVars renders the values of the vars as Go templates with the EnvArgs, and returns the rendered vars merged on top of a.Vars.
+// The vars are rendered in the order of their names, and each var can refer to the ones rendered before it via `{{ .Vars.name }}`.
+//
+// Vars that are secret references, like `ref+env://TOKEN`, are kept as they are,
+// and resolved by ResolveSecretRefs only in the run that renders or applies the provisioners.
+func (a EnvArgs) RenderVars(vars map[string]string) (map[string]string, error) {
+	rendered := map[string]string{}
+	for k, v := range a.Vars {
+		rendered[k] = v
+	}
+
+	var names []string
+	for k := range vars {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	for _, k := range names {
+		if secretref.IsRef(vars[k]) {
+			rendered[k] = vars[k]
+			continue
+		}
+
+		a.Vars = rendered
+
+		v, err := render.ExecuteString(render.EngineText, "vars."+k, vars[k], a)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render vars.%s: %w", k, err)
+		}
+
+		// A template can produce a secret reference out of the untrusted inputs, like the title of the pull request,
+		// which must never be resolved.
+		if secretref.IsRef(v) {
+			return nil, fmt.Errorf("vars.%s: the rendered value %q must not be a secret reference. Use a secret reference as the value of the var as is instead", k, v)
+		}
+
+		rendered[k] = v
+	}
+
+	return rendered, nil
+}
+
+// ResolveSecretRefs returns a copy of the EnvArgs with the vars that are secret references resolved.
+// It implements secretref.Resolvable.
+//
+// The rest of the fields are left untouched, as they contain untrusted inputs like the title of the pull request
+// and the event payload.
+func (a EnvArgs) ResolveSecretRefs(ctx context.Context) (interface{}, error) {
+	if a.Vars == nil {
+		return a, nil
+	}
+
+	vars := make(map[string]string, len(a.Vars))
+	for k, v := range a.Vars {
+		r, err := secretref.ResolveString(ctx, v)
+		if err != nil {
+			return nil, fmt.Errorf("vars.%s: %w", k, err)
+		}
+
+		vars[k] = r
+	}
+
+	a.Vars = vars
+
+	return a, nil
+}
+
+func (a *EnvArgs) Validate() error {
+	if a.PullRequest != nil {
+		return a.PullRequest.Validate()
+	}
+
+	if a.Name == "" {
+		return fmt.Errorf("the name of the environment is required")
+	}
+
+	return nil
+}
+
+// RefEnvArgs is the branch or the tag that the branch generator generates the environment for.
+type RefEnvArgs struct {
+	// Name is the name of the branch or the tag, like `release/1.2`.
+	Name string `yaml:"name,omitempty"`
+	// Type is either "branch" or "tag".
+	Type string `yaml:"type,omitempty"`
+	// Slug is Name in lowercase with the characters other than the alphanumerics replaced with `-`, like `release-1-2`,
+	// which can be a part of the names of the resources.
+	Slug string `yaml:"slug,omitempty"`
+	// SHA is the SHA of the commit that the branch or the tag points to.
+	SHA string `yaml:"sha,omitempty"`
+	// Repository is the repository of the branch or the tag, in the form of owner/repo.
+	Repository string `yaml:"repository,omitempty"`
+}
+
 type PullRequestEnvArgs struct {
 	// Number is the number of the pull request to be deployed.
 	Number int `yaml:"number,omitempty"`
@@ -58,33 +222,106 @@ type PullRequestEnvArgs struct {
 	// It is in the form of owner/repo.
 	// This is used to populate PullRequestNumbers.
 	Repository string `yaml:"repository,omitempty"`
+
+	// Title is the title of the pull request.
+	Title string `yaml:"title,omitempty"`
+	// Branch is the name of the head branch of the pull request.
+	Branch string `yaml:"branch,omitempty"`
+	// BaseRef is the name of the base branch of the pull request.
+	BaseRef string `yaml:"baseRef,omitempty"`
+	// Author is the login name of the user who opened the pull request.
+	Author string `yaml:"author,omitempty"`
+	// Labels is the names of the labels of the pull request.
+	Labels []string `yaml:"labels,omitempty"`
+}
+
+// loadMetadataFromEvent loads the metadata of the pull request from the pull_request field of the event payload.
+// Fields that are already set are left untouched.
+func (a *PullRequestEnvArgs) loadMetadataFromEvent(pr map[string]interface{}) {
+	str := func(m map[string]interface{}, keys ...string) string {
+		for _, k := range keys[:len(keys)-1] {
+			m, _ = m[k].(map[string]interface{})
+		}
+		s, _ := m[keys[len(keys)-1]].(string)
+		return s
+	}
+
+	var labels []string
+	if ls, ok := pr["labels"].([]interface{}); ok {
+		for _, l := range ls {
+			if m, ok := l.(map[string]interface{}); ok {
+				labels = append(labels, str(m, "name"))
+			}
+		}
+	}
+
+	a.setMetadata(str(pr, "title"), str(pr, "head", "ref"), str(pr, "base", "ref"), str(pr, "user", "login"), labels)
+}
+
+// loadMetadata loads the metadata of the pull request from the GitHub API response.
+// Fields that are already set are left untouched.
+func (a *PullRequestEnvArgs) loadMetadata(pr *github.PullRequest) {
+	var labels []string
+	for _, l := range pr.Labels {
+		labels = append(labels, l.GetName())
+	}
+
+	a.setMetadata(pr.GetTitle(), pr.GetHead().GetRef(), pr.GetBase().GetRef(), pr.GetUser().GetLogin(), labels)
+}
+
+func (a *PullRequestEnvArgs) setMetadata(title, branch, baseRef, author string, labels []string) {
+	if a.Title == "" {
+		a.Title = title
+	}
+
+	if a.Branch == "" {
+		a.Branch = branch
+	}
+
+	if a.BaseRef == "" {
+		a.BaseRef = baseRef
+	}
+
+	if a.Author == "" {
+		a.Author = author
+	}
+
+	if a.Labels == nil {
+		a.Labels = labels
+	}
 }
 
 // LoadEnvVarsAndEvent loads the environment variables and the GitHub Actions event payload.
 // The loaded values are set to the EnvParams and therefore avaiable for Go templates used
 // for generating the Kubernetes manifests.
+//
+// Fields that are already set, usually via the command-line flags, take precedence over
+// the environment variables and the event payload, and are left untouched.
+// That way, prenv can run outside of GitHub Actions, without GITHUB_EVENT_PATH,
+// as long as the pull request number, the head SHA, and the repository are given.
 func (a *PullRequestEnvArgs) LoadEnvVarsAndEvent() error {
-	prNumber, err := GetPullRequestNumber()
-	if err != nil {
-		return err
-	}
-
-	sha, err := GetSHA()
-	if err != nil {
-		return err
+	if a.Number == 0 {
+		prNumber, err := GetPullRequestNumber()
+		if err != nil {
+			return err
+		}
+
+		if prNumber != nil {
+			a.Number = *prNumber
+		}
 	}
 
-	a.HeadSHA = sha
+	if a.HeadSHA == "" {
+		sha, err := GetSHA()
+		if err != nil {
+			return err
+		}
 
-	if prNumber != nil {
-		a.Number = *prNumber
+		a.HeadSHA = sha
 	}
 
-	a.Repository = os.Getenv(envvar.GitHubRepository)
-
-	_, err = GetEventPayload()
-	if err != nil {
-		return err
+	if a.Repository == "" {
+		a.Repository = os.Getenv(envvar.GitHubRepository)
 	}
 
 	if err := a.LoadPullRequestNumbers(); err != nil {
@@ -96,7 +333,7 @@ func (a *PullRequestEnvArgs) LoadEnvVarsAndEvent() error {
 
 func (a *PullRequestEnvArgs) LoadPullRequestNumbers() error {
 	if a.Repository == "" {
-		return fmt.Errorf("repository is required")
+		return fmt.Errorf("repository is required. Set GITHUB_REPOSITORY env var or specify --repo")
 	}
 
 	ownerRepo := strings.Split(a.Repository, "/")
@@ -120,6 +357,12 @@ func (a *PullRequestEnvArgs) LoadPullRequestNumbers() error {
 
 	for _, pr := range r {
 		prNums = append(prNums, *pr.Number)
+
+		// The metadata is loaded from the API when it is not available in the event payload,
+		// like when prenv is run outside of GitHub Actions.
+		if pr.GetNumber() == a.Number {
+			a.loadMetadata(pr)
+		}
 	}
 
 	a.Numbers = prNums
@@ -129,11 +372,11 @@ func (a *PullRequestEnvArgs) LoadPullRequestNumbers() error {
 
 func (a *PullRequestEnvArgs) Validate() error {
 	if a.HeadSHA == "" {
-		return fmt.Errorf("githubSHA is required. Set GITHUB_SHA env var")
+		return fmt.Errorf("githubSHA is required. Set GITHUB_SHA env var or specify --sha")
 	}
 
 	if a.Number == 0 {
-		return fmt.Errorf("pullRequestNumber is required")
+		return fmt.Errorf("pullRequestNumber is required. Set GITHUB_EVENT_PATH env var or specify --pr")
 	}
 
 	return nil
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderVars(t *testing.T) {
+	env := EnvArgs{
+		Name: "prenv-123",
+		PullRequest: &PullRequestEnvArgs{
+			Number: 123,
+			Branch: "feature/foo",
+		},
+		Inputs: map[string]string{"size": "small"},
+	}
+
+	global, err := env.RenderVars(map[string]string{
+		"domain":   "{{ .Name }}.example.com",
+		"size":     "{{ .Inputs.size }}",
+		"url":      "https://{{ .Vars.domain }}",
+		"branch":   "{{ .PullRequest.Branch }}",
+		"constant": "foo",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"domain":   "prenv-123.example.com",
+		"size":     "small",
+		"url":      "https://prenv-123.example.com",
+		"branch":   "feature/foo",
+		"constant": "foo",
+	}, global)
+
+	env.Vars = global
+
+	component, err := env.RenderVars(map[string]string{
+		"constant": "bar",
+		"path":     "{{ .Vars.url }}/api",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"domain":   "prenv-123.example.com",
+		"size":     "small",
+		"url":      "https://prenv-123.example.com",
+		"branch":   "feature/foo",
+		"constant": "bar",
+		"path":     "https://prenv-123.example.com/api",
+	}, component)
+
+	require.Equal(t, global, env.Vars, "rendering component vars must not modify the global vars")
+
+	_, err = env.RenderVars(map[string]string{"broken": "{{ .Vars.domain"})
+	require.ErrorContains(t, err, "unable to render vars.broken")
+}
+
+func TestLoadMetadataFromEvent(t *testing.T) {
+	pr := &PullRequestEnvArgs{
+		Author: "overridden",
+	}
+
+	pr.loadMetadataFromEvent(map[string]interface{}{
+		"number": 123,
+		"title":  "Add foo",
+		"head":   map[string]interface{}{"ref": "feature/foo"},
+		"base":   map[string]interface{}{"ref": "main"},
+		"user":   map[string]interface{}{"login": "octocat"},
+		"labels": []interface{}{
+			map[string]interface{}{"name": "preview"},
+			map[string]interface{}{"name": "size/small"},
+		},
+	})
+
+	require.Equal(t, &PullRequestEnvArgs{
+		Title:   "Add foo",
+		Branch:  "feature/foo",
+		BaseRef: "main",
+		Author:  "overridden",
+		Labels:  []string{"preview", "size/small"},
+	}, pr)
+}
+
+func TestVarsSecretRefs(t *testing.T) {
+	t.Setenv("PRENV_TEST_VARS_TOKEN", "s3cr3t")
+
+	env := EnvArgs{
+		PullRequest: &PullRequestEnvArgs{
+			Title: "ref+env://PRENV_TEST_VARS_TOKEN",
+		},
+	}
+
+	vars, err := env.RenderVars(map[string]string{
+		"token": "ref+env://PRENV_TEST_VARS_TOKEN",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"token": "ref+env://PRENV_TEST_VARS_TOKEN"}, vars, "secret references must be kept as is until resolved")
+
+	_, err = env.RenderVars(map[string]string{
+		"title": "{{ .PullRequest.Title }}",
+	})
+	require.ErrorContains(t, err, "vars.title: the rendered value \"ref+env://PRENV_TEST_VARS_TOKEN\" must not be a secret reference")
+
+	env.Vars = vars
+
+	r, err := env.ResolveSecretRefs(context.Background())
+	require.NoError(t, err)
+
+	resolved := r.(EnvArgs)
+	require.Equal(t, map[string]string{"token": "s3cr3t"}, resolved.Vars)
+	require.Equal(t, "ref+env://PRENV_TEST_VARS_TOKEN", resolved.PullRequest.Title, "untrusted inputs must never be resolved")
+	require.Equal(t, "ref+env://PRENV_TEST_VARS_TOKEN", env.Vars["token"])
+}
@@ -1,5 +1,7 @@
 package config
 
+import "fmt"
+
 // Delegate contains the configuration for delegating the deployment to
 // another workflow in the same repository, or another workflow in another repository.
 //
@@ -69,6 +71,36 @@ type Delegate struct {
 	RepositoryDispatch *RepositoryDispatch `yaml:"repositoryDispatch,omitempty"`
 }
 
+// Validate checks that the fields are consistent with each other,
+// like pullRequest that needs git to know the repository the pull request is opened against.
+func (d *Delegate) Validate() error {
+	if d.Git != nil && d.Git.Repo == "" {
+		return fmt.Errorf("git.repo is required")
+	}
+
+	if d.PullRequest != nil {
+		if d.Git == nil {
+			return fmt.Errorf("pullRequest requires git")
+		}
+
+		if err := d.PullRequest.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if rd := d.RepositoryDispatch; rd != nil {
+		if rd.Owner == "" {
+			return fmt.Errorf("repositoryDispatch.owner is required")
+		}
+
+		if rd.Repo == "" {
+			return fmt.Errorf("repositoryDispatch.repo is required")
+		}
+	}
+
+	return nil
+}
+
 type Git struct {
 	// Repo is either REPO/NAME or URL of the git repository that contains the gitops config.
 	// A gitops config can be either a directory or a file, that contains Kubernetes manifests,
@@ -95,7 +127,78 @@ type Git struct {
 	Push bool `yaml:"push,omitempty"`
 }
 
-type PullRequest struct{}
+// PullRequest specifies how the gitops config is updated via pull request.
+//
+// prenv pushes to a stable branch per environment and provisioner, named
+// prenv/<environment name>/<provisioner name>, so that subsequent runs for the same environment
+// update the existing open pull request, instead of opening a new one on every push.
+type PullRequest struct {
+	// Update is how the branch is updated on subsequent runs.
+	// "forcePush" recreates the branch from the base branch and force-pushes it.
+	// "append" adds a new commit on top of the existing branch.
+	// Defaults to "forcePush".
+	Update string `yaml:"update,omitempty"`
+
+	// OnDestroy is what prenv does to the pull request when the environment is destroyed.
+	// "close" closes the open pull request and deletes the branch.
+	// If the base branch still holds the files of the environment, like the ones merged by the earlier pull requests,
+	// prenv opens a removal pull request for them, too.
+	// "pullRequest" always opens a removal pull request.
+	// Defaults to "close".
+	OnDestroy string `yaml:"onDestroy,omitempty"`
+
+	// TitleTemplate is the Go template used to generate the title of the pull request.
+	// Defaults to the commit subject.
+	TitleTemplate string `yaml:"titleTemplate,omitempty"`
+
+	// BodyTemplate is the Go template used to generate the body of the pull request.
+	// Defaults to the commit body.
+	BodyTemplate string `yaml:"bodyTemplate,omitempty"`
+
+	// Labels is the list of labels added to the pull request.
+	Labels []string `yaml:"labels,omitempty"`
+
+	// Reviewers is the list of users requested to review the pull request.
+	Reviewers []string `yaml:"reviewers,omitempty"`
+
+	// TeamReviewers is the list of team slugs requested to review the pull request.
+	TeamReviewers []string `yaml:"teamReviewers,omitempty"`
+
+	// AutoMerge enables auto-merge of the pull request with the given merge method.
+	// It is either "merge", "squash", or "rebase".
+	// Auto-merge is not enabled if empty.
+	AutoMerge string `yaml:"autoMerge,omitempty"`
+}
+
+const (
+	PullRequestUpdateForcePush = "forcePush"
+	PullRequestUpdateAppend    = "append"
+
+	PullRequestOnDestroyClose       = "close"
+	PullRequestOnDestroyPullRequest = "pullRequest"
+)
+
+func (p *PullRequest) Validate() error {
+	switch p.Update {
+	case "", PullRequestUpdateForcePush, PullRequestUpdateAppend:
+	default:
+		return fmt.Errorf("pullRequest.update must be either %q or %q: %q", PullRequestUpdateForcePush, PullRequestUpdateAppend, p.Update)
+	}
+
+	switch p.OnDestroy {
+	case "", PullRequestOnDestroyClose, PullRequestOnDestroyPullRequest:
+	default:
+		return fmt.Errorf("pullRequest.onDestroy must be either %q or %q: %q", PullRequestOnDestroyClose, PullRequestOnDestroyPullRequest, p.OnDestroy)
+	}
+
+	switch p.AutoMerge {
+	case "", "merge", "squash", "rebase":
+	default:
+		return fmt.Errorf("pullRequest.autoMerge must be either \"merge\", \"squash\", or \"rebase\": %q", p.AutoMerge)
+	}
+
+	return nil
+}
 
 // RepositoryDispatch specifies whether the prenv run is triggered via GitHub repository_dispatch.
 type RepositoryDispatch struct {
@@ -0,0 +1,121 @@
+package config
+
+import "fmt"
+
+const (
+	// HelmOutputFluxHelmRelease renders a Flux HelmRelease along with the values file.
+	HelmOutputFluxHelmRelease = "fluxHelmRelease"
+	// HelmOutputArgoCDApp renders an ArgoCD Application with a helm source along with the values file.
+	HelmOutputArgoCDApp = "argocdApp"
+)
+
+// Helm deploys a Helm chart per environment.
+//
+// By default, it renders the values file for the environment and runs `helm upgrade --install` on apply
+// and `helm uninstall` on destroy.
+// When Output is set, it renders the values file and a Flux HelmRelease or an ArgoCD Application instead,
+// which are usually written to the gitops repository via Git or PullRequest.
+//
+// The release name is generated from the appNameTemplate of the environment,
+// with ShortName available as `{{ .ShortName }}`.
+type Helm struct {
+	Delegate `yaml:",inline"`
+
+	// ShortName is the short name of the application used to generate the release name.
+	// Defaults to the base name of Chart or Path.
+	ShortName string `yaml:"shortName,omitempty"`
+
+	// RepoURL is the URL of the Helm chart repository, or the git repository containing the chart when Path is set.
+	RepoURL string `yaml:"repoURL,omitempty"`
+
+	// Chart is the name of the chart in the Helm chart repository,
+	// or the path to the local chart when RepoURL is empty.
+	Chart string `yaml:"chart,omitempty"`
+
+	// Path is the path to the chart in the git repository at RepoURL.
+	// It is only supported when Output is set.
+	Path string `yaml:"path,omitempty"`
+
+	// Version is the version of the chart, or the git revision when Path is set.
+	Version string `yaml:"version,omitempty"`
+
+	// Namespace is the Go template used to generate the namespace the release is installed to.
+	// Defaults to the release name.
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// ValuesTemplate is the Go template used to generate the values of the release in YAML,
+	// like `image: {tag: "{{ .PullRequest.HeadSHA }}"}`.
+	ValuesTemplate string `yaml:"valuesTemplate,omitempty"`
+
+	// Dir is the Go template used to generate the directory the files are rendered to.
+	// Defaults to the directory the provisioner renders to.
+	Dir string `yaml:"dir,omitempty"`
+
+	// Output is either "fluxHelmRelease" or "argocdApp".
+	// If empty, helm is run directly.
+	Output string `yaml:"output,omitempty"`
+
+	// Flux is the settings for the Flux HelmRelease.
+	Flux *HelmFlux `yaml:"flux,omitempty"`
+
+	// ArgoCD is the settings for the ArgoCD Application.
+	ArgoCD *HelmArgoCD `yaml:"argocd,omitempty"`
+}
+
+func (h *Helm) Validate() error {
+	if (h.Chart == "") == (h.Path == "") {
+		return fmt.Errorf("helm: exactly one of chart and path must be set")
+	}
+
+	switch h.Output {
+	case "":
+		if h.Path != "" {
+			return fmt.Errorf("helm: path requires output to be either %q or %q", HelmOutputFluxHelmRelease, HelmOutputArgoCDApp)
+		}
+	case HelmOutputFluxHelmRelease:
+		if h.Flux == nil || h.Flux.SourceRef.Name == "" {
+			return fmt.Errorf("helm: flux.sourceRef.name is required for output %q", h.Output)
+		}
+	case HelmOutputArgoCDApp:
+		if h.RepoURL == "" {
+			return fmt.Errorf("helm: repoURL is required for output %q", h.Output)
+		}
+	default:
+		return fmt.Errorf("helm: output must be either %q or %q, but got %q", HelmOutputFluxHelmRelease, HelmOutputArgoCDApp, h.Output)
+	}
+
+	return nil
+}
+
+// HelmFlux is the settings for the Flux HelmRelease.
+type HelmFlux struct {
+	// Namespace is the namespace of the HelmRelease.
+	// Defaults to "flux-system".
+	Namespace string `yaml:"namespace,omitempty"`
+	// Interval is the interval at which the HelmRelease is reconciled.
+	// Defaults to "5m".
+	Interval string `yaml:"interval,omitempty"`
+	// SourceRef is the reference to the Flux source that contains the chart.
+	SourceRef HelmFluxSourceRef `yaml:"sourceRef"`
+}
+
+// HelmFluxSourceRef is the reference to the Flux HelmRepository or GitRepository.
+type HelmFluxSourceRef struct {
+	// Kind defaults to "HelmRepository", or "GitRepository" when Path is set.
+	Kind      string `yaml:"kind,omitempty"`
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// HelmArgoCD is the settings for the ArgoCD Application.
+type HelmArgoCD struct {
+	// Namespace is the namespace of the ArgoCD Application.
+	// Defaults to "argocd".
+	Namespace string `yaml:"namespace,omitempty"`
+	// DestinationServer is the URL of the Kubernetes cluster to deploy to.
+	// Defaults to "https://kubernetes.default.svc".
+	DestinationServer string `yaml:"destinationServer,omitempty"`
+	// Project is the ArgoCD project.
+	// Defaults to "default".
+	Project string `yaml:"project,omitempty"`
+}
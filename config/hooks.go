@@ -0,0 +1,194 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// HookFailurePolicyFail fails the run when the hook fails.
+	HookFailurePolicyFail = "fail"
+
+	// HookFailurePolicyIgnore logs the failure of the hook, and continues the run.
+	HookFailurePolicyIgnore = "ignore"
+
+	// DefaultHookTimeout is the default Timeout of the hooks.
+	DefaultHookTimeout = 10 * time.Minute
+)
+
+// Hooks is the commands run before and after the provisioners of the component,
+// like seeding the database and running the smoke tests once the environment is ready,
+// or dumping the database snapshot before the environment is destroyed.
+//
+// The hooks of a component run only when any of its provisioners runs, like when the pull request changes the files matching its paths.
+// When the component delegates any of its provisioners via repositoryDispatch,
+// the hooks run in the delegated run on the target repository instead, next to the resources they act on.
+// The hooks do not run while rolling back the failed apply.
+type Hooks struct {
+	// PreApply is run in order before the provisioners of the component are applied.
+	PreApply []Hook `yaml:"preApply,omitempty"`
+
+	// PostApply is run in order after the provisioners of the component are applied.
+	PostApply []Hook `yaml:"postApply,omitempty"`
+
+	// PreDestroy is run in order before the provisioners of the component are destroyed.
+	PreDestroy []Hook `yaml:"preDestroy,omitempty"`
+
+	// PostDestroy is run in order after the provisioners of the component are destroyed.
+	PostDestroy []Hook `yaml:"postDestroy,omitempty"`
+}
+
+func (h *Hooks) Validate() error {
+	for _, phase := range []struct {
+		name  string
+		hooks []Hook
+	}{
+		{"preApply", h.PreApply},
+		{"postApply", h.PostApply},
+		{"preDestroy", h.PreDestroy},
+		{"postDestroy", h.PostDestroy},
+	} {
+		for i, hook := range phase.hooks {
+			if err := hook.Validate(); err != nil {
+				return fmt.Errorf("%s[%d]: %w", phase.name, i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Hook is either a command run by prenv, or a Kubernetes Job run to completion.
+//
+// The command, the args, and the env are Go templates rendered with the args of the environment,
+// like `{{ .Name }}` and `{{ .Outputs.terraform.db_host }}`.
+// The output of the hook is captured into the run report,
+// which is written to the job summary when prenv runs on GitHub Actions.
+type Hook struct {
+	// Name is the name of the hook shown in the logs and the run report.
+	// Defaults to the command or the image.
+	Name string `yaml:"name,omitempty"`
+
+	// Exec runs the command in the working directory of prenv.
+	Exec *ExecHook `yaml:"exec,omitempty"`
+
+	// Job runs the Kubernetes Job via kubectl, waits for it to complete, and captures its logs.
+	Job *JobHook `yaml:"job,omitempty"`
+
+	// Timeout is the duration, like `5m`, that the hook is given to complete.
+	// Defaults to 10m.
+	Timeout string `yaml:"timeout,omitempty"`
+
+	// FailurePolicy is either "fail" to fail the run when the hook fails or times out,
+	// or "ignore" to log the failure and continue the run.
+	// Defaults to "fail".
+	FailurePolicy string `yaml:"failurePolicy,omitempty"`
+}
+
+func (h *Hook) Validate() error {
+	if (h.Exec == nil) == (h.Job == nil) {
+		return fmt.Errorf("exactly one of exec or job is required")
+	}
+
+	if h.Exec != nil && len(h.Exec.Command) == 0 {
+		return fmt.Errorf("exec.command is required")
+	}
+
+	if h.Job != nil && h.Job.Image == "" {
+		return fmt.Errorf("job.image is required")
+	}
+
+	if _, err := h.GetTimeout(); err != nil {
+		return err
+	}
+
+	switch h.FailurePolicy {
+	case "", HookFailurePolicyFail, HookFailurePolicyIgnore:
+	default:
+		return fmt.Errorf("failurePolicy must be either %q or %q, but got %q", HookFailurePolicyFail, HookFailurePolicyIgnore, h.FailurePolicy)
+	}
+
+	return nil
+}
+
+// GetName returns the name of the hook shown in the logs and the run report.
+func (h *Hook) GetName() string {
+	if h.Name != "" {
+		return h.Name
+	}
+
+	if h.Exec != nil && len(h.Exec.Command) > 0 {
+		return h.Exec.Command[0]
+	}
+
+	if h.Job != nil {
+		return h.Job.Image
+	}
+
+	return ""
+}
+
+// GetTimeout returns the duration that the hook is given to complete.
+func (h *Hook) GetTimeout() (time.Duration, error) {
+	if h.Timeout == "" {
+		return DefaultHookTimeout, nil
+	}
+
+	d, err := time.ParseDuration(h.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", h.Timeout, err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be greater than 0, but got %q", h.Timeout)
+	}
+
+	return d, nil
+}
+
+// Ignored returns true if the failure of the hook does not fail the run.
+func (h *Hook) Ignored() bool {
+	return h.FailurePolicy == HookFailurePolicyIgnore
+}
+
+// ExecHook is the command run by prenv.
+type ExecHook struct {
+	// Command is the command and its args, like `["make", "seed"]`.
+	// It is run directly without a shell, so that the rendered values, like the title of the pull request, are never interpreted by a shell.
+	// Use `["sh", "-c", "..."]` for a shell script.
+	Command []string `yaml:"command"`
+
+	// Env is the environment variables set for the command, in addition to the ones of prenv.
+	Env map[string]string `yaml:"env,omitempty"`
+
+	// Dir is the working directory of the command.
+	// Defaults to the working directory of prenv.
+	Dir string `yaml:"dir,omitempty"`
+}
+
+// JobHook is the Kubernetes Job run in the cluster that kubectl is configured for.
+//
+// The Job is named after the environment, the component, and the hook,
+// replaced on every run, and deleted once it succeeds.
+// The failed one is kept for debugging until the next run replaces it.
+type JobHook struct {
+	// Namespace is the namespace of the Job.
+	// Defaults to the namespace of the current context of kubectl.
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// Image is the container image of the Job.
+	Image string `yaml:"image"`
+
+	// Command overrides the entrypoint of the image.
+	Command []string `yaml:"command,omitempty"`
+
+	// Args is the args of the entrypoint.
+	Args []string `yaml:"args,omitempty"`
+
+	// Env is the environment variables of the container.
+	// Note that they are visible to anyone who can read the Job.
+	Env map[string]string `yaml:"env,omitempty"`
+
+	// ServiceAccountName is the service account the Job runs as.
+	ServiceAccountName string `yaml:"serviceAccountName,omitempty"`
+}
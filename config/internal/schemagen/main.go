@@ -0,0 +1,23 @@
+// Command schemagen writes the JSON Schema of prenv.yaml generated from the config package.
+// It is run via `go generate ./config`, in the directory of the config package.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mumoshu/prenv/config"
+)
+
+func main() {
+	s, err := config.GenerateSchema(".")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(config.SchemaFileName, s, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import "fmt"
+
+const (
+	// DefaultKustomizeOverlayDirTemplate is the default OverlayDirTemplate of Kustomize.
+	DefaultKustomizeOverlayDirTemplate = "overlays/{{ .Name }}"
+)
+
+// Kustomize generates a kustomize overlay per environment on top of an existing kustomize base.
+//
+// The overlay is a directory containing a kustomization.yaml generated from the fields below.
+// It is written to the gitops repository when Git or PullRequest is set, and removed on destroy.
+// All the string fields except Base are Go templates rendered with the environment args, like `{{ .PullRequest.Number }}`.
+type Kustomize struct {
+	Delegate `yaml:",inline"`
+
+	// Base is the path to the kustomize base directory.
+	// The path is relative to the directory the overlay is rendered to, which is Git.Path when Git is set.
+	Base string `yaml:"base"`
+
+	// OverlayDirTemplate is the path to the overlay directory, relative to the same directory as Base.
+	// Defaults to "overlays/{{ .Name }}".
+	OverlayDirTemplate string `yaml:"overlayDirTemplate,omitempty"`
+
+	// Namespace is the namespace set to all the resources, like "myapp-{{ .PullRequest.Number }}".
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// NamePrefix is prepended to the names of all the resources.
+	NamePrefix string `yaml:"namePrefix,omitempty"`
+
+	// NameSuffix is appended to the names of all the resources.
+	NameSuffix string `yaml:"nameSuffix,omitempty"`
+
+	// Images overrides the images used by the resources.
+	// The tag defaults to the head commit SHA of the pull request when neither NewTag nor Digest is set.
+	Images []KustomizeImage `yaml:"images,omitempty"`
+
+	// CommonLabels are added to all the resources and selectors.
+	CommonLabels map[string]string `yaml:"commonLabels,omitempty"`
+
+	// ConfigMapGenerator generates ConfigMaps from the literals.
+	ConfigMapGenerator []KustomizeConfigMap `yaml:"configMapGenerator,omitempty"`
+
+	// Patches is the list of strategic merge or JSON 6902 patches applied to the resources.
+	Patches []KustomizeOverlayPatch `yaml:"patches,omitempty"`
+}
+
+func (k *Kustomize) Validate() error {
+	if k.Base == "" {
+		return fmt.Errorf("kustomize.base is required")
+	}
+
+	for i, img := range k.Images {
+		if img.Name == "" {
+			return fmt.Errorf("kustomize.images[%d]: name is required", i)
+		}
+	}
+
+	for i, cm := range k.ConfigMapGenerator {
+		if cm.Name == "" {
+			return fmt.Errorf("kustomize.configMapGenerator[%d]: name is required", i)
+		}
+	}
+
+	for i, p := range k.Patches {
+		if p.Patch == "" {
+			return fmt.Errorf("kustomize.patches[%d]: patch is required", i)
+		}
+	}
+
+	return nil
+}
+
+// KustomizeConfigMap is an entry in the configMapGenerator field of kustomization.yaml.
+type KustomizeConfigMap struct {
+	Name string `yaml:"name"`
+	// Literals is the data of the ConfigMap.
+	Literals map[string]string `yaml:"literals,omitempty"`
+}
+
+// KustomizeOverlayPatch is an entry in the patches field of kustomization.yaml.
+type KustomizeOverlayPatch struct {
+	// Patch is the inline strategic merge patch or JSON 6902 patch.
+	Patch string `yaml:"patch"`
+	// Target selects the resources to be patched.
+	// It can be omitted for a strategic merge patch, which is matched by its kind and name.
+	Target *KustomizePatchTarget `yaml:"target,omitempty"`
+}
+
+// KustomizePatchTarget selects the resources to be patched.
+type KustomizePatchTarget struct {
+	Group         string `yaml:"group,omitempty"`
+	Version       string `yaml:"version,omitempty"`
+	Kind          string `yaml:"kind,omitempty"`
+	Name          string `yaml:"name,omitempty"`
+	Namespace     string `yaml:"namespace,omitempty"`
+	LabelSelector string `yaml:"labelSelector,omitempty"`
+}
@@ -0,0 +1,23 @@
+package config
+
+import "fmt"
+
+const (
+	// OnFailureKeep leaves the environment as is when a provisioner fails to apply,
+	// so that `prenv apply --resume` can continue the apply from the failed provisioner.
+	OnFailureKeep = "keep"
+	// OnFailureRollback rolls back the provisioners applied by the failed apply, in reverse order.
+	OnFailureRollback = "rollback"
+	// OnFailureDestroy destroys the whole environment when a provisioner fails to apply.
+	OnFailureDestroy = "destroy"
+)
+
+// ValidateOnFailure checks that onFailure is one of the supported policies.
+func (c Config) ValidateOnFailure() error {
+	switch c.OnFailure {
+	case "", OnFailureKeep, OnFailureRollback, OnFailureDestroy:
+		return nil
+	}
+
+	return fmt.Errorf("onFailure must be either %q, %q, or %q, but got %q", OnFailureKeep, OnFailureRollback, OnFailureDestroy, c.OnFailure)
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Paths filters the pull requests that deploy the component by the files they change.
+//
+// A pull request deploys the component when any of its changed files matches Include and none of Exclude.
+// Otherwise, the provisioners of the component are skipped and the environment keeps what they deployed before.
+// They are never skipped on the first apply of the environment.
+type Paths struct {
+	// Include is the list of the globs, like `services/api/**`, that the changed files are matched against.
+	// `*` matches any sequence of characters except `/`, and `**` matches any sequence of characters including `/`.
+	// Any file matches if empty.
+	Include []string `yaml:"include,omitempty"`
+
+	// Exclude is the list of the globs, like `**/*.md`, of the changed files to be ignored.
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+func (p *Paths) Validate() error {
+	for _, g := range append(append([]string{}, p.Include...), p.Exclude...) {
+		if _, err := globRegexp(g); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", g, err)
+		}
+	}
+
+	return nil
+}
+
+// Match returns true if any of the changed files matches the paths.
+func (p *Paths) Match(files []string) (bool, error) {
+	include, err := globRegexps(p.Include)
+	if err != nil {
+		return false, err
+	}
+
+	exclude, err := globRegexps(p.Exclude)
+	if err != nil {
+		return false, err
+	}
+
+	for _, f := range files {
+		if matchAnyRegexp(exclude, f) {
+			continue
+		}
+
+		if len(include) == 0 || matchAnyRegexp(include, f) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func globRegexps(globs []string) ([]*regexp.Regexp, error) {
+	var rs []*regexp.Regexp
+
+	for _, g := range globs {
+		r, err := globRegexp(g)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", g, err)
+		}
+
+		rs = append(rs, r)
+	}
+
+	return rs, nil
+}
+
+func matchAnyRegexp(rs []*regexp.Regexp, s string) bool {
+	for _, r := range rs {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// globRegexp converts the glob, which can contain `**` that matches any sequence of characters including `/`,
+// to the regular expression.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+
+	b.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				// Matches zero or more directories, so that `**/*.md` matches README.md too.
+				b.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+
+			class := glob[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			b.WriteString("[" + class + "]")
+			i += j
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathsMatch(t *testing.T) {
+	testcases := []struct {
+		name  string
+		paths Paths
+		files []string
+		want  bool
+	}{
+		{
+			name:  "include",
+			paths: Paths{Include: []string{"services/api/**"}},
+			files: []string{"README.md", "services/api/cmd/main.go"},
+			want:  true,
+		},
+		{
+			name:  "no match",
+			paths: Paths{Include: []string{"services/api/**"}},
+			files: []string{"services/web/index.html", "services/api"},
+			want:  false,
+		},
+		{
+			name:  "star does not match slash",
+			paths: Paths{Include: []string{"charts/*.yaml"}},
+			files: []string{"charts/api/values.yaml"},
+			want:  false,
+		},
+		{
+			name:  "double star matches zero directories",
+			paths: Paths{Include: []string{"**/*.go"}},
+			files: []string{"main.go"},
+			want:  true,
+		},
+		{
+			name:  "exclude",
+			paths: Paths{Include: []string{"services/api/**"}, Exclude: []string{"**/*.md"}},
+			files: []string{"services/api/README.md", "docs/api.md"},
+			want:  false,
+		},
+		{
+			name:  "exclude only",
+			paths: Paths{Exclude: []string{"docs/**"}},
+			files: []string{"docs/index.md", "go.mod"},
+			want:  true,
+		},
+		{
+			name:  "character class",
+			paths: Paths{Include: []string{"v[!0]/?.txt"}},
+			files: []string{"v0/a.txt", "v1/b.txt"},
+			want:  true,
+		},
+		{
+			name:  "no files",
+			paths: Paths{},
+			files: nil,
+			want:  false,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.paths.Match(tc.files)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestPathsValidate(t *testing.T) {
+	require.NoError(t, (&Paths{Include: []string{"services/**"}}).Validate())
+	require.EqualError(t, (&Paths{Exclude: []string{"docs/[a"}}).Validate(), `invalid glob "docs/[a": missing ]`)
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Policy is the set of rules that the Kubernetes manifests rendered by the provisioners must satisfy.
+// The rendered files are checked before they are committed to the gitops repository or applied,
+// so that a pull request cannot deploy something that affects the resources shared among the environments.
+//
+// Note that a pull request can change the policy in its own prenv.yaml,
+// so only the policy files given via PRENV_POLICY_FILES in the environment of the run are an enforcement boundary.
+type Policy struct {
+	// AllowedNamespaces is the list of the namespaces, like `pr-*`, that the manifests can be deployed to.
+	// It is checked against metadata.namespace, the name of the Namespace, and the destination namespace of the ArgoCD Application.
+	// Any namespace is allowed if empty.
+	AllowedNamespaces []string `yaml:"allowedNamespaces,omitempty"`
+
+	// ForbiddenKinds is the list of the kinds, like ClusterRoleBinding, that must not be rendered.
+	ForbiddenKinds []string `yaml:"forbiddenKinds,omitempty"`
+
+	// RequiredLabels is the list of the labels that every manifest must have.
+	// Each entry is either a label key, or key=value to require the specific value.
+	RequiredLabels []string `yaml:"requiredLabels,omitempty"`
+
+	// AllowedRegistries is the list of the registries and repositories, like `ghcr.io/myorg`,
+	// that the images of the containers must be pulled from.
+	// Images without the registry, like `nginx`, are considered to be pulled from `docker.io`.
+	// Any registry is allowed if empty.
+	AllowedRegistries []string `yaml:"allowedRegistries,omitempty"`
+
+	// MaxReplicas is the maximum spec.replicas of the manifests.
+	MaxReplicas *int `yaml:"maxReplicas,omitempty"`
+
+	// Files is the list of the paths to the policy files evaluated against every manifest.
+	// Files ending with .rego are Rego policies, whose data.prenv.deny is the set of the violation messages.
+	// They are evaluated in-process, so the opa binary is not needed.
+	// The other files are YAML files that contain CEL rules.
+	// The paths are relative to the working directory of the prenv run that renders the files,
+	// which is the target repository for the runs delegated via repositoryDispatch.
+	Files []string `yaml:"files,omitempty"`
+}
+
+func (p *Policy) Validate() error {
+	for _, ns := range p.AllowedNamespaces {
+		if _, err := path.Match(ns, ""); err != nil {
+			return fmt.Errorf("allowedNamespaces: invalid pattern %q: %w", ns, err)
+		}
+	}
+
+	for _, l := range p.RequiredLabels {
+		if k, _, _ := strings.Cut(l, "="); k == "" {
+			return fmt.Errorf("requiredLabels: label key must not be empty: %q", l)
+		}
+	}
+
+	if p.MaxReplicas != nil && *p.MaxReplicas < 0 {
+		return fmt.Errorf("maxReplicas must not be negative: %d", *p.MaxReplicas)
+	}
+
+	return nil
+}
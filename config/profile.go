@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Profile is a named set of the dedicated components deployed as an environment of its own,
+// like `minimal` for a frontend preview and `full` for the whole backend stack.
+//
+// A pull request can select more than one profile to have as many environments at once.
+// The name of each environment includes the name of the profile.
+type Profile struct {
+	// Components is the names of the components in dedicated.components deployed to the environments of this profile.
+	// The shared component and the dedicated component itself are deployed regardless of the profile.
+	Components []string `yaml:"components,omitempty"`
+
+	// Label is the label of the pull request that selects this profile.
+	// Defaults to `prenv:NAME` where NAME is the name of the profile.
+	Label string `yaml:"label,omitempty"`
+
+	// Default selects this profile for the pull requests without any label selecting a profile.
+	Default bool `yaml:"default,omitempty"`
+}
+
+// GetLabel returns the label of the pull request that selects the profile named name.
+func (p Profile) GetLabel(name string) string {
+	if p.Label != "" {
+		return p.Label
+	}
+
+	return "prenv:" + name
+}
+
+// ValidateProfiles checks that the profiles refer to the components defined in dedicated.components.
+func (c Config) ValidateProfiles() error {
+	for _, name := range c.ProfileNames() {
+		for _, comp := range c.Profiles[name].Components {
+			var found bool
+			if c.Dedicated != nil {
+				_, found = c.Dedicated.Components[comp]
+			}
+
+			if !found {
+				return fmt.Errorf("profile %q: component %q is not defined in dedicated.components", name, comp)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ProfileNames returns the names of the profiles in alphabetical order.
+func (c Config) ProfileNames() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// SelectProfiles returns the names of the profiles selected by the labels of the pull request,
+// or the default profiles when no label selects any profile.
+func (c Config) SelectProfiles(labels []string) []string {
+	var selected, defaults []string
+
+	for _, name := range c.ProfileNames() {
+		p := c.Profiles[name]
+
+		for _, l := range labels {
+			if l == p.GetLabel(name) {
+				selected = append(selected, name)
+				break
+			}
+		}
+
+		if p.Default {
+			defaults = append(defaults, name)
+		}
+	}
+
+	if len(selected) == 0 {
+		return defaults
+	}
+
+	return selected
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectProfiles(t *testing.T) {
+	cfg := Config{
+		Dedicated: &Component{
+			Components: map[string]Component{
+				"web": {},
+				"api": {},
+			},
+		},
+		Profiles: map[string]Profile{
+			"minimal": {Components: []string{"web"}, Default: true},
+			"full":    {Components: []string{"web", "api"}, Label: "full-stack"},
+			"debug":   {},
+		},
+	}
+
+	require.NoError(t, cfg.ValidateProfiles())
+
+	require.Equal(t, []string{"minimal"}, cfg.SelectProfiles(nil))
+	require.Equal(t, []string{"minimal"}, cfg.SelectProfiles([]string{"bug", "prenv:full"}))
+	require.Equal(t, []string{"full"}, cfg.SelectProfiles([]string{"full-stack"}))
+	require.Equal(t, []string{"debug", "full"}, cfg.SelectProfiles([]string{"full-stack", "prenv:debug"}))
+
+	cfg.Profiles["broken"] = Profile{Components: []string{"db"}}
+
+	require.EqualError(t, cfg.ValidateProfiles(), `profile "broken": component "db" is not defined in dedicated.components`)
+}
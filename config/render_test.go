@@ -47,4 +47,30 @@ func TestRender(t *testing.T) {
 
 		require.Equal(t, r, rev)
 	})
+
+	t.Run("invalid engine", func(t *testing.T) {
+		r := Render{Engine: "jinja"}
+
+		require.ErrorContains(t, r.Validate(), `render.engine must be either "text" or "html", but got "jinja"`)
+	})
+
+	t.Run("patch with contentTemplate", func(t *testing.T) {
+		r := Render{
+			Files: []RenderedFile{
+				{Name: "values.yaml", ContentTemplate: "a: 1", Patch: &Patch{MergePatch: "b: 2"}},
+			},
+		}
+
+		require.ErrorContains(t, r.Validate(), "render.files[0]: patch cannot be used with contentTemplate, templateFile, or templateDir")
+	})
+
+	t.Run("empty patch", func(t *testing.T) {
+		r := Render{
+			Files: []RenderedFile{
+				{Name: "values.yaml", Patch: &Patch{}},
+			},
+		}
+
+		require.ErrorContains(t, r.Validate(), "render.files[0]: patch must have at least one of mergePatch, set, delete, and kustomize")
+	})
 }
@@ -0,0 +1,244 @@
+package config
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//go:generate go run ./internal/schemagen
+
+// SchemaFileName is the name of the file that contains the JSON Schema of prenv.yaml,
+// next to this file in the repository.
+//
+// Editors that support JSON Schema, like VS Code with the YAML extension, can validate prenv.yaml against it
+// by adding the following comment at the top of prenv.yaml:
+//
+//	# yaml-language-server: $schema=https://raw.githubusercontent.com/mumoshu/prenv/main/config/prenv.schema.json
+const SchemaFileName = "prenv.schema.json"
+
+// SchemaURL is the URL the JSON Schema of prenv.yaml is published at, which is also the $id of the schema.
+const SchemaURL = "https://raw.githubusercontent.com/mumoshu/prenv/main/config/" + SchemaFileName
+
+//go:embed prenv.schema.json
+var schema []byte
+
+// Schema returns the JSON Schema of prenv.yaml, generated from Config by GenerateSchema.
+func Schema() []byte {
+	return schema
+}
+
+// GenerateSchema generates the JSON Schema of prenv.yaml from Config.
+// The descriptions are the doc comments of the types and the fields,
+// read from the Go source files of this package in dir.
+//
+// The schema follows how the yaml tags are interpreted by gopkg.in/yaml.v2 that decodes prenv.yaml:
+// inline fields are merged into their parents, fields without the tags are named in lowercase,
+// and unknown fields are not allowed.
+func GenerateSchema(dir string) ([]byte, error) {
+	docs, err := readDocComments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &schemaGenerator{
+		docs:        docs,
+		definitions: map[string]interface{}{},
+	}
+
+	root := g.structSchema(reflect.TypeOf(Config{}))
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["$id"] = SchemaURL
+	root["title"] = "prenv.yaml"
+	root["definitions"] = g.definitions
+
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type schemaGenerator struct {
+	// docs is the doc comments keyed by either the type name or TYPE.FIELD.
+	docs map[string]string
+
+	definitions map[string]interface{}
+}
+
+// schema returns the schema of the value of the type.
+// Structs are added to the definitions and referenced via $ref.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		name := t.Name()
+
+		if _, ok := g.definitions[name]; !ok {
+			// Registered before generating the properties to stop the recursion of Component.Components.
+			g.definitions[name] = nil
+			g.definitions[name] = g.structSchema(t)
+		}
+
+		return map[string]interface{}{"$ref": "#/definitions/" + name}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": g.schema(t.Elem()),
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": g.schema(t.Elem()),
+		}
+	case reflect.String:
+		// yaml.v2 decodes any scalar into a string, like `tag: 1.0` into "1.0".
+		return map[string]interface{}{"type": []string{"string", "number", "boolean"}}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the schema of the object decoded into the struct.
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	s := map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": false,
+	}
+
+	if d := g.docs[t.Name()]; d != "" {
+		s["description"] = d
+	}
+
+	props := map[string]interface{}{}
+
+	g.addProperties(props, t)
+
+	s["properties"] = props
+
+	return s
+}
+
+func (g *schemaGenerator) addProperties(props map[string]interface{}, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if strings.Contains(","+opts+",", ",inline,") {
+			g.addProperties(props, f.Type)
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		p := g.schema(f.Type)
+
+		if d := g.docs[t.Name()+"."+f.Name]; d != "" {
+			if _, isRef := p["$ref"]; isRef {
+				// $ref ignores the sibling keywords in draft-07.
+				p = map[string]interface{}{"allOf": []interface{}{p}}
+			}
+
+			p["description"] = d
+		}
+
+		props[name] = p
+	}
+}
+
+// readDocComments reads the doc comments of the struct types and their fields in the Go source files in dir.
+func readDocComments(dir string) (map[string]string, error) {
+	fset := token.NewFileSet()
+
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", dir, err)
+	}
+
+	docs := map[string]string{}
+
+	var names []string
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, f := range pkgs[name].Files {
+			for _, d := range f.Decls {
+				gd, ok := d.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+
+				for _, spec := range gd.Specs {
+					ts := spec.(*ast.TypeSpec)
+
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+
+					doc := ts.Doc
+					if doc == nil && len(gd.Specs) == 1 {
+						doc = gd.Doc
+					}
+
+					docs[ts.Name.Name] = docText(doc)
+
+					for _, field := range st.Fields.List {
+						for _, n := range field.Names {
+							docs[ts.Name.Name+"."+n.Name] = docText(field.Doc)
+						}
+
+						if len(field.Names) == 0 {
+							if id, ok := field.Type.(*ast.Ident); ok {
+								docs[ts.Name.Name+"."+id.Name] = docText(field.Doc)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return docs, nil
+}
+
+func docText(c *ast.CommentGroup) string {
+	return strings.TrimSpace(c.Text())
+}
@@ -0,0 +1,13 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaUpToDate(t *testing.T) {
+	s, err := GenerateSchema(".")
+	require.NoError(t, err)
+	require.Equal(t, string(s), string(Schema()), "%s is out of date. Run `go generate ./config` to update it", SchemaFileName)
+}
@@ -0,0 +1,51 @@
+package config
+
+import "fmt"
+
+const (
+	// DefaultTerraformWorkspaceTemplate is the default WorkspaceTemplate of Terraform.
+	DefaultTerraformWorkspaceTemplate = "{{ .Name }}"
+)
+
+// Terraform runs terraform for the Terraform module per environment.
+//
+// Each environment gets its own Terraform workspace, so that the environments share the module
+// but not the state.
+// On apply, prenv runs terraform init, plan, and apply with the variables rendered for the environment,
+// and captures `terraform output -json` as the outputs of the provisioner.
+// The outputs marked sensitive are left out, because the outputs are stored in plain text in the state store.
+// On destroy, prenv runs terraform destroy and deletes the workspace.
+//
+// When Git or PullRequest is set, prenv only renders the variables to <Dir>/<workspace>.tfvars.json in the gitops repository,
+// so that your Terraform automation, like Atlantis, applies it to the workspace.
+type Terraform struct {
+	Delegate `yaml:",inline"`
+
+	// Dir is the path to the Terraform module.
+	Dir string `yaml:"dir"`
+
+	// Vars is the map of the Terraform variables to their values.
+	// Each value is a Go template, like `{{ .PullRequest.Number }}`.
+	Vars map[string]string `yaml:"vars,omitempty"`
+
+	// VarsTemplate is the Go template used to generate the Terraform variables in YAML or JSON.
+	// It is for the variables that are not strings, like lists and objects.
+	// Vars take precedence over VarsTemplate.
+	VarsTemplate string `yaml:"varsTemplate,omitempty"`
+
+	// WorkspaceTemplate is the Go template used to generate the name of the Terraform workspace.
+	// Defaults to "{{ .Name }}".
+	WorkspaceTemplate string `yaml:"workspaceTemplate,omitempty"`
+
+	// Binary is the path to the terraform binary.
+	// Defaults to "terraform".
+	Binary string `yaml:"binary,omitempty"`
+}
+
+func (t *Terraform) Validate() error {
+	if t.Dir == "" {
+		return fmt.Errorf("terraform.dir is required")
+	}
+
+	return nil
+}
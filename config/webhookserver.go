@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WebhookServer is the configuration for the standalone webhook server
+// that reacts to GitHub webhooks without GitHub Actions.
+type WebhookServer struct {
+	// The address the server listens on.
+	Address string `yaml:"address"`
+	// The secret used to verify the X-Hub-Signature-256 header of the webhooks.
+	WebhookSecret string `yaml:"webhookSecret"`
+	// The path to the prenv.yaml file.
+	ConfigFile string `yaml:"configFile"`
+	// The maximum number of webhooks waiting to be processed.
+	// Webhooks received while the queue is full are rejected with 503 so that GitHub can redeliver them.
+	QueueSize int `yaml:"queueSize"`
+	// The maximum number of delivery IDs remembered to deduplicate webhook deliveries.
+	MaxDeliveries int `yaml:"maxDeliveries"`
+	// If true, provisioners with repositoryDispatch send repository_dispatch events as usual.
+	// If false, they are run in-process by the server, which removes the need for repository_dispatch round-trips.
+	RepositoryDispatch bool `yaml:"repositoryDispatch"`
+	// The author associations, like OWNER, MEMBER, and COLLABORATOR, of the commenters allowed to run the slash commands.
+	// Comments from anyone else are ignored, so that anyone who can comment on a public repository cannot deploy or destroy environments.
+	// Defaults to DefaultCommentAuthorAssociations.
+	CommentAuthorAssociations []string `yaml:"commentAuthorAssociations"`
+}
+
+// DefaultCommentAuthorAssociations is the default CommentAuthorAssociations,
+// which allows the owner, the members of the organization, and the collaborators of the repository.
+var DefaultCommentAuthorAssociations = []string{"OWNER", "MEMBER", "COLLABORATOR"}
+
+const (
+	FlagAddress                   = "address"
+	FlagWebhookSecret             = "webhook-secret"
+	FlagQueueSize                 = "queue-size"
+	FlagMaxDeliveries             = "max-deliveries"
+	FlagRepositoryDispatch        = "repository-dispatch"
+	FlagCommentAuthorAssociations = "comment-author-associations"
+	EnvWebhookSecret              = "PRENV_WEBHOOK_SECRET"
+)
+
+func (s *WebhookServer) String() string {
+	return fmt.Sprintf("WebhookServer{Address: %s, ConfigFile: %s, QueueSize: %d, MaxDeliveries: %d, RepositoryDispatch: %t, CommentAuthorAssociations: %v}", s.Address, s.ConfigFile, s.QueueSize, s.MaxDeliveries, s.RepositoryDispatch, s.CommentAuthorAssociations)
+}
+
+// AllowsCommentAuthor returns true if the commenter with the author association, like MEMBER, is allowed to run the slash commands.
+func (s *WebhookServer) AllowsCommentAuthor(association string) bool {
+	allowed := s.CommentAuthorAssociations
+	if allowed == nil {
+		allowed = DefaultCommentAuthorAssociations
+	}
+
+	for _, a := range allowed {
+		if strings.EqualFold(a, association) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *WebhookServer) Validate() error {
+	if s.Address == "" {
+		return errors.New("address is required")
+	}
+
+	if s.WebhookSecret == "" {
+		return errors.New("webhook_secret is required")
+	}
+
+	if s.ConfigFile == "" {
+		return errors.New("config_file is required")
+	}
+
+	if s.QueueSize <= 0 {
+		return errors.New("queue size must be greater than 0")
+	}
+
+	if s.MaxDeliveries <= 0 {
+		return errors.New("max deliveries must be greater than 0")
+	}
+
+	return nil
+}
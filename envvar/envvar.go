@@ -41,6 +41,31 @@ const (
 	// URL from the local git repository URL, and push the local git repository to the remote repository.
 	StateFilePath = Prefix + "STATE_FILE_PATH"
 
+	// DispatchHMACKey is the shared secret used to sign the repository_dispatch payloads sent to,
+	// and to verify the ones received from, other repositories with HMAC-SHA256.
+	DispatchHMACKey = Prefix + "DISPATCH_HMAC_KEY"
+
+	// DispatchSigningKey is the PEM-encoded Ed25519 private key used to sign the repository_dispatch payloads
+	// sent to other repositories.
+	DispatchSigningKey = Prefix + "DISPATCH_SIGNING_KEY"
+
+	// DispatchVerificationKey is the PEM-encoded Ed25519 public key used to verify the repository_dispatch payloads
+	// received from other repositories.
+	DispatchVerificationKey = Prefix + "DISPATCH_VERIFICATION_KEY"
+
+	// DispatchAllowedRepositories is the comma-separated list of the repositories, in the form of owner/repo,
+	// that are allowed to send repository_dispatch payloads.
+	// Each entry can be a glob like `myorg/*`.
+	DispatchAllowedRepositories = Prefix + "DISPATCH_ALLOWED_REPOSITORIES"
+
+	// DispatchTTL is the duration, like `10m`, that the signed repository_dispatch payloads are valid for.
+	DispatchTTL = Prefix + "DISPATCH_TTL"
+
+	// PolicyFiles is the comma-separated list of the paths to the CEL or Rego policy files
+	// that the rendered files are checked against, in addition to the policy in prenv.yaml.
+	// Set this in the target repository, so that the policy cannot be modified by the pull requests to the source repository.
+	PolicyFiles = Prefix + "POLICY_FILES"
+
 	//
 	// Configuration of the pull-request environment
 	//
@@ -81,4 +106,13 @@ const (
 
 	// https://docs.github.com/en/actions/learn-github-actions/variables#default-environment-variables
 	GitHubRepository = "GITHUB_REPOSITORY"
+
+	// GitHubEventName is the name of the event that triggered the workflow, like `pull_request` and `push`.
+	GitHubEventName = "GITHUB_EVENT_NAME"
+
+	// GitHubRef is the fully-formed ref of the branch or the tag that triggered the workflow, like `refs/heads/main`.
+	GitHubRef = "GITHUB_REF"
+
+	// GitHubStepSummary is the path to the file that the Markdown written to becomes the job summary of the workflow run.
+	GitHubStepSummary = "GITHUB_STEP_SUMMARY"
 )
@@ -0,0 +1,137 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/sirupsen/logrus"
+)
+
+// Branch generates an environment per branch or tag matching the globs in the branches field of prenv.yaml.
+type Branch struct {
+	// Ref is the branch or the tag, like `refs/heads/release/1.2`, `refs/tags/v1.2`, or the name of a branch.
+	// It is read from the event payload of the delete event, or GITHUB_REF, when empty.
+	Ref string
+
+	// SHA is the SHA of the commit to deploy.
+	// It is read from GITHUB_SHA when empty.
+	SHA string
+
+	// Repository is the repository of the branch or the tag, in the form of owner/repo.
+	// It is read from GITHUB_REPOSITORY when empty.
+	Repository string
+}
+
+func (g *Branch) Generate(cfg config.Config) (*config.EnvArgs, error) {
+	if cfg.Branches == nil {
+		return nil, fmt.Errorf("branches must be configured in prenv.yaml to generate environments per branch or tag")
+	}
+
+	args := &config.EnvArgs{
+		AppNameTemplate: appNameTemplate,
+	}
+
+	if err := args.LoadEvent(); err != nil {
+		return nil, err
+	}
+
+	ref := g.Ref
+	if ref == "" {
+		ref = eventRef(args.Event)
+	}
+
+	if ref == "" {
+		return nil, fmt.Errorf("unable to determine the branch or the tag. Set %s env var or specify --ref", envvar.GitHubRef)
+	}
+
+	r := ParseRef(ref)
+
+	r.SHA = g.SHA
+	if r.SHA == "" {
+		sha, err := config.GetSHA()
+		if err != nil {
+			return nil, err
+		}
+
+		r.SHA = sha
+	}
+
+	r.Repository = g.Repository
+	if r.Repository == "" {
+		r.Repository = os.Getenv(envvar.GitHubRepository)
+	}
+
+	ok, err := cfg.Branches.Match(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		logrus.Infof("No environment is generated for %s %s as it matches none of the globs in branches", r.Type, r.Name)
+		return nil, nil
+	}
+
+	args.Ref = &r
+
+	args.Name, err = g.Name(cfg, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+// Name returns the name of the environment for the branch or the tag, like `prenv-release-1-2`.
+func (g *Branch) Name(cfg config.Config, args *config.EnvArgs) (string, error) {
+	envNameTemplate := "prenv-{{ .Ref.Slug }}"
+	if cfg.Branches != nil && cfg.Branches.NameTemplate != "" {
+		envNameTemplate = cfg.Branches.NameTemplate
+	}
+
+	return renderName(cfg, args, envNameTemplate)
+}
+
+// eventRef returns the ref that triggered the workflow.
+// The delete event has the deleted branch or tag in the payload, as GITHUB_REF is the default branch.
+func eventRef(event map[string]interface{}) string {
+	if os.Getenv(envvar.GitHubEventName) == "delete" {
+		ref, _ := event["ref"].(string)
+		if ref == "" {
+			return ""
+		}
+
+		if t, _ := event["ref_type"].(string); t == config.RefTypeTag {
+			return "refs/tags/" + ref
+		}
+
+		return "refs/heads/" + ref
+	}
+
+	return os.Getenv(envvar.GitHubRef)
+}
+
+var nonAlphanumerics = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ParseRef parses the ref like `refs/heads/release/1.2` or `refs/tags/v1.2`.
+// Anything else is the name of a branch.
+func ParseRef(ref string) config.RefEnvArgs {
+	r := config.RefEnvArgs{
+		Type: config.RefTypeBranch,
+		Name: ref,
+	}
+
+	if name, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+		r.Name = name
+	} else if name, ok := strings.CutPrefix(ref, "refs/tags/"); ok {
+		r.Type = config.RefTypeTag
+		r.Name = name
+	}
+
+	r.Slug = strings.Trim(nonAlphanumerics.ReplaceAllString(strings.ToLower(r.Name), "-"), "-")
+
+	return r
+}
@@ -16,18 +16,38 @@
 // when the command is invoked by GitHub Actions.
 // This package loads the payload, and extracts the pull request number from it.
 //
+// The SHA, the pull request number, and the repository can also be given explicitly,
+// usually via the command-line flags, so that the command can run outside of GitHub Actions.
+//
 // This package manages both the lifecycle of per-environment SQS queues and the Kubernetes resources,
 // and reconfiguration of the SQS forwarder.
+//
+// Besides the pull requests, environments can be generated per branch or tag by Branch,
+// and on demand with the names given by the user by Manual. See Generator.
 package generator
 
 import (
 	"bytes"
+	"strings"
 	"text/template"
 
 	"github.com/mumoshu/prenv/config"
 )
 
-func BuildGitHubActionsPullRequestEnvArgs(cfg config.Config) (*config.EnvArgs, error) {
+// PullRequest generates an environment per pull request.
+// It is the default generator.
+type PullRequest struct {
+	// PullRequest contains the pull request inputs given via the command-line flags.
+	// Non-zero fields take precedence over the environment variables and the event payload.
+	PullRequest config.PullRequestEnvArgs
+}
+
+func (g *PullRequest) Generate(cfg config.Config) (*config.EnvArgs, error) {
+	return BuildGitHubActionsPullRequestEnvArgs(cfg, g.PullRequest)
+}
+
+// Name returns the name of the environment for the pull request, like `prenv-123`.
+func (g *PullRequest) Name(cfg config.Config, args *config.EnvArgs) (string, error) {
 	envNameTemplate := cfg.EnvironmentNameTemplate
 	if envNameTemplate == "" && cfg.NamePrefix != "" {
 		envNameTemplate = "{{ .NamePrefix }}{{.PullRequest.Number}}"
@@ -35,26 +55,54 @@ func BuildGitHubActionsPullRequestEnvArgs(cfg config.Config) (*config.EnvArgs, e
 		envNameTemplate = "prenv-{{.PullRequest.Number}}"
 	}
 
-	envParams := config.EnvArgs{}
+	return renderName(cfg, args, envNameTemplate)
+}
+
+// BuildGitHubActionsPullRequestEnvArgs builds the EnvArgs for the pull request.
+// Non-zero fields in pr take precedence over the environment variables and the event payload.
+func BuildGitHubActionsPullRequestEnvArgs(cfg config.Config, pr config.PullRequestEnvArgs) (*config.EnvArgs, error) {
+	envParams := config.EnvArgs{
+		PullRequest: &pr,
+	}
 	if err := envParams.LoadEnvVarsAndEvent(); err != nil {
 		return nil, err
 	}
 
+	name, err := (&PullRequest{}).Name(cfg, &envParams)
+	if err != nil {
+		return nil, err
+	}
+	envParams.Name = name
+
+	return &envParams, nil
+}
+
+// renderName renders the name template of the environment with the config and the args.
+// The name of the profile is appended to the name, like `prenv-1-full`,
+// unless the template refers to it by itself via `{{ .Profile }}`.
+func renderName(cfg config.Config, args *config.EnvArgs, envNameTemplate string) (string, error) {
+	if args.Profile != "" && !strings.Contains(envNameTemplate, ".Profile") {
+		envNameTemplate += "-{{ .Profile }}"
+	}
+
 	type templateData struct {
 		config.Config
 		*config.EnvArgs
 	}
 	d := templateData{
 		Config:  cfg,
-		EnvArgs: &envParams,
+		EnvArgs: args,
+	}
+
+	envNameTmpl, err := template.New("envName template").Parse(envNameTemplate)
+	if err != nil {
+		return "", err
 	}
 
-	envNameTmpl := template.Must(template.New("envName template").Parse(envNameTemplate))
 	var buf bytes.Buffer
 	if err := envNameTmpl.Execute(&buf, d); err != nil {
-		return nil, err
+		return "", err
 	}
-	envParams.Name = buf.String()
 
-	return &envParams, nil
+	return buf.String(), nil
 }
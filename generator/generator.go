@@ -0,0 +1,65 @@
+package generator
+
+import (
+	"os"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/envvar"
+)
+
+// Generator generates the args of an environment, which the provisioner chain deploys.
+//
+// Each generator provides its own template data, like PullRequest and Ref of config.EnvArgs, and naming of the environment.
+type Generator interface {
+	// Generate returns the args of the environment, named by Name.
+	// It returns nil without an error when there is no environment to generate, like for a branch that matches no globs.
+	Generate(cfg config.Config) (*config.EnvArgs, error)
+
+	// Name returns the name of the environment for the args.
+	// It is called again with the args of each profile, as the name includes the name of the profile.
+	Name(cfg config.Config, args *config.EnvArgs) (string, error)
+}
+
+// Inputs is the set of inputs given via the command-line flags that select and configure the generator.
+type Inputs struct {
+	// PullRequest contains the pull request number, the head SHA, and the repository.
+	// The SHA and the repository are used by the branch generator, too.
+	PullRequest config.PullRequestEnvArgs
+
+	// EnvName is the name of the environment given to the manual generator, like `sandbox-alice`.
+	EnvName string
+
+	// Ref is the branch or the tag given to the branch generator, like `refs/heads/release/1.2` or `release/1.2`.
+	Ref string
+}
+
+// New returns the generator for the inputs.
+//
+// The manual generator is used when the name of the environment is given,
+// and the branch generator when the ref is given or prenv is triggered by a push to, or a deletion of, a branch or a tag.
+// Otherwise, the pull request generator is used.
+func New(in Inputs) Generator {
+	if in.EnvName != "" {
+		return &Manual{EnvName: in.EnvName}
+	}
+
+	if in.Ref != "" || isRefEvent() {
+		return &Branch{Ref: in.Ref, SHA: in.PullRequest.HeadSHA, Repository: in.PullRequest.Repository}
+	}
+
+	return &PullRequest{PullRequest: in.PullRequest}
+}
+
+// isRefEvent returns true if prenv is triggered by a push to, or a deletion of, a branch or a tag on GitHub Actions.
+func isRefEvent() bool {
+	switch os.Getenv(envvar.GitHubEventName) {
+	case "push", "delete":
+		return true
+	}
+
+	return false
+}
+
+// appNameTemplate is the default template of the names of the applications in the environments
+// generated by the generators other than the pull request generator, which have no pull request numbers.
+const appNameTemplate = "{{ .Environment.Name }}-{{ .ShortName }}"
@@ -0,0 +1,79 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Setenv(envvar.GitHubEventName, "pull_request")
+
+	require.IsType(t, &PullRequest{}, New(Inputs{}))
+	require.IsType(t, &Manual{}, New(Inputs{EnvName: "sandbox-alice"}))
+	require.IsType(t, &Branch{}, New(Inputs{Ref: "main"}))
+
+	t.Setenv(envvar.GitHubEventName, "push")
+
+	require.IsType(t, &Branch{}, New(Inputs{}))
+	require.IsType(t, &Manual{}, New(Inputs{EnvName: "sandbox-alice"}))
+}
+
+func TestParseRef(t *testing.T) {
+	require.Equal(t, config.RefEnvArgs{Type: config.RefTypeBranch, Name: "release/1.2", Slug: "release-1-2"}, ParseRef("refs/heads/release/1.2"))
+	require.Equal(t, config.RefEnvArgs{Type: config.RefTypeTag, Name: "v1.2.0", Slug: "v1-2-0"}, ParseRef("refs/tags/v1.2.0"))
+	require.Equal(t, config.RefEnvArgs{Type: config.RefTypeBranch, Name: "Feature/_X_", Slug: "feature-x"}, ParseRef("Feature/_X_"))
+}
+
+func TestBranch(t *testing.T) {
+	t.Setenv(envvar.GitHubEventPath, "")
+	t.Setenv(envvar.GitHubRef, "refs/heads/release/1.2")
+	t.Setenv(config.EnvVarGitHubSHA, "abc")
+	t.Setenv(envvar.GitHubRepository, "o/r")
+
+	cfg := config.Config{
+		Branches: &config.Branches{
+			Include: []string{"release/*"},
+			Tags:    []string{"v*"},
+		},
+	}
+
+	args, err := (&Branch{}).Generate(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "prenv-release-1-2", args.Name)
+	require.Equal(t, &config.RefEnvArgs{Type: config.RefTypeBranch, Name: "release/1.2", Slug: "release-1-2", SHA: "abc", Repository: "o/r"}, args.Ref)
+
+	args, err = (&Branch{Ref: "refs/tags/v1"}).Generate(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "prenv-v1", args.Name)
+
+	args.Profile = "full"
+	name, err := (&Branch{}).Name(cfg, args)
+	require.NoError(t, err)
+	require.Equal(t, "prenv-v1-full", name)
+
+	args, err = (&Branch{Ref: "main"}).Generate(cfg)
+	require.NoError(t, err)
+	require.Nil(t, args)
+
+	cfg.Branches.NameTemplate = "staging-{{ .Ref.Slug }}"
+
+	args, err = (&Branch{}).Generate(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "staging-release-1-2", args.Name)
+}
+
+func TestManual(t *testing.T) {
+	t.Setenv(envvar.GitHubEventPath, "")
+
+	args, err := (&Manual{EnvName: "sandbox-alice"}).Generate(config.Config{})
+	require.NoError(t, err)
+	require.Equal(t, "sandbox-alice", args.Name)
+	require.Nil(t, args.PullRequest)
+	require.NoError(t, args.Validate())
+
+	_, err = (&Manual{EnvName: "Sandbox_Alice"}).Generate(config.Config{})
+	require.EqualError(t, err, `invalid environment name "Sandbox_Alice": it must consist of lowercase alphanumeric characters or '-', and start and end with an alphanumeric character`)
+}
@@ -0,0 +1,49 @@
+package generator
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/mumoshu/prenv/config"
+)
+
+// Manual generates the environment with the name given by the user, like `prenv apply --env sandbox-alice`.
+//
+// It is useful for the long-lived sandboxes for developers, and the environments for demos,
+// which have nothing to do with pull requests.
+type Manual struct {
+	// EnvName is the name of the environment.
+	EnvName string
+}
+
+// envNameRegexp matches the names of the environments given by the user,
+// which are usually a part of the names of Kubernetes resources.
+var envNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+func (g *Manual) Generate(cfg config.Config) (*config.EnvArgs, error) {
+	if !envNameRegexp.MatchString(g.EnvName) {
+		return nil, fmt.Errorf("invalid environment name %q: it must consist of lowercase alphanumeric characters or '-', and start and end with an alphanumeric character", g.EnvName)
+	}
+
+	args := &config.EnvArgs{
+		AppNameTemplate: appNameTemplate,
+	}
+
+	if err := args.LoadEvent(); err != nil {
+		return nil, err
+	}
+
+	name, err := g.Name(cfg, args)
+	if err != nil {
+		return nil, err
+	}
+
+	args.Name = name
+
+	return args, nil
+}
+
+// Name returns the name given by the user, followed by the name of the profile if any.
+func (g *Manual) Name(cfg config.Config, args *config.EnvArgs) (string, error) {
+	return renderName(cfg, args, g.EnvName)
+}
@@ -7,4 +7,17 @@ package ghactions
 type Inputs struct {
 	RawConfig   string   `json:"raw_config"`
 	TriggeredBy []string `json:"triggered_by"`
+
+	// The following fields are set only when the payload is signed.
+	// See SignatureConfig for more details.
+
+	// Action is the event type the payload is sent with, like prenv-apply.
+	// It is signed so that a payload cannot be replayed as another action.
+	Action string `json:"action,omitempty"`
+	// SourceRepository is the repository that sent the payload, in the form of owner/repo.
+	SourceRepository string `json:"source_repository,omitempty"`
+	// ExpiresAt is the time in RFC3339 after which the payload is no longer accepted.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// Signature is the signature of the rest of the fields, like `hmac-sha256=<hex>` or `ed25519=<base64>`.
+	Signature string `json:"signature,omitempty"`
 }
@@ -6,10 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/google/go-github/v56/github"
 	"github.com/mumoshu/prenv/config"
 	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/retry"
 )
 
 const (
@@ -22,7 +24,19 @@ const (
 // SendRepositoryDispatch sends a GitHub Actions repository_dispatch event to the target repository.
 // The clientPayload is a JSON-encoded Inputs, which contains the raw_config field,
 // which is parsed by UnmarshalClientPayload in the target repository.
-func SendRepositoryDispatch(ctx context.Context, eventType string, d config.RepositoryDispatch, in Inputs) error {
+//
+// The Inputs is signed when the signing key is configured, as sent from sourceRepository,
+// the repository that prenv runs for in the form of owner/repo. See SignatureConfig.
+func SendRepositoryDispatch(ctx context.Context, eventType string, d config.RepositoryDispatch, in Inputs, sourceRepository string) error {
+	sc, err := LoadSignatureConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := sc.Sign(&in, eventType, sourceRepository, time.Now()); err != nil {
+		return fmt.Errorf("unable to sign repository_dispatch payload: %w", err)
+	}
+
 	token := os.Getenv(envvar.GitHubToken)
 	return sendRepositoryDispatch(ctx, d.Owner, d.Repo, token, eventType, in)
 }
@@ -45,12 +59,14 @@ func sendRepositoryDispatch(ctx context.Context, owner, repo, token, eventType s
 
 	raw := json.RawMessage(payload)
 
-	if _, _, err := client.Repositories.Dispatch(ctx, owner, repo, github.DispatchRequestOptions{
-		EventType:     eventType,
-		ClientPayload: &raw,
-	}); err != nil && !errors.Is(err, &github.AcceptedError{}) {
-		return err
-	}
+	return retry.Do(ctx, fmt.Sprintf("send repository_dispatch to %s/%s", owner, repo), func() error {
+		if _, _, err := client.Repositories.Dispatch(ctx, owner, repo, github.DispatchRequestOptions{
+			EventType:     eventType,
+			ClientPayload: &raw,
+		}); err != nil && !errors.Is(err, &github.AcceptedError{}) {
+			return err
+		}
 
-	return nil
+		return nil
+	})
 }
@@ -0,0 +1,250 @@
+package ghactions
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mumoshu/prenv/envvar"
+)
+
+const (
+	// DefaultDispatchTTL is the default duration that the signed payloads are valid for.
+	// It is long enough for the workflow run on the target repository to be queued and started.
+	DefaultDispatchTTL = 30 * time.Minute
+
+	signatureHMACSHA256 = "hmac-sha256"
+	signatureEd25519    = "ed25519"
+)
+
+// SignatureConfig is the configuration for signing and verifying the Inputs sent via repository_dispatch.
+//
+// Without signatures, the prenv run on the target repository would accept any repository_dispatch
+// whose raw_config parses, letting anyone with the permission to send repository_dispatch events
+// render arbitrary content into the gitops repository.
+//
+// The source repository signs the payload either with the shared HMAC key or the Ed25519 private key,
+// and the target repository verifies it with the same HMAC key or the corresponding Ed25519 public key,
+// along with the expiry and the allow-list of the source repositories.
+type SignatureConfig struct {
+	// HMACKey is the shared secret used to both sign and verify the payloads with HMAC-SHA256.
+	HMACKey []byte
+	// SigningKey is the private key used to sign the payloads.
+	SigningKey ed25519.PrivateKey
+	// VerificationKey is the public key used to verify the payloads.
+	VerificationKey ed25519.PublicKey
+	// AllowedRepositories is the list of the source repositories, like `owner/repo` or `owner/*`,
+	// the payloads are accepted from. Any repository is accepted if empty.
+	AllowedRepositories []string
+	// TTL is the duration that the signed payloads are valid for. Defaults to DefaultDispatchTTL.
+	TTL time.Duration
+}
+
+// LoadSignatureConfig reads the SignatureConfig from the environment variables.
+func LoadSignatureConfig() (*SignatureConfig, error) {
+	var c SignatureConfig
+
+	if v := os.Getenv(envvar.DispatchHMACKey); v != "" {
+		c.HMACKey = []byte(v)
+	}
+
+	if v := os.Getenv(envvar.DispatchSigningKey); v != "" {
+		key, err := parsePEM(envvar.DispatchSigningKey, v, x509.ParsePKCS8PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		k, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an Ed25519 private key, but got %T", envvar.DispatchSigningKey, key)
+		}
+
+		c.SigningKey = k
+	}
+
+	if v := os.Getenv(envvar.DispatchVerificationKey); v != "" {
+		key, err := parsePEM(envvar.DispatchVerificationKey, v, x509.ParsePKIXPublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an Ed25519 public key, but got %T", envvar.DispatchVerificationKey, key)
+		}
+
+		c.VerificationKey = k
+	}
+
+	if v := os.Getenv(envvar.DispatchAllowedRepositories); v != "" {
+		for _, r := range strings.Split(v, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				c.AllowedRepositories = append(c.AllowedRepositories, r)
+			}
+		}
+	}
+
+	if v := os.Getenv(envvar.DispatchTTL); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", envvar.DispatchTTL, err)
+		}
+
+		c.TTL = d
+	}
+
+	if len(c.AllowedRepositories) > 0 && len(c.HMACKey) == 0 && c.VerificationKey == nil {
+		return nil, fmt.Errorf("%s requires either %s or %s, as the source repository of an unsigned payload can be forged", envvar.DispatchAllowedRepositories, envvar.DispatchHMACKey, envvar.DispatchVerificationKey)
+	}
+
+	return &c, nil
+}
+
+func parsePEM(name, v string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	b, _ := pem.Decode([]byte(v))
+	if b == nil {
+		return nil, fmt.Errorf("%s must be a PEM-encoded key", name)
+	}
+
+	key, err := parse(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", name, err)
+	}
+
+	return key, nil
+}
+
+// Sign sets the action, the source repository, the expiry, and the signature to the Inputs.
+// It does nothing when neither HMACKey nor SigningKey is set.
+func (c *SignatureConfig) Sign(in *Inputs, action, sourceRepository string, now time.Time) error {
+	if len(c.HMACKey) == 0 && c.SigningKey == nil {
+		return nil
+	}
+
+	if sourceRepository == "" {
+		return fmt.Errorf("the source repository is required to sign the payload. Set --repo or %s", envvar.GitHubRepository)
+	}
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultDispatchTTL
+	}
+
+	in.Action = action
+	in.SourceRepository = sourceRepository
+	in.ExpiresAt = now.Add(ttl).UTC().Format(time.RFC3339)
+
+	msg, err := signedMessage(*in)
+	if err != nil {
+		return err
+	}
+
+	if len(c.HMACKey) > 0 {
+		in.Signature = signatureHMACSHA256 + "=" + hex.EncodeToString(computeHMAC(c.HMACKey, msg))
+	} else {
+		in.Signature = signatureEd25519 + "=" + base64.StdEncoding.EncodeToString(ed25519.Sign(c.SigningKey, msg))
+	}
+
+	return nil
+}
+
+// Verify returns an error unless the Inputs is signed with the HMACKey or the key pair of the VerificationKey,
+// is not expired, is sent for the action, and is sent from one of the AllowedRepositories.
+// It does nothing when neither HMACKey nor VerificationKey is set.
+func (c *SignatureConfig) Verify(in Inputs, action string, now time.Time) error {
+	if len(c.HMACKey) == 0 && c.VerificationKey == nil {
+		return nil
+	}
+
+	if in.Signature == "" {
+		return errors.New("the payload is not signed")
+	}
+
+	scheme, sig, _ := strings.Cut(in.Signature, "=")
+
+	msg, err := signedMessage(in)
+	if err != nil {
+		return err
+	}
+
+	switch scheme {
+	case signatureHMACSHA256:
+		if len(c.HMACKey) == 0 {
+			return fmt.Errorf("the payload is signed with %s, but %s is not set", scheme, envvar.DispatchHMACKey)
+		}
+
+		got, err := hex.DecodeString(sig)
+		if err != nil || !hmac.Equal(got, computeHMAC(c.HMACKey, msg)) {
+			return errors.New("invalid signature")
+		}
+	case signatureEd25519:
+		if c.VerificationKey == nil {
+			return fmt.Errorf("the payload is signed with %s, but %s is not set", scheme, envvar.DispatchVerificationKey)
+		}
+
+		got, err := base64.StdEncoding.DecodeString(sig)
+		if err != nil || !ed25519.Verify(c.VerificationKey, msg, got) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported signature scheme %q", scheme)
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, in.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("invalid expires_at %q: %w", in.ExpiresAt, err)
+	}
+
+	if now.After(expiresAt) {
+		return fmt.Errorf("the payload expired at %s", in.ExpiresAt)
+	}
+
+	if action != "" && in.Action != action {
+		return fmt.Errorf("the payload is signed for %q, but received as %q", in.Action, action)
+	}
+
+	if len(c.AllowedRepositories) > 0 && !matchRepository(c.AllowedRepositories, in.SourceRepository) {
+		return fmt.Errorf("the source repository %q is not allowed. Add it to %s", in.SourceRepository, envvar.DispatchAllowedRepositories)
+	}
+
+	return nil
+}
+
+func matchRepository(patterns []string, repo string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signedMessage returns the message to be signed, which is the JSON-encoded Inputs without the signature.
+func signedMessage(in Inputs) ([]byte, error) {
+	in.Signature = ""
+
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal the payload: %w", err)
+	}
+
+	return b, nil
+}
+
+func computeHMAC(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
@@ -0,0 +1,124 @@
+package ghactions
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip simulates sending the Inputs via repository_dispatch.
+func roundTrip(t *testing.T, in Inputs) Inputs {
+	t.Helper()
+
+	b, err := json.Marshal(in)
+	require.NoError(t, err)
+
+	var out Inputs
+	require.NoError(t, json.Unmarshal(b, &out))
+
+	return out
+}
+
+func TestSignatureHMAC(t *testing.T) {
+	now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	source := &SignatureConfig{HMACKey: []byte("s3cr3t")}
+	target := &SignatureConfig{HMACKey: []byte("s3cr3t"), AllowedRepositories: []string{"mumoshu/*"}}
+
+	in := Inputs{
+		RawConfig:   "dedicated: {}\n",
+		TriggeredBy: []string{"pr-render"},
+	}
+
+	require.NoError(t, source.Sign(&in, EventTypeApply, "mumoshu/prenv-source", now))
+	require.Equal(t, "2023-10-01T00:30:00Z", in.ExpiresAt)
+	require.Regexp(t, "^hmac-sha256=[0-9a-f]{64}$", in.Signature)
+
+	received := roundTrip(t, in)
+
+	require.NoError(t, target.Verify(received, EventTypeApply, now.Add(time.Minute)))
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := received
+		tampered.RawConfig = "shared: {}\n"
+		require.EqualError(t, target.Verify(tampered, EventTypeApply, now), "invalid signature")
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		other := &SignatureConfig{HMACKey: []byte("other")}
+		require.EqualError(t, other.Verify(received, EventTypeApply, now), "invalid signature")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		require.EqualError(t, target.Verify(received, EventTypeApply, now.Add(time.Hour)), "the payload expired at 2023-10-01T00:30:00Z")
+	})
+
+	t.Run("replayed as another action", func(t *testing.T) {
+		require.EqualError(t, target.Verify(received, EventTypeDestroy, now), `the payload is signed for "prenv-apply", but received as "prenv-destroy"`)
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		strict := &SignatureConfig{HMACKey: []byte("s3cr3t"), AllowedRepositories: []string{"mumoshu/prenv-other"}}
+		require.ErrorContains(t, strict.Verify(received, EventTypeApply, now), `the source repository "mumoshu/prenv-source" is not allowed`)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		require.EqualError(t, target.Verify(Inputs{RawConfig: "dedicated: {}\n"}, EventTypeApply, now), "the payload is not signed")
+	})
+
+	t.Run("verification disabled", func(t *testing.T) {
+		require.NoError(t, (&SignatureConfig{}).Verify(Inputs{RawConfig: "dedicated: {}\n"}, EventTypeApply, now))
+	})
+}
+
+func TestSignatureEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+
+	t.Setenv(envvar.DispatchSigningKey, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})))
+	t.Setenv(envvar.DispatchTTL, "5m")
+
+	source, err := LoadSignatureConfig()
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Minute, source.TTL)
+
+	now := time.Now()
+
+	in := Inputs{RawConfig: "dedicated: {}\n", TriggeredBy: []string{"pr-render"}}
+	require.NoError(t, source.Sign(&in, EventTypeApply, "mumoshu/prenv-source", now))
+	require.Regexp(t, "^ed25519=", in.Signature)
+
+	t.Setenv(envvar.DispatchSigningKey, "")
+	t.Setenv(envvar.DispatchVerificationKey, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})))
+	t.Setenv(envvar.DispatchAllowedRepositories, "mumoshu/prenv-source, mumoshu/prenv-other")
+
+	target, err := LoadSignatureConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"mumoshu/prenv-source", "mumoshu/prenv-other"}, target.AllowedRepositories)
+
+	received := roundTrip(t, in)
+	require.NoError(t, target.Verify(received, EventTypeApply, now))
+
+	received.TriggeredBy = []string{"pr-render", "pr-k8s"}
+	require.EqualError(t, target.Verify(received, EventTypeApply, now), "invalid signature")
+}
+
+func TestLoadSignatureConfigRequiresKeyForAllowList(t *testing.T) {
+	t.Setenv(envvar.DispatchAllowedRepositories, "mumoshu/prenv-source")
+
+	_, err := LoadSignatureConfig()
+	require.ErrorContains(t, err, "PRENV_DISPATCH_ALLOWED_REPOSITORIES requires either PRENV_DISPATCH_HMAC_KEY or PRENV_DISPATCH_VERIFICATION_KEY")
+}
@@ -0,0 +1,602 @@
+// Package patch edits existing YAML and JSON files in place,
+// preserving the comments and the order of the keys where possible.
+//
+// It is used to add an entry for a pull-request environment to a file that is shared with humans and other tools,
+// like values.yaml and kustomization.yaml in the gitops repository, and to remove the entry once the environment is destroyed.
+// Blank lines are not preserved.
+// Every edit has its inverse, so that what is added on apply can be removed on destroy.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Document is a YAML or JSON document to be edited.
+type Document struct {
+	// root is the document node whose only content is the top-level node.
+	root *yaml.Node
+	// json is true when the document is written back as JSON.
+	json bool
+}
+
+// Parse parses the content of the file at path.
+// The file is treated as JSON if the path ends with .json, or YAML otherwise.
+// Empty content is treated as an empty mapping, so that a missing file can be created by the edits.
+func Parse(path string, content []byte) (*Document, error) {
+	d := &Document{
+		json: strings.EqualFold(filepath.Ext(path), ".json"),
+	}
+
+	var root yaml.Node
+
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+
+	if root.Kind == 0 {
+		root = yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{newMapping()},
+		}
+	}
+
+	d.root = &root
+
+	return d, nil
+}
+
+// Bytes returns the edited content.
+func (d *Document) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+
+	if d.json {
+		if err := writeJSON(&buf, d.top(), 0); err != nil {
+			return nil, err
+		}
+		buf.WriteString("\n")
+		return buf.Bytes(), nil
+	}
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(d.root); err != nil {
+		return nil, err
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// IsEmpty returns true if the document is an empty mapping or null.
+func (d *Document) IsEmpty() bool {
+	top := d.top()
+	return (top.Kind == yaml.MappingNode && len(top.Content) == 0) || isNull(top)
+}
+
+func (d *Document) top() *yaml.Node {
+	return d.root.Content[0]
+}
+
+// MergePatch applies the JSON Merge Patch (RFC 7386) written in YAML or JSON to the document.
+func (d *Document) MergePatch(patch []byte) error {
+	p, err := parseValue(patch)
+	if err != nil {
+		return fmt.Errorf("unable to parse merge patch: %w", err)
+	}
+
+	d.root.Content[0] = mergePatch(d.top(), p)
+
+	return nil
+}
+
+// UnmergePatch reverts the JSON Merge Patch previously applied via MergePatch.
+//
+// The keys that the patch sets are removed, and so are the mappings emptied by the removal.
+// The keys that the patch deletes with null cannot be restored and are left as is.
+func (d *Document) UnmergePatch(patch []byte) error {
+	p, err := parseValue(patch)
+	if err != nil {
+		return fmt.Errorf("unable to parse merge patch: %w", err)
+	}
+
+	unmergePatch(d.top(), p)
+
+	return nil
+}
+
+// Set sets the value written in YAML or JSON at the path, like `.a.b[0].c`.
+// Missing mappings along the path are created.
+func (d *Document) Set(path string, value []byte) error {
+	segs, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+
+	v, err := parseValue(value)
+	if err != nil {
+		return fmt.Errorf("unable to parse the value for %s: %w", path, err)
+	}
+
+	parent := d.top()
+
+	for i, seg := range segs {
+		last := i == len(segs)-1
+
+		if seg.isIndex {
+			if parent.Kind != yaml.SequenceNode {
+				return fmt.Errorf("unable to set %s: %s is not a sequence", path, pathString(segs[:i]))
+			}
+
+			switch {
+			case seg.index < len(parent.Content):
+				if last {
+					parent.Content[seg.index] = v
+				}
+			case seg.index == len(parent.Content):
+				next := v
+				if !last {
+					next = newNodeFor(segs[i+1])
+				}
+				parent.Content = append(parent.Content, next)
+			default:
+				return fmt.Errorf("unable to set %s: index %d is out of range", path, seg.index)
+			}
+
+			parent = parent.Content[seg.index]
+
+			continue
+		}
+
+		if parent.Kind != yaml.MappingNode {
+			return fmt.Errorf("unable to set %s: %s is not a mapping", path, pathString(segs[:i]))
+		}
+
+		j := mappingIndex(parent, seg.key)
+
+		switch {
+		case j < 0:
+			next := v
+			if !last {
+				next = newNodeFor(segs[i+1])
+			}
+			parent.Content = append(parent.Content, newString(seg.key), next)
+			parent = next
+		case last:
+			replaceValue(parent.Content[j+1], v)
+		default:
+			parent = parent.Content[j+1]
+		}
+	}
+
+	return nil
+}
+
+// Delete deletes the node at the path, like `.a.b[0].c`.
+// It does nothing if the node does not exist.
+// The mappings emptied by the deletion are removed, too, except for the top-level one.
+func (d *Document) Delete(path string) error {
+	segs, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+
+	deleteAt(d.top(), segs)
+
+	return nil
+}
+
+// deleteAt deletes the node at the path relative to n, and returns true if n has become empty by the deletion.
+func deleteAt(n *yaml.Node, segs []segment) bool {
+	seg := segs[0]
+
+	var (
+		child  *yaml.Node
+		remove func()
+	)
+
+	switch {
+	case seg.isIndex && n.Kind == yaml.SequenceNode && seg.index < len(n.Content):
+		child = n.Content[seg.index]
+		remove = func() {
+			n.Content = append(n.Content[:seg.index], n.Content[seg.index+1:]...)
+		}
+	case !seg.isIndex && n.Kind == yaml.MappingNode:
+		j := mappingIndex(n, seg.key)
+		if j < 0 {
+			return false
+		}
+		child = n.Content[j+1]
+		remove = func() {
+			n.Content = append(n.Content[:j], n.Content[j+2:]...)
+		}
+	default:
+		return false
+	}
+
+	if len(segs) == 1 || deleteAt(child, segs[1:]) {
+		remove()
+		return len(n.Content) == 0
+	}
+
+	return false
+}
+
+// SetKustomizeImage adds or updates the entry for the image in the images field of kustomization.yaml.
+// Empty fields are left as is.
+func (d *Document) SetKustomizeImage(name, newName, newTag, digest string) error {
+	images, err := d.kustomizeList("images")
+	if err != nil {
+		return err
+	}
+
+	var image *yaml.Node
+
+	for _, img := range images.Content {
+		if img.Kind == yaml.MappingNode && mappingValue(img, "name") == name {
+			image = img
+			break
+		}
+	}
+
+	if image == nil {
+		image = newMapping()
+		image.Content = append(image.Content, newString("name"), newString(name))
+		images.Content = append(images.Content, image)
+	}
+
+	for _, kv := range [][2]string{{"newName", newName}, {"newTag", newTag}, {"digest", digest}} {
+		if kv[1] == "" {
+			continue
+		}
+
+		if j := mappingIndex(image, kv[0]); j >= 0 {
+			replaceValue(image.Content[j+1], newString(kv[1]))
+		} else {
+			image.Content = append(image.Content, newString(kv[0]), newString(kv[1]))
+		}
+	}
+
+	return nil
+}
+
+// RemoveKustomizeImage removes the entry for the image from the images field of kustomization.yaml.
+func (d *Document) RemoveKustomizeImage(name string) error {
+	return d.removeFromKustomizeList("images", func(n *yaml.Node) bool {
+		return n.Kind == yaml.MappingNode && mappingValue(n, "name") == name
+	})
+}
+
+// AddKustomizeResource adds the resource to the resources field of kustomization.yaml, unless it is already there.
+func (d *Document) AddKustomizeResource(resource string) error {
+	resources, err := d.kustomizeList("resources")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range resources.Content {
+		if r.Kind == yaml.ScalarNode && r.Value == resource {
+			return nil
+		}
+	}
+
+	resources.Content = append(resources.Content, newString(resource))
+
+	return nil
+}
+
+// RemoveKustomizeResource removes the resource from the resources field of kustomization.yaml.
+func (d *Document) RemoveKustomizeResource(resource string) error {
+	return d.removeFromKustomizeList("resources", func(n *yaml.Node) bool {
+		return n.Kind == yaml.ScalarNode && n.Value == resource
+	})
+}
+
+// kustomizeList returns the sequence at the top-level field of kustomization.yaml, creating it if missing.
+func (d *Document) kustomizeList(field string) (*yaml.Node, error) {
+	top := d.top()
+	if top.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("kustomization must be a mapping")
+	}
+
+	j := mappingIndex(top, field)
+	if j < 0 {
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		top.Content = append(top.Content, newString(field), seq)
+		return seq, nil
+	}
+
+	seq := top.Content[j+1]
+	if seq.Kind == yaml.ScalarNode && seq.Tag == "!!null" {
+		seq.Kind, seq.Tag, seq.Value = yaml.SequenceNode, "!!seq", ""
+	}
+
+	if seq.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("kustomization %s must be a sequence", field)
+	}
+
+	return seq, nil
+}
+
+// removeFromKustomizeList removes the matching items from the top-level field of kustomization.yaml,
+// and removes the field itself once it is empty.
+func (d *Document) removeFromKustomizeList(field string, match func(*yaml.Node) bool) error {
+	top := d.top()
+	if top.Kind != yaml.MappingNode {
+		return fmt.Errorf("kustomization must be a mapping")
+	}
+
+	j := mappingIndex(top, field)
+	if j < 0 {
+		return nil
+	}
+
+	seq := top.Content[j+1]
+	if seq.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	var kept []*yaml.Node
+	for _, n := range seq.Content {
+		if !match(n) {
+			kept = append(kept, n)
+		}
+	}
+
+	if len(kept) == len(seq.Content) {
+		return nil
+	}
+
+	seq.Content = kept
+
+	if len(kept) == 0 {
+		top.Content = append(top.Content[:j], top.Content[j+2:]...)
+	}
+
+	return nil
+}
+
+func mergePatch(target, patch *yaml.Node) *yaml.Node {
+	if patch.Kind != yaml.MappingNode {
+		if target == nil {
+			return patch
+		}
+		replaceValue(target, patch)
+		return target
+	}
+
+	if target == nil || target.Kind != yaml.MappingNode {
+		m := newMapping()
+		if target != nil {
+			m.HeadComment, m.LineComment, m.FootComment = target.HeadComment, target.LineComment, target.FootComment
+		}
+		target = m
+	}
+
+	for i := 0; i < len(patch.Content); i += 2 {
+		k, v := patch.Content[i].Value, patch.Content[i+1]
+
+		j := mappingIndex(target, k)
+
+		if isNull(v) {
+			if j >= 0 {
+				target.Content = append(target.Content[:j], target.Content[j+2:]...)
+			}
+			continue
+		}
+
+		if j >= 0 {
+			target.Content[j+1] = mergePatch(target.Content[j+1], v)
+		} else {
+			target.Content = append(target.Content, newString(k), mergePatch(nil, v))
+		}
+	}
+
+	return target
+}
+
+// unmergePatch removes the keys set by the patch from the target, and returns true if the target has become empty.
+func unmergePatch(target, patch *yaml.Node) bool {
+	if target.Kind != yaml.MappingNode || patch.Kind != yaml.MappingNode {
+		return false
+	}
+
+	for i := 0; i < len(patch.Content); i += 2 {
+		k, v := patch.Content[i].Value, patch.Content[i+1]
+
+		if isNull(v) {
+			continue
+		}
+
+		j := mappingIndex(target, k)
+		if j < 0 {
+			continue
+		}
+
+		if v.Kind == yaml.MappingNode && target.Content[j+1].Kind == yaml.MappingNode {
+			if !unmergePatch(target.Content[j+1], v) {
+				continue
+			}
+		}
+
+		target.Content = append(target.Content[:j], target.Content[j+2:]...)
+	}
+
+	return len(target.Content) == 0
+}
+
+// parseValue parses the YAML or JSON value, resetting the styles so that
+// the value is written in the style of the document it is inserted into.
+func parseValue(b []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+
+	v := doc.Content[0]
+
+	resetStyle(v)
+
+	return v, nil
+}
+
+func resetStyle(n *yaml.Node) {
+	if n.Kind != yaml.ScalarNode || n.Tag != "!!str" || n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+		n.Style = 0
+	}
+
+	for _, c := range n.Content {
+		resetStyle(c)
+	}
+}
+
+// replaceValue replaces the content of dst with src, keeping the comments of dst.
+func replaceValue(dst, src *yaml.Node) {
+	head, line, foot := dst.HeadComment, dst.LineComment, dst.FootComment
+
+	*dst = *src
+
+	if dst.HeadComment == "" {
+		dst.HeadComment = head
+	}
+	if dst.LineComment == "" {
+		dst.LineComment = line
+	}
+	if dst.FootComment == "" {
+		dst.FootComment = foot
+	}
+}
+
+func mappingIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func mappingValue(m *yaml.Node, key string) string {
+	if j := mappingIndex(m, key); j >= 0 {
+		return m.Content[j+1].Value
+	}
+	return ""
+}
+
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+func newMapping() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+func newString(s string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+}
+
+func newNodeFor(next segment) *yaml.Node {
+	if next.isIndex {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	return newMapping()
+}
+
+func pathString(segs []segment) string {
+	if len(segs) == 0 {
+		return "the root"
+	}
+
+	var b strings.Builder
+	for _, s := range segs {
+		b.WriteString(s.String())
+	}
+	return b.String()
+}
+
+// writeJSON writes the node as JSON with two-space indentation, preserving the order of the keys.
+func writeJSON(buf *bytes.Buffer, n *yaml.Node, level int) error {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	indent := func(l int) {
+		buf.WriteString("\n")
+		buf.WriteString(strings.Repeat("  ", l))
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+
+		buf.WriteString("{")
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			indent(level + 1)
+
+			k, err := json.Marshal(n.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(k)
+			buf.WriteString(": ")
+
+			if err := writeJSON(buf, n.Content[i+1], level+1); err != nil {
+				return err
+			}
+		}
+		indent(level)
+		buf.WriteString("}")
+	case yaml.SequenceNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+
+		buf.WriteString("[")
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			indent(level + 1)
+
+			if err := writeJSON(buf, c, level+1); err != nil {
+				return err
+			}
+		}
+		indent(level)
+		buf.WriteString("]")
+	default:
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+
+	return nil
+}
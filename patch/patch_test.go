@@ -0,0 +1,193 @@
+package patch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const valuesYAML = `# Values shared by all the environments.
+image:
+  repository: example/app # the app image
+  tag: main
+# Per-environment overrides.
+environments:
+  staging:
+    replicas: 2
+`
+
+func TestMergePatch(t *testing.T) {
+	d, err := Parse("values.yaml", []byte(valuesYAML))
+	require.NoError(t, err)
+
+	patch := []byte(`{"environments": {"pr-123": {"replicas": 1, "tag": "abc"}}, "image": {"tag": "v2"}}`)
+
+	require.NoError(t, d.MergePatch(patch))
+
+	got, err := d.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `# Values shared by all the environments.
+image:
+  repository: example/app # the app image
+  tag: v2
+# Per-environment overrides.
+environments:
+  staging:
+    replicas: 2
+  pr-123:
+    replicas: 1
+    tag: abc
+`, string(got))
+
+	require.NoError(t, d.UnmergePatch(patch))
+
+	got, err = d.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `# Values shared by all the environments.
+image:
+  repository: example/app # the app image
+# Per-environment overrides.
+environments:
+  staging:
+    replicas: 2
+`, string(got))
+}
+
+func TestMergePatchNullDeletes(t *testing.T) {
+	d, err := Parse("values.yaml", []byte(valuesYAML))
+	require.NoError(t, err)
+
+	require.NoError(t, d.MergePatch([]byte("environments:\n  staging: null\n")))
+
+	got, err := d.Bytes()
+	require.NoError(t, err)
+	require.NotContains(t, string(got), "staging")
+	require.Contains(t, string(got), "# the app image")
+}
+
+func TestSetAndDelete(t *testing.T) {
+	d, err := Parse("values.yaml", []byte(valuesYAML))
+	require.NoError(t, err)
+
+	require.NoError(t, d.Set(`.environments["pr-123"].hosts[0]`, []byte("pr-123.example.com")))
+	require.NoError(t, d.Set("$.image.tag", []byte("v3")))
+	require.NoError(t, d.Set("environments.staging.replicas", []byte("3")))
+
+	got, err := d.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `# Values shared by all the environments.
+image:
+  repository: example/app # the app image
+  tag: v3
+# Per-environment overrides.
+environments:
+  staging:
+    replicas: 3
+  pr-123:
+    hosts:
+      - pr-123.example.com
+`, string(got))
+
+	require.NoError(t, d.Delete(`.environments["pr-123"].hosts[0]`))
+	require.NoError(t, d.Delete(".missing.key"))
+
+	got, err = d.Bytes()
+	require.NoError(t, err)
+	require.NotContains(t, string(got), "pr-123")
+
+	require.ErrorContains(t, d.Set(".image.repository[0]", []byte("x")), "is not a sequence")
+}
+
+func TestParsePathErrors(t *testing.T) {
+	for path, want := range map[string]string{
+		"":         "path must not point to the root",
+		"$":        "path must not point to the root",
+		".a..b":    "empty key",
+		".a[0":     "missing ]",
+		".a[-1]":   "index must be a non-negative integer",
+		`.a["b]`:   "unterminated quote",
+		`.a["b"]c`: `unexpected "c"`,
+	} {
+		_, err := parsePath(path)
+		require.ErrorContains(t, err, want, path)
+	}
+}
+
+func TestKustomize(t *testing.T) {
+	d, err := Parse("kustomization.yaml", []byte(`resources:
+  - base # the shared base
+images:
+  - name: example/app
+    newTag: main
+`))
+	require.NoError(t, err)
+
+	require.NoError(t, d.AddKustomizeResource("pr-123"))
+	require.NoError(t, d.AddKustomizeResource("pr-123"))
+	require.NoError(t, d.SetKustomizeImage("example/app", "", "abc", ""))
+	require.NoError(t, d.SetKustomizeImage("example/worker", "registry.example.com/worker", "def", ""))
+
+	got, err := d.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `resources:
+  - base # the shared base
+  - pr-123
+images:
+  - name: example/app
+    newTag: abc
+  - name: example/worker
+    newName: registry.example.com/worker
+    newTag: def
+`, string(got))
+
+	require.NoError(t, d.RemoveKustomizeResource("pr-123"))
+	require.NoError(t, d.RemoveKustomizeImage("example/worker"))
+	require.NoError(t, d.RemoveKustomizeImage("example/app"))
+
+	got, err = d.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `resources:
+  - base # the shared base
+`, string(got))
+}
+
+func TestJSON(t *testing.T) {
+	d, err := Parse("config.json", []byte(`{"z": 1, "a": {"b": [1, "two", true, null]}}`))
+	require.NoError(t, err)
+
+	require.NoError(t, d.Set(".a.c", []byte(`{"d": 1.5}`)))
+
+	got, err := d.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "z": 1,
+  "a": {
+    "b": [
+      1,
+      "two",
+      true,
+      null
+    ],
+    "c": {
+      "d": 1.5
+    }
+  }
+}
+`, string(got))
+}
+
+func TestEmpty(t *testing.T) {
+	d, err := Parse("values.yaml", nil)
+	require.NoError(t, err)
+	require.True(t, d.IsEmpty())
+
+	require.NoError(t, d.MergePatch([]byte("a:\n  b: 1\n")))
+	require.False(t, d.IsEmpty())
+
+	got, err := d.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, "a:\n  b: 1\n", string(got))
+
+	require.NoError(t, d.UnmergePatch([]byte("a:\n  b: 1\n")))
+	require.True(t, d.IsEmpty())
+}
@@ -0,0 +1,113 @@
+package patch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// segment is a segment of the path to a node.
+// It is either a key in a mapping or an index in a sequence.
+type segment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func (s segment) String() string {
+	if s.isIndex {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	return "." + s.key
+}
+
+// parsePath parses the yq-style or JSONPath-style path to a node, like `.a.b[0].c`, `$.a["b.c"]`, or `a.b`.
+func parsePath(p string) ([]segment, error) {
+	orig := p
+
+	p = strings.TrimPrefix(p, "$")
+
+	var segs []segment
+
+	for i := 0; len(p) > 0; i++ {
+		switch {
+		case p[0] == '.':
+			p = p[1:]
+
+			if len(p) > 0 && p[0] == '"' {
+				key, rest, err := parseQuoted(p, orig)
+				if err != nil {
+					return nil, err
+				}
+				segs = append(segs, segment{key: key})
+				p = rest
+				continue
+			}
+
+			key, rest := parseKey(p)
+			if key == "" {
+				return nil, fmt.Errorf("invalid path %q: empty key", orig)
+			}
+			segs = append(segs, segment{key: key})
+			p = rest
+		case p[0] == '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: missing ]", orig)
+			}
+
+			inner := p[1:end]
+
+			if len(inner) > 0 && (inner[0] == '"' || inner[0] == '\'') {
+				key, rest, err := parseQuoted(inner, orig)
+				if err != nil {
+					return nil, err
+				}
+				if rest != "" {
+					return nil, fmt.Errorf("invalid path %q: unexpected %q after the quoted key", orig, rest)
+				}
+				segs = append(segs, segment{key: key})
+			} else {
+				n, err := strconv.Atoi(inner)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid path %q: index must be a non-negative integer, but got %q", orig, inner)
+				}
+				segs = append(segs, segment{index: n, isIndex: true})
+			}
+
+			p = p[end+1:]
+		case i == 0:
+			// The leading dot is optional, like `a.b`.
+			key, rest := parseKey(p)
+			segs = append(segs, segment{key: key})
+			p = rest
+		default:
+			return nil, fmt.Errorf("invalid path %q: unexpected %q", orig, p)
+		}
+	}
+
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("invalid path %q: path must not point to the root", orig)
+	}
+
+	return segs, nil
+}
+
+func parseKey(p string) (string, string) {
+	end := strings.IndexAny(p, ".[")
+	if end < 0 {
+		return p, ""
+	}
+	return p[:end], p[end:]
+}
+
+func parseQuoted(p, orig string) (string, string, error) {
+	quote := p[0]
+
+	end := strings.IndexByte(p[1:], quote)
+	if end < 0 {
+		return "", "", fmt.Errorf("invalid path %q: unterminated quote", orig)
+	}
+
+	return p[1 : end+1], p[end+2:], nil
+}
@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/google/cel-go/cel"
+	"gopkg.in/yaml.v3"
+)
+
+// celRules is the content of a CEL policy file, like:
+//
+//	rules:
+//	- name: no-host-network
+//	  expression: "!has(object.spec.template.spec.hostNetwork) || !object.spec.template.spec.hostNetwork"
+//	  message: hostNetwork is not allowed
+type celRules struct {
+	Rules []celRule `yaml:"rules"`
+}
+
+// celRule is a CEL expression that evaluates to true when the manifest satisfies the rule.
+// The manifest is available as `object`, and the path to the rendered file as `file`.
+type celRule struct {
+	// Name is the name of the rule shown in the violations.
+	Name string `yaml:"name"`
+	// Expression is the CEL expression that evaluates to a bool.
+	Expression string `yaml:"expression"`
+	// Message is the message shown in the violations.
+	// Defaults to "failed <expression>".
+	Message string `yaml:"message"`
+
+	program cel.Program
+}
+
+func loadCELRules(file string) ([]celRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs celRules
+
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(&rs); err != nil {
+		return nil, fmt.Errorf("unable to parse CEL rules in %s: %w", file, err)
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("file", cel.StringType),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("%s[%d]", file, i)
+		}
+
+		ast, iss := env.Compile(r.Expression)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("unable to compile rule %s in %s: %w", r.Name, file, iss.Err())
+		}
+
+		r.program, err = env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile rule %s in %s: %w", r.Name, file, err)
+		}
+	}
+
+	return rs.Rules, nil
+}
+
+func (r celRule) eval(m manifest) (bool, error) {
+	out, _, err := r.program.Eval(map[string]interface{}{
+		"object": m.obj,
+		"file":   m.file,
+	})
+	if err != nil {
+		return false, fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return false, fmt.Errorf("rule %s must evaluate to a bool, but got %v", r.Name, out.Value())
+	}
+
+	return ok, nil
+}
+
+func (r celRule) message() string {
+	if r.Message != "" {
+		return r.Message
+	}
+
+	return "failed " + r.Expression
+}
@@ -0,0 +1,408 @@
+// Package policy checks the Kubernetes manifests rendered by the provisioners against config.Policy,
+// before they are committed to the gitops repository or applied.
+//
+// Every YAML or JSON document that has apiVersion and kind in the rendered files is checked.
+// Violations are reported with the file and the line of the offending field.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mumoshu/prenv/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Violation is a manifest that does not satisfy a rule.
+type Violation struct {
+	// File is the path to the rendered file that contains the manifest.
+	File string
+	// Line is the line of the offending field in the file.
+	Line int
+	// Object is the kind and the name of the manifest, like Deployment/app.
+	Object string
+	// Rule is the name of the rule, like maxReplicas or the name of the CEL rule.
+	Rule string
+	// Message describes the violation.
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s (%s)", v.File, v.Line, v.Object, v.Message, v.Rule)
+}
+
+// Error is the error returned by Check when there are violations.
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d policy violation(s):", len(e.Violations))
+
+	for _, v := range e.Violations {
+		b.WriteString("\n  ")
+		b.WriteString(v.String())
+	}
+
+	return b.String()
+}
+
+// Checker checks the rendered files against the policy.
+type Checker struct {
+	policy config.Policy
+	cel    []celRule
+	rego   []*regoPolicy
+}
+
+// New returns the Checker for the policy.
+// The policy files in the policy and the extra files are read relative to the current working directory,
+// and compiled once so that the Checker evaluates them against any number of manifests.
+func New(p config.Policy, extraFiles ...string) (*Checker, error) {
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+
+	c := &Checker{policy: p}
+
+	for _, f := range append(append([]string{}, p.Files...), extraFiles...) {
+		if filepath.Ext(f) == ".rego" {
+			r, err := loadRegoPolicy(context.Background(), f)
+			if err != nil {
+				return nil, fmt.Errorf("policy: %w", err)
+			}
+
+			c.rego = append(c.rego, r)
+			continue
+		}
+
+		rules, err := loadCELRules(f)
+		if err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+
+		c.cel = append(c.cel, rules...)
+	}
+
+	return c, nil
+}
+
+// Check checks the manifests in the files, whose paths are relative to dir.
+// It returns *Error when there are violations.
+func (c *Checker) Check(ctx context.Context, dir string, files []string) error {
+	var violations []Violation
+
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+
+	for _, f := range sorted {
+		manifests, err := readManifests(dir, f)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range manifests {
+			vs, err := c.checkManifest(ctx, m)
+			if err != nil {
+				return err
+			}
+
+			violations = append(violations, vs...)
+		}
+	}
+
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+
+	return nil
+}
+
+func (c *Checker) checkManifest(ctx context.Context, m manifest) ([]Violation, error) {
+	var vs []Violation
+
+	violate := func(n *yaml.Node, rule, format string, args ...interface{}) {
+		vs = append(vs, m.violation(n, rule, fmt.Sprintf(format, args...)))
+	}
+
+	p := c.policy
+
+	kind := m.lookup("kind")
+	for _, k := range p.ForbiddenKinds {
+		if kind.Value == k {
+			violate(kind, "forbiddenKinds", "kind %s is forbidden", k)
+		}
+	}
+
+	if len(p.AllowedNamespaces) > 0 {
+		var namespaces []*yaml.Node
+
+		namespaces = append(namespaces, m.lookup("metadata", "namespace"))
+
+		if kind.Value == "Namespace" {
+			namespaces = append(namespaces, m.lookup("metadata", "name"))
+		}
+
+		if strings.HasPrefix(m.lookup("apiVersion").Value, "argoproj.io/") && kind.Value == "Application" {
+			namespaces = append(namespaces, m.lookup("spec", "destination", "namespace"))
+		}
+
+		for _, ns := range namespaces {
+			if ns != nil && ns.Value != "" && !matchAny(p.AllowedNamespaces, ns.Value) {
+				violate(ns, "allowedNamespaces", "namespace %s is not allowed", ns.Value)
+			}
+		}
+	}
+
+	if len(p.RequiredLabels) > 0 {
+		labels := m.lookup("metadata", "labels")
+
+		for _, l := range p.RequiredLabels {
+			k, v, hasValue := strings.Cut(l, "=")
+
+			got := lookup(labels, k)
+
+			switch {
+			case got == nil:
+				violate(labels, "requiredLabels", "label %s is required", k)
+			case hasValue && got.Value != v:
+				violate(got, "requiredLabels", "label %s must be %q, but got %q", k, v, got.Value)
+			}
+		}
+	}
+
+	if len(p.AllowedRegistries) > 0 {
+		for _, image := range findImages(m.node) {
+			if !registryAllowed(p.AllowedRegistries, image.Value) {
+				violate(image, "allowedRegistries", "image %s is not from the allowed registries", image.Value)
+			}
+		}
+	}
+
+	if p.MaxReplicas != nil {
+		replicas := m.lookup("spec", "replicas")
+
+		var n int
+		if replicas != nil && replicas.Decode(&n) == nil && n > *p.MaxReplicas {
+			violate(replicas, "maxReplicas", "replicas %d exceeds %d", n, *p.MaxReplicas)
+		}
+	}
+
+	for _, r := range c.cel {
+		ok, err := r.eval(m)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", m.file, m.node.Line, m.object(), err)
+		}
+
+		if !ok {
+			violate(nil, r.Name, "%s", r.message())
+		}
+	}
+
+	for _, r := range c.rego {
+		msgs, err := r.eval(ctx, m)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", m.file, m.node.Line, m.object(), err)
+		}
+
+		for _, msg := range msgs {
+			violate(nil, r.file, "%s", msg)
+		}
+	}
+
+	return vs, nil
+}
+
+// manifest is a Kubernetes manifest in a rendered file.
+type manifest struct {
+	file string
+	// node is the mapping node of the manifest, which knows the line of each field.
+	node *yaml.Node
+	// obj is the manifest decoded for the CEL and Rego policies.
+	obj map[string]interface{}
+}
+
+func (m manifest) object() string {
+	kind := m.lookup("kind").Value
+
+	if name := m.lookup("metadata", "name"); name != nil {
+		return kind + "/" + name.Value
+	}
+
+	return kind
+}
+
+func (m manifest) lookup(keys ...string) *yaml.Node {
+	return lookup(m.node, keys...)
+}
+
+// violation returns the violation at the line of n, or the line of the manifest if n is nil.
+func (m manifest) violation(n *yaml.Node, rule, msg string) Violation {
+	line := m.node.Line
+	if n != nil {
+		line = n.Line
+	}
+
+	return Violation{
+		File:    m.file,
+		Line:    line,
+		Object:  m.object(),
+		Rule:    rule,
+		Message: msg,
+	}
+}
+
+// lookup returns the value node at the keys in the mapping node, or nil if not found.
+func lookup(n *yaml.Node, keys ...string) *yaml.Node {
+	for _, k := range keys {
+		if n == nil || n.Kind != yaml.MappingNode {
+			return nil
+		}
+
+		var found *yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == k {
+				found = n.Content[i+1]
+				break
+			}
+		}
+
+		n = found
+	}
+
+	return n
+}
+
+// readManifests reads the Kubernetes manifests in the YAML or JSON file.
+// Documents that are not Kubernetes manifests, like Terraform variables, are skipped.
+func readManifests(dir, file string) ([]manifest, error) {
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		// The file can be deleted by a later step in the same render.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var manifests []manifest
+
+	d := yaml.NewDecoder(bytes.NewReader(data))
+
+	for {
+		var doc yaml.Node
+		if err := d.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("unable to parse %s for the policy check: %w", file, err)
+		}
+
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+
+		root := doc.Content[0]
+
+		if lookup(root, "apiVersion") == nil || lookup(root, "kind") == nil {
+			continue
+		}
+
+		var obj map[string]interface{}
+		if err := root.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("unable to parse %s for the policy check: %w", file, err)
+		}
+
+		manifests = append(manifests, manifest{file: file, node: root, obj: obj})
+	}
+
+	return manifests, nil
+}
+
+// findImages returns the image nodes of all the containers in the manifest,
+// including the ones in the pod templates of the workloads.
+func findImages(n *yaml.Node) []*yaml.Node {
+	var images []*yaml.Node
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i].Value, n.Content[i+1]
+
+			if (k == "containers" || k == "initContainers" || k == "ephemeralContainers") && v.Kind == yaml.SequenceNode {
+				for _, c := range v.Content {
+					if image := lookup(c, "image"); image != nil {
+						images = append(images, image)
+					}
+				}
+				continue
+			}
+
+			images = append(images, findImages(v)...)
+		}
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			images = append(images, findImages(c)...)
+		}
+	}
+
+	return images
+}
+
+// imageRepository returns the repository of the image including the registry, like docker.io/library/nginx for nginx:1.25.
+func imageRepository(image string) string {
+	name, _, _ := strings.Cut(image, "@")
+
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	first, _, found := strings.Cut(name, "/")
+
+	switch {
+	case !found:
+		name = "docker.io/library/" + name
+	case !strings.ContainsAny(first, ".:") && first != "localhost":
+		name = "docker.io/" + name
+	}
+
+	return name
+}
+
+func registryAllowed(allowed []string, image string) bool {
+	repo := imageRepository(image)
+
+	for _, a := range allowed {
+		a = strings.TrimSuffix(a, "/")
+		if repo == a || strings.HasPrefix(repo, a+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+
+	return false
+}
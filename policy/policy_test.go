@@ -0,0 +1,172 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/stretchr/testify/require"
+)
+
+const manifests = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: pr-123
+  labels:
+    app: app
+    team: foo
+spec:
+  replicas: 10
+  template:
+    spec:
+      hostNetwork: true
+      initContainers:
+      - name: init
+        image: ghcr.io/myorg/init:v1
+      containers:
+      - name: app
+        image: nginx:1.25
+      - name: sidecar
+        image: ghcr.io/other/sidecar@sha256:abc
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: admin
+  labels:
+    team: platform
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: kube-system
+  labels:
+    team: platform
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: app-123
+  namespace: argocd
+  labels:
+    team: platform
+spec:
+  destination:
+    namespace: pr-123
+`
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	return dir
+}
+
+func TestCheck(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"k8s/app.yaml":         manifests,
+		"terraform/vars.json":  `{"foo": "bar"}`,
+		"README.md":            "not a manifest",
+		"k8s/empty.yaml":       "",
+		"policies/rules.yaml":  "rules:\n- name: no-host-network\n  expression: \"!has(object.spec) || !has(object.spec.template) || !has(object.spec.template.spec.hostNetwork) || !object.spec.template.spec.hostNetwork\"\n  message: hostNetwork is not allowed\n- expression: file.startsWith('k8s/')\n",
+		"policies/broken.yaml": "rules:\n- name: broken\n  expression: \"object.kind ==\"\n",
+	})
+
+	maxReplicas := 3
+
+	c, err := New(config.Policy{
+		AllowedNamespaces: []string{"pr-*", "argocd"},
+		ForbiddenKinds:    []string{"ClusterRoleBinding"},
+		RequiredLabels:    []string{"team", "app"},
+		AllowedRegistries: []string{"ghcr.io/myorg"},
+		MaxReplicas:       &maxReplicas,
+		Files:             []string{filepath.Join(dir, "policies/rules.yaml")},
+	})
+	require.NoError(t, err)
+
+	err = c.Check(context.Background(), dir, []string{"k8s/app.yaml", "terraform/vars.json", "README.md", "k8s/empty.yaml", "k8s/missing.yaml"})
+
+	var perr *Error
+	require.ErrorAs(t, err, &perr)
+
+	var got []string
+	for _, v := range perr.Violations {
+		got = append(got, v.String())
+	}
+
+	require.Equal(t, []string{
+		"k8s/app.yaml:19: Deployment/app: image nginx:1.25 is not from the allowed registries (allowedRegistries)",
+		"k8s/app.yaml:21: Deployment/app: image ghcr.io/other/sidecar@sha256:abc is not from the allowed registries (allowedRegistries)",
+		"k8s/app.yaml:10: Deployment/app: replicas 10 exceeds 3 (maxReplicas)",
+		"k8s/app.yaml:1: Deployment/app: hostNetwork is not allowed (no-host-network)",
+		"k8s/app.yaml:24: ClusterRoleBinding/admin: kind ClusterRoleBinding is forbidden (forbiddenKinds)",
+		"k8s/app.yaml:28: ClusterRoleBinding/admin: label app is required (requiredLabels)",
+		"k8s/app.yaml:33: Namespace/kube-system: namespace kube-system is not allowed (allowedNamespaces)",
+		"k8s/app.yaml:35: Namespace/kube-system: label app is required (requiredLabels)",
+		"k8s/app.yaml:43: Application/app-123: label app is required (requiredLabels)",
+	}, got)
+
+	require.ErrorContains(t, err, "9 policy violation(s):\n  k8s/app.yaml:19: Deployment/app: image nginx:1.25")
+
+	_, err = New(config.Policy{Files: []string{filepath.Join(dir, "policies/broken.yaml")}})
+	require.ErrorContains(t, err, "unable to compile rule broken")
+
+	c, err = New(config.Policy{RequiredLabels: []string{"team=platform"}})
+	require.NoError(t, err)
+
+	err = c.Check(context.Background(), dir, []string{"k8s/app.yaml"})
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, []Violation{
+		{File: "k8s/app.yaml", Line: 8, Object: "Deployment/app", Rule: "requiredLabels", Message: `label team must be "platform", but got "foo"`},
+	}, perr.Violations)
+}
+
+func TestImageRepository(t *testing.T) {
+	for image, want := range map[string]string{
+		"nginx":                        "docker.io/library/nginx",
+		"nginx:1.25":                   "docker.io/library/nginx",
+		"bitnami/redis:7":              "docker.io/bitnami/redis",
+		"ghcr.io/myorg/app:v1":         "ghcr.io/myorg/app",
+		"localhost:5000/app@sha256:ab": "localhost:5000/app",
+		"localhost/app":                "localhost/app",
+	} {
+		require.Equal(t, want, imageRepository(image), image)
+	}
+
+	require.True(t, registryAllowed([]string{"docker.io/library"}, "nginx"))
+	require.False(t, registryAllowed([]string{"ghcr.io/myorg"}, "ghcr.io/myorgevil/app"))
+}
+
+func TestCheckRego(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"k8s/app.yaml": manifests,
+		"policy.rego":  "package prenv\n\ndeny[msg] {\n  input.object.kind == \"ClusterRoleBinding\"\n  msg := sprintf(\"%s is not allowed in %s\", [input.object.kind, input.file])\n}\n",
+	})
+
+	c, err := New(config.Policy{Files: []string{filepath.Join(dir, "policy.rego")}})
+	require.NoError(t, err)
+
+	err = c.Check(context.Background(), dir, []string{"k8s/app.yaml"})
+
+	var perr *Error
+	require.ErrorAs(t, err, &perr)
+	require.Len(t, perr.Violations, 1)
+	require.Equal(t, "ClusterRoleBinding is not allowed in k8s/app.yaml", perr.Violations[0].Message)
+	require.Equal(t, 23, perr.Violations[0].Line)
+
+	// Invalid policies are reported once by New, instead of on every manifest.
+	invalid := writeFiles(t, map[string]string{"policy.rego": "package prenv\n\ndeny[msg] {\n"})
+
+	_, err = New(config.Policy{Files: []string{filepath.Join(invalid, "policy.rego")}})
+	require.ErrorContains(t, err, "unable to compile Rego policy")
+}
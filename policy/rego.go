@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// regoQuery is the query evaluated against every manifest.
+// The Rego policies define the set of the violation messages in the prenv package, like:
+//
+//	package prenv
+//
+//	import future.keywords
+//
+//	deny contains msg if {
+//	  input.object.kind == "Deployment"
+//	  not input.object.spec.template.spec.securityContext.runAsNonRoot
+//	  msg := "containers must not run as root"
+//	}
+const regoQuery = "data.prenv.deny"
+
+// regoPolicy is the Rego policy in a policy file, prepared for the evaluation against the manifests.
+type regoPolicy struct {
+	file  string
+	query rego.PreparedEvalQuery
+}
+
+func loadRegoPolicy(ctx context.Context, file string) (*regoPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := rego.New(
+		rego.Query(regoQuery),
+		rego.Module(file, string(data)),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile Rego policy in %s: %w", file, err)
+	}
+
+	return &regoPolicy{file: file, query: q}, nil
+}
+
+// eval evaluates the Rego policy against the manifest, and returns the violation messages.
+// The manifest is available as `input.object`, and the path to the rendered file as `input.file`.
+func (p *regoPolicy) eval(ctx context.Context, m manifest) ([]string, error) {
+	rs, err := p.query.Eval(ctx, rego.EvalInput(map[string]interface{}{
+		"object": m.obj,
+		"file":   m.file,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to evaluate Rego policy in %s: %w", p.file, err)
+	}
+
+	var msgs []string
+
+	for _, r := range rs {
+		for _, e := range r.Expressions {
+			vs, ok := e.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s in %s must be a set of messages, but got %v", regoQuery, p.file, e.Value)
+			}
+
+			for _, v := range vs {
+				msgs = append(msgs, fmt.Sprintf("%v", v))
+			}
+		}
+	}
+
+	return msgs, nil
+}
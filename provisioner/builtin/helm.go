@@ -0,0 +1,456 @@
+package builtin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/provisioner/builtin/k8sdeploy"
+	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/mumoshu/prenv/render"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// BuiltinHelmProvisioner deploys a Helm chart for the environment,
+// either by running helm directly or by rendering a Flux HelmRelease or an ArgoCD Application.
+type BuiltinHelmProvisioner struct {
+	Config    config.Helm
+	EnvParams config.EnvArgs
+}
+
+// helmRelease is the Helm release generated for the environment.
+type helmRelease struct {
+	Name      string
+	Namespace string
+	// Values is the values of the release, keeping the order of the keys in the values template.
+	Values yaml.MapSlice
+	// Dir is the directory the files are rendered to.
+	Dir string
+}
+
+// helmReleaseNameData is the template data for the appNameTemplate of the environment.
+type helmReleaseNameData struct {
+	ShortName   string
+	Environment helmReleaseNameEnvironment
+}
+
+type helmReleaseNameEnvironment struct {
+	config.EnvArgs
+
+	// PullRequestNumber is for the default appNameTemplate.
+	PullRequestNumber int
+}
+
+func (p *BuiltinHelmProvisioner) release() (*helmRelease, error) {
+	cfg := p.Config
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	shortName := cfg.ShortName
+	if shortName == "" {
+		shortName = path.Base(cfg.Chart + cfg.Path)
+	}
+
+	data := helmReleaseNameData{
+		ShortName: shortName,
+		Environment: helmReleaseNameEnvironment{
+			EnvArgs: p.EnvParams,
+		},
+	}
+
+	if p.EnvParams.PullRequest != nil {
+		data.Environment.PullRequestNumber = p.EnvParams.PullRequest.Number
+	}
+
+	nameTemplate := p.EnvParams.AppNameTemplate
+	if nameTemplate == "" {
+		return nil, fmt.Errorf("assertion error: environment.appNameTemplate is required")
+	}
+
+	name, err := render.ExecuteString(render.EngineText, "appName", nameTemplate, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render the release name: %w", err)
+	}
+
+	r := &helmRelease{
+		Name:      name,
+		Namespace: name,
+	}
+
+	if cfg.Namespace != "" {
+		r.Namespace, err = render.ExecuteString(render.EngineText, "namespace", cfg.Namespace, p.EnvParams)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render helm.namespace: %w", err)
+		}
+	}
+
+	if cfg.Dir != "" {
+		r.Dir, err = render.ExecuteString(render.EngineText, "dir", cfg.Dir, p.EnvParams)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render helm.dir: %w", err)
+		}
+	}
+
+	if cfg.ValuesTemplate != "" {
+		values, err := render.ExecuteString(render.EngineText, "values", cfg.ValuesTemplate, p.EnvParams)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render helm.valuesTemplate: %w", err)
+		}
+
+		if err := yaml.Unmarshal([]byte(values), &r.Values); err != nil {
+			return nil, fmt.Errorf("helm.valuesTemplate must render a YAML mapping: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+func (p *BuiltinHelmProvisioner) Render(ctx context.Context, dir string) (*plugin.RenderResult, error) {
+	r, err := p.release()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := p.files(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.Path)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(path, []byte(f.Content), 0644); err != nil {
+			return nil, fmt.Errorf("unable to write %s: %w", f.Path, err)
+		}
+
+		names = append(names, f.Path)
+	}
+
+	return &plugin.RenderResult{
+		AddedOrModifiedFiles: names,
+	}, nil
+}
+
+// files returns the values file and the manifest for the release.
+func (p *BuiltinHelmProvisioner) files(r *helmRelease) ([]render.File, error) {
+	values, err := marshalValues(r.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []render.File{
+		{Path: filepath.Join(r.Dir, r.Name+".values.yaml"), Content: values},
+	}
+
+	manifest, err := p.manifest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest != nil {
+		files = append(files, *manifest)
+	}
+
+	return files, nil
+}
+
+// manifest returns the Flux HelmRelease or the ArgoCD Application for the release,
+// or nil when helm is run directly.
+func (p *BuiltinHelmProvisioner) manifest(r *helmRelease) (*render.File, error) {
+	cfg := p.Config
+
+	var (
+		obj  yaml.MapSlice
+		name string
+	)
+
+	switch cfg.Output {
+	case config.HelmOutputFluxHelmRelease:
+		obj = p.fluxHelmRelease(r)
+		name = r.Name + ".helmrelease.yaml"
+	case config.HelmOutputArgoCDApp:
+		values, err := marshalValues(r.Values)
+		if err != nil {
+			return nil, err
+		}
+
+		obj = p.argoCDApp(r, values)
+		name = r.Name + ".application.yaml"
+	default:
+		return nil, nil
+	}
+
+	b, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal %s: %w", name, err)
+	}
+
+	return &render.File{Path: filepath.Join(r.Dir, name), Content: string(b)}, nil
+}
+
+func (p *BuiltinHelmProvisioner) fluxHelmRelease(r *helmRelease) yaml.MapSlice {
+	cfg := p.Config
+	flux := cfg.Flux
+
+	namespace := flux.Namespace
+	if namespace == "" {
+		namespace = "flux-system"
+	}
+
+	interval := flux.Interval
+	if interval == "" {
+		interval = "5m"
+	}
+
+	kind := flux.SourceRef.Kind
+	if kind == "" {
+		kind = "HelmRepository"
+		if cfg.Path != "" {
+			kind = "GitRepository"
+		}
+	}
+
+	sourceRef := yaml.MapSlice{
+		{Key: "kind", Value: kind},
+		{Key: "name", Value: flux.SourceRef.Name},
+	}
+	if flux.SourceRef.Namespace != "" {
+		sourceRef = append(sourceRef, yaml.MapItem{Key: "namespace", Value: flux.SourceRef.Namespace})
+	}
+
+	chart := yaml.MapSlice{
+		{Key: "chart", Value: cfg.Chart + cfg.Path},
+	}
+	if cfg.Version != "" && cfg.Path == "" {
+		chart = append(chart, yaml.MapItem{Key: "version", Value: cfg.Version})
+	}
+	chart = append(chart, yaml.MapItem{Key: "sourceRef", Value: sourceRef})
+
+	spec := yaml.MapSlice{
+		{Key: "interval", Value: interval},
+		{Key: "releaseName", Value: r.Name},
+		{Key: "targetNamespace", Value: r.Namespace},
+		{Key: "install", Value: yaml.MapSlice{{Key: "createNamespace", Value: true}}},
+		{Key: "chart", Value: yaml.MapSlice{{Key: "spec", Value: chart}}},
+	}
+	if len(r.Values) > 0 {
+		spec = append(spec, yaml.MapItem{Key: "values", Value: r.Values})
+	}
+
+	return yaml.MapSlice{
+		{Key: "apiVersion", Value: "helm.toolkit.fluxcd.io/v2beta1"},
+		{Key: "kind", Value: "HelmRelease"},
+		{Key: "metadata", Value: yaml.MapSlice{
+			{Key: "name", Value: r.Name},
+			{Key: "namespace", Value: namespace},
+		}},
+		{Key: "spec", Value: spec},
+	}
+}
+
+func (p *BuiltinHelmProvisioner) argoCDApp(r *helmRelease, values string) yaml.MapSlice {
+	cfg := p.Config
+
+	var argocd config.HelmArgoCD
+	if cfg.ArgoCD != nil {
+		argocd = *cfg.ArgoCD
+	}
+
+	if argocd.Namespace == "" {
+		argocd.Namespace = "argocd"
+	}
+
+	if argocd.DestinationServer == "" {
+		argocd.DestinationServer = "https://kubernetes.default.svc"
+	}
+
+	if argocd.Project == "" {
+		argocd.Project = "default"
+	}
+
+	source := yaml.MapSlice{
+		{Key: "repoURL", Value: cfg.RepoURL},
+	}
+	if cfg.Path != "" {
+		source = append(source, yaml.MapItem{Key: "path", Value: cfg.Path})
+	} else {
+		source = append(source, yaml.MapItem{Key: "chart", Value: cfg.Chart})
+	}
+	if cfg.Version != "" {
+		source = append(source, yaml.MapItem{Key: "targetRevision", Value: cfg.Version})
+	}
+
+	helm := yaml.MapSlice{
+		{Key: "releaseName", Value: r.Name},
+	}
+	if len(r.Values) > 0 {
+		helm = append(helm, yaml.MapItem{Key: "values", Value: values})
+	}
+	source = append(source, yaml.MapItem{Key: "helm", Value: helm})
+
+	return yaml.MapSlice{
+		{Key: "apiVersion", Value: "argoproj.io/v1alpha1"},
+		{Key: "kind", Value: "Application"},
+		{Key: "metadata", Value: yaml.MapSlice{
+			{Key: "name", Value: r.Name},
+			{Key: "namespace", Value: argocd.Namespace},
+		}},
+		{Key: "spec", Value: yaml.MapSlice{
+			{Key: "project", Value: argocd.Project},
+			{Key: "destination", Value: yaml.MapSlice{
+				{Key: "namespace", Value: r.Namespace},
+				{Key: "server", Value: argocd.DestinationServer},
+			}},
+			{Key: "source", Value: source},
+			{Key: "syncPolicy", Value: yaml.MapSlice{
+				{Key: "automated", Value: yaml.MapSlice{}},
+				{Key: "syncOptions", Value: []string{"CreateNamespace=true"}},
+			}},
+		}},
+	}
+}
+
+func marshalValues(values yaml.MapSlice) (string, error) {
+	if len(values) == 0 {
+		return "{}\n", nil
+	}
+
+	b, err := yaml.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal values: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// Apply runs `helm upgrade --install` when helm is run directly,
+// or kubectl-applies the rendered HelmRelease or Application otherwise.
+func (p *BuiltinHelmProvisioner) Apply(ctx context.Context, _ *plugin.RenderResult) (*plugin.Result, error) {
+	r, err := p.release()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Config.Output != "" {
+		return p.kubectl(ctx, r, k8sdeploy.KubectlApply)
+	}
+
+	values, err := marshalValues(r.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp("", "prenv-helm-values-*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create values file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(values); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to write values file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write values file: %w", err)
+	}
+
+	if err := runHelm(ctx, p.upgradeArgs(r, f.Name())...); err != nil {
+		return nil, err
+	}
+
+	return &plugin.Result{}, nil
+}
+
+// Destroy runs `helm uninstall` when helm is run directly,
+// or kubectl-deletes the rendered HelmRelease or Application otherwise.
+func (p *BuiltinHelmProvisioner) Destroy(ctx context.Context) (*plugin.Result, error) {
+	r, err := p.release()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Config.Output != "" {
+		return p.kubectl(ctx, r, k8sdeploy.KubectlDelete)
+	}
+
+	if err := runHelm(ctx, "uninstall", r.Name, "--namespace", r.Namespace); err != nil {
+		return nil, err
+	}
+
+	return &plugin.Result{}, nil
+}
+
+func (p *BuiltinHelmProvisioner) kubectl(ctx context.Context, r *helmRelease, fn func(context.Context, string) error) (*plugin.Result, error) {
+	manifest, err := p.manifest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "prenv-helm")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, filepath.Base(manifest.Path))
+
+	if err := os.WriteFile(path, []byte(manifest.Content), 0644); err != nil {
+		return nil, fmt.Errorf("unable to write %s: %w", manifest.Path, err)
+	}
+
+	if err := fn(ctx, path); err != nil {
+		return nil, err
+	}
+
+	return &plugin.Result{}, nil
+}
+
+// upgradeArgs returns the arguments to `helm upgrade --install` for the release.
+func (p *BuiltinHelmProvisioner) upgradeArgs(r *helmRelease, valuesFile string) []string {
+	args := []string{"upgrade", "--install", r.Name, p.Config.Chart}
+
+	if p.Config.RepoURL != "" {
+		args = append(args, "--repo", p.Config.RepoURL)
+	}
+
+	if p.Config.Version != "" {
+		args = append(args, "--version", p.Config.Version)
+	}
+
+	return append(args, "--namespace", r.Namespace, "--create-namespace", "--values", valuesFile, "--wait")
+}
+
+func runHelm(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "helm", args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logrus.Debugf("running %s", strings.Join(cmd.Args, " "))
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "helm %s failed: %s", args[0], stderr.String())
+	}
+
+	logrus.Debugf("helm %s succeeded: %s", args[0], stdout.String())
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package builtin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHelmRender(t *testing.T) {
+	env := config.EnvArgs{
+		Name:            "prenv-123",
+		AppNameTemplate: "{{ .Environment.Name }}-{{ .ShortName }}",
+		PullRequest: &config.PullRequestEnvArgs{
+			Number:  123,
+			HeadSHA: "0123abc",
+		},
+	}
+
+	helm := config.Helm{
+		RepoURL:        "https://charts.example.com",
+		Chart:          "myapp",
+		Version:        "1.2.3",
+		ValuesTemplate: "image:\n  tag: {{ .PullRequest.HeadSHA }}\nreplicas: 1\n",
+		Dir:            "releases",
+	}
+
+	testcases := []struct {
+		name  string
+		tweak func(*config.Helm)
+		files map[string]string
+	}{
+		{
+			name: "helm",
+			files: map[string]string{
+				"releases/prenv-123-myapp.values.yaml": "image:\n  tag: 0123abc\nreplicas: 1\n",
+			},
+		},
+		{
+			name: "flux",
+			tweak: func(h *config.Helm) {
+				h.Output = config.HelmOutputFluxHelmRelease
+				h.Flux = &config.HelmFlux{SourceRef: config.HelmFluxSourceRef{Name: "example"}}
+				h.Namespace = "myapp-{{ .PullRequest.Number }}"
+			},
+			files: map[string]string{
+				"releases/prenv-123-myapp.values.yaml": "image:\n  tag: 0123abc\nreplicas: 1\n",
+				"releases/prenv-123-myapp.helmrelease.yaml": `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: prenv-123-myapp
+  namespace: flux-system
+spec:
+  interval: 5m
+  releaseName: prenv-123-myapp
+  targetNamespace: myapp-123
+  install:
+    createNamespace: true
+  chart:
+    spec:
+      chart: myapp
+      version: 1.2.3
+      sourceRef:
+        kind: HelmRepository
+        name: example
+  values:
+    image:
+      tag: 0123abc
+    replicas: 1
+`,
+			},
+		},
+		{
+			name: "argocd",
+			tweak: func(h *config.Helm) {
+				h.Output = config.HelmOutputArgoCDApp
+			},
+			files: map[string]string{
+				"releases/prenv-123-myapp.values.yaml": "image:\n  tag: 0123abc\nreplicas: 1\n",
+				"releases/prenv-123-myapp.application.yaml": `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: prenv-123-myapp
+  namespace: argocd
+spec:
+  project: default
+  destination:
+    namespace: prenv-123-myapp
+    server: https://kubernetes.default.svc
+  source:
+    repoURL: https://charts.example.com
+    chart: myapp
+    targetRevision: 1.2.3
+    helm:
+      releaseName: prenv-123-myapp
+      values: |
+        image:
+          tag: 0123abc
+        replicas: 1
+  syncPolicy:
+    automated: {}
+    syncOptions:
+    - CreateNamespace=true
+`,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			h := helm
+			if tc.tweak != nil {
+				tc.tweak(&h)
+			}
+
+			p := &BuiltinHelmProvisioner{Config: h, EnvParams: env}
+
+			dir := t.TempDir()
+
+			r, err := p.Render(context.Background(), dir)
+			require.NoError(t, err)
+			require.Len(t, r.AddedOrModifiedFiles, len(tc.files))
+
+			for name, want := range tc.files {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				require.NoError(t, err)
+				require.Equal(t, want, string(got), name)
+			}
+		})
+	}
+
+	t.Run("upgrade args", func(t *testing.T) {
+		p := &BuiltinHelmProvisioner{Config: helm, EnvParams: env}
+
+		r, err := p.release()
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"upgrade", "--install", "prenv-123-myapp", "myapp",
+			"--repo", "https://charts.example.com",
+			"--version", "1.2.3",
+			"--namespace", "prenv-123-myapp", "--create-namespace",
+			"--values", "values.yaml", "--wait",
+		}, p.upgradeArgs(r, "values.yaml"))
+	})
+
+	t.Run("path requires output", func(t *testing.T) {
+		h := helm
+		h.Chart = ""
+		h.Path = "charts/myapp"
+
+		p := &BuiltinHelmProvisioner{Config: h, EnvParams: env}
+
+		_, err := p.Render(context.Background(), t.TempDir())
+		require.ErrorContains(t, err, "helm: path requires output")
+	})
+}
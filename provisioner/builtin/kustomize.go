@@ -0,0 +1,174 @@
+package builtin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/mumoshu/prenv/render"
+	"gopkg.in/yaml.v2"
+)
+
+// BuiltinKustomizeProvisioner renders a kustomize overlay for the environment.
+//
+// It only renders files, so that it works offline.
+// The overlay is deployed by whatever watches the gitops repository, like ArgoCD or Flux,
+// and removed from the gitops repository on destroy.
+type BuiltinKustomizeProvisioner struct {
+	Config    config.Kustomize
+	EnvParams config.EnvArgs
+}
+
+// kustomization is the kustomization.yaml of the overlay.
+type kustomization struct {
+	APIVersion         string                         `yaml:"apiVersion"`
+	Kind               string                         `yaml:"kind"`
+	Namespace          string                         `yaml:"namespace,omitempty"`
+	NamePrefix         string                         `yaml:"namePrefix,omitempty"`
+	NameSuffix         string                         `yaml:"nameSuffix,omitempty"`
+	CommonLabels       map[string]string              `yaml:"commonLabels,omitempty"`
+	Resources          []string                       `yaml:"resources"`
+	Images             []config.KustomizeImage        `yaml:"images,omitempty"`
+	ConfigMapGenerator []configMapGenerator           `yaml:"configMapGenerator,omitempty"`
+	Patches            []config.KustomizeOverlayPatch `yaml:"patches,omitempty"`
+}
+
+type configMapGenerator struct {
+	Name     string   `yaml:"name"`
+	Literals []string `yaml:"literals,omitempty"`
+}
+
+func (p *BuiltinKustomizeProvisioner) Render(ctx context.Context, dir string) (*plugin.RenderResult, error) {
+	cfg := p.Config
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var err error
+
+	exec := func(name, text string) string {
+		if err != nil || text == "" {
+			return ""
+		}
+
+		var s string
+		s, err = render.ExecuteString(render.EngineText, name, text, p.EnvParams)
+		if err != nil {
+			err = fmt.Errorf("unable to render kustomize.%s: %w", name, err)
+		}
+		return s
+	}
+
+	overlayDirTemplate := cfg.OverlayDirTemplate
+	if overlayDirTemplate == "" {
+		overlayDirTemplate = config.DefaultKustomizeOverlayDirTemplate
+	}
+
+	overlayDir := filepath.Clean(exec("overlayDirTemplate", overlayDirTemplate))
+
+	base, relErr := filepath.Rel(overlayDir, filepath.Clean(cfg.Base))
+	if relErr != nil {
+		return nil, fmt.Errorf("unable to compute the path from the overlay %s to the base %s: %w", overlayDir, cfg.Base, relErr)
+	}
+
+	k := kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Namespace:  exec("namespace", cfg.Namespace),
+		NamePrefix: exec("namePrefix", cfg.NamePrefix),
+		NameSuffix: exec("nameSuffix", cfg.NameSuffix),
+		Resources:  []string{filepath.ToSlash(base)},
+	}
+
+	for key, value := range cfg.CommonLabels {
+		if k.CommonLabels == nil {
+			k.CommonLabels = map[string]string{}
+		}
+		k.CommonLabels[key] = exec("commonLabels", value)
+	}
+
+	for _, img := range cfg.Images {
+		i := config.KustomizeImage{
+			Name:    exec("images.name", img.Name),
+			NewName: exec("images.newName", img.NewName),
+			NewTag:  exec("images.newTag", img.NewTag),
+			Digest:  exec("images.digest", img.Digest),
+		}
+
+		if i.NewTag == "" && i.Digest == "" && p.EnvParams.PullRequest != nil {
+			i.NewTag = p.EnvParams.PullRequest.HeadSHA
+		}
+
+		k.Images = append(k.Images, i)
+	}
+
+	for _, cm := range cfg.ConfigMapGenerator {
+		g := configMapGenerator{
+			Name: exec("configMapGenerator.name", cm.Name),
+		}
+
+		for key, value := range cm.Literals {
+			g.Literals = append(g.Literals, key+"="+exec("configMapGenerator.literals", value))
+		}
+
+		sort.Strings(g.Literals)
+
+		k.ConfigMapGenerator = append(k.ConfigMapGenerator, g)
+	}
+
+	for _, patch := range cfg.Patches {
+		pt := config.KustomizeOverlayPatch{
+			Patch: exec("patches.patch", patch.Patch),
+		}
+
+		if t := patch.Target; t != nil {
+			pt.Target = &config.KustomizePatchTarget{
+				Group:         exec("patches.target.group", t.Group),
+				Version:       exec("patches.target.version", t.Version),
+				Kind:          exec("patches.target.kind", t.Kind),
+				Name:          exec("patches.target.name", t.Name),
+				Namespace:     exec("patches.target.namespace", t.Namespace),
+				LabelSelector: exec("patches.target.labelSelector", t.LabelSelector),
+			}
+		}
+
+		k.Patches = append(k.Patches, pt)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := yaml.Marshal(k)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal kustomization.yaml: %w", err)
+	}
+
+	name := filepath.Join(overlayDir, "kustomization.yaml")
+	path := filepath.Join(dir, name)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return nil, fmt.Errorf("unable to write %s: %w", name, err)
+	}
+
+	return &plugin.RenderResult{
+		AddedOrModifiedFiles: []string{name},
+	}, nil
+}
+
+func (p *BuiltinKustomizeProvisioner) Apply(ctx context.Context, r *plugin.RenderResult) (*plugin.Result, error) {
+	return &plugin.Result{}, nil
+}
+
+func (p *BuiltinKustomizeProvisioner) Destroy(ctx context.Context) (*plugin.Result, error) {
+	return &plugin.Result{}, nil
+}
@@ -0,0 +1,88 @@
+package builtin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKustomizeRender(t *testing.T) {
+	p := &BuiltinKustomizeProvisioner{
+		Config: config.Kustomize{
+			Base:       "apps/myapp/base",
+			Namespace:  "myapp-{{ .PullRequest.Number }}",
+			NamePrefix: "pr-{{ .PullRequest.Number }}-",
+			Images: []config.KustomizeImage{
+				{Name: "example/myapp"},
+				{Name: "example/worker", NewName: "registry.example.com/worker", NewTag: "v1"},
+			},
+			CommonLabels: map[string]string{
+				"prenv.io/environment": "{{ .Name }}",
+			},
+			ConfigMapGenerator: []config.KustomizeConfigMap{
+				{Name: "myapp-env", Literals: map[string]string{"PR": "{{ .PullRequest.Number }}", "ENV": "preview"}},
+			},
+			Patches: []config.KustomizeOverlayPatch{
+				{
+					Patch:  "- op: replace\n  path: /spec/replicas\n  value: 1\n",
+					Target: &config.KustomizePatchTarget{Kind: "Deployment", Name: "myapp"},
+				},
+			},
+		},
+		EnvParams: config.EnvArgs{
+			Name: "prenv-123",
+			PullRequest: &config.PullRequestEnvArgs{
+				Number:  123,
+				HeadSHA: "0123abc",
+			},
+		},
+	}
+
+	dir := t.TempDir()
+
+	r, err := p.Render(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"overlays/prenv-123/kustomization.yaml"}, r.AddedOrModifiedFiles)
+
+	got, err := os.ReadFile(filepath.Join(dir, "overlays", "prenv-123", "kustomization.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namespace: myapp-123
+namePrefix: pr-123-
+commonLabels:
+  prenv.io/environment: prenv-123
+resources:
+- ../../apps/myapp/base
+images:
+- name: example/myapp
+  newTag: 0123abc
+- name: example/worker
+  newName: registry.example.com/worker
+  newTag: v1
+configMapGenerator:
+- name: myapp-env
+  literals:
+  - ENV=preview
+  - PR=123
+patches:
+- patch: |
+    - op: replace
+      path: /spec/replicas
+      value: 1
+  target:
+    kind: Deployment
+    name: myapp
+`, string(got))
+
+	t.Run("base is required", func(t *testing.T) {
+		p := &BuiltinKustomizeProvisioner{}
+
+		_, err := p.Render(context.Background(), t.TempDir())
+		require.ErrorContains(t, err, "kustomize.base is required")
+	})
+}
@@ -0,0 +1,339 @@
+package builtin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/mumoshu/prenv/render"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// BuiltinTerraformProvisioner runs terraform for the environment in its own Terraform workspace.
+type BuiltinTerraformProvisioner struct {
+	Config    config.Terraform
+	EnvParams config.EnvArgs
+}
+
+// workspace returns the name of the Terraform workspace for the environment.
+func (p *BuiltinTerraformProvisioner) workspace() (string, error) {
+	tmpl := p.Config.WorkspaceTemplate
+	if tmpl == "" {
+		tmpl = config.DefaultTerraformWorkspaceTemplate
+	}
+
+	ws, err := render.ExecuteString(render.EngineText, "workspace", tmpl, p.EnvParams)
+	if err != nil {
+		return "", fmt.Errorf("unable to render terraform.workspaceTemplate: %w", err)
+	}
+
+	if ws == "" {
+		return "", fmt.Errorf("terraform.workspaceTemplate rendered an empty workspace name")
+	}
+
+	return ws, nil
+}
+
+// tfvars returns the Terraform variables for the environment in JSON.
+func (p *BuiltinTerraformProvisioner) tfvars() ([]byte, error) {
+	vars := map[string]interface{}{}
+
+	if p.Config.VarsTemplate != "" {
+		s, err := render.ExecuteString(render.EngineText, "varsTemplate", p.Config.VarsTemplate, p.EnvParams)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render terraform.varsTemplate: %w", err)
+		}
+
+		// yaml.v3 decodes mappings into map[string]interface{}, which can be marshaled to JSON.
+		if err := yaml.Unmarshal([]byte(s), &vars); err != nil {
+			return nil, fmt.Errorf("terraform.varsTemplate must render a YAML or JSON object: %w", err)
+		}
+	}
+
+	for k, v := range p.Config.Vars {
+		s, err := render.ExecuteString(render.EngineText, "vars."+k, v, p.EnvParams)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render terraform.vars.%s: %w", k, err)
+		}
+
+		vars[k] = s
+	}
+
+	b, err := json.MarshalIndent(vars, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal tfvars: %w", err)
+	}
+
+	return append(b, '\n'), nil
+}
+
+// Render renders the Terraform variables to <dir>/<Dir>/<workspace>.tfvars.json.
+func (p *BuiltinTerraformProvisioner) Render(ctx context.Context, dir string) (*plugin.RenderResult, error) {
+	if err := p.Config.Validate(); err != nil {
+		return nil, err
+	}
+
+	ws, err := p.workspace()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := p.tfvars()
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Join(p.Config.Dir, ws+".tfvars.json")
+	path := filepath.Join(dir, name)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return nil, fmt.Errorf("unable to write %s: %w", name, err)
+	}
+
+	return &plugin.RenderResult{
+		AddedOrModifiedFiles: []string{name},
+	}, nil
+}
+
+// Apply runs terraform init, plan, and apply in the workspace for the environment,
+// and returns the Terraform outputs as the outputs of the provisioner.
+func (p *BuiltinTerraformProvisioner) Apply(ctx context.Context, _ *plugin.RenderResult) (*plugin.Result, error) {
+	tf, ws, varFile, cleanup, err := p.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err := tf.selectOrCreateWorkspace(ctx, ws); err != nil {
+		return nil, err
+	}
+
+	planFile := varFile + ".tfplan"
+	defer os.Remove(planFile)
+
+	if _, err := tf.run(ctx, "plan", "-input=false", "-var-file="+varFile, "-out="+planFile); err != nil {
+		return nil, err
+	}
+
+	if _, err := tf.run(ctx, "apply", "-input=false", planFile); err != nil {
+		return nil, err
+	}
+
+	out, err := tf.run(ctx, "output", "-json")
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := parseTerraformOutputs(out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plugin.Result{
+		Outputs: outputs,
+	}, nil
+}
+
+// Destroy runs terraform destroy in the workspace for the environment, and deletes the workspace.
+// It does nothing if the workspace does not exist.
+func (p *BuiltinTerraformProvisioner) Destroy(ctx context.Context) (*plugin.Result, error) {
+	tf, ws, varFile, cleanup, err := p.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	exists, err := tf.workspaceExists(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		logrus.Infof("terraform workspace %s does not exist. Nothing to destroy", ws)
+		return &plugin.Result{}, nil
+	}
+
+	if _, err := tf.run(ctx, "workspace", "select", ws); err != nil {
+		return nil, err
+	}
+
+	if _, err := tf.run(ctx, "destroy", "-input=false", "-auto-approve", "-var-file="+varFile); err != nil {
+		return nil, err
+	}
+
+	if _, err := tf.run(ctx, "workspace", "select", "default"); err != nil {
+		return nil, err
+	}
+
+	if _, err := tf.run(ctx, "workspace", "delete", ws); err != nil {
+		return nil, err
+	}
+
+	return &plugin.Result{}, nil
+}
+
+// prepare runs terraform init, and writes the variables to a temporary var file.
+// The returned cleanup func removes the var file.
+func (p *BuiltinTerraformProvisioner) prepare(ctx context.Context) (*terraform, string, string, func(), error) {
+	if err := p.Config.Validate(); err != nil {
+		return nil, "", "", nil, err
+	}
+
+	ws, err := p.workspace()
+	if err != nil {
+		return nil, "", "", nil, err
+	}
+
+	b, err := p.tfvars()
+	if err != nil {
+		return nil, "", "", nil, err
+	}
+
+	f, err := os.CreateTemp("", "prenv-*.tfvars.json")
+	if err != nil {
+		return nil, "", "", nil, fmt.Errorf("unable to create var file: %w", err)
+	}
+
+	cleanup := func() {
+		os.Remove(f.Name())
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		cleanup()
+		return nil, "", "", nil, fmt.Errorf("unable to write var file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		cleanup()
+		return nil, "", "", nil, fmt.Errorf("unable to write var file: %w", err)
+	}
+
+	tf := &terraform{
+		binary: p.Config.Binary,
+		dir:    p.Config.Dir,
+	}
+
+	if _, err := tf.run(ctx, "init", "-input=false"); err != nil {
+		cleanup()
+		return nil, "", "", nil, err
+	}
+
+	return tf, ws, f.Name(), cleanup, nil
+}
+
+// parseTerraformOutputs converts the result of `terraform output -json` to the outputs of the provisioner.
+// The type of each output is the Terraform type, like "string" or `["list","string"]`.
+// The outputs marked sensitive are left out, because the outputs are stored in plain text in the state store
+// and sent along with the repository dispatches.
+func parseTerraformOutputs(out []byte) (map[string]plugin.Output, error) {
+	var raw map[string]struct {
+		Type      json.RawMessage `json:"type"`
+		Value     interface{}     `json:"value"`
+		Sensitive bool            `json:"sensitive"`
+	}
+
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return nil, fmt.Errorf("unable to parse terraform output: %w", err)
+	}
+
+	outputs := map[string]plugin.Output{}
+
+	for k, o := range raw {
+		if o.Sensitive {
+			logrus.Infof("leaving out the sensitive terraform output %q", k)
+			continue
+		}
+
+		var typ string
+		if err := json.Unmarshal(o.Type, &typ); err != nil {
+			typ = string(o.Type)
+		}
+
+		outputs[k] = plugin.Output{
+			Type:  typ,
+			Value: o.Value,
+		}
+	}
+
+	return outputs, nil
+}
+
+// terraform runs the terraform commands in the directory of the Terraform module.
+type terraform struct {
+	binary string
+	dir    string
+}
+
+func (t *terraform) run(ctx context.Context, args ...string) ([]byte, error) {
+	bin := t.binary
+	if bin == "" {
+		bin = "terraform"
+	}
+
+	cmd := exec.CommandContext(ctx, bin, append([]string{"-chdir=" + t.dir}, args...)...)
+	cmd.Env = append(os.Environ(), "TF_IN_AUTOMATION=1")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logrus.Debugf("running %s", strings.Join(cmd.Args, " "))
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "terraform %s failed: %s", args[0], stderr.String())
+	}
+
+	// The stdout of `terraform output` contains the values of the sensitive outputs.
+	if args[0] == "output" {
+		logrus.Debugf("terraform %s succeeded", args[0])
+	} else {
+		logrus.Debugf("terraform %s succeeded: %s", args[0], stdout.String())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (t *terraform) workspaceExists(ctx context.Context, ws string) (bool, error) {
+	out, err := t.run(ctx, "workspace", "list")
+	if err != nil {
+		return false, err
+	}
+
+	// The current workspace is marked with "*", like "* default".
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*")) == ws {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (t *terraform) selectOrCreateWorkspace(ctx context.Context, ws string) error {
+	exists, err := t.workspaceExists(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		_, err = t.run(ctx, "workspace", "select", ws)
+	} else {
+		_, err = t.run(ctx, "workspace", "new", ws)
+	}
+
+	return err
+}
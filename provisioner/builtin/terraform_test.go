@@ -0,0 +1,164 @@
+package builtin
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTerraform is a fake terraform binary that logs the arguments,
+// lists only the default workspace, and prints fixed outputs including a sensitive one.
+const fakeTerraform = `#!/bin/sh
+echo "$@" >> "$FAKE_TERRAFORM_LOG"
+case "$2 $3" in
+  "workspace list") echo "* default" ;;
+  "output -json") echo '{"url":{"sensitive":false,"type":"string","value":"https://pr-123.example.com"},"ports":{"sensitive":false,"type":["list","number"],"value":[80,443]},"db_password":{"sensitive":true,"type":"string","value":"s3cr3t"}}' ;;
+esac
+`
+
+func TestTerraformApplyAndDestroy(t *testing.T) {
+	dir := t.TempDir()
+
+	bin := filepath.Join(dir, "terraform")
+	require.NoError(t, os.WriteFile(bin, []byte(fakeTerraform), 0755))
+
+	log := filepath.Join(dir, "log")
+	t.Setenv("FAKE_TERRAFORM_LOG", log)
+
+	p := &BuiltinTerraformProvisioner{
+		Config: config.Terraform{
+			Dir:          "infra",
+			Vars:         map[string]string{"pr": "{{ .PullRequest.Number }}"},
+			VarsTemplate: `{"ports": [80, 443]}`,
+			Binary:       bin,
+		},
+		EnvParams: config.EnvArgs{
+			Name:        "prenv-123",
+			PullRequest: &config.PullRequestEnvArgs{Number: 123},
+		},
+	}
+
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	logrus.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetLevel(logrus.InfoLevel)
+	}()
+
+	r, err := p.Apply(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]plugin.Output{
+		"url":   {Type: "string", Value: "https://pr-123.example.com"},
+		"ports": {Type: `["list","number"]`, Value: []interface{}{float64(80), float64(443)}},
+	}, r.Outputs, "the sensitive output must be left out")
+	require.NotContains(t, logs.String(), "s3cr3t")
+
+	_, err = p.Destroy(context.Background())
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(log)
+	require.NoError(t, err)
+
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(string(got)), "\n") {
+		fields := strings.Fields(line)
+		// Omit the paths to the temporary var and plan files.
+		commands = append(commands, strings.Join(fields[:3], " "))
+	}
+
+	require.Equal(t, []string{
+		"-chdir=infra init -input=false",
+		"-chdir=infra workspace list",
+		"-chdir=infra workspace new",
+		"-chdir=infra plan -input=false",
+		"-chdir=infra apply -input=false",
+		"-chdir=infra output -json",
+		"-chdir=infra init -input=false",
+		"-chdir=infra workspace list",
+	}, commands, "destroy must be skipped because the fake terraform never creates the workspace")
+}
+
+func TestTerraformRender(t *testing.T) {
+	p := &BuiltinTerraformProvisioner{
+		Config: config.Terraform{
+			Dir:          "infra",
+			Vars:         map[string]string{"pr": "{{ .PullRequest.Number }}"},
+			VarsTemplate: "tags:\n  env: {{ .Name }}\n",
+		},
+		EnvParams: config.EnvArgs{
+			Name:        "prenv-123",
+			PullRequest: &config.PullRequestEnvArgs{Number: 123},
+		},
+	}
+
+	dir := t.TempDir()
+
+	r, err := p.Render(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"infra/prenv-123.tfvars.json"}, r.AddedOrModifiedFiles)
+
+	got, err := os.ReadFile(filepath.Join(dir, "infra", "prenv-123.tfvars.json"))
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "pr": "123",
+  "tags": {
+    "env": "prenv-123"
+  }
+}
+`, string(got))
+}
+
+// TestTerraformWithRealBinary runs the real terraform with the built-in terraform_data resource,
+// which requires no provider to be downloaded.
+func TestTerraformWithRealBinary(t *testing.T) {
+	if _, err := exec.LookPath("terraform"); err != nil {
+		t.Skip("terraform is not installed")
+	}
+
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.tf"), []byte(`
+variable "pr" {
+  type = string
+}
+
+resource "terraform_data" "env" {
+  input = "pr-${var.pr}"
+}
+
+output "name" {
+  value = terraform_data.env.output
+}
+`), 0644))
+
+	p := &BuiltinTerraformProvisioner{
+		Config: config.Terraform{
+			Dir:  dir,
+			Vars: map[string]string{"pr": "{{ .PullRequest.Number }}"},
+		},
+		EnvParams: config.EnvArgs{
+			Name:        "prenv-123",
+			PullRequest: &config.PullRequestEnvArgs{Number: 123},
+		},
+	}
+
+	r, err := p.Apply(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, plugin.Output{Type: "string", Value: "pr-123"}, r.Outputs["name"])
+
+	_, err = p.Destroy(context.Background())
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "terraform.tfstate.d", "prenv-123"))
+	require.True(t, os.IsNotExist(err), "the workspace must be deleted")
+}
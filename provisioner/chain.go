@@ -3,11 +3,13 @@ package provisioner
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/mumoshu/prenv/config"
-	"github.com/mumoshu/prenv/generator"
 	"github.com/mumoshu/prenv/ghactions"
+	"github.com/mumoshu/prenv/provisioner/plugin"
 	"github.com/mumoshu/prenv/state"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 )
@@ -23,11 +25,45 @@ type Chain struct {
 
 	cfg config.Config
 
+	// state is the state store that records the environments and the outputs of the provisioners.
+	state state.Store
+
+	// outputs is the outputs of the provisioners for the environment, shared with the EnvArgs of all the provisioners
+	// so that the outputs of a provisioner are available to the templates of the provisioners that run after it.
+	outputs map[string]map[string]interface{}
+
 	provisioners []delegatableProvisioner
+
+	// unwanted is the provisioners of the components that are not a part of the profile of the environment.
+	// The ones that have been applied, like before the profile is changed, are destroyed on apply.
+	unwanted []delegatableProvisioner
+
+	// delegated is true when the chain is run for the args sent from another prenv run,
+	// which has already skipped the provisioners that the pull request does not affect.
+	delegated bool
+
+	// resume is true when the apply continues the failed one recorded in the journal,
+	// skipping the provisioners that the failed one completed.
+	resume bool
+
+	// journal is the journal of the running apply.
+	// It is nil when the chain is destroying or rolling back, which are not journaled.
+	journal *state.Journal
+
+	// appliedBefore is the provisioners that had been applied to the environment before the running apply.
+	appliedBefore map[string]bool
+
+	// changedFiles is the files changed by the pull request, loaded on the first use.
+	// It is nil when they are not loaded yet or unavailable.
+	changedFiles       []string
+	changedFilesLoaded bool
+
+	// hookReports is the results of the hooks run by the chain, written to the run report.
+	hookReports []hookReport
 }
 
-func ChainFromEnv() (*Chain, error) {
-	cfg, err := GetConfig()
+func ChainFromEnv(opts Options) (*Chain, error) {
+	cfg, err := GetConfig(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -36,8 +72,31 @@ func ChainFromEnv() (*Chain, error) {
 }
 
 func NewChain(cfg *Config) (*Chain, error) {
+	if cfg.EnvArgs != nil {
+		return newChain(cfg, cfg.EnvArgs, true)
+	}
+
+	envArgs, err := cfg.generator().Generate(*cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	if envArgs == nil {
+		return nil, fmt.Errorf("no environment is generated for the inputs")
+	}
+
+	return newChain(cfg, envArgs, false)
+}
+
+// newChain returns the chain for the environment of envArgs.
+// delegated is true when envArgs is sent from another prenv run, which has already rendered the vars.
+func newChain(cfg *Config, envArgs *config.EnvArgs, delegated bool) (*Chain, error) {
 	ctx := context.Background()
 
+	if err := cfg.ValidateOnFailure(); err != nil {
+		return nil, err
+	}
+
 	triggeredBy := cfg.TriggeredBy
 
 	var chain Chain
@@ -73,23 +132,44 @@ func NewChain(cfg *Config) (*Chain, error) {
 		}
 	}
 
-	var envArgs *config.EnvArgs
-
-	if cfg.EnvArgs == nil {
-		var err error
-		// TODO we might want to trigger this only when the pull-request generator is enabled
-		envArgs, err = generator.BuildGitHubActionsPullRequestEnvArgs(*cfg.Config)
+	if !delegated {
+		// The vars are rendered only once on the first run, and passed to the delegated runs via the args as is,
+		// so that all the runs see identical vars.
+		envArgs.Vars, err = envArgs.RenderVars(cfg.Vars)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		envArgs = cfg.EnvArgs
 	}
 
+	chain.delegated = delegated
+
 	if err := store.AddEnvironmentName(ctx, envArgs.Name); err != nil {
 		return nil, err
 	}
 
+	outputs, err := store.GetOutputs(ctx, envArgs.Name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get outputs: %w", err)
+	}
+
+	// The outputs passed via the args, like the ones sent from the source repository via repository_dispatch,
+	// are newer than the ones in the state store.
+	if outputs == nil {
+		outputs = map[string]map[string]interface{}{}
+	}
+
+	for name, o := range envArgs.Outputs {
+		outputs[name] = o
+	}
+
+	// This map is shared among all the copies of envArgs given to the provisioners.
+	envArgs.Outputs = outputs
+	chain.outputs = outputs
+	chain.state = store
+
+	// The policy is compiled at most once per run, and shared among all the provisioners.
+	checker := newPolicyChecker(cfg.Policy)
+
 	// TODO: Iterate over pull request(s)?
 
 	{
@@ -97,37 +177,37 @@ func NewChain(cfg *Config) (*Chain, error) {
 			envArgs.AppNameTemplate = "{{ .Environment.Name }}-{{ .Environment.PullRequestNumber }}-{{ .ShortName }}"
 		}
 
-		components := map[string]config.Component{}
+		components, componentVars, namePrefixes := flattenComponents(*cfg.Config)
 
-		if cfg.Shared != nil {
-			components[""] = *cfg.Shared
+		unwanted, err := unwantedNamePrefixes(*cfg.Config, envArgs.Profile)
+		if err != nil {
+			return nil, err
 		}
 
-		if cfg.Dedicated != nil {
-			p1 := cfg.Dedicated.NamePrefix
-			if p1 == "" {
-				p1 = "pr-"
-			}
-			components[p1] = *cfg.Dedicated
+		for _, namePrefix := range namePrefixes {
+			svc := components[namePrefix]
 
-			for name, s := range cfg.Dedicated.Components {
-				p2 := s.NamePrefix
-				if p2 == "" {
-					p2 = name + "-"
+			componentEnvArgs := *envArgs
+			for _, vars := range componentVars[namePrefix] {
+				componentEnvArgs.Vars, err = componentEnvArgs.RenderVars(vars)
+				if err != nil {
+					return nil, fmt.Errorf("component %q: %w", namePrefix, err)
 				}
-				components[p1+p2] = s
 			}
-		}
 
-		for namePrefix, svc := range components {
 			for _, p := range Plugins {
 				provisioners := p(PluginConfig{
 					Service:   svc,
-					EnvParams: *envArgs,
+					EnvParams: componentEnvArgs,
 				})
 
 				for i := range provisioners {
 					provisioners[i].name = namePrefix + provisioners[i].name
+					provisioners[i].envArgs = componentEnvArgs
+					provisioners[i].policy = checker
+					provisioners[i].paths = svc.Paths
+					provisioners[i].component = namePrefix
+					provisioners[i].hooks = svc.Hooks
 				}
 
 				var triggeredProvisioners []delegatableProvisioner
@@ -149,12 +229,21 @@ func NewChain(cfg *Config) (*Chain, error) {
 
 						// This is used to prevent infinite loop of the repository_dispatch events.
 						p.triggeredViaRepositoryDispatch = true
+					} else if cfg.InProcess {
+						// Pretend that the provisioner is triggered via repository_dispatch
+						// so that it runs within this process instead of sending repository_dispatch.
+						p.triggeredViaRepositoryDispatch = true
 					}
 
 					triggeredProvisioners = append(triggeredProvisioners, p)
 				}
 
-				chain.provisioners = append(chain.provisioners, triggeredProvisioners...)
+				// The delegated runs run whatever the source run triggered, including the unwanted ones to be destroyed.
+				if len(triggeredBy) == 0 && unwanted[namePrefix] {
+					chain.unwanted = append(chain.unwanted, triggeredProvisioners...)
+				} else {
+					chain.provisioners = append(chain.provisioners, triggeredProvisioners...)
+				}
 			}
 		}
 	}
@@ -162,10 +251,182 @@ func NewChain(cfg *Config) (*Chain, error) {
 	cfg.EnvArgs = envArgs
 	chain.cfg = *cfg.Config
 	chain.action = cfg.Action
+	chain.resume = cfg.Resume
 
 	return &chain, nil
 }
 
+// flattenComponents returns the shared component, the dedicated component, and the components of the dedicated one,
+// keyed by the name prefix of their provisioners.
+// It also returns the vars of each component and its parents, from the outermost one,
+// and the name prefixes in the order the components are run.
+func flattenComponents(cfg config.Config) (map[string]config.Component, map[string][]map[string]string, []string) {
+	components := map[string]config.Component{}
+
+	componentVars := map[string][]map[string]string{}
+
+	if cfg.Shared != nil {
+		components[""] = *cfg.Shared
+		componentVars[""] = []map[string]string{cfg.Shared.Vars}
+	}
+
+	if cfg.Dedicated != nil {
+		p1 := dedicatedNamePrefix(*cfg.Dedicated)
+		components[p1] = *cfg.Dedicated
+		componentVars[p1] = []map[string]string{cfg.Dedicated.Vars}
+
+		for name, s := range cfg.Dedicated.Components {
+			p2 := componentNamePrefix(*cfg.Dedicated, name)
+			components[p2] = s
+			componentVars[p2] = []map[string]string{cfg.Dedicated.Vars, s.Vars}
+		}
+	}
+
+	// The components are run in a stable order, the shared one first,
+	// so that the outputs of the earlier provisioners are available to the later ones.
+	var namePrefixes []string
+	for namePrefix := range components {
+		namePrefixes = append(namePrefixes, namePrefix)
+	}
+
+	sort.Strings(namePrefixes)
+
+	return components, componentVars, namePrefixes
+}
+
+// dedicatedNamePrefix returns the name prefix of the provisioners of the dedicated component.
+func dedicatedNamePrefix(dedicated config.Component) string {
+	if dedicated.NamePrefix != "" {
+		return dedicated.NamePrefix
+	}
+
+	return "pr-"
+}
+
+// componentNamePrefix returns the name prefix of the provisioners of the component in dedicated.components.
+func componentNamePrefix(dedicated config.Component, name string) string {
+	p := dedicated.Components[name].NamePrefix
+	if p == "" {
+		p = name + "-"
+	}
+
+	return dedicatedNamePrefix(dedicated) + p
+}
+
+// unwantedNamePrefixes returns the name prefixes of the components in dedicated.components that are not a part of the profile.
+// None is unwanted when the environment has no profile.
+func unwantedNamePrefixes(cfg config.Config, profile string) (map[string]bool, error) {
+	unwanted := map[string]bool{}
+
+	if profile == "" || cfg.Dedicated == nil {
+		return unwanted, nil
+	}
+
+	p, ok := cfg.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("profile %q is not defined", profile)
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range p.Components {
+		wanted[name] = true
+	}
+
+	for name := range cfg.Dedicated.Components {
+		if !wanted[name] {
+			unwanted[componentNamePrefix(*cfg.Dedicated, name)] = true
+		}
+	}
+
+	return unwanted, nil
+}
+
+// setOutputs makes the outputs of the provisioner available to the provisioners that run after it,
+// and records them in the state store for the later runs.
+// On destroy, the outputs are deleted from the state store only,
+// so that the provisioners and the hooks destroyed after it can still use them.
+// run deletes them from c.outputs once all the provisioners are destroyed.
+func (c *Chain) setOutputs(ctx context.Context, action string, p delegatableProvisioner, outputs map[string]plugin.Output) error {
+	values := map[string]interface{}{}
+
+	if action != ghactions.EventTypeDestroy {
+		if len(outputs) == 0 {
+			return nil
+		}
+
+		for k, o := range outputs {
+			values[k] = o.Value
+		}
+
+		c.outputs[p.name] = values
+	} else {
+		if _, ok := c.outputs[p.name]; !ok {
+			return nil
+		}
+	}
+
+	if err := c.state.SetOutputs(ctx, p.envArgs.Name, p.name, values); err != nil {
+		return fmt.Errorf("unable to record outputs of %s: %w", p.name, err)
+	}
+
+	return nil
+}
+
+// setApplied records that the provisioner has been applied to the environment, or destroyed.
+func (c *Chain) setApplied(ctx context.Context, action, envName, provisioner string) error {
+	if err := c.state.SetApplied(ctx, envName, provisioner, action != ghactions.EventTypeDestroy); err != nil {
+		return fmt.Errorf("unable to record %s as applied: %w", provisioner, err)
+	}
+
+	return nil
+}
+
+// affected returns false when the provisioner can be skipped because the pull request changes no files matching
+// the paths of its component.
+// A provisioner that has never been applied to the environment is always affected,
+// and so are all the provisioners when the changed files are unavailable.
+func (c *Chain) affected(ctx context.Context, p delegatableProvisioner) (bool, error) {
+	if p.paths == nil || c.delegated || p.envArgs.PullRequest == nil {
+		return true, nil
+	}
+
+	applied, err := c.state.GetApplied(ctx, p.envArgs.Name)
+	if err != nil {
+		return false, fmt.Errorf("unable to get applied provisioners: %w", err)
+	}
+
+	var found bool
+	for _, name := range applied {
+		if name == p.name {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return true, nil
+	}
+
+	if !c.changedFilesLoaded {
+		c.changedFilesLoaded = true
+
+		files, err := p.envArgs.PullRequest.ChangedFiles(ctx)
+		if err != nil {
+			logrus.Warnf("Applying all the components because the changed files of the pull request are unavailable: %v", err)
+		} else if files == nil {
+			files = []string{}
+		}
+
+		c.changedFiles = files
+	}
+
+	if c.changedFiles == nil {
+		return true, nil
+	}
+
+	return p.paths.Match(c.changedFiles)
+}
+
 type triggeredRepositoryDispatch struct {
 	*config.RepositoryDispatch
 
@@ -204,11 +465,38 @@ type mergedRepositoryDispatch struct {
 // If the configuration does not contain gitOps field, it creates the Kubernetes resources and/or AWS resources defined in the configuration
 // using the built-in provisioners.
 func (c *Chain) Apply(ctx context.Context) error {
-	_, err := c.run(ctx, ghactions.EventTypeApply, func(ctx context.Context, p delegatableProvisioner) (*Result, error) {
-		return p.Apply(ctx)
-	})
+	defer c.writeReport(ghactions.EventTypeApply)
+
+	unwanted, err := c.appliedUnwanted(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(unwanted) > 0 {
+		if _, err := c.run(ctx, ghactions.EventTypeDestroy, reversed(unwanted), destroy); err != nil {
+			return err
+		}
+	}
 
-	return err
+	journal, err := c.startJournal(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.journal = journal
+	defer func() {
+		c.journal = nil
+	}()
+
+	if _, err := c.run(ctx, ghactions.EventTypeApply, c.provisioners, apply); err != nil {
+		return c.handleFailure(ctx, err)
+	}
+
+	return c.finishJournal(ctx)
+}
+
+func apply(ctx context.Context, p delegatableProvisioner) (*Result, error) {
+	return p.Apply(ctx)
 }
 
 // Destroy deletes the pull-request environment and reconfigures the infrastructure.
@@ -235,11 +523,52 @@ func (c *Chain) Apply(ctx context.Context) error {
 // If the configuration does not contain gitOps field, it deletes the Kubernetes resources and/or AWS resources defined in the configuration
 // using the built-in provisioners.
 func (c *Chain) Destroy(ctx context.Context) error {
-	_, err := c.run(ctx, ghactions.EventTypeDestroy, func(ctx context.Context, p delegatableProvisioner) (*Result, error) {
-		return p.Destroy(ctx)
-	})
+	defer c.writeReport(ghactions.EventTypeDestroy)
+
+	unwanted, err := c.appliedUnwanted(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The provisioners are destroyed in the reverse order of the apply,
+	// so that what depends on the infrastructure, like the gitops config rendered with its outputs,
+	// is torn down before the infrastructure.
+	ps := append(append([]delegatableProvisioner{}, c.provisioners...), unwanted...)
 
-	return err
+	if _, err := c.run(ctx, ghactions.EventTypeDestroy, reversed(ps), destroy); err != nil {
+		return err
+	}
+
+	return c.clearJournal(ctx)
+}
+
+func destroy(ctx context.Context, p delegatableProvisioner) (*Result, error) {
+	return p.Destroy(ctx)
+}
+
+// appliedUnwanted returns the unwanted provisioners that have been applied to the environment.
+func (c *Chain) appliedUnwanted(ctx context.Context) ([]delegatableProvisioner, error) {
+	if len(c.unwanted) == 0 {
+		return nil, nil
+	}
+
+	applied, err := c.state.GetApplied(ctx, c.unwanted[0].envArgs.Name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get applied provisioners: %w", err)
+	}
+
+	var ps []delegatableProvisioner
+
+	for _, p := range c.unwanted {
+		for _, name := range applied {
+			if name == p.name {
+				ps = append(ps, p)
+				break
+			}
+		}
+	}
+
+	return ps, nil
 }
 
 func (c *Chain) Action(ctx context.Context) error {
@@ -253,24 +582,97 @@ func (c *Chain) Action(ctx context.Context) error {
 	return fmt.Errorf("unknown action: %s", c.action)
 }
 
-func (c *Chain) run(ctx context.Context, action string, fn func(ctx context.Context, p delegatableProvisioner) (*Result, error)) ([]*mergedRepositoryDispatch, error) {
-	var triggeredDispatches []*triggeredRepositoryDispatch
-	for _, p := range c.provisioners {
-		r, err := fn(ctx, p)
-		if err != nil {
-			return nil, err
+func (c *Chain) run(ctx context.Context, action string, provisioners []delegatableProvisioner, fn func(ctx context.Context, p delegatableProvisioner) (*Result, error)) ([]*mergedRepositoryDispatch, error) {
+	var (
+		triggeredDispatches []*triggeredRepositoryDispatch
+		destroyed           []string
+	)
+
+	pre, post := hookPhases(action)
+
+	// The hooks of a component run around its provisioners, only when any of them runs.
+	for _, group := range groupByComponent(provisioners) {
+		var ran bool
+
+		for _, p := range group {
+			if c.journal != nil && c.journal.Completed()[p.name] {
+				logrus.Infof("Skipping %s because the failed apply has already applied it", p.name)
+				continue
+			}
+
+			if action == ghactions.EventTypeApply {
+				affected, err := c.affected(ctx, p)
+				if err != nil {
+					return nil, err
+				}
+
+				if !affected {
+					logrus.Infof("Skipping %s because the pull request changes no files matching its paths", p.name)
+					continue
+				}
+			}
+
+			if !ran {
+				ran = true
+
+				if err := c.runHooks(ctx, pre, group); err != nil {
+					return nil, err
+				}
+			}
+
+			r, err := fn(ctx, p)
+			if err != nil {
+				if jerr := c.record(ctx, p, state.JournalStatusFailed, err); jerr != nil {
+					logrus.Warnf("%v", jerr)
+				}
+
+				return nil, err
+			}
+
+			if len(r.RepositoryDispatches) == 0 {
+				if err := c.setOutputs(ctx, action, p, r.Outputs); err != nil {
+					return nil, err
+				}
+
+				if err := c.setApplied(ctx, action, p.envArgs.Name, p.name); err != nil {
+					return nil, err
+				}
+
+				if action == ghactions.EventTypeDestroy {
+					destroyed = append(destroyed, p.name)
+				}
+			}
+
+			status := state.JournalStatusApplied
+			if len(r.RepositoryDispatches) > 0 {
+				status = state.JournalStatusDispatched
+			}
+
+			if err := c.record(ctx, p, status, nil); err != nil {
+				return nil, err
+			}
+
+			if len(r.RepositoryDispatches) > 0 {
+				for _, d := range r.RepositoryDispatches {
+					triggeredDispatches = append(triggeredDispatches, &triggeredRepositoryDispatch{
+						RepositoryDispatch: d,
+						provisionerName:    p.name,
+					})
+				}
+			}
 		}
 
-		if len(r.RepositoryDispatches) > 0 {
-			for _, d := range r.RepositoryDispatches {
-				triggeredDispatches = append(triggeredDispatches, &triggeredRepositoryDispatch{
-					RepositoryDispatch: d,
-					provisionerName:    p.name,
-				})
+		if ran {
+			if err := c.runHooks(ctx, post, group); err != nil {
+				return nil, err
 			}
 		}
 	}
 
+	for _, name := range destroyed {
+		delete(c.outputs, name)
+	}
+
 	var mergedDispatches []*mergedRepositoryDispatch
 
 	for _, d := range triggeredDispatches {
@@ -325,9 +727,15 @@ func (c *Chain) run(ctx context.Context, action string, fn func(ctx context.Cont
 		inputs.RawConfig = string(rawConfig)
 		inputs.TriggeredBy = d.provisionerNames
 
-		if err := ghactions.SendRepositoryDispatch(ctx, action, *d.RepositoryDispatch, inputs); err != nil {
+		if err := ghactions.SendRepositoryDispatch(ctx, action, *d.RepositoryDispatch, inputs, c.cfg.EnvArgs.SourceRepository()); err != nil {
 			return nil, fmt.Errorf("unable to send repository_dispatch event: %w", err)
 		}
+
+		for _, name := range d.provisionerNames {
+			if err := c.setApplied(ctx, action, c.cfg.EnvArgs.Name, name); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return mergedDispatches, nil
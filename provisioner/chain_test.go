@@ -0,0 +1,691 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/ghactions"
+	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/mumoshu/prenv/provisioner/render"
+	"github.com/mumoshu/prenv/state"
+	"github.com/stretchr/testify/require"
+)
+
+type outputsProvisioner struct {
+	outputs map[string]plugin.Output
+}
+
+func (p *outputsProvisioner) Apply(ctx context.Context, r *plugin.RenderResult) (*plugin.Result, error) {
+	return &plugin.Result{Outputs: p.outputs}, nil
+}
+
+func (p *outputsProvisioner) Destroy(ctx context.Context) (*plugin.Result, error) {
+	return &plugin.Result{}, nil
+}
+
+func (p *outputsProvisioner) Render(ctx context.Context, dir string) (*plugin.RenderResult, error) {
+	return &plugin.RenderResult{}, nil
+}
+
+func TestChainPassesOutputs(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	store := &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")}
+
+	outputs := map[string]map[string]interface{}{}
+
+	env := config.EnvArgs{
+		Name:    "prenv-1",
+		Outputs: outputs,
+	}
+
+	infra := newDelegetableProvisioner("infra", nil, &outputsProvisioner{
+		outputs: map[string]plugin.Output{
+			"queueURL": {Type: "sqsQueue", Value: "https://sqs.example.com/prenv-1"},
+		},
+	})
+	infra.envArgs = env
+
+	app := newDelegetableProvisioner("app", nil, &render.Provisioner{
+		Config: config.Render{
+			Files: []config.RenderedFile{
+				{Name: "app.yaml", ContentTemplate: "queueURL: {{ .Outputs.infra.queueURL }}\n"},
+			},
+		},
+		EnvParams: env,
+	})
+	app.envArgs = env
+
+	c := &Chain{
+		cfg:          config.Config{EnvArgs: &env},
+		state:        store,
+		outputs:      outputs,
+		provisioners: []delegatableProvisioner{infra, app},
+	}
+
+	require.NoError(t, c.Apply(context.Background()))
+
+	got, err := os.ReadFile(filepath.Join(dir, ".prenv", "app", "app.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "queueURL: https://sqs.example.com/prenv-1\n", string(got))
+
+	recorded, err := store.GetOutputs(context.Background(), "prenv-1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[string]interface{}{
+		"infra": {"queueURL": "https://sqs.example.com/prenv-1"},
+	}, recorded)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, ".prenv", "app", "app.yaml")))
+
+	require.NoError(t, c.Destroy(context.Background()))
+
+	// The app is destroyed before the infra it depends on, with the outputs of the infra.
+	got, err = os.ReadFile(filepath.Join(dir, ".prenv", "app", "app.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "queueURL: https://sqs.example.com/prenv-1\n", string(got))
+
+	recorded, err = store.GetOutputs(context.Background(), "prenv-1")
+	require.NoError(t, err)
+	require.Empty(t, recorded)
+	require.Empty(t, c.outputs)
+}
+
+func TestChainResolvesSecretRefs(t *testing.T) {
+	t.Setenv("PRENV_TEST_CHAIN_TOKEN", "s3cr3t")
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	env := config.EnvArgs{
+		Name: "prenv-1",
+		Vars: map[string]string{"token": "ref+env://PRENV_TEST_CHAIN_TOKEN"},
+	}
+
+	cfg := config.Render{
+		Files: []config.RenderedFile{
+			{Name: "app.yaml", ContentTemplate: "token: {{ .Vars.token }}\n"},
+			{Name: "webhook.txt", ContentTemplate: "ref+env://PRENV_TEST_CHAIN_TOKEN"},
+		},
+	}
+
+	app := newDelegetableProvisioner("app", nil, &render.Provisioner{
+		Config:    cfg,
+		EnvParams: env,
+	})
+	app.envArgs = env
+
+	c := &Chain{
+		cfg:          config.Config{EnvArgs: &env},
+		state:        &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")},
+		outputs:      map[string]map[string]interface{}{},
+		provisioners: []delegatableProvisioner{app},
+	}
+
+	require.NoError(t, c.Apply(context.Background()))
+
+	got, err := os.ReadFile(filepath.Join(dir, ".prenv", "app", "app.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "token: s3cr3t\n", string(got))
+
+	got, err = os.ReadFile(filepath.Join(dir, ".prenv", "app", "webhook.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", string(got))
+
+	// The configuration that would be sent over repository_dispatch keeps the references.
+	require.Equal(t, "ref+env://PRENV_TEST_CHAIN_TOKEN", cfg.Files[1].ContentTemplate)
+	require.Equal(t, "ref+env://PRENV_TEST_CHAIN_TOKEN", c.provisioners[0].Provisioner.(*render.Provisioner).Config.Files[1].ContentTemplate)
+	require.Equal(t, "ref+env://PRENV_TEST_CHAIN_TOKEN", c.provisioners[0].Provisioner.(*render.Provisioner).EnvParams.Vars["token"])
+}
+
+func TestChainChecksPolicy(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	env := config.EnvArgs{Name: "prenv-1"}
+
+	app := newDelegetableProvisioner("app", nil, &render.Provisioner{
+		Config: config.Render{
+			Files: []config.RenderedFile{
+				{Name: "app.yaml", ContentTemplate: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: kube-system\n"},
+			},
+		},
+		EnvParams: env,
+	})
+	app.envArgs = env
+	app.policy = newPolicyChecker(&config.Policy{AllowedNamespaces: []string{"pr-*"}})
+
+	c := &Chain{
+		cfg:          config.Config{EnvArgs: &env},
+		state:        &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")},
+		outputs:      map[string]map[string]interface{}{},
+		provisioners: []delegatableProvisioner{app},
+	}
+
+	err = c.Apply(context.Background())
+	require.ErrorContains(t, err, "app: 1 policy violation(s):\n  app.yaml:5: ConfigMap/app: namespace kube-system is not allowed (allowedNamespaces)")
+
+	// Destroying an environment is never blocked by the policy.
+	require.NoError(t, c.Destroy(context.Background()))
+}
+
+func TestChainCompilesPolicyOnce(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	require.NoError(t, os.WriteFile("rules.yaml", []byte("rules:\n- name: configmaps-only\n  expression: object.kind == 'ConfigMap'\n"), 0644))
+
+	manifest := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n"
+
+	cfg := config.Config{
+		Shared: &config.Component{
+			Render: &config.Render{Files: []config.RenderedFile{{Name: "shared.yaml", ContentTemplate: manifest}}},
+		},
+		Dedicated: &config.Component{
+			Render: &config.Render{Files: []config.RenderedFile{{Name: "app.yaml", ContentTemplate: manifest}}},
+		},
+		Policy: &config.Policy{Files: []string{"rules.yaml"}},
+	}
+
+	c, err := newChain(&Config{Config: &cfg, Action: ghactions.EventTypeApply}, &config.EnvArgs{Name: "prenv-1"}, true)
+	require.NoError(t, err)
+	require.Len(t, c.provisioners, 2)
+	require.Same(t, c.provisioners[0].policy, c.provisioners[1].policy)
+
+	require.NoError(t, c.Apply(context.Background()))
+
+	// The compiled policy is reused instead of reading the file again.
+	require.NoError(t, os.Remove("rules.yaml"))
+	require.NoError(t, c.Apply(context.Background()))
+}
+
+type countingProvisioner struct {
+	outputsProvisioner
+
+	// applied is a pointer as the chain applies a copy of the provisioner with the secret references resolved.
+	applied *int
+}
+
+func (p *countingProvisioner) Apply(ctx context.Context, r *plugin.RenderResult) (*plugin.Result, error) {
+	*p.applied++
+	return p.outputsProvisioner.Apply(ctx, r)
+}
+
+func TestChainSkipsUnaffectedComponents(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	store := &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")}
+
+	env := config.EnvArgs{
+		Name:        "prenv-1",
+		PullRequest: &config.PullRequestEnvArgs{Number: 1},
+	}
+
+	var apiApplied, webApplied int
+
+	api := &countingProvisioner{
+		outputsProvisioner: outputsProvisioner{
+			outputs: map[string]plugin.Output{"url": {Value: "https://api.example.com"}},
+		},
+		applied: &apiApplied,
+	}
+	web := &countingProvisioner{applied: &webApplied}
+
+	newChain := func(changedFiles ...string) *Chain {
+		a := newDelegetableProvisioner("api", nil, api)
+		a.envArgs = env
+		a.paths = &config.Paths{Include: []string{"services/api/**"}, Exclude: []string{"**/*.md"}}
+
+		w := newDelegetableProvisioner("web", nil, web)
+		w.envArgs = env
+		w.paths = &config.Paths{Include: []string{"services/web/**"}}
+
+		return &Chain{
+			cfg:                config.Config{EnvArgs: &env},
+			state:              store,
+			outputs:            map[string]map[string]interface{}{},
+			provisioners:       []delegatableProvisioner{a, w},
+			changedFiles:       changedFiles,
+			changedFilesLoaded: true,
+		}
+	}
+
+	// The first apply deploys everything regardless of the changed files.
+	require.NoError(t, newChain("services/web/index.html").Apply(context.Background()))
+	require.Equal(t, 1, apiApplied)
+	require.Equal(t, 1, webApplied)
+
+	require.NoError(t, newChain("services/web/index.html", "services/api/README.md").Apply(context.Background()))
+	require.Equal(t, 1, apiApplied)
+	require.Equal(t, 2, webApplied)
+
+	// The skipped component keeps its outputs.
+	recorded, err := store.GetOutputs(context.Background(), "prenv-1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[string]interface{}{
+		"api": {"url": "https://api.example.com"},
+	}, recorded)
+
+	require.NoError(t, newChain("services/api/main.go").Apply(context.Background()))
+	require.Equal(t, 2, apiApplied)
+	require.Equal(t, 2, webApplied)
+
+	// Everything is deployed when the changed files are unavailable.
+	require.NoError(t, newChain().Apply(context.Background()))
+	require.Equal(t, 3, apiApplied)
+	require.Equal(t, 3, webApplied)
+
+	require.NoError(t, newChain().Destroy(context.Background()))
+
+	applied, err := store.GetApplied(context.Background(), "prenv-1")
+	require.NoError(t, err)
+	require.Empty(t, applied)
+}
+
+type destroyCountingProvisioner struct {
+	outputsProvisioner
+
+	// destroyed is a pointer as the chain destroys a copy of the provisioner with the secret references resolved.
+	destroyed *int
+}
+
+func (p *destroyCountingProvisioner) Destroy(ctx context.Context) (*plugin.Result, error) {
+	*p.destroyed++
+	return p.outputsProvisioner.Destroy(ctx)
+}
+
+func TestChainDestroysUnwantedComponents(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	store := &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")}
+
+	env := config.EnvArgs{
+		Name:    "prenv-1-minimal",
+		Profile: "minimal",
+	}
+
+	// The api component was deployed before it was removed from the profile.
+	require.NoError(t, store.SetApplied(context.Background(), env.Name, "pr-api-k8s", true))
+
+	var apiDestroyed int
+
+	web := newDelegetableProvisioner("pr-web-k8s", nil, &outputsProvisioner{})
+	web.envArgs = env
+
+	api := newDelegetableProvisioner("pr-api-k8s", nil, &destroyCountingProvisioner{destroyed: &apiDestroyed})
+	api.envArgs = env
+
+	c := &Chain{
+		cfg:          config.Config{EnvArgs: &env},
+		state:        store,
+		outputs:      map[string]map[string]interface{}{},
+		provisioners: []delegatableProvisioner{web},
+		unwanted:     []delegatableProvisioner{api},
+	}
+
+	require.NoError(t, c.Apply(context.Background()))
+	require.Equal(t, 1, apiDestroyed)
+
+	applied, err := store.GetApplied(context.Background(), env.Name)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pr-web-k8s"}, applied)
+
+	// The unwanted component is destroyed only once.
+	require.NoError(t, c.Apply(context.Background()))
+	require.Equal(t, 1, apiDestroyed)
+}
+
+type recordingProvisioner struct {
+	outputsProvisioner
+
+	name string
+
+	// log and fail are pointers as the chain runs a copy of the provisioner with the secret references resolved.
+	log  *[]string
+	fail *bool
+}
+
+func (p *recordingProvisioner) Apply(ctx context.Context, r *plugin.RenderResult) (*plugin.Result, error) {
+	if *p.fail {
+		*p.log = append(*p.log, "fail "+p.name)
+		return nil, fmt.Errorf("%s failed", p.name)
+	}
+
+	*p.log = append(*p.log, "apply "+p.name)
+
+	return p.outputsProvisioner.Apply(ctx, r)
+}
+
+func (p *recordingProvisioner) Destroy(ctx context.Context) (*plugin.Result, error) {
+	*p.log = append(*p.log, "destroy "+p.name)
+
+	return p.outputsProvisioner.Destroy(ctx)
+}
+
+func TestChainOnFailure(t *testing.T) {
+	recordingChain := func(t *testing.T, onFailure string, log *[]string, fail map[string]*bool) *Chain {
+		t.Helper()
+
+		dir := t.TempDir()
+
+		env := config.EnvArgs{Name: "prenv-1"}
+
+		var ps []delegatableProvisioner
+
+		for _, name := range []string{"a", "b", "c"} {
+			if fail[name] == nil {
+				fail[name] = new(bool)
+			}
+
+			p := newDelegetableProvisioner(name, nil, &recordingProvisioner{name: name, log: log, fail: fail[name]})
+			p.envArgs = env
+			ps = append(ps, p)
+		}
+
+		return &Chain{
+			cfg:          config.Config{OnFailure: onFailure, EnvArgs: &env},
+			state:        &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")},
+			outputs:      map[string]map[string]interface{}{},
+			provisioners: ps,
+		}
+	}
+
+	t.Run("keep and resume", func(t *testing.T) {
+		var log []string
+		fail := map[string]*bool{"b": new(bool)}
+		*fail["b"] = true
+
+		c := recordingChain(t, config.OnFailureKeep, &log, fail)
+
+		require.EqualError(t, c.Apply(context.Background()), "b failed")
+		require.Equal(t, []string{"apply a", "fail b"}, log)
+
+		journal, err := c.state.GetJournal(context.Background(), "prenv-1")
+		require.NoError(t, err)
+		require.Equal(t, &state.Journal{
+			Entries: []state.JournalEntry{
+				{Provisioner: "a", Created: true, Status: state.JournalStatusApplied},
+				{Provisioner: "b", Created: true, Status: state.JournalStatusFailed},
+			},
+			Error: "b failed",
+		}, journal)
+
+		*fail["b"] = false
+		log = nil
+		c.resume = true
+
+		require.NoError(t, c.Apply(context.Background()))
+		require.Equal(t, []string{"apply b", "apply c"}, log)
+
+		journal, err = c.state.GetJournal(context.Background(), "prenv-1")
+		require.NoError(t, err)
+		require.Nil(t, journal)
+
+		require.EqualError(t, c.Apply(context.Background()), "unable to resume: no failed apply of prenv-1 is recorded")
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		wd, err := os.Getwd()
+		require.NoError(t, err)
+
+		dir := t.TempDir()
+		require.NoError(t, os.Chdir(dir))
+		defer func() {
+			require.NoError(t, os.Chdir(wd))
+		}()
+
+		renderChain := func(shared, dedicated string) *Chain {
+			cfg := config.Config{
+				OnFailure: config.OnFailureRollback,
+				Shared: &config.Component{
+					Render: &config.Render{Files: []config.RenderedFile{{Name: "app.yaml", ContentTemplate: shared}}},
+				},
+			}
+
+			if dedicated != "" {
+				cfg.Dedicated = &config.Component{
+					Render: &config.Render{Files: []config.RenderedFile{{Name: "app.yaml", ContentTemplate: dedicated}}},
+				}
+				cfg.Policy = &config.Policy{AllowedNamespaces: []string{"pr-*"}}
+			}
+
+			c, err := newChain(&Config{Config: &cfg, Action: ghactions.EventTypeApply}, &config.EnvArgs{Name: "prenv-1"}, true)
+			require.NoError(t, err)
+
+			return c
+		}
+
+		require.NoError(t, renderChain("v1", "").Apply(context.Background()))
+
+		// The shared render is re-applied with v1, and the dedicated one created by the failed apply is destroyed.
+		err = renderChain("v2", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: kube-system\n").Apply(context.Background())
+		require.ErrorContains(t, err, "rolled back prenv-1: pr-render: 1 policy violation(s)")
+
+		got, err := os.ReadFile(filepath.Join(dir, ".prenv", "render", "app.yaml"))
+		require.NoError(t, err)
+		require.Equal(t, "v1", string(got))
+
+		store := &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")}
+
+		applied, err := store.GetApplied(context.Background(), "prenv-1")
+		require.NoError(t, err)
+		require.Equal(t, []string{"render"}, applied)
+
+		journal, err := store.GetJournal(context.Background(), "prenv-1")
+		require.NoError(t, err)
+		require.Nil(t, journal)
+	})
+
+	t.Run("rollback created", func(t *testing.T) {
+		var log []string
+		fail := map[string]*bool{"c": new(bool)}
+		*fail["c"] = true
+
+		c := recordingChain(t, config.OnFailureRollback, &log, fail)
+
+		require.EqualError(t, c.Apply(context.Background()), "rolled back prenv-1: c failed")
+		require.Equal(t, []string{"apply a", "apply b", "fail c", "destroy c", "destroy b", "destroy a"}, log)
+	})
+
+	t.Run("destroy", func(t *testing.T) {
+		var log []string
+		fail := map[string]*bool{"b": new(bool)}
+		*fail["b"] = true
+
+		c := recordingChain(t, config.OnFailureDestroy, &log, fail)
+
+		require.EqualError(t, c.Apply(context.Background()), "destroyed prenv-1: b failed")
+		require.Equal(t, []string{"apply a", "fail b", "destroy c", "destroy b", "destroy a"}, log)
+
+		journal, err := c.state.GetJournal(context.Background(), "prenv-1")
+		require.NoError(t, err)
+		require.Nil(t, journal)
+	})
+}
+
+func TestChainRunsHooks(t *testing.T) {
+	dir := t.TempDir()
+
+	hooksLog := filepath.Join(dir, "hooks.log")
+
+	echo := func(msg string) config.Hook {
+		return config.Hook{
+			Name: msg,
+			Exec: &config.ExecHook{
+				Command: []string{"sh", "-c", `echo "$1" | tee -a "$2"`, "echo", msg, hooksLog},
+			},
+		}
+	}
+
+	hooks := &config.Hooks{
+		PreApply:    []config.Hook{echo("pre {{ .Name }}")},
+		PostApply:   []config.Hook{echo("post {{ .Outputs.infra.queueURL }}"), {Exec: &config.ExecHook{Command: []string{"false"}}, FailurePolicy: config.HookFailurePolicyIgnore}},
+		PreDestroy:  []config.Hook{echo("pre-destroy {{ .Name }}")},
+		PostDestroy: []config.Hook{echo("post-destroy {{ .Name }}")},
+	}
+
+	newHookedChain := func(hooks *config.Hooks) (*Chain, *bool) {
+		outputs := map[string]map[string]interface{}{}
+
+		env := config.EnvArgs{Name: "prenv-1", Outputs: outputs}
+
+		infra := newDelegetableProvisioner("infra", nil, &outputsProvisioner{
+			outputs: map[string]plugin.Output{
+				"queueURL": {Type: "sqsQueue", Value: "https://sqs.example.com/prenv-1"},
+			},
+		})
+		infra.envArgs = env
+		infra.component = "pr-api-"
+		infra.hooks = hooks
+
+		fail := new(bool)
+
+		var log []string
+		app := newDelegetableProvisioner("app", nil, &recordingProvisioner{name: "app", log: &log, fail: fail})
+		app.envArgs = env
+		app.component = "pr-api-"
+		app.hooks = hooks
+
+		return &Chain{
+			cfg:          config.Config{EnvArgs: &env},
+			state:        &state.YAMLFileStore{Path: filepath.Join(dir, "prenv.state.yaml")},
+			outputs:      outputs,
+			provisioners: []delegatableProvisioner{infra, app},
+		}, fail
+	}
+
+	t.Run("apply and destroy", func(t *testing.T) {
+		summary := filepath.Join(dir, "summary.md")
+		t.Setenv(envvar.GitHubStepSummary, summary)
+
+		c, _ := newHookedChain(hooks)
+
+		require.NoError(t, c.Apply(context.Background()))
+		require.NoError(t, c.Destroy(context.Background()))
+
+		got, err := os.ReadFile(hooksLog)
+		require.NoError(t, err)
+		require.Equal(t, "pre prenv-1\npost https://sqs.example.com/prenv-1\npre-destroy prenv-1\npost-destroy prenv-1\n", string(got))
+
+		report, err := os.ReadFile(summary)
+		require.NoError(t, err)
+		require.Contains(t, string(report), "### prenv apply prenv-1\n")
+		require.Contains(t, string(report), "| pr-api | postApply false | failed (ignored) |")
+		require.Contains(t, string(report), "<details><summary>pr-api postApply post {{ .Outputs.infra.queueURL }}</summary>\n\n```\npost https://sqs.example.com/prenv-1\n```")
+		require.Contains(t, string(report), "### prenv destroy prenv-1\n")
+	})
+
+	t.Run("pre-destroy hook with the outputs of another component", func(t *testing.T) {
+		c, _ := newHookedChain(nil)
+
+		// The infra belongs to the shared component, which is destroyed after the dedicated ones.
+		c.provisioners[0].component = ""
+		c.provisioners[1].hooks = &config.Hooks{
+			PreDestroy: []config.Hook{echo("snapshot {{ .Outputs.infra.queueURL }}")},
+		}
+
+		require.NoError(t, os.Remove(hooksLog))
+
+		require.NoError(t, c.Apply(context.Background()))
+		require.NoError(t, c.Destroy(context.Background()))
+
+		got, err := os.ReadFile(hooksLog)
+		require.NoError(t, err)
+		require.Equal(t, "snapshot https://sqs.example.com/prenv-1\n", string(got))
+	})
+
+	t.Run("failed pre hook", func(t *testing.T) {
+		failing := &config.Hooks{
+			PreApply: []config.Hook{{Exec: &config.ExecHook{Command: []string{"sh", "-c", "echo seeding failed; exit 1"}}}},
+		}
+
+		c, _ := newHookedChain(failing)
+
+		require.EqualError(t, c.Apply(context.Background()), "preApply hook sh of pr-api: exit status 1")
+
+		applied, err := c.state.GetApplied(context.Background(), "prenv-1")
+		require.NoError(t, err)
+		require.Empty(t, applied)
+
+		require.Len(t, c.hookReports, 1)
+		require.Equal(t, "seeding failed\n", c.hookReports[0].output)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		slow := &config.Hooks{
+			PostApply: []config.Hook{{Name: "slow", Exec: &config.ExecHook{Command: []string{"sleep", "10"}}, Timeout: "100ms"}},
+		}
+
+		c, _ := newHookedChain(slow)
+
+		require.ErrorContains(t, c.Apply(context.Background()), "postApply hook slow of pr-api: timed out after 100ms")
+	})
+
+	t.Run("delegated via repository_dispatch", func(t *testing.T) {
+		c, _ := newHookedChain(hooks)
+
+		group := c.provisioners
+		group[1].Delegate = &config.Delegate{RepositoryDispatch: &config.RepositoryDispatch{Owner: "mumoshu", Repo: "prenv-target"}}
+
+		require.NoError(t, c.runHooks(context.Background(), hookPhasePreApply, group))
+		require.Empty(t, c.hookReports)
+
+		// The run triggered via repository_dispatch runs the hooks.
+		group[1].triggeredViaRepositoryDispatch = true
+
+		require.NoError(t, c.runHooks(context.Background(), hookPhasePreApply, group))
+		require.Len(t, c.hookReports, 1)
+	})
+}
+
+func TestHookJobName(t *testing.T) {
+	require.Equal(t, "prenv-1-pr-api-preapply-0", hookJobName("prenv-1", "pr-api-", hookPhasePreApply, 0))
+	require.Equal(t, "prenv-1-postdestroy-1", hookJobName("prenv-1", "", hookPhasePostDestroy, 1))
+
+	long := hookJobName("prenv-feature-very-long-branch-name-for-testing", "pr-some-component-", hookPhasePostApply, 0)
+	require.Len(t, long, 63)
+	require.NotEqual(t, long, hookJobName("prenv-feature-very-long-branch-name-for-testing", "pr-some-component-", hookPhasePostApply, 1))
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mumoshu/prenv/config"
 	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/generator"
 	"github.com/mumoshu/prenv/ghactions"
 	"gopkg.in/yaml.v2"
 )
@@ -21,6 +24,62 @@ type Config struct {
 
 	Action      string
 	TriggeredBy []string
+
+	// PullRequest contains the pull request inputs given via the command-line flags.
+	// Non-zero fields take precedence over the environment variables and the event payload
+	// when building the EnvArgs.
+	PullRequest config.PullRequestEnvArgs
+
+	// EnvName is the name of the environment given via the command-line flags, which selects the manual generator.
+	EnvName string
+
+	// Ref is the branch or the tag given via the command-line flags, which selects the branch generator.
+	Ref string
+
+	// Resume is true when the apply continues the failed one, skipping the provisioners that the failed one completed.
+	Resume bool
+
+	// RequestedProfiles is the names of the profiles requested via the command-line flags or the slash command.
+	// The profiles selected by the labels of the pull request are used when empty.
+	RequestedProfiles []string
+
+	// InProcess is true when the provisioners that would otherwise be delegated via repository_dispatch
+	// should be run within this process.
+	// This is used by the webhook server that has everything needed to run all the provisioners by itself.
+	InProcess bool
+}
+
+// Options is the set of inputs given via the command-line flags.
+//
+// Each non-zero field takes precedence over the corresponding environment variables
+// and the GitHub Actions event payload, so that prenv can run outside of GitHub Actions,
+// like on Jenkins, Buildkite, or your laptop.
+type Options struct {
+	// ConfigFile is the path to the prenv.yaml file.
+	// If set, it takes precedence over PRENV_RAW_CONFIG and the raw_config in the event payload.
+	ConfigFile string
+
+	// Action is either "prenv-apply" or "prenv-destroy".
+	// If set, it takes precedence over the action in the event payload.
+	Action string
+
+	// PullRequest contains the pull request number, the head SHA, and the repository.
+	// If set, they take precedence over GITHUB_EVENT_PATH, GITHUB_SHA, and GITHUB_REPOSITORY respectively.
+	PullRequest config.PullRequestEnvArgs
+
+	// EnvName is the name of the environment to deploy, like sandbox-alice, instead of the one for the pull request.
+	EnvName string
+
+	// Ref is the branch or the tag to deploy, like refs/heads/release/1.2, instead of the pull request.
+	// If set, it takes precedence over GITHUB_REF.
+	Ref string
+
+	// Resume continues the failed apply recorded in the state store, instead of applying all the provisioners.
+	Resume bool
+
+	// Profiles is the names of the profiles to deploy.
+	// If set, they take precedence over the labels of the pull request.
+	Profiles []string
 }
 
 // GetConfig reads the prenv.yaml file, GitHub Actions and prenv specific environment variables,
@@ -28,50 +87,80 @@ type Config struct {
 // It returns an error if it fails to read the configuration.
 //
 // It reads the prenv.yaml file from the current working directory, if any.
+// opts.ConfigFile and opts.Action, when set, take precedence over the environment variables
+// and the event payload.
 //
 // It's also worth noting that it can read the config from workflow_dispatch event inputs.
 // This is crucial to support the use case where you want to split prenv runs into two steps:
 // - prenv-apply in the source repository
 // - prenv-apply in the target repository
-func GetConfig() (*Config, error) {
+func GetConfig(opts Options) (*Config, error) {
 	var (
 		r      io.Reader
 		cfg    config.Config
 		inputs ghactions.Inputs
+
+		// configFile is the path to the prenv.yaml file the config is read from, if any.
+		// It is empty when the config is read from the raw_config,
+		// which has the template files already loaded by the prenv run that sent it.
+		configFile string
+
+		// fromEvent is true when the config is read from the event payload sent by another repository,
+		// which needs to be verified before being accepted.
+		fromEvent bool
 	)
 
-	v := os.Getenv(envvar.RawConfig)
-	if v != "" {
+	if opts.ConfigFile != "" {
+		configFile = opts.ConfigFile
+	} else if v := os.Getenv(envvar.RawConfig); v != "" {
 		r = strings.NewReader(v)
 	} else if err := ghactions.UnmarshalInputs(&inputs); err == nil {
 		if inputs.RawConfig == "" {
 			return nil, fmt.Errorf("missing required input in actions workflow_dispatch payload: %s", envvar.RawConfig)
 		}
 		r = strings.NewReader(inputs.RawConfig)
+		fromEvent = true
 	} else if err := ghactions.UnmarshalClientPayload(&inputs); err == nil {
 		if inputs.RawConfig == "" {
 			return nil, fmt.Errorf("missing required input in actions repository_dispatch payload: %s", envvar.RawConfig)
 		}
 		r = strings.NewReader(inputs.RawConfig)
+		fromEvent = true
 	} else {
-		f, err := os.Open(ConfigFileName)
+		configFile = ConfigFileName
+	}
+
+	action := opts.Action
+	if action == "" && os.Getenv(envvar.GitHubEventPath) != "" {
+		var err error
+
+		action, err = ghactions.GetAction()
 		if err != nil {
-			return nil, fmt.Errorf("unable to open config file %s: %w", ConfigFileName, err)
+			return nil, fmt.Errorf("unable to get action: %w", err)
 		}
-		defer f.Close()
-
-		r = f
 	}
 
-	d := yaml.NewDecoder(r)
-	d.SetStrict(true)
-	if err := d.Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("unable to decode yaml: %w", err)
+	if fromEvent {
+		sc, err := ghactions.LoadSignatureConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := sc.Verify(inputs, action, time.Now()); err != nil {
+			return nil, fmt.Errorf("unable to verify the payload sent from another repository: %w", err)
+		}
 	}
 
-	action, err := ghactions.GetAction()
-	if err != nil {
-		return nil, fmt.Errorf("unable to get action: %w", err)
+	if configFile != "" {
+		if err := readConfigFile(configFile, &cfg); err != nil {
+			return nil, err
+		}
+
+		if err := cfg.LoadRenderSources(filepath.Dir(configFile)); err != nil {
+			return nil, err
+		}
+	} else if err := decodeConfig(r, &cfg); err != nil {
+		return nil, err
 	}
 
 	var c Config
@@ -79,6 +168,46 @@ func GetConfig() (*Config, error) {
 	c.Action = action
 	c.Config = &cfg
 	c.TriggeredBy = inputs.TriggeredBy
+	c.PullRequest = opts.PullRequest
+	c.EnvName = opts.EnvName
+	c.Ref = opts.Ref
+	c.RequestedProfiles = opts.Profiles
+	c.Resume = opts.Resume
 
 	return &c, nil
 }
+
+// ReadConfigFile reads the prenv.yaml file at the given path.
+// Unlike GetConfig, it does not read any environment variables or the GitHub Actions event payload.
+func ReadConfigFile(path string) (*config.Config, error) {
+	var cfg config.Config
+
+	if err := readConfigFile(path, &cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.LoadRenderSources(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func decodeConfig(r io.Reader, cfg *config.Config) error {
+	d := yaml.NewDecoder(r)
+	d.SetStrict(true)
+	if err := d.Decode(cfg); err != nil {
+		return fmt.Errorf("unable to decode yaml: %w", err)
+	}
+
+	return nil
+}
+
+// generator returns the generator of the environment for the inputs.
+func (c *Config) generator() generator.Generator {
+	return generator.New(generator.Inputs{
+		PullRequest: c.PullRequest,
+		EnvName:     c.EnvName,
+		Ref:         c.Ref,
+	})
+}
@@ -0,0 +1,450 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/ghactions"
+	"github.com/mumoshu/prenv/render"
+	"github.com/mumoshu/prenv/secretref"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hookPhasePreApply    = "preApply"
+	hookPhasePostApply   = "postApply"
+	hookPhasePreDestroy  = "preDestroy"
+	hookPhasePostDestroy = "postDestroy"
+)
+
+// hookJobPollInterval is the interval of checking whether the Job of a hook has completed.
+var hookJobPollInterval = 5 * time.Second
+
+// hookReport is the result of a hook, captured into the run report.
+type hookReport struct {
+	component string
+	phase     string
+	hook      string
+	output    string
+	duration  time.Duration
+	err       error
+	ignored   bool
+}
+
+// hookPhases returns the phases of the hooks run before and after the provisioners for the action.
+func hookPhases(action string) (string, string) {
+	if action == ghactions.EventTypeDestroy {
+		return hookPhasePreDestroy, hookPhasePostDestroy
+	}
+
+	return hookPhasePreApply, hookPhasePostApply
+}
+
+func phaseHooks(h *config.Hooks, phase string) []config.Hook {
+	switch phase {
+	case hookPhasePreApply:
+		return h.PreApply
+	case hookPhasePostApply:
+		return h.PostApply
+	case hookPhasePreDestroy:
+		return h.PreDestroy
+	case hookPhasePostDestroy:
+		return h.PostDestroy
+	}
+
+	return nil
+}
+
+// groupByComponent splits the provisioners into the runs of the consecutive provisioners of the same component.
+func groupByComponent(ps []delegatableProvisioner) [][]delegatableProvisioner {
+	var groups [][]delegatableProvisioner
+
+	for i, p := range ps {
+		if i == 0 || ps[i-1].component != p.component {
+			groups = append(groups, nil)
+		}
+
+		groups[len(groups)-1] = append(groups[len(groups)-1], p)
+	}
+
+	return groups
+}
+
+// componentName returns the name of the component of the provisioners with the name prefix, shown in the logs and the run report.
+func componentName(namePrefix string) string {
+	if namePrefix == "" {
+		return "shared"
+	}
+
+	return strings.TrimSuffix(namePrefix, "-")
+}
+
+// runHooks runs the hooks of the phase of the component that the provisioners in the group belong to.
+// The hooks are left to the delegated run when any of the provisioners is delegated via repository_dispatch.
+func (c *Chain) runHooks(ctx context.Context, phase string, group []delegatableProvisioner) error {
+	p := group[0]
+
+	if p.hooks == nil {
+		return nil
+	}
+
+	hooks := phaseHooks(p.hooks, phase)
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	component := componentName(p.component)
+
+	for _, gp := range group {
+		if gp.dispatches() {
+			logrus.Infof("Leaving the %s hooks of %s to the run triggered via repository_dispatch", phase, component)
+			return nil
+		}
+	}
+
+	for i := range hooks {
+		h := hooks[i]
+
+		logrus.Infof("Running %s hook %s of %s", phase, h.GetName(), component)
+
+		start := time.Now()
+
+		out, err := runHook(ctx, p, phase, i, h)
+
+		r := hookReport{
+			component: component,
+			phase:     phase,
+			hook:      h.GetName(),
+			output:    out,
+			duration:  time.Since(start),
+			err:       err,
+			ignored:   err != nil && h.Ignored(),
+		}
+
+		c.hookReports = append(c.hookReports, r)
+
+		if out != "" {
+			logrus.Infof("Output of %s hook %s of %s:\n%s", phase, h.GetName(), component, out)
+		}
+
+		if err != nil {
+			if h.Ignored() {
+				logrus.Warnf("Ignoring the failure of %s hook %s of %s: %v", phase, h.GetName(), component, err)
+				continue
+			}
+
+			return fmt.Errorf("%s hook %s of %s: %w", phase, h.GetName(), component, err)
+		}
+	}
+
+	return nil
+}
+
+// runHook runs the i-th hook of the phase for the component of the provisioner, and returns its output.
+func runHook(ctx context.Context, p delegatableProvisioner, phase string, i int, h config.Hook) (string, error) {
+	if err := h.Validate(); err != nil {
+		return "", err
+	}
+
+	timeout, err := h.GetTimeout()
+	if err != nil {
+		return "", err
+	}
+
+	// The secret references in the hook are resolved before rendering,
+	// so that the rendered values, like the title of the pull request, are never resolved.
+	resolvedHook, err := secretref.ResolveAll(ctx, &h)
+	if err != nil {
+		return "", err
+	}
+
+	resolvedArgs, err := secretref.ResolveAll(ctx, p.envArgs)
+	if err != nil {
+		return "", err
+	}
+
+	hook := resolvedHook.(*config.Hook)
+	args := resolvedArgs.(config.EnvArgs)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var out string
+
+	if hook.Exec != nil {
+		out, err = runExecHook(ctx, *hook.Exec, args)
+	} else {
+		out, err = runJobHook(ctx, hookJobName(p.envArgs.Name, p.component, phase, i), *hook.Job, args)
+	}
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+
+	return out, err
+}
+
+func runExecHook(ctx context.Context, h config.ExecHook, args config.EnvArgs) (string, error) {
+	command, err := renderHookStrings("exec.command", h.Command, args)
+	if err != nil {
+		return "", err
+	}
+
+	env, err := renderHookEnv("exec.env", h.Env, args)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = h.Dir
+	cmd.Env = os.Environ()
+
+	for _, e := range env {
+		cmd.Env = append(cmd.Env, e.name+"="+e.value)
+	}
+
+	// The processes spawned by the command, like the ones run by `sh -c`, can keep the output open after the command is killed on timeout.
+	cmd.WaitDelay = 10 * time.Second
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	logrus.Debugf("running %s", strings.Join(cmd.Args, " "))
+
+	err = cmd.Run()
+
+	return out.String(), err
+}
+
+// runJobHook replaces the Job of the hook with the one rendered from h, waits for it to complete, and returns its logs.
+// The Job is deleted once it succeeds, and kept for debugging otherwise until the next run replaces it.
+func runJobHook(ctx context.Context, name string, h config.JobHook, args config.EnvArgs) (string, error) {
+	command, err := renderHookStrings("job.command", h.Command, args)
+	if err != nil {
+		return "", err
+	}
+
+	jobArgs, err := renderHookStrings("job.args", h.Args, args)
+	if err != nil {
+		return "", err
+	}
+
+	env, err := renderHookEnv("job.env", h.Env, args)
+	if err != nil {
+		return "", err
+	}
+
+	manifest, err := hookJobManifest(name, h, command, jobArgs, env)
+	if err != nil {
+		return "", err
+	}
+
+	var ns []string
+	if h.Namespace != "" {
+		ns = []string{"--namespace", h.Namespace}
+	}
+
+	if _, err := kubectl(ctx, nil, append([]string{"delete", "job", name, "--ignore-not-found", "--wait"}, ns...)...); err != nil {
+		return "", err
+	}
+
+	if _, err := kubectl(ctx, manifest, append([]string{"apply", "-f", "-"}, ns...)...); err != nil {
+		return "", err
+	}
+
+	waitErr := waitForJob(ctx, name, ns)
+
+	// The logs are collected even when the Job failed or timed out, as they tell why.
+	logsCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	logs, err := kubectl(logsCtx, nil, append([]string{"logs", "job/" + name, "--all-containers"}, ns...)...)
+	if err != nil {
+		logrus.Warnf("unable to get the logs of job %s: %v", name, err)
+	}
+
+	if waitErr != nil {
+		return string(logs), waitErr
+	}
+
+	if _, err := kubectl(ctx, nil, append([]string{"delete", "job", name, "--ignore-not-found", "--cascade=background"}, ns...)...); err != nil {
+		logrus.Warnf("unable to delete job %s: %v", name, err)
+	}
+
+	return string(logs), nil
+}
+
+// waitForJob waits for the Job to either succeed or fail.
+func waitForJob(ctx context.Context, name string, ns []string) error {
+	for {
+		out, err := kubectl(ctx, nil, append([]string{"get", "job", name, "-o", "jsonpath={.status.succeeded}/{.status.failed}"}, ns...)...)
+		if err != nil {
+			return err
+		}
+
+		succeeded, failed, _ := strings.Cut(strings.TrimSpace(string(out)), "/")
+
+		if n, _ := strconv.Atoi(succeeded); n > 0 {
+			return nil
+		}
+
+		if n, _ := strconv.Atoi(failed); n > 0 {
+			return fmt.Errorf("job %s failed", name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("job %s did not complete: %w", name, ctx.Err())
+		case <-time.After(hookJobPollInterval):
+		}
+	}
+}
+
+// hookJobManifest returns the JSON manifest of the Job of the hook, which is run once without retries.
+func hookJobManifest(name string, h config.JobHook, command, args []string, env []hookEnvVar) ([]byte, error) {
+	container := map[string]interface{}{
+		"name":  "hook",
+		"image": h.Image,
+	}
+
+	if len(command) > 0 {
+		container["command"] = command
+	}
+
+	if len(args) > 0 {
+		container["args"] = args
+	}
+
+	if len(env) > 0 {
+		var vars []map[string]string
+		for _, e := range env {
+			vars = append(vars, map[string]string{"name": e.name, "value": e.value})
+		}
+
+		container["env"] = vars
+	}
+
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers":    []interface{}{container},
+	}
+
+	if h.ServiceAccountName != "" {
+		podSpec["serviceAccountName"] = h.ServiceAccountName
+	}
+
+	metadata := map[string]interface{}{
+		"name": name,
+		"labels": map[string]string{
+			"app.kubernetes.io/managed-by": "prenv",
+		},
+	}
+
+	if h.Namespace != "" {
+		metadata["namespace"] = h.Namespace
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   metadata,
+		"spec": map[string]interface{}{
+			"backoffLimit": 0,
+			"template": map[string]interface{}{
+				"spec": podSpec,
+			},
+		},
+	})
+}
+
+var invalidJobNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// hookJobName returns the name of the Job of the i-th hook of the phase for the component in the environment.
+// Names longer than the limit of Kubernetes are truncated and suffixed with their hash, so that they are still unique.
+func hookJobName(envName, namePrefix, phase string, i int) string {
+	name := fmt.Sprintf("%s-%s%s-%d", envName, namePrefix, phase, i)
+	name = strings.Trim(invalidJobNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+
+	if len(name) > 63 {
+		sum := sha256.Sum256([]byte(name))
+		name = strings.TrimRight(name[:54], "-") + "-" + hex.EncodeToString(sum[:])[:8]
+	}
+
+	return name
+}
+
+func kubectl(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logrus.Debugf("running %s", strings.Join(cmd.Args, " "))
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("kubectl %s failed: %s: %w", args[0], stderr.String(), err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+type hookEnvVar struct {
+	name, value string
+}
+
+func renderHookStrings(field string, ss []string, args config.EnvArgs) ([]string, error) {
+	var rendered []string
+
+	for i, s := range ss {
+		r, err := render.ExecuteString(render.EngineText, fmt.Sprintf("%s[%d]", field, i), s, args)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render %s[%d]: %w", field, i, err)
+		}
+
+		rendered = append(rendered, r)
+	}
+
+	return rendered, nil
+}
+
+// renderHookEnv renders the values of the env, and returns them in the order of their names.
+func renderHookEnv(field string, env map[string]string, args config.EnvArgs) ([]hookEnvVar, error) {
+	var names []string
+	for k := range env {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	var rendered []hookEnvVar
+
+	for _, k := range names {
+		v, err := render.ExecuteString(render.EngineText, field+"."+k, env[k], args)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render %s.%s: %w", field, k, err)
+		}
+
+		rendered = append(rendered, hookEnvVar{name: k, value: v})
+	}
+
+	return rendered, nil
+}
@@ -0,0 +1,273 @@
+package provisioner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mumoshu/prenv/config"
+	"gopkg.in/yaml.v2"
+)
+
+// configDocument is the content of a prenv.yaml file merged with the files it imports.
+type configDocument struct {
+	file string
+
+	data map[interface{}]interface{}
+
+	// origins is the file that defined each field, keyed by the path to the field like dedicated.components.api.
+	// The fields missing in the map are defined in the file that defined the closest parent field in the map.
+	origins map[string]string
+
+	// files is the list of the files merged into the document, including the file itself.
+	files []string
+}
+
+// origin returns the file that defined the field at the path.
+func (d *configDocument) origin(path string) string {
+	for {
+		if f, ok := d.origins[path]; ok {
+			return f
+		}
+
+		if path == "" {
+			return d.file
+		}
+
+		if i := strings.LastIndex(path, "."); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+}
+
+// readConfigFile reads the prenv.yaml file at path into cfg, merging the files it imports.
+// The imports are removed from the merged config, so that the config sent to the delegated runs is self-contained.
+func readConfigFile(path string, cfg *config.Config) error {
+	doc, err := readConfigDocument(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(doc.data)
+	if err != nil {
+		return err
+	}
+
+	if err := decodeConfig(bytes.NewReader(data), cfg); err != nil {
+		return fmt.Errorf("unable to decode the config merged from %s: %w", strings.Join(doc.files, ", "), err)
+	}
+
+	return nil
+}
+
+// readConfigDocument reads the prenv.yaml file at path and the files it imports, and deep-merges them into one document.
+func readConfigDocument(path string) (*configDocument, error) {
+	return readConfigDocumentRec(path, filepath.Dir(path), nil)
+}
+
+// readConfigDocumentRec reads the file at path, rewriting the paths to the template files to be relative to rootDir,
+// which is the directory containing the prenv.yaml file that imports all the others.
+// stack is the list of the files importing this file, used to detect import cycles.
+func readConfigDocumentRec(path, rootDir string, stack []string) (*configDocument, error) {
+	for _, f := range stack {
+		if f == path {
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(append(stack, path), " -> "))
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open config file %s: %w", path, err)
+	}
+
+	// Decoded into the config first so that the unknown fields are reported with the file that contains them.
+	var cfg config.Config
+	if err := decodeConfig(bytes.NewReader(b), &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var data map[interface{}]interface{}
+	if err := yaml.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if data == nil {
+		data = map[interface{}]interface{}{}
+	}
+
+	delete(data, "imports")
+
+	rel, err := filepath.Rel(rootDir, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if rel != "." {
+		rebaseRenderPaths(data, rel)
+	}
+
+	doc := &configDocument{
+		file:    path,
+		data:    data,
+		origins: map[string]string{"": path},
+		files:   []string{path},
+	}
+
+	imports, err := resolveImports(path, cfg.Imports)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range imports {
+		child, err := readConfigDocumentRec(m, rootDir, append(stack, path))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := doc.merge(doc.data, child.data, child, ""); err != nil {
+			return nil, err
+		}
+
+		doc.files = append(doc.files, child.files...)
+	}
+
+	return doc, nil
+}
+
+// resolveImports returns the paths to the files imported by the file at path, expanding the globs in the imports.
+func resolveImports(path string, imports []string) ([]string, error) {
+	var files []string
+
+	imported := map[string]bool{path: true}
+
+	for _, pattern := range imports {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid import %q: %w", path, pattern, err)
+		}
+
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: imported file %s does not exist", path, pattern)
+		}
+
+		for _, m := range matches {
+			// A glob like *.yaml can match the importing file itself.
+			if imported[m] {
+				continue
+			}
+			imported[m] = true
+
+			files = append(files, m)
+		}
+	}
+
+	return files, nil
+}
+
+// merge deep-merges the src map at the path in the imported document into dst.
+// Maps are merged recursively. It is an error to define the same component, or a different value for the same field, in both.
+func (d *configDocument) merge(dst, src map[interface{}]interface{}, imported *configDocument, path string) error {
+	var keys []interface{}
+	for k := range src {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+
+	for _, k := range keys {
+		v := src[k]
+		p := joinPath(path, fmt.Sprint(k))
+
+		existing, ok := dst[k]
+		if !ok {
+			dst[k] = v
+
+			d.origins[p] = imported.origin(p)
+			for o, f := range imported.origins {
+				if strings.HasPrefix(o, p+".") {
+					d.origins[o] = f
+				}
+			}
+
+			continue
+		}
+
+		if strings.HasSuffix("."+path, ".components") {
+			return fmt.Errorf("component %q is defined in both %s and %s", k, d.origin(p), imported.origin(p))
+		}
+
+		dm, dstIsMap := existing.(map[interface{}]interface{})
+		sm, srcIsMap := v.(map[interface{}]interface{})
+
+		if dstIsMap && srcIsMap {
+			if err := d.merge(dm, sm, imported, p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(existing, v) {
+			return fmt.Errorf("%s is defined differently in %s and %s", p, d.origin(p), imported.origin(p))
+		}
+	}
+
+	return nil
+}
+
+// rebaseRenderPaths prefixes the paths to the template files of the render provisioners in the data with dir,
+// so that the paths in an imported file, which are relative to the imported file, are relative to the importing prenv.yaml.
+func rebaseRenderPaths(data interface{}, dir string) {
+	rebase := func(p interface{}) interface{} {
+		s, ok := p.(string)
+		if !ok || s == "" || filepath.IsAbs(s) {
+			return p
+		}
+
+		return filepath.ToSlash(filepath.Join(dir, s))
+	}
+
+	switch d := data.(type) {
+	case map[interface{}]interface{}:
+		if r, ok := d["render"].(map[interface{}]interface{}); ok {
+			if files, ok := r["files"].([]interface{}); ok {
+				for _, f := range files {
+					if f, ok := f.(map[interface{}]interface{}); ok {
+						for _, k := range []string{"templateFile", "templateDir"} {
+							if v, ok := f[k]; ok {
+								f[k] = rebase(v)
+							}
+						}
+					}
+				}
+			}
+
+			if partials, ok := r["partials"].([]interface{}); ok {
+				for i := range partials {
+					partials[i] = rebase(partials[i])
+				}
+			}
+		}
+
+		for k, v := range d {
+			if k != "render" {
+				rebaseRenderPaths(v, dir)
+			}
+		}
+	case []interface{}:
+		for _, v := range d {
+			rebaseRenderPaths(v, dir)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package provisioner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+}
+
+func TestReadConfigFileImports(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFiles(t, dir, map[string]string{
+		"prenv.yaml": `imports:
+- services/*/prenv.yaml
+vars:
+  domain: example.com
+dedicated:
+  render:
+    files:
+    - name: ns.yaml
+      contentTemplate: ns
+`,
+		"services/api/prenv.yaml": `vars:
+  domain: example.com
+  apiPort: "8080"
+dedicated:
+  components:
+    api:
+      render:
+        partials:
+        - templates/_helpers.tpl
+        files:
+        - templateFile: templates/api.yaml
+`,
+		"services/api/templates/api.yaml":     `port: {{ .Vars.apiPort }}`,
+		"services/api/templates/_helpers.tpl": `{{ define "name" }}api{{ end }}`,
+		"services/web/prenv.yaml": `dedicated:
+  components:
+    web:
+      render:
+        files:
+        - name: web.yaml
+          contentTemplate: web
+`,
+	})
+
+	cfg, err := ReadConfigFile(filepath.Join(dir, "prenv.yaml"))
+	require.NoError(t, err)
+
+	require.Empty(t, cfg.Imports)
+	require.Equal(t, map[string]string{"domain": "example.com", "apiPort": "8080"}, cfg.Vars)
+	require.Equal(t, []config.RenderedFile{{Name: "ns.yaml", ContentTemplate: "ns"}}, cfg.Dedicated.Render.Files)
+
+	api := cfg.Dedicated.Components["api"].Render
+	require.Equal(t, []config.RenderedFile{{TemplateFile: "services/api/templates/api.yaml"}}, api.Files)
+	require.Equal(t, []string{"services/api/templates/_helpers.tpl"}, api.Partials)
+	require.Equal(t, map[string]string{
+		"services/api/templates/api.yaml":     `port: {{ .Vars.apiPort }}`,
+		"services/api/templates/_helpers.tpl": `{{ define "name" }}api{{ end }}`,
+	}, api.Sources)
+
+	require.Equal(t, []config.RenderedFile{{Name: "web.yaml", ContentTemplate: "web"}}, cfg.Dedicated.Components["web"].Render.Files)
+}
+
+func TestReadConfigFileImportConflicts(t *testing.T) {
+	testcases := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "duplicate component",
+			files: map[string]string{
+				"prenv.yaml": "imports: [a.yaml, b.yaml]\n",
+				"a.yaml":     "dedicated:\n  components:\n    api:\n      render: {}\n",
+				"b.yaml":     "dedicated:\n  components:\n    api:\n      helm: {}\n",
+			},
+			err: `component "api" is defined in both DIR/a.yaml and DIR/b.yaml`,
+		},
+		{
+			name: "different values",
+			files: map[string]string{
+				"prenv.yaml": "imports: [a.yaml]\nvars:\n  domain: example.com\n",
+				"a.yaml":     "vars:\n  domain: example.org\n",
+			},
+			err: `vars.domain is defined differently in DIR/prenv.yaml and DIR/a.yaml`,
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"prenv.yaml": "imports: [a.yaml]\n",
+				"a.yaml":     "imports: [prenv.yaml]\n",
+			},
+			err: `import cycle: DIR/prenv.yaml -> DIR/a.yaml -> DIR/prenv.yaml`,
+		},
+		{
+			name: "missing file",
+			files: map[string]string{
+				"prenv.yaml": "imports: [a.yaml]\n",
+			},
+			err: `DIR/prenv.yaml: imported file DIR/a.yaml does not exist`,
+		},
+		{
+			name: "unknown field in imported file",
+			files: map[string]string{
+				"prenv.yaml": "imports: [a.yaml]\n",
+				"a.yaml":     "dedicated:\n  foo: bar\n",
+			},
+			err: `DIR/a.yaml: unable to decode yaml`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			writeFiles(t, dir, tc.files)
+
+			_, err := ReadConfigFile(filepath.Join(dir, "prenv.yaml"))
+			require.ErrorContains(t, err, strings.ReplaceAll(tc.err, "DIR", dir))
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/ghactions"
+	"github.com/mumoshu/prenv/state"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// startJournal returns the journal of the apply that is about to start, recording it in the state store.
+//
+// When resuming, the journal starts with the provisioners that the failed apply completed,
+// so that the chain skips them, and a rollback of the resumed apply rolls them back, too.
+func (c *Chain) startJournal(ctx context.Context) (*state.Journal, error) {
+	envName := c.cfg.EnvArgs.Name
+
+	applied, err := c.state.GetApplied(ctx, envName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get applied provisioners: %w", err)
+	}
+
+	c.appliedBefore = map[string]bool{}
+	for _, name := range applied {
+		c.appliedBefore[name] = true
+	}
+
+	journal := &state.Journal{}
+
+	if c.resume {
+		failed, err := c.state.GetJournal(ctx, envName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get journal: %w", err)
+		}
+
+		if failed == nil || failed.Error == "" {
+			return nil, fmt.Errorf("unable to resume: no failed apply of %s is recorded", envName)
+		}
+
+		for _, e := range failed.Entries {
+			if e.Status != state.JournalStatusFailed {
+				journal.Entries = append(journal.Entries, e)
+			}
+		}
+	}
+
+	if err := c.state.SetJournal(ctx, envName, journal); err != nil {
+		return nil, fmt.Errorf("unable to record journal: %w", err)
+	}
+
+	return journal, nil
+}
+
+// record adds what the provisioner did to the journal of the running apply, and records it in the state store.
+// It does nothing when the chain is not applying, like when destroying or rolling back.
+func (c *Chain) record(ctx context.Context, p delegatableProvisioner, status string, cause error) error {
+	if c.journal == nil {
+		return nil
+	}
+
+	c.journal.Entries = append(c.journal.Entries, state.JournalEntry{
+		Provisioner: p.name,
+		Created:     !c.appliedBefore[p.name],
+		Status:      status,
+	})
+
+	if cause != nil {
+		c.journal.Error = cause.Error()
+	}
+
+	if err := c.state.SetJournal(ctx, c.cfg.EnvArgs.Name, c.journal); err != nil {
+		return fmt.Errorf("unable to record journal: %w", err)
+	}
+
+	return nil
+}
+
+// finishJournal deletes the journal of the apply that succeeded.
+// With onFailure rollback, it also records the config of the apply to roll the provisioners back to on the later failures.
+func (c *Chain) finishJournal(ctx context.Context) error {
+	envName := c.cfg.EnvArgs.Name
+
+	if err := c.state.SetJournal(ctx, envName, nil); err != nil {
+		return fmt.Errorf("unable to delete journal: %w", err)
+	}
+
+	if c.cfg.OnFailure == config.OnFailureRollback {
+		data, err := yaml.Marshal(c.cfg)
+		if err != nil {
+			return fmt.Errorf("unable to marshal config: %w", err)
+		}
+
+		if err := c.state.SetConfig(ctx, envName, string(data)); err != nil {
+			return fmt.Errorf("unable to record config: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// clearJournal deletes the journal and the config of the destroyed environment.
+func (c *Chain) clearJournal(ctx context.Context) error {
+	envName := c.cfg.EnvArgs.Name
+
+	if err := c.state.SetJournal(ctx, envName, nil); err != nil {
+		return fmt.Errorf("unable to delete journal: %w", err)
+	}
+
+	if err := c.state.SetConfig(ctx, envName, ""); err != nil {
+		return fmt.Errorf("unable to delete config: %w", err)
+	}
+
+	return nil
+}
+
+// handleFailure handles the failed apply according to onFailure, and returns the error to fail the run with.
+func (c *Chain) handleFailure(ctx context.Context, cause error) error {
+	envName := c.cfg.EnvArgs.Name
+
+	journal := c.journal
+
+	// Neither the rollback nor the destroy is journaled, so that the journal keeps what the failed apply did.
+	c.journal = nil
+
+	switch c.cfg.OnFailure {
+	case config.OnFailureRollback:
+		logrus.Warnf("Rolling back %s because the apply failed: %v", envName, cause)
+
+		if err := c.rollback(ctx, journal); err != nil {
+			return fmt.Errorf("%w, and then unable to roll back %s: %v", cause, envName, err)
+		}
+
+		if err := c.state.SetJournal(ctx, envName, nil); err != nil {
+			return fmt.Errorf("%w, and then unable to delete journal: %v", cause, err)
+		}
+
+		return fmt.Errorf("rolled back %s: %w", envName, cause)
+	case config.OnFailureDestroy:
+		logrus.Warnf("Destroying %s because the apply failed: %v", envName, cause)
+
+		unwanted, err := c.appliedUnwanted(ctx)
+		if err != nil {
+			return fmt.Errorf("%w, and then unable to destroy %s: %v", cause, envName, err)
+		}
+
+		ps := append(append([]delegatableProvisioner{}, c.provisioners...), unwanted...)
+
+		if _, err := c.run(ctx, ghactions.EventTypeDestroy, reversed(ps), destroy); err != nil {
+			return fmt.Errorf("%w, and then unable to destroy %s: %v", cause, envName, err)
+		}
+
+		if err := c.clearJournal(ctx); err != nil {
+			return fmt.Errorf("%w, and then %v", cause, err)
+		}
+
+		return fmt.Errorf("destroyed %s: %w", envName, cause)
+	}
+
+	logrus.Infof("Run `prenv apply --resume` to continue the apply of %s from the failed provisioner", envName)
+
+	return cause
+}
+
+// rollback rolls back the provisioners in the journal in reverse order.
+// The ones created by the apply are destroyed,
+// and the others are re-applied with the config that the environment was last applied with successfully.
+func (c *Chain) rollback(ctx context.Context, journal *state.Journal) error {
+	var previous *Chain
+
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		e := journal.Entries[i]
+
+		p, ok := findProvisioner(c.provisioners, e.Provisioner)
+		if !ok {
+			logrus.Warnf("Unable to roll back %s because it is no longer in the config", e.Provisioner)
+			continue
+		}
+
+		// The hooks are for the applies and the destroys of the components, not for the rollbacks.
+		p.hooks = nil
+
+		if e.Created {
+			if _, err := c.run(ctx, ghactions.EventTypeDestroy, []delegatableProvisioner{p}, destroy); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if previous == nil {
+			var err error
+
+			previous, err = c.previousChain(ctx)
+			if err != nil {
+				return err
+			}
+
+			if previous == nil {
+				logrus.Warnf("Unable to roll back %s because no successful apply of %s is recorded", e.Provisioner, c.cfg.EnvArgs.Name)
+				continue
+			}
+		}
+
+		pp, ok := findProvisioner(previous.provisioners, e.Provisioner)
+		if !ok {
+			logrus.Warnf("Unable to roll back %s because it was not in the config of the last successful apply", e.Provisioner)
+			continue
+		}
+
+		pp.triggeredViaRepositoryDispatch = p.triggeredViaRepositoryDispatch
+		pp.hooks = nil
+
+		if _, err := previous.run(ctx, ghactions.EventTypeApply, []delegatableProvisioner{pp}, apply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// previousChain returns the chain for the config that the environment was last applied with successfully,
+// or nil if there is none.
+func (c *Chain) previousChain(ctx context.Context) (*Chain, error) {
+	data, err := c.state.GetConfig(ctx, c.cfg.EnvArgs.Name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get config: %w", err)
+	}
+
+	if data == "" {
+		return nil, nil
+	}
+
+	var cfg config.Config
+	if err := decodeConfig(strings.NewReader(data), &cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode the config of the last successful apply: %w", err)
+	}
+
+	// The config contains the args of the environment with the vars already rendered, like the ones sent to the delegated runs.
+	previous, err := newChain(&Config{Config: &cfg, Action: ghactions.EventTypeApply}, cfg.EnvArgs, true)
+	if err != nil {
+		return nil, err
+	}
+
+	previous.state = c.state
+
+	return previous, nil
+}
+
+func findProvisioner(ps []delegatableProvisioner, name string) (delegatableProvisioner, bool) {
+	for _, p := range ps {
+		if p.name == name {
+			return p, true
+		}
+	}
+
+	return delegatableProvisioner{}, false
+}
+
+func reversed(ps []delegatableProvisioner) []delegatableProvisioner {
+	r := make([]delegatableProvisioner, 0, len(ps))
+
+	for i := len(ps) - 1; i >= 0; i-- {
+		r = append(r, ps[i])
+	}
+
+	return r
+}
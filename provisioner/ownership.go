@@ -0,0 +1,278 @@
+package provisioner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ownershipManifest lists the files that each environment rendered into the gitops directory.
+//
+// The manifest is stored as files in the directory the provisioner renders to,
+// so that prenv can tell the files it rendered from the files owned by other tools or humans.
+// Only the files listed in the manifest are ever pruned or deleted by prenv.
+//
+// Each environment has its own file named after the provisioner and the environment,
+// and no file is shared among the environments,
+// so that the gitops pull requests of concurrent environments never touch the same manifest file.
+// Note that they can still conflict on the files rendered for all the environments, like the ones rendered via forEach.
+type ownershipManifest struct {
+	// Environments maps the name of the environment to the paths of the files rendered for it.
+	// The paths are relative to the directory that contains the manifest.
+	Environments map[string][]string
+
+	// Shared maps the name of the environment to the paths of the files rendered for all the environments,
+	// like the ones rendered via forEach, by the last run for the environment.
+	// They are not owned by any single environment, and are pruned once they are no longer rendered.
+	Shared map[string][]string
+}
+
+// ownershipFile is the content of the file of the ownership manifest for an environment.
+type ownershipFile struct {
+	Files  []string `yaml:"files,omitempty"`
+	Shared []string `yaml:"shared,omitempty"`
+}
+
+// ownershipManifestName returns the name of the file of the ownership manifest
+// that lists the files rendered by the provisioner for the environment.
+func ownershipManifestName(provisioner, env string) string {
+	return fmt.Sprintf(".prenv-owned.%s.%s.yaml", provisioner, env)
+}
+
+// loadOwnershipManifest reads the files of the ownership manifest of the provisioner in dir.
+// It returns an empty manifest if there is no file yet.
+func loadOwnershipManifest(dir, provisioner string) (*ownershipManifest, error) {
+	m := &ownershipManifest{
+		Environments: map[string][]string{},
+		Shared:       map[string][]string{},
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, ownershipManifestName(provisioner, "*")))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ownership manifests in %s: %w", dir, err)
+	}
+
+	for _, path := range paths {
+		env := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), ".prenv-owned."+provisioner+"."), ".yaml")
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ownership manifest %s: %w", path, err)
+		}
+
+		var f ownershipFile
+
+		if err := yaml.UnmarshalStrict(b, &f); err != nil {
+			return nil, fmt.Errorf("unable to parse ownership manifest %s: %w", path, err)
+		}
+
+		m.Environments[env] = f.Files
+
+		if len(f.Shared) > 0 {
+			m.Shared[env] = f.Shared
+		}
+	}
+
+	return m, nil
+}
+
+// set records the files rendered for the environment, and the files rendered for all the environments.
+func (m *ownershipManifest) set(env string, files, shared []string) {
+	m.Environments[env] = cleanPaths(files)
+	m.Shared[env] = cleanPaths(shared)
+}
+
+// remove removes the records of the environment.
+func (m *ownershipManifest) remove(env string) {
+	delete(m.Environments, env)
+	delete(m.Shared, env)
+}
+
+// sharedFiles returns the files rendered for all the environments, recorded by any environment.
+func (m *ownershipManifest) sharedFiles() []string {
+	var files []string
+
+	for _, fs := range m.Shared {
+		for _, f := range fs {
+			if !containsPath(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+
+	sort.Strings(files)
+
+	return files
+}
+
+// ownedByOthers returns true if the file is rendered for any environment other than env,
+// or for all the environments.
+// Such a file must survive the pruning for env.
+func (m *ownershipManifest) ownedByOthers(env, file string) bool {
+	f := filepath.Clean(file)
+
+	if containsPath(m.sharedFiles(), f) {
+		return true
+	}
+
+	for e, files := range m.Environments {
+		if e != env && containsPath(files, f) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sharedOrphans returns the files in prev, the files previously rendered for all the environments,
+// that are neither in current, the ones rendered for all the environments by the running render,
+// nor rendered for any environment, and still exist in dir.
+//
+// The running render is authoritative, because every render renders the files for all the environments.
+// The records of the other environments may be stale until their next runs.
+func (m *ownershipManifest) sharedOrphans(dir string, prev, current []string) ([]string, error) {
+	var orphans []string
+
+	for _, f := range prev {
+		if containsPath(current, f) {
+			continue
+		}
+
+		var owned bool
+		for _, files := range m.Environments {
+			if containsPath(files, f) {
+				owned = true
+				break
+			}
+		}
+
+		if owned {
+			continue
+		}
+
+		exists, err := fileExists(filepath.Join(dir, f))
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			orphans = append(orphans, f)
+		}
+	}
+
+	return orphans, nil
+}
+
+// orphans returns the files that were rendered for the environment previously but are no longer rendered,
+// and still exist in dir.
+func (m *ownershipManifest) orphans(dir, env string, rendered []string) ([]string, error) {
+	current := map[string]bool{}
+	for _, f := range rendered {
+		current[filepath.Clean(f)] = true
+	}
+
+	var orphans []string
+
+	for _, f := range m.Environments[env] {
+		if current[f] || m.ownedByOthers(env, f) {
+			continue
+		}
+
+		exists, err := fileExists(filepath.Join(dir, f))
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			orphans = append(orphans, f)
+		}
+	}
+
+	return orphans, nil
+}
+
+// save writes the file of the manifest for the environment to dir,
+// or deletes it when the environment no longer renders any file.
+// The files of the other environments are left untouched.
+// It returns the added or modified file and the deleted file respectively, if any,
+// so that the caller can include them in the render result.
+func (m *ownershipManifest) save(dir, provisioner, env string) ([]string, []string, error) {
+	name := ownershipManifestName(provisioner, env)
+	path := filepath.Join(dir, name)
+
+	exists, err := fileExists(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f := ownershipFile{
+		Files:  m.Environments[env],
+		Shared: m.Shared[env],
+	}
+
+	if len(f.Files) == 0 && len(f.Shared) == 0 {
+		if !exists {
+			return nil, nil, nil
+		}
+		return nil, []string{name}, nil
+	}
+
+	b, err := yaml.Marshal(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to marshal ownership manifest: %w", err)
+	}
+
+	if exists {
+		prev, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read ownership manifest %s: %w", path, err)
+		}
+
+		if bytes.Equal(prev, b) {
+			return nil, nil, nil
+		}
+	}
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return nil, nil, fmt.Errorf("unable to write ownership manifest %s: %w", path, err)
+	}
+
+	return []string{name}, nil, nil
+}
+
+func fileExists(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to stat %s: %w", path, err)
+	}
+
+	return true, nil
+}
+
+func cleanPaths(files []string) []string {
+	var cleaned []string
+	for _, f := range files {
+		cleaned = append(cleaned, filepath.Clean(f))
+	}
+
+	sort.Strings(cleaned)
+
+	return cleaned
+}
+
+func containsPath(files []string, file string) bool {
+	for _, f := range files {
+		if f == file {
+			return true
+		}
+	}
+
+	return false
+}
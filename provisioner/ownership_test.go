@@ -0,0 +1,101 @@
+package provisioner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnershipManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, f := range []string{"app.1.yaml", "app.1.old.yaml", "shared.yaml", "unowned.yaml"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), []byte(f), 0644))
+	}
+
+	m, err := loadOwnershipManifest(dir, "render")
+	require.NoError(t, err)
+	require.Empty(t, m.Environments)
+
+	m.set("prenv-2", []string{"shared.yaml"}, nil)
+
+	added, deleted, err := m.save(dir, "render", "prenv-2")
+	require.NoError(t, err)
+	require.Equal(t, []string{".prenv-owned.render.prenv-2.yaml"}, added)
+	require.Empty(t, deleted)
+
+	m.set("prenv-1", []string{"./app.1.yaml", "app.1.old.yaml", "shared.yaml", "gone.yaml"}, nil)
+
+	added, deleted, err = m.save(dir, "render", "prenv-1")
+	require.NoError(t, err)
+	require.Equal(t, []string{".prenv-owned.render.prenv-1.yaml"}, added, "the files of the other environments must be left untouched")
+	require.Empty(t, deleted)
+
+	m, err = loadOwnershipManifest(dir, "render")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"prenv-1": {"app.1.old.yaml", "app.1.yaml", "gone.yaml", "shared.yaml"},
+		"prenv-2": {"shared.yaml"},
+	}, m.Environments)
+
+	// Files that are still rendered, shared with other environments, already gone, or not owned by prenv are never pruned.
+	orphans, err := m.orphans(dir, "prenv-1", []string{"app.1.yaml"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"app.1.old.yaml"}, orphans)
+
+	added, deleted, err = m.save(dir, "render", "prenv-1")
+	require.NoError(t, err)
+	require.Empty(t, added, "unchanged manifest must not be rewritten")
+	require.Empty(t, deleted)
+
+	m.remove("prenv-1")
+
+	added, deleted, err = m.save(dir, "render", "prenv-1")
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Equal(t, []string{".prenv-owned.render.prenv-1.yaml"}, deleted)
+}
+
+func TestOwnershipManifestShared(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, f := range []string{"app.1.yaml", "app.2.yaml", "app.3.yaml"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), []byte(f), 0644))
+	}
+
+	m := &ownershipManifest{
+		Environments: map[string][]string{
+			"prenv-3": {"app.3.yaml"},
+		},
+		Shared: map[string][]string{
+			"prenv-1": {"app.1.yaml", "app.2.yaml", "app.3.yaml"},
+			"prenv-2": {"app.1.yaml", "app.2.yaml"},
+		},
+	}
+
+	// Shared files survive the pruning for any single environment.
+	require.True(t, m.ownedByOthers("prenv-1", "app.1.yaml"))
+
+	// The pull request 1 has been closed, and the pull request 3 has turned its file into an environment-owned one.
+	// The record of prenv-2 is stale until its next run, but the running render is authoritative.
+	prev := m.sharedFiles()
+	m.remove("prenv-1")
+
+	orphans, err := m.sharedOrphans(dir, prev, []string{"app.2.yaml"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"app.1.yaml"}, orphans)
+
+	m.set("prenv-3", []string{"app.3.yaml"}, []string{"app.2.yaml"})
+
+	added, deleted, err := m.save(dir, "render", "prenv-3")
+	require.NoError(t, err)
+	require.Equal(t, []string{".prenv-owned.render.prenv-3.yaml"}, added, "no manifest file must be shared among the environments")
+	require.Empty(t, deleted)
+
+	m, err = loadOwnershipManifest(dir, "render")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"prenv-3": {"app.3.yaml"}}, m.Environments)
+	require.Equal(t, map[string][]string{"prenv-3": {"app.2.yaml"}}, m.Shared)
+}
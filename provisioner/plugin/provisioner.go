@@ -20,4 +20,22 @@ type Provisioner interface {
 type RenderResult struct {
 	AddedOrModifiedFiles []string
 	DeletedFiles         []string
+
+	// SharedFiles is the subset of AddedOrModifiedFiles that are rendered for all the environments,
+	// like the files rendered per open pull request via forEach,
+	// rather than for the environment being applied.
+	// They are pruned once they are no longer rendered, instead of when the environment is destroyed.
+	SharedFiles []string
+
+	// PatchedFiles is the subset of AddedOrModifiedFiles that are existing files edited in place,
+	// rather than rendered as a whole.
+	// They are not owned by the environment, and are reverted via Unrenderer instead of being deleted on destroy.
+	PatchedFiles []string
+}
+
+// Unrenderer is implemented by the provisioners that edit existing files in place on Render.
+type Unrenderer interface {
+	// Unrender reverts the edits made by Render to the files in the directory,
+	// and returns the files modified or deleted by the reversion.
+	Unrender(ctx context.Context, dir string) (*RenderResult, error)
 }
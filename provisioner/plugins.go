@@ -2,15 +2,24 @@ package provisioner
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/policy"
 	"github.com/mumoshu/prenv/provisioner/builtin"
 	"github.com/mumoshu/prenv/provisioner/plugin"
 	"github.com/mumoshu/prenv/provisioner/render"
+	"github.com/mumoshu/prenv/retry"
+	"github.com/mumoshu/prenv/secretref"
 	"github.com/mumoshu/prenv/store"
+	"github.com/sirupsen/logrus"
 )
 
 type PluginConfig struct {
@@ -20,7 +29,34 @@ type PluginConfig struct {
 
 type Plugin func(PluginConfig) []delegatableProvisioner
 
+// Plugins are run in order for each component.
+// The provisioners that create the infrastructure come first,
+// so that their outputs are available to the templates of the provisioners that deploy to it.
 var Plugins = []Plugin{
+	func(cfg PluginConfig) []delegatableProvisioner {
+		if cfg.Service.AWSResources == nil {
+			return nil
+		}
+
+		var provisioners []delegatableProvisioner
+		provisioners = append(provisioners, newDelegetableProvisioner("aws", cfg.Service.AWSResources.GitOps, &builtin.BuiltinAWSProvisioner{
+			Config: *cfg.Service.AWSResources,
+		}))
+
+		return provisioners
+	},
+	func(cfg PluginConfig) []delegatableProvisioner {
+		if cfg.Service.Terraform == nil {
+			return nil
+		}
+
+		var provisioners []delegatableProvisioner
+		provisioners = append(provisioners, newDelegetableProvisioner("terraform", &cfg.Service.Terraform.Delegate, &builtin.BuiltinTerraformProvisioner{
+			Config:    *cfg.Service.Terraform,
+			EnvParams: cfg.EnvParams,
+		}))
+		return provisioners
+	},
 	func(cfg PluginConfig) []delegatableProvisioner {
 		if cfg.Service.Render == nil {
 			return nil
@@ -34,26 +70,38 @@ var Plugins = []Plugin{
 		return provisioners
 	},
 	func(cfg PluginConfig) []delegatableProvisioner {
-		if cfg.Service.KubernetesResources == nil {
+		if cfg.Service.Kustomize == nil {
 			return nil
 		}
 
 		var provisioners []delegatableProvisioner
-		provisioners = append(provisioners, newDelegetableProvisioner("k8s", cfg.Service.KubernetesResources.Delegate, &builtin.BuiltinKubernetesProvisioner{
-			Config: *cfg.Service.KubernetesResources,
+		provisioners = append(provisioners, newDelegetableProvisioner("kustomize", &cfg.Service.Kustomize.Delegate, &builtin.BuiltinKustomizeProvisioner{
+			Config:    *cfg.Service.Kustomize,
+			EnvParams: cfg.EnvParams,
 		}))
 		return provisioners
 	},
 	func(cfg PluginConfig) []delegatableProvisioner {
-		if cfg.Service.AWSResources == nil {
+		if cfg.Service.Helm == nil {
 			return nil
 		}
 
 		var provisioners []delegatableProvisioner
-		provisioners = append(provisioners, newDelegetableProvisioner("aws", cfg.Service.AWSResources.GitOps, &builtin.BuiltinAWSProvisioner{
-			Config: *cfg.Service.AWSResources,
+		provisioners = append(provisioners, newDelegetableProvisioner("helm", &cfg.Service.Helm.Delegate, &builtin.BuiltinHelmProvisioner{
+			Config:    *cfg.Service.Helm,
+			EnvParams: cfg.EnvParams,
 		}))
+		return provisioners
+	},
+	func(cfg PluginConfig) []delegatableProvisioner {
+		if cfg.Service.KubernetesResources == nil {
+			return nil
+		}
 
+		var provisioners []delegatableProvisioner
+		provisioners = append(provisioners, newDelegetableProvisioner("k8s", cfg.Service.KubernetesResources.Delegate, &builtin.BuiltinKubernetesProvisioner{
+			Config: *cfg.Service.KubernetesResources,
+		}))
 		return provisioners
 	},
 	func(cfg PluginConfig) []delegatableProvisioner {
@@ -90,6 +138,21 @@ func newDelegetableProvisioner(name string, g *config.Delegate, p plugin.Provisi
 type delegatableProvisioner struct {
 	name string
 
+	// envArgs is the environment the provisioner is run for.
+	envArgs config.EnvArgs
+
+	// policy is the policy that the rendered files must satisfy, shared among the provisioners of the chain.
+	policy *policyChecker
+
+	// paths is the paths of the component, which the provisioner is skipped unless the pull request changes.
+	paths *config.Paths
+
+	// component is the name prefix of the component that the provisioner belongs to.
+	component string
+
+	// hooks is the hooks of the component, if any.
+	hooks *config.Hooks
+
 	triggeredViaRepositoryDispatch bool
 
 	*config.Delegate
@@ -100,32 +163,327 @@ type delegatableProvisioner struct {
 // prepare prepares the provisioner for the Apply and Destroy methods.
 // The passed store.Store that is linked to either a temporary directory or
 // the specified directory in the clone of the gitops repository.
+//
+// On destroy of a provisioner that delegates to a gitops repository,
+// the files that the environment owns are removed from the repository instead of being rendered.
 func (p *delegatableProvisioner) prepare(ctx context.Context, op string, ds store.Store) (*plugin.RenderResult, error) {
 	return ds.Transact(func(path string) (*plugin.RenderResult, error) {
-		wd, err := os.Getwd()
+		var (
+			r   *plugin.RenderResult
+			err error
+		)
+
+		if !p.delegatesToGitOps() {
+			r, err = p.render(ctx, path)
+		} else {
+			r, err = p.renderOwned(ctx, op, path)
+		}
+
 		if err != nil {
-			return nil, fmt.Errorf("getwd: %w", err)
+			return nil, err
 		}
 
-		defer func() {
-			if err := os.Chdir(wd); err != nil {
-				panic(err)
+		if op != "destroy" {
+			if err := p.checkPolicy(ctx, path, r); err != nil {
+				return nil, fmt.Errorf("%s: %w", p.name, err)
 			}
-		}()
+		}
+
+		return r, nil
+	})
+}
 
-		// Render wants the current working directory to be the directory that the provisioner
-		// should render the configuration to.
-		if err := os.Chdir(path); err != nil {
-			return nil, fmt.Errorf("chdir to %s: %w", path, err)
+// checkPolicy checks the files rendered to the directory at path against the policy,
+// so that nothing violating it is committed or applied.
+func (p *delegatableProvisioner) checkPolicy(ctx context.Context, path string, r *plugin.RenderResult) error {
+	if p.policy == nil {
+		return nil
+	}
+
+	c, err := p.policy.get()
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	return c.Check(ctx, path, r.AddedOrModifiedFiles)
+}
+
+// policyChecker is the policy.Checker shared among all the provisioners of the chain,
+// so that the policy files are read and compiled only once per run, rather than on every render.
+//
+// The checker is built on the first use, because the policy files are in the repository of the run that renders the files,
+// which is not the one that delegates the rendering via repository_dispatch.
+type policyChecker struct {
+	policy *config.Policy
+	files  []string
+
+	once    sync.Once
+	checker *policy.Checker
+	err     error
+}
+
+// newPolicyChecker returns the policyChecker for the policy in the config, if any,
+// and the policy files given via PRENV_POLICY_FILES.
+func newPolicyChecker(p *config.Policy) *policyChecker {
+	var files []string
+	for _, f := range strings.Split(os.Getenv(envvar.PolicyFiles), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, f)
+		}
+	}
+
+	return &policyChecker{
+		policy: p,
+		files:  files,
+	}
+}
+
+// get returns the policy.Checker, or nil if there is no policy to check against.
+func (c *policyChecker) get() (*policy.Checker, error) {
+	c.once.Do(func() {
+		if c.policy == nil && len(c.files) == 0 {
+			return
+		}
+
+		var cfg config.Policy
+		if c.policy != nil {
+			cfg = *c.policy
+		}
+
+		c.checker, c.err = policy.New(cfg, c.files...)
+	})
+
+	return c.checker, c.err
+}
+
+// renderOwned renders or deletes the files in the gitops directory at path,
+// keeping track of the files that each environment owns in the ownership manifest of the provisioner.
+//
+// On apply, the files that the environment rendered previously but no longer renders,
+// like the ones left behind by renaming an entry in files or changing a nameTemplate, are pruned.
+// The files shared among all the environments, like the ones rendered per pull request via forEach,
+// are pruned on both apply and destroy once they are no longer rendered, like when the pull request is closed.
+func (p *delegatableProvisioner) renderOwned(ctx context.Context, op string, path string) (*plugin.RenderResult, error) {
+	m, err := loadOwnershipManifest(path, p.name)
+	if err != nil {
+		return nil, err
+	}
+
+	env := p.envArgs.Name
+
+	var r *plugin.RenderResult
+
+	if op == "destroy" {
+		r, err = p.renderDeletions(ctx, path, m)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r, err = p.render(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prevShared := m.sharedFiles()
+	shared := cleanPaths(r.SharedFiles)
+
+	if op == "destroy" {
+		m.remove(env)
+	} else {
+		var owned []string
+		for _, f := range r.AddedOrModifiedFiles {
+			if !containsPath(shared, filepath.Clean(f)) && !containsPath(cleanPaths(r.PatchedFiles), filepath.Clean(f)) {
+				owned = append(owned, f)
+			}
 		}
 
-		r, err := p.Provisioner.Render(ctx, ".")
+		orphans, err := m.orphans(path, env, append(append([]string{}, owned...), shared...))
 		if err != nil {
-			return nil, fmt.Errorf("render: %w", err)
+			return nil, err
 		}
 
+		r.DeletedFiles = append(r.DeletedFiles, orphans...)
+
+		m.set(env, owned, shared)
+	}
+
+	sharedOrphans, err := m.sharedOrphans(path, prevShared, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	r.DeletedFiles = append(r.DeletedFiles, sharedOrphans...)
+
+	added, deleted, err := m.save(path, p.name, env)
+	if err != nil {
+		return nil, err
+	}
+
+	r.AddedOrModifiedFiles = append(r.AddedOrModifiedFiles, added...)
+	r.DeletedFiles = append(r.DeletedFiles, deleted...)
+
+	return r, nil
+}
+
+// render renders the provisioner's configuration to the directory at path.
+func (p *delegatableProvisioner) render(ctx context.Context, path string) (*plugin.RenderResult, error) {
+	var r *plugin.RenderResult
+
+	if err := inDir(path, func() (err error) {
+		r, err = p.Provisioner.Render(ctx, ".")
+		if err != nil {
+			return fmt.Errorf("render: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// unrender reverts the edits that the provisioner made to the existing files in the directory at path,
+// if the provisioner edits files in place.
+func (p *delegatableProvisioner) unrender(ctx context.Context, path string) (*plugin.RenderResult, error) {
+	r := &plugin.RenderResult{}
+
+	u, ok := p.Provisioner.(plugin.Unrenderer)
+	if !ok {
 		return r, nil
-	})
+	}
+
+	if err := inDir(path, func() (err error) {
+		r, err = u.Unrender(ctx, ".")
+		if err != nil {
+			return fmt.Errorf("unrender: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// inDir runs fn with the current working directory set to path,
+// because the provisioners want the current working directory to be the directory that they should render the configuration to.
+func inDir(path string, fn func() error) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("getwd: %w", err)
+	}
+
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			panic(err)
+		}
+	}()
+
+	if err := os.Chdir(path); err != nil {
+		return fmt.Errorf("chdir to %s: %w", path, err)
+	}
+
+	return fn()
+}
+
+// renderDeletions computes the files that the environment owns in the directory at path,
+// and returns them as the deleted files so that the store removes them from the gitops repository.
+//
+// The files are the ones recorded in the ownership manifest for the environment.
+// If the manifest has no record for the environment, like when the files were rendered by an older prenv,
+// they are computed by rendering the configuration to a temporary directory,
+// so that the same templates used on apply, like app.{{ .PullRequest.Number }}.yaml, determine the files to delete.
+// Files that are owned by other environments, or do not exist in the directory
+// because they have never been applied or have already been deleted, are omitted from the result.
+//
+// The files shared among all the environments are re-rendered to the directory instead,
+// so that they reflect the environment being gone.
+// The existing files edited in place via patch are reverted instead of being deleted.
+func (p *delegatableProvisioner) renderDeletions(ctx context.Context, path string, m *ownershipManifest) (*plugin.RenderResult, error) {
+	env := p.envArgs.Name
+
+	tmp, err := os.MkdirTemp("", "prenvdestroy")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	rendered, err := p.render(ctx, tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := p.unrender(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range rendered.SharedFiles {
+		b, err := os.ReadFile(filepath.Join(tmp, f))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read rendered file %s: %w", f, err)
+		}
+
+		dst := filepath.Join(path, f)
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, fmt.Errorf("unable to create directory for %s: %w", f, err)
+		}
+
+		if err := os.WriteFile(dst, b, 0644); err != nil {
+			return nil, fmt.Errorf("unable to write %s: %w", f, err)
+		}
+
+		r.AddedOrModifiedFiles = append(r.AddedOrModifiedFiles, f)
+		r.SharedFiles = append(r.SharedFiles, f)
+	}
+
+	notOwned := cleanPaths(append(append([]string{}, rendered.SharedFiles...), rendered.PatchedFiles...))
+
+	owned, ok := m.Environments[env]
+	if !ok {
+		for _, f := range rendered.AddedOrModifiedFiles {
+			if !containsPath(notOwned, filepath.Clean(f)) {
+				owned = append(owned, f)
+			}
+		}
+	}
+
+	for _, f := range owned {
+		if m.ownedByOthers(env, f) || containsPath(notOwned, filepath.Clean(f)) {
+			continue
+		}
+
+		exists, err := fileExists(filepath.Join(path, f))
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			r.DeletedFiles = append(r.DeletedFiles, f)
+		}
+	}
+
+	return r, nil
+}
+
+// delegatesToGitOps returns true if the provisioner updates the gitops repository
+// via git commits or pull requests, instead of running provider-specific commands locally.
+func (p *delegatableProvisioner) delegatesToGitOps() bool {
+	return p.Delegate != nil && (p.Delegate.Git != nil || p.Delegate.PullRequest != nil)
+}
+
+// dispatches returns true if the provisioner is delegated to the run triggered via repository_dispatch,
+// instead of being applied by this run.
+// We have to prevent infinite loop of the repository_dispatch events,
+// and that's why we check if the current run is triggered by a repository_dispatch event.
+func (p *delegatableProvisioner) dispatches() bool {
+	return p.Delegate != nil && p.Delegate.RepositoryDispatch != nil && !p.triggeredViaRepositoryDispatch
 }
 
 func (p *delegatableProvisioner) Apply(ctx context.Context) (*Result, error) {
@@ -145,32 +503,102 @@ func (p *delegatableProvisioner) run(ctx context.Context, op string, fn func(*pl
 
 	var renderRes *plugin.RenderResult
 
-	if p.Delegate != nil {
-		// We have to prevent infinite loop of the repository_dispatch events,
-		// and that's why we check if the current run is triggered by a repository_dispatch event.
-		if p.Delegate.RepositoryDispatch != nil && !p.triggeredViaRepositoryDispatch {
-			repositoryDispatches = append(repositoryDispatches, p.Delegate.RepositoryDispatch)
+	if p.dispatches() {
+		repositoryDispatches = append(repositoryDispatches, p.Delegate.RepositoryDispatch)
+
+		return &Result{
+			RepositoryDispatches: repositoryDispatches,
+		}, nil
+	}
+
+	// Secret references are resolved only here, in the run that renders or applies the provisioner,
+	// so that they are never sent over repository_dispatch.
+	// The resolved copy of the provisioner is used only for this run, leaving the configuration untouched.
+	resolved, err := secretref.ResolveAll(ctx, p.Provisioner)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.name, err)
+	}
+
+	defer func(orig plugin.Provisioner) {
+		p.Provisioner = orig
+	}(p.Provisioner)
 
-			return &Result{
-				RepositoryDispatches: repositoryDispatches,
-			}, nil
+	p.Provisioner = resolved.(plugin.Provisioner)
+
+	if p.Delegate != nil && p.Delegate.PullRequest != nil {
+		if err := p.Delegate.PullRequest.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", p.name, err)
 		}
 	}
 
-	ds := store.Init(p.name, time.Now(), p.Delegate)
+	ds := store.Init(p.name, p.envArgs, op, p.Delegate)
 
-	r, err := p.prepare(ctx, op, ds)
-	if err != nil {
-		return nil, err
+	var closed bool
+
+	if pr, ok := ds.(*store.PullRequest); ok && op == "destroy" && pr.ClosesOnDestroy() {
+		closed, err = pr.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// The closed pull request might be only the latest update of the environment,
+		// while the earlier ones, like the auto-merged first apply, have already put its files on the base branch.
+		// So we proceed to render the removal from the base branch anyway.
 	}
 
-	renderRes = r
+	// A push can be rejected when someone else pushed to the same branch after we cloned it.
+	// In that case the store is reset to the remote branch, and we re-render and re-commit
+	// on top of it, backing off so that the concurrent runs do not keep colliding on the branch.
+	// Only the rejected push is retried here, as the other errors have already been retried by the store.
+	commitPolicy := retry.DefaultPolicy
+	commitPolicy.Classify = func(err error) (bool, time.Duration) {
+		return errors.Is(err, store.ErrNonFastForward), 0
+	}
+
+	var done bool
+
+	err = commitPolicy.Do(ctx, fmt.Sprintf("%s: commit to the gitops repository", p.name), func() error {
+		r, err := p.prepare(ctx, op, ds)
+		if err != nil {
+			return err
+		}
+
+		renderRes = r
 
-	if err := ds.Commit(ctx, "automated commit", "n/a"); err != nil {
+		// There is nothing to commit when the files have already been deleted from the gitops repository.
+		if op == "destroy" && p.delegatesToGitOps() && len(r.DeletedFiles) == 0 && len(r.AddedOrModifiedFiles) == 0 {
+			logrus.Infof("%s: no files to delete from the gitops repository", p.name)
+			done = true
+			return nil
+		}
+
+		// Closing the open pull request was enough when the base branch holds nothing of the environment,
+		// like when the environment has never been merged.
+		// The re-rendered shared files are reported as modified even when they are unchanged, hence the check of the worktree.
+		if closed {
+			changed, err := ds.(*store.PullRequest).Git.HasChanges()
+			if err != nil {
+				return err
+			}
+
+			if !changed {
+				logrus.Infof("%s: closed the gitops pull request, and nothing of the environment is left on the base branch", p.name)
+				done = true
+				return nil
+			}
+		}
+
+		return ds.Commit(ctx, "automated commit", "n/a")
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if p.Delegate != nil && (p.Delegate.Git != nil || p.Delegate.PullRequest != nil) {
+	if done {
+		return &Result{}, nil
+	}
+
+	if p.delegatesToGitOps() {
 		return &Result{}, nil
 	}
 
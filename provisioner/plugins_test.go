@@ -0,0 +1,180 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/provisioner/render"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGitHub serves the pull request API of owner/repo, just enough for the gitops pull requests.
+type fakeGitHub struct {
+	pulls []*fakePull
+}
+
+type fakePull struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	State  string `json:"state"`
+	Head   struct {
+		Ref string `json:"ref"`
+	} `json:"head"`
+}
+
+func (g *fakeGitHub) open() []*fakePull {
+	var open []*fakePull
+	for _, p := range g.pulls {
+		if p.State == "open" {
+			open = append(open, p)
+		}
+	}
+	return open
+}
+
+func (g *fakeGitHub) serve(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/pulls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			require.NoError(t, json.NewEncoder(w).Encode(g.open()))
+		case http.MethodPost:
+			var req struct {
+				Title string `json:"title"`
+				Head  string `json:"head"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			p := &fakePull{Number: len(g.pulls) + 1, Title: req.Title, State: "open"}
+			p.Head.Ref = strings.TrimPrefix(req.Head, "refs/heads/")
+			g.pulls = append(g.pulls, p)
+			w.WriteHeader(http.StatusCreated)
+			require.NoError(t, json.NewEncoder(w).Encode(p))
+		}
+	})
+	mux.HandleFunc("/repos/owner/repo/pulls/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPatch, r.Method)
+		var req struct {
+			State *string `json:"state"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		for _, p := range g.pulls {
+			if r.URL.Path == "/repos/owner/repo/pulls/"+strconv.Itoa(p.Number) {
+				if req.State != nil {
+					p.State = *req.State
+				}
+				require.NoError(t, json.NewEncoder(w).Encode(p))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/repos/owner/repo/git/refs/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodDelete, r.Method)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestDestroyRemovesMergedFilesAfterClosingPullRequest(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	baseDir := t.TempDir()
+	require.NoError(t, os.Chdir(baseDir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	remoteDir := filepath.Join(baseDir, "owner", "repo.git")
+	seedDir := filepath.Join(baseDir, "seed")
+
+	gitCmd(t, baseDir, "init", "--bare", "--initial-branch=main", remoteDir)
+	gitCmd(t, baseDir, "clone", remoteDir, seedDir)
+	require.NoError(t, os.WriteFile(filepath.Join(seedDir, "README"), []byte("seed"), 0644))
+	gitCmd(t, seedDir, "add", ".")
+	gitCmd(t, seedDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "initial commit")
+	gitCmd(t, seedDir, "push", "origin", "HEAD:main")
+
+	gh := &fakeGitHub{}
+
+	t.Setenv(envvar.GitHubBaseURL, gh.serve(t).URL+"/")
+	t.Setenv(envvar.GitRoot, filepath.Join(baseDir, "gitroot"))
+
+	newProvisioner := func(env string, pullRequest bool) *delegatableProvisioner {
+		args := config.EnvArgs{Name: env}
+
+		delegate := config.Delegate{
+			Git: &config.Git{Repo: "file://" + remoteDir, Branch: "main", Push: true},
+		}
+		if pullRequest {
+			delegate.PullRequest = &config.PullRequest{}
+		}
+
+		p := newDelegetableProvisioner("render", &delegate, &render.Provisioner{
+			Config: config.Render{
+				Files: []config.RenderedFile{
+					{NameTemplate: "app.{{ .Name }}.yaml", ContentTemplate: "name: {{ .Name }}\n"},
+				},
+			},
+			EnvParams: args,
+		})
+		p.envArgs = args
+
+		return &p
+	}
+
+	ctx := context.Background()
+
+	// The first apply of prenv-1 has been merged, and the second one is still open.
+	_, err = newProvisioner("prenv-1", false).Apply(ctx)
+	require.NoError(t, err)
+	_, err = newProvisioner("prenv-1", true).Apply(ctx)
+	require.NoError(t, err)
+	require.Len(t, gh.open(), 1)
+
+	_, err = newProvisioner("prenv-1", true).Destroy(ctx)
+	require.NoError(t, err)
+
+	require.Equal(t, "closed", gh.pulls[0].State)
+	require.Len(t, gh.open(), 1, "a removal pull request must be opened for the files merged into the base branch")
+
+	files := gitCmd(t, baseDir, "--git-dir", remoteDir, "ls-tree", "--name-only", "prenv/prenv-1/render")
+	require.NotContains(t, files, "app.prenv-1.yaml")
+
+	// prenv-2 has never been merged, so closing its pull request is enough.
+	_, err = newProvisioner("prenv-2", true).Apply(ctx)
+	require.NoError(t, err)
+	require.Len(t, gh.open(), 2)
+
+	_, err = newProvisioner("prenv-2", true).Destroy(ctx)
+	require.NoError(t, err)
+
+	require.Equal(t, "closed", gh.pulls[2].State)
+	require.Len(t, gh.open(), 1)
+}
+
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	return strings.TrimSpace(string(out))
+}
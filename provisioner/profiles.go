@@ -0,0 +1,187 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mumoshu/prenv/ghactions"
+	"github.com/mumoshu/prenv/state"
+	"github.com/sirupsen/logrus"
+)
+
+// Chains is the chains of all the environments generated for the inputs, like a pull request.
+//
+// There is one environment per profile selected for the pull request when prenv.yaml defines profiles,
+// or the only environment of the pull request otherwise.
+// There can be none when the generator generates no environment, like for a branch that matches no globs.
+type Chains struct {
+	// action is either "prenv-apply" or "prenv-destroy".
+	action string
+
+	// chains is the chains of the environments of the selected profiles.
+	chains []*Chain
+
+	// deselected is the chains of the environments of the profiles that have been applied but are no longer selected,
+	// like after the label of the pull request is changed. They are destroyed on apply.
+	deselected []*Chain
+}
+
+func ChainsFromEnv(opts Options) (*Chains, error) {
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewChains(cfg)
+}
+
+// NewChains returns the chains of the environments of the pull request.
+//
+// The profiles are the ones requested via cfg.RequestedProfiles if any, or the ones selected by the labels of the pull request.
+// Only when they are selected by the labels, the environments of the other profiles are destroyed on apply,
+// so that requesting a profile via the command deploys it in addition to the others.
+func NewChains(cfg *Config) (*Chains, error) {
+	ctx := context.Background()
+
+	// The delegated runs get the args of a single environment, including the profile.
+	if cfg.EnvArgs != nil {
+		c, err := NewChain(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Chains{action: cfg.Action, chains: []*Chain{c}}, nil
+	}
+
+	gen := cfg.generator()
+
+	base, err := gen.Generate(*cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	if base == nil {
+		return &Chains{action: cfg.Action}, nil
+	}
+
+	if len(cfg.Profiles) == 0 {
+		c, err := newChain(cfg, base, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Chains{action: cfg.Action, chains: []*Chain{c}}, nil
+	}
+
+	// Only the pull requests have labels. The other environments get the requested or the default profiles.
+	var labels []string
+	if base.PullRequest != nil {
+		labels = base.PullRequest.Labels
+	}
+
+	selected := cfg.RequestedProfiles
+	if len(selected) == 0 {
+		selected = cfg.SelectProfiles(labels)
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range selected {
+		if _, ok := cfg.Profiles[name]; !ok {
+			return nil, fmt.Errorf("profile %q is not defined", name)
+		}
+
+		wanted[name] = true
+	}
+
+	if len(selected) == 0 {
+		logrus.Infof("No profile is selected for %s", base.Name)
+	}
+
+	store := state.NewStore(*cfg.Config)
+
+	chains := &Chains{action: cfg.Action}
+
+	for _, name := range cfg.ProfileNames() {
+		args := *base
+		args.Profile = name
+
+		args.Name, err = gen.Name(*cfg.Config, &args)
+		if err != nil {
+			return nil, err
+		}
+
+		if !wanted[name] {
+			if len(cfg.RequestedProfiles) > 0 {
+				continue
+			}
+
+			applied, err := store.GetApplied(ctx, args.Name)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get applied provisioners: %w", err)
+			}
+
+			if len(applied) == 0 {
+				continue
+			}
+		}
+
+		// Each chain gets its own copy of the config, as NewChain modifies it for the environment.
+		c := *cfg
+		conf := cfg.Config.DeepCopy()
+		c.Config = &conf
+
+		chain, err := newChain(&c, &args, false)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+
+		if wanted[name] {
+			chains.chains = append(chains.chains, chain)
+		} else {
+			chains.deselected = append(chains.deselected, chain)
+		}
+	}
+
+	return chains, nil
+}
+
+// Apply destroys the environments of the deselected profiles, and then creates and updates the environments of the selected ones.
+func (c *Chains) Apply(ctx context.Context) error {
+	for _, d := range c.deselected {
+		logrus.Infof("Destroying %s because its profile is no longer selected", d.cfg.EnvArgs.Name)
+
+		if err := d.Destroy(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, chain := range c.chains {
+		if err := chain.Apply(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Destroy deletes all the environments of the pull request.
+func (c *Chains) Destroy(ctx context.Context) error {
+	for _, chain := range append(append([]*Chain{}, c.chains...), c.deselected...) {
+		if err := chain.Destroy(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Chains) Action(ctx context.Context) error {
+	switch c.action {
+	case ghactions.EventTypeApply:
+		return c.Apply(ctx)
+	case ghactions.EventTypeDestroy:
+		return c.Destroy(ctx)
+	}
+
+	return fmt.Errorf("unknown action: %s", c.action)
+}
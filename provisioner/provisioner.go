@@ -2,7 +2,7 @@
 // and AWS resources.
 // There are two types of provisioners:
 // - Kubectl provisioner which writes Kubernetes manifests to a store and then runs kubectl apply
-// - Tfvars provisioner which writes a .auto.tfvars file to a store and then runs terraform apply
+// - Terraform provisioner which writes a .tfvars.json file to a store and then runs terraform apply in a workspace per environment
 package provisioner
 
 import (
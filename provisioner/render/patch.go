@@ -0,0 +1,175 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/patch"
+	"github.com/mumoshu/prenv/render"
+)
+
+// patchFile applies the patch of the entry in files to the existing file in dir, or reverts it when revert is true.
+// It returns the name of the file relative to dir, and whether the file should be deleted because the reversion left it empty.
+// On revert, the name is empty when there is nothing to revert.
+func (p *Provisioner) patchFile(dir string, f config.RenderedFile, revert bool) (string, bool, error) {
+	exec := func(name, text string) (string, error) {
+		return render.ExecuteString(p.Config.Engine, name, text, p.EnvParams)
+	}
+
+	name := f.Name
+	if f.NameTemplate != "" {
+		n, err := exec("name", f.NameTemplate)
+		if err != nil {
+			return "", false, err
+		}
+		name = n
+	}
+
+	path := filepath.Join(dir, name)
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", false, fmt.Errorf("unable to read %s: %w", name, err)
+	}
+
+	if revert && os.IsNotExist(err) {
+		return "", false, nil
+	}
+
+	doc, err := patch.Parse(name, content)
+	if err != nil {
+		return "", false, err
+	}
+
+	if err := p.editDocument(doc, f.Patch, exec, revert); err != nil {
+		return "", false, fmt.Errorf("unable to patch %s: %w", name, err)
+	}
+
+	if revert && doc.IsEmpty() {
+		return name, true, nil
+	}
+
+	b, err := doc.Bytes()
+	if err != nil {
+		return "", false, fmt.Errorf("unable to encode %s: %w", name, err)
+	}
+
+	if revert && bytes.Equal(b, content) {
+		return "", false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", false, err
+	}
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return "", false, fmt.Errorf("unable to write %s: %w", name, err)
+	}
+
+	return name, false, nil
+}
+
+// editDocument applies the edits in the patch to the document in order, or reverts them when revert is true.
+func (p *Provisioner) editDocument(doc *patch.Document, pt *config.Patch, exec func(name, text string) (string, error), revert bool) error {
+	if pt.MergePatch != "" {
+		mp, err := exec("mergePatch", pt.MergePatch)
+		if err != nil {
+			return err
+		}
+
+		if revert {
+			err = doc.UnmergePatch([]byte(mp))
+		} else {
+			err = doc.MergePatch([]byte(mp))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range pt.Set {
+		path, err := exec("path", s.Path)
+		if err != nil {
+			return err
+		}
+
+		if revert {
+			err = doc.Delete(path)
+		} else {
+			var value string
+
+			value, err = exec("value", s.Value)
+			if err != nil {
+				return err
+			}
+
+			err = doc.Set(path, []byte(value))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !revert {
+		for _, d := range pt.Delete {
+			path, err := exec("path", d)
+			if err != nil {
+				return err
+			}
+
+			if err := doc.Delete(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if k := pt.Kustomize; k != nil {
+		for _, img := range k.Images {
+			var (
+				v   [4]string
+				err error
+			)
+
+			for i, t := range []string{img.Name, img.NewName, img.NewTag, img.Digest} {
+				v[i], err = exec("image", t)
+				if err != nil {
+					return err
+				}
+			}
+
+			if revert {
+				err = doc.RemoveKustomizeImage(v[0])
+			} else {
+				err = doc.SetKustomizeImage(v[0], v[1], v[2], v[3])
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, res := range k.Resources {
+			r, err := exec("resource", res)
+			if err != nil {
+				return err
+			}
+
+			if revert {
+				err = doc.RemoveKustomizeResource(r)
+			} else {
+				err = doc.AddKustomizeResource(r)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
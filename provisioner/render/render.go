@@ -1,9 +1,12 @@
 package render
 
 import (
-	"bytes"
 	"context"
-	"html/template"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/mumoshu/prenv/config"
 	"github.com/mumoshu/prenv/provisioner/plugin"
@@ -15,31 +18,56 @@ type Provisioner struct {
 	EnvParams config.EnvArgs
 }
 
+// ForEachData is the template data for the files rendered per item via forEach.
+type ForEachData struct {
+	config.EnvArgs
+
+	// Item is the current item in the list.
+	Item interface{}
+	// Index is the index of the Item in the list.
+	Index int
+}
+
 func (p *Provisioner) Render(ctx context.Context, dir string) (*plugin.RenderResult, error) {
-	var ts []render.Template
+	if err := p.Config.Validate(); err != nil {
+		return nil, err
+	}
+
+	partials := p.partials()
+
+	var (
+		ts      []render.Template
+		shared  []string
+		patches []config.RenderedFile
+	)
 
 	for _, r := range p.Config.Files {
-		name := r.Name
-		if r.NameTemplate != "" {
-			tmpl, err := template.New("name").Parse(r.NameTemplate)
+		if r.Patch != nil {
+			patches = append(patches, r)
+			continue
+		}
+
+		if r.ForEach == "" {
+			files, err := p.templates(r, partials, p.EnvParams)
 			if err != nil {
 				return nil, err
 			}
 
-			var buf bytes.Buffer
-			if err := tmpl.Execute(&buf, p.EnvParams); err != nil {
-				return nil, err
-			}
-			name = buf.String()
+			ts = append(ts, files...)
+
+			continue
 		}
 
-		t := render.Template{
-			Name: name,
-			Body: r.ContentTemplate,
-			Data: p.EnvParams,
+		files, err := p.forEachTemplates(r, partials)
+		if err != nil {
+			return nil, err
 		}
 
-		ts = append(ts, t)
+		ts = append(ts, files...)
+
+		for _, f := range files {
+			shared = append(shared, f.Name)
+		}
 	}
 
 	r, err := render.ToDir(dir, ts...)
@@ -47,11 +75,197 @@ func (p *Provisioner) Render(ctx context.Context, dir string) (*plugin.RenderRes
 		return nil, err
 	}
 
+	var patched []string
+
+	for _, f := range patches {
+		name, _, err := p.patchFile(dir, f, false)
+		if err != nil {
+			return nil, err
+		}
+
+		patched = append(patched, name)
+	}
+
 	return &plugin.RenderResult{
-		AddedOrModifiedFiles: r,
+		AddedOrModifiedFiles: append(r, patched...),
+		SharedFiles:          shared,
+		PatchedFiles:         patched,
 	}, nil
 }
 
+// Unrender reverts the edits made to the existing files via patch.
+// The files left empty by the reversion are returned as the deleted files.
+func (p *Provisioner) Unrender(ctx context.Context, dir string) (*plugin.RenderResult, error) {
+	if err := p.Config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var r plugin.RenderResult
+
+	for _, f := range p.Config.Files {
+		if f.Patch == nil {
+			continue
+		}
+
+		name, empty, err := p.patchFile(dir, f, true)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case name == "":
+		case empty:
+			r.DeletedFiles = append(r.DeletedFiles, name)
+		default:
+			r.AddedOrModifiedFiles = append(r.AddedOrModifiedFiles, name)
+			r.PatchedFiles = append(r.PatchedFiles, name)
+		}
+	}
+
+	return &r, nil
+}
+
+// forEachTemplates returns the templates of the files to be rendered per item in the forEach list.
+func (p *Provisioner) forEachTemplates(r config.RenderedFile, partials []string) ([]render.Template, error) {
+	pipeline := r.ForEach
+	if pipeline == config.ForEachPullRequests {
+		pipeline = ".PullRequest.Numbers"
+	}
+
+	items, err := render.EvaluateList(pipeline, p.EnvParams)
+	if err != nil {
+		return nil, fmt.Errorf("forEach: %w", err)
+	}
+
+	var (
+		ts    []render.Template
+		names = map[string]bool{}
+	)
+
+	for i, item := range items {
+		files, err := p.templates(r, partials, ForEachData{
+			EnvArgs: p.EnvParams,
+			Item:    item,
+			Index:   i,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			if names[f.Name] {
+				return nil, fmt.Errorf("forEach renders multiple items to %s: the name must include .Item", f.Name)
+			}
+			names[f.Name] = true
+		}
+
+		ts = append(ts, files...)
+	}
+
+	return ts, nil
+}
+
+// templates returns the templates of the files to be rendered for the entry in files.
+func (p *Provisioner) templates(r config.RenderedFile, partials []string, data interface{}) ([]render.Template, error) {
+	name := r.Name
+	if r.NameTemplate != "" {
+		n, err := render.ExecuteString(p.Config.Engine, "name", r.NameTemplate, data)
+		if err != nil {
+			return nil, err
+		}
+		name = n
+	}
+
+	newTemplate := func(name, body string) render.Template {
+		return render.Template{
+			Name:     name,
+			Body:     body,
+			Data:     data,
+			Engine:   p.Config.Engine,
+			Partials: partials,
+		}
+	}
+
+	switch {
+	case r.TemplateFile != "":
+		body, ok := p.Config.Sources[sourceKey(r.TemplateFile)]
+		if !ok {
+			return nil, fmt.Errorf("template file %s is not loaded: it must exist relative to the directory containing prenv.yaml", r.TemplateFile)
+		}
+
+		if name == "" {
+			name = path.Base(sourceKey(r.TemplateFile))
+		}
+
+		return []render.Template{newTemplate(name, body)}, nil
+	case r.TemplateDir != "":
+		prefix := sourceKey(r.TemplateDir) + "/"
+
+		var keys []string
+		for k := range p.Config.Sources {
+			if strings.HasPrefix(k, prefix) && !isPartial(k) {
+				keys = append(keys, k)
+			}
+		}
+
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("template dir %s has no templates: it must exist relative to the directory containing prenv.yaml", r.TemplateDir)
+		}
+
+		sort.Strings(keys)
+
+		var ts []render.Template
+
+		for _, k := range keys {
+			// Each path segment can be a template like {{ .PullRequest.Number }}/app.yaml.
+			rel, err := render.ExecuteString(p.Config.Engine, "path", strings.TrimPrefix(k, prefix), data)
+			if err != nil {
+				return nil, fmt.Errorf("unable to render path of %s: %w", k, err)
+			}
+
+			ts = append(ts, newTemplate(filepath.Join(name, filepath.FromSlash(rel)), p.Config.Sources[k]))
+		}
+
+		return ts, nil
+	}
+
+	return []render.Template{newTemplate(name, r.ContentTemplate)}, nil
+}
+
+// partials returns the partials available to all the files,
+// which are the files listed in partials and the files whose names start with "_" in the template dirs.
+func (p *Provisioner) partials() []string {
+	listed := map[string]bool{}
+	for _, f := range p.Config.Partials {
+		listed[sourceKey(f)] = true
+	}
+
+	var keys []string
+	for k := range p.Config.Sources {
+		if listed[k] || isPartial(k) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	var partials []string
+	for _, k := range keys {
+		partials = append(partials, p.Config.Sources[k])
+	}
+
+	return partials
+}
+
+// sourceKey returns the key of the template file in config.Render.Sources.
+func sourceKey(p string) string {
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+func isPartial(key string) bool {
+	return strings.HasPrefix(path.Base(key), "_")
+}
+
 func (p *Provisioner) Apply(ctx context.Context, r *plugin.RenderResult) (*plugin.Result, error) {
 	return &plugin.Result{}, nil
 }
@@ -0,0 +1,235 @@
+package render
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRenderTemplateFilesAndDirs(t *testing.T) {
+	srcDir := t.TempDir()
+
+	writeFile := func(name, content string) {
+		t.Helper()
+
+		p := filepath.Join(srcDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+
+	writeFile("deploy/app.yaml", `name: {{ template "appName" . }}`+"\n")
+	writeFile("deploy/kustomize/_helpers.tpl", `{{ define "appName" }}app-{{ .PullRequest.Number }}{{ end }}`)
+	writeFile("deploy/kustomize/kustomization.yaml", "namePrefix: {{ template \"appName\" . }}-\n")
+	writeFile("deploy/kustomize/{{ .PullRequest.Number }}/patch.yaml", "tag: {{ .PullRequest.HeadSHA | quote }}\n")
+	writeFile("deploy/partials/labels.tpl", `{{ define "labels" }}pr: "{{ .PullRequest.Number }}"{{ end }}`)
+	writeFile("deploy/labels.yaml", `{{ template "labels" . }}`+"\n")
+
+	r := config.Render{
+		Files: []config.RenderedFile{
+			{TemplateFile: "deploy/app.yaml"},
+			{NameTemplate: "labels.{{ .PullRequest.Number }}.yaml", TemplateFile: "./deploy/labels.yaml"},
+			{Name: "overlays", TemplateDir: "deploy/kustomize"},
+		},
+		Partials: []string{"deploy/partials/labels.tpl"},
+	}
+
+	require.NoError(t, r.LoadSources(srcDir))
+
+	// The templates must travel in the raw_config so that the target repository
+	// can render them without the source repository.
+	rawConfig, err := yaml.Marshal(r)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(srcDir))
+
+	var received config.Render
+	require.NoError(t, yaml.UnmarshalStrict(rawConfig, &received))
+
+	p := &Provisioner{
+		Config: received,
+		EnvParams: config.EnvArgs{
+			PullRequest: &config.PullRequestEnvArgs{
+				Number:  123,
+				HeadSHA: "0123abc",
+			},
+		},
+	}
+
+	outDir := t.TempDir()
+
+	res, err := p.Render(context.Background(), outDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"app.yaml",
+		"labels.123.yaml",
+		"overlays/kustomization.yaml",
+		"overlays/123/patch.yaml",
+	}, res.AddedOrModifiedFiles)
+
+	want := map[string]string{
+		"app.yaml":                    "name: app-123\n",
+		"labels.123.yaml":             "pr: \"123\"\n",
+		"overlays/123/patch.yaml":     "tag: \"0123abc\"\n",
+		"overlays/kustomization.yaml": "namePrefix: app-123-\n",
+	}
+
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(outDir, name))
+		require.NoError(t, err)
+		require.Equal(t, content, string(got), name)
+	}
+}
+
+func TestRenderMissingTemplateFile(t *testing.T) {
+	p := &Provisioner{
+		Config: config.Render{
+			Files: []config.RenderedFile{
+				{TemplateFile: "deploy/missing.yaml"},
+			},
+		},
+		EnvParams: config.EnvArgs{},
+	}
+
+	_, err := p.Render(context.Background(), t.TempDir())
+	require.ErrorContains(t, err, "template file deploy/missing.yaml is not loaded")
+}
+
+func TestRenderForEach(t *testing.T) {
+	p := &Provisioner{
+		Config: config.Render{
+			Files: []config.RenderedFile{
+				{
+					ForEach:         config.ForEachPullRequests,
+					NameTemplate:    "apps/app.{{ .Item }}.yaml",
+					ContentTemplate: "name: app-{{ .Item }}\nindex: {{ .Index }}\nenv: {{ .Name }}\n",
+				},
+				{
+					ForEach:         `list "a" "b"`,
+					NameTemplate:    "{{ .Item }}.txt",
+					ContentTemplate: "{{ .Item }}",
+				},
+				{
+					Name:            "numbers.json",
+					ContentTemplate: "{{ .PullRequest.Numbers | toJson }}",
+				},
+			},
+		},
+		EnvParams: config.EnvArgs{
+			Name: "prenv-1",
+			PullRequest: &config.PullRequestEnvArgs{
+				Number:  1,
+				Numbers: []int{1, 2},
+			},
+		},
+	}
+
+	outDir := t.TempDir()
+
+	res, err := p.Render(context.Background(), outDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"apps/app.1.yaml", "apps/app.2.yaml", "a.txt", "b.txt", "numbers.json"}, res.AddedOrModifiedFiles)
+	require.Equal(t, []string{"apps/app.1.yaml", "apps/app.2.yaml", "a.txt", "b.txt"}, res.SharedFiles)
+
+	got, err := os.ReadFile(filepath.Join(outDir, "apps", "app.2.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "name: app-2\nindex: 1\nenv: prenv-1\n", string(got))
+
+	t.Run("name without item", func(t *testing.T) {
+		p.Config.Files = []config.RenderedFile{
+			{
+				ForEach:         config.ForEachPullRequests,
+				NameTemplate:    "app.yaml",
+				ContentTemplate: "{{ .Item }}",
+			},
+		}
+
+		_, err := p.Render(context.Background(), t.TempDir())
+		require.ErrorContains(t, err, "forEach renders multiple items to app.yaml")
+	})
+
+	t.Run("not a list", func(t *testing.T) {
+		p.Config.Files = []config.RenderedFile{
+			{
+				ForEach:         ".Name",
+				NameTemplate:    "{{ .Item }}.yaml",
+				ContentTemplate: "{{ .Item }}",
+			},
+		}
+
+		_, err := p.Render(context.Background(), t.TempDir())
+		require.ErrorContains(t, err, `".Name" must evaluate to a list`)
+	})
+}
+
+func TestRenderPatch(t *testing.T) {
+	dir := t.TempDir()
+
+	kustomization := "resources:\n  - base # shared\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(kustomization), 0644))
+
+	p := &Provisioner{
+		Config: config.Render{
+			Files: []config.RenderedFile{
+				{
+					Name: "kustomization.yaml",
+					Patch: &config.Patch{
+						Kustomize: &config.KustomizePatch{
+							Images:    []config.KustomizeImage{{Name: "app-{{ .PullRequest.Number }}", NewTag: "{{ .PullRequest.HeadSHA }}"}},
+							Resources: []string{"pr-{{ .PullRequest.Number }}"},
+						},
+					},
+				},
+				{
+					Name: "values.json",
+					Patch: &config.Patch{
+						MergePatch: `{"envs": {"{{ .Name }}": {"sha": "{{ .PullRequest.HeadSHA }}"}}}`,
+						Set:        []config.PatchSet{{Path: `.hosts["{{ .Name }}"]`, Value: "{{ .Name }}.example.com"}},
+					},
+				},
+			},
+		},
+		EnvParams: config.EnvArgs{
+			Name: "prenv-123",
+			PullRequest: &config.PullRequestEnvArgs{
+				Number:  123,
+				HeadSHA: "0123abc",
+			},
+		},
+	}
+
+	res, err := p.Render(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"kustomization.yaml", "values.json"}, res.AddedOrModifiedFiles)
+	require.Equal(t, []string{"kustomization.yaml", "values.json"}, res.PatchedFiles)
+
+	got, err := os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "resources:\n  - base # shared\n  - pr-123\nimages:\n  - name: app-123\n    newTag: 0123abc\n", string(got))
+
+	got, err = os.ReadFile(filepath.Join(dir, "values.json"))
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "envs": {
+    "prenv-123": {
+      "sha": "0123abc"
+    }
+  },
+  "hosts": {
+    "prenv-123": "prenv-123.example.com"
+  }
+}
+`, string(got))
+
+	res, err = p.Unrender(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"kustomization.yaml"}, res.AddedOrModifiedFiles)
+	require.Equal(t, []string{"values.json"}, res.DeletedFiles)
+
+	got, err = os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, kustomization, string(got))
+}
@@ -0,0 +1,78 @@
+package provisioner
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/ghactions"
+	"github.com/mumoshu/prenv/secretref"
+	"github.com/sirupsen/logrus"
+)
+
+// writeReport writes the run report, which is the results and the outputs of the hooks run by the chain,
+// to the job summary when prenv runs on GitHub Actions.
+// The outputs are logged as the hooks run, so there is nothing to write otherwise.
+func (c *Chain) writeReport(action string) {
+	path := os.Getenv(envvar.GitHubStepSummary)
+
+	if path == "" || len(c.hookReports) == 0 {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logrus.Warnf("unable to open the job summary: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(formatReport(action, c.cfg.EnvArgs.Name, c.hookReports)); err != nil {
+		logrus.Warnf("unable to write the run report to the job summary: %v", err)
+	}
+}
+
+// formatReport returns the run report in Markdown, with the resolved secrets in the outputs redacted.
+func formatReport(action, envName string, reports []hookReport) string {
+	verb := "apply"
+	if action == ghactions.EventTypeDestroy {
+		verb = "destroy"
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "### prenv %s %s\n\n", verb, envName)
+	b.WriteString("| Component | Hook | Result | Duration |\n")
+	b.WriteString("| --- | --- | --- | --- |\n")
+
+	for _, r := range reports {
+		result := "succeeded"
+		if r.err != nil {
+			result = "failed"
+			if r.ignored {
+				result = "failed (ignored)"
+			}
+		}
+
+		fmt.Fprintf(&b, "| %s | %s %s | %s | %s |\n", r.component, r.phase, r.hook, result, r.duration.Round(time.Second))
+	}
+
+	for _, r := range reports {
+		out := r.output
+		if r.err != nil {
+			out += "\n" + r.err.Error()
+		}
+
+		if strings.TrimSpace(out) == "" {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n<details><summary>%s %s %s</summary>\n\n```\n%s\n```\n\n</details>\n", r.component, r.phase, r.hook, strings.TrimRight(secretref.Redact(out), "\n"))
+	}
+
+	b.WriteString("\n")
+
+	return b.String()
+}
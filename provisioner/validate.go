@@ -0,0 +1,690 @@
+package provisioner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/render"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a mistake in prenv.yaml found by Validate.
+type Problem struct {
+	// File is the path to prenv.yaml, or to the template file that contains the mistake.
+	File string
+	// Line is the line of the offending field in the file, or 0 if unknown.
+	Line int
+	// Path is the path to the offending field, like dedicated.render.files[0].contentTemplate.
+	Path string
+	// Message describes the mistake.
+	Message string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+
+	b.WriteString(p.File)
+
+	if p.Line > 0 {
+		fmt.Fprintf(&b, ":%d", p.Line)
+	}
+
+	b.WriteString(": ")
+
+	if p.Path != "" {
+		b.WriteString(p.Path)
+		b.WriteString(": ")
+	}
+
+	b.WriteString(p.Message)
+
+	return b.String()
+}
+
+var (
+	// templateErrorPattern matches the errors of text/template and html/template that contain the line in the template.
+	templateErrorPattern = regexp.MustCompile(`^template: [^:]*:(\d+):(?:\d+:)? (.*)$`)
+
+	// outputsRefPattern matches the references to the outputs of the provisioners,
+	// either .Outputs.NAME or index .Outputs "NAME".
+	outputsRefPattern = regexp.MustCompile(`\.Outputs\.([A-Za-z0-9_]+)|index\s+\.Outputs\s+"([^"]+)"`)
+
+	// varsRefPattern matches the references to the vars, either .Vars.NAME or index .Vars "NAME".
+	varsRefPattern = regexp.MustCompile(`\.Vars\.([A-Za-z0-9_]+)|index\s+\.Vars\s+"([^"]+)"`)
+)
+
+// Validate checks the prenv.yaml file at the given path, and the files it imports, without running any provisioner,
+// and returns the problems found.
+//
+// It checks the files against the JSON Schema generated from config.Config,
+// the syntax of the Go templates in the files and in the template files referenced by the render provisioners,
+// the consistency of the delegations, like pullRequest without git,
+// and the references to the vars and the outputs of the provisioners that do not exist.
+//
+// The returned error is for the failures to run the checks, like the file not found.
+func Validate(path string) ([]Problem, error) {
+	v := &validator{
+		file:  path,
+		roots: map[string]*yaml.Node{},
+	}
+
+	if err := v.checkFile(path); err != nil {
+		return nil, err
+	}
+
+	// The rest of the checks need the config decoded, which fails for the same reasons as the schema.
+	if len(v.problems) > 0 {
+		return v.sorted(), nil
+	}
+
+	doc, err := readConfigDocument(path)
+	if err != nil {
+		v.add(path, nil, "", "%v", err)
+		return v.problems, nil
+	}
+
+	v.origin = doc.origin
+
+	cfg, err := ReadConfigFile(path)
+	if err != nil {
+		v.add(path, nil, "", "%v", err)
+		return v.problems, nil
+	}
+
+	components := validatedComponents(*cfg)
+
+	v.provisioners = map[string]bool{}
+
+	flattened, _, namePrefixes := flattenComponents(*cfg)
+	for _, namePrefix := range namePrefixes {
+		for _, p := range Plugins {
+			for _, prov := range p(PluginConfig{Service: flattened[namePrefix]}) {
+				v.provisioners[namePrefix+prov.name] = true
+			}
+		}
+	}
+
+	v.scopes = map[string]map[string]bool{}
+	for _, c := range components {
+		v.scopes[c.path] = c.vars
+	}
+
+	for _, f := range v.files {
+		v.checkTemplates(f, v.roots[f], "", "", v.scopes[""])
+	}
+
+	for _, c := range components {
+		v.checkComponent(c, filepath.Dir(path))
+	}
+
+	if cfg.Branches != nil {
+		if err := cfg.Branches.Validate(); err != nil {
+			v.addAt("branches", "%v", err)
+		}
+	}
+
+	if err := cfg.ValidateOnFailure(); err != nil {
+		v.addAt("onFailure", "%v", err)
+	}
+
+	if err := cfg.ValidateProfiles(); err != nil {
+		v.addAt("profiles", "%v", err)
+	}
+
+	if cfg.Policy != nil {
+		if err := cfg.Policy.Validate(); err != nil {
+			v.addAt("policy", "%v", err)
+		}
+	}
+
+	return v.sorted(), nil
+}
+
+type validator struct {
+	// file is the path to prenv.yaml.
+	file string
+
+	// files is the list of prenv.yaml and the files it imports, in the order they are merged.
+	files []string
+
+	// roots is the root node of each file in files.
+	roots map[string]*yaml.Node
+
+	// origin returns the file that defines the field at the path, like dedicated.components.app.
+	origin func(path string) string
+
+	problems []Problem
+
+	// provisioners is the set of the names of the provisioners, which .Outputs can refer to.
+	provisioners map[string]bool
+
+	// scopes is the set of the names of the vars available to each component, keyed by the path to the component.
+	scopes map[string]map[string]bool
+}
+
+// checkFile parses the file and checks it against the schema, and then does the same for the files it imports.
+func (v *validator) checkFile(file string) error {
+	if _, ok := v.roots[file]; ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("unable to read config file %s: %w", file, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		v.add(file, nil, "", "%v", err)
+		return nil
+	}
+
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+
+	v.files = append(v.files, file)
+	v.roots[file] = root
+
+	if err := v.checkSchema(file); err != nil {
+		return err
+	}
+
+	var imports []string
+
+	_, n := mappingEntry(root, "imports")
+	if n != nil && n.Decode(&imports) != nil {
+		// Reported by the schema.
+		return nil
+	}
+
+	files, err := resolveImports(file, imports)
+	if err != nil {
+		v.add(file, n, "imports", "%v", err)
+		return nil
+	}
+
+	for _, f := range files {
+		if err := v.checkFile(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *validator) add(file string, n *yaml.Node, path, format string, args ...interface{}) {
+	var line int
+	if n != nil {
+		line = n.Line
+	}
+
+	v.problems = append(v.problems, Problem{
+		File:    file,
+		Line:    line,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// addAt adds the problem at the field at the path, like dedicated.render, in the file that defines it.
+func (v *validator) addAt(path, format string, args ...interface{}) {
+	file := v.origin(path)
+
+	v.add(file, v.lookup(file, path), path, format, args...)
+}
+
+func (v *validator) sorted() []Problem {
+	order := map[string]int{}
+	for i, f := range v.files {
+		order[f] = i + 1
+	}
+
+	// The problems in prenv.yaml and the imported files come first, followed by the ones in the template files.
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		if a.File != b.File {
+			oa, ob := order[a.File], order[b.File]
+			if oa == 0 || ob == 0 {
+				if oa != ob {
+					return ob == 0
+				}
+				return a.File < b.File
+			}
+			return oa < ob
+		}
+		return a.Line < b.Line
+	})
+
+	return v.problems
+}
+
+// lookup returns the key node of the field at the path, like dedicated.components.app.render, in the file.
+// It returns the deepest node found when some of the fields in the path do not exist.
+func (v *validator) lookup(file, path string) *yaml.Node {
+	n, found := v.roots[file], v.roots[file]
+
+	if path == "" {
+		return n
+	}
+
+	for _, k := range strings.Split(path, ".") {
+		key, value := mappingEntry(n, k)
+		if value == nil {
+			break
+		}
+
+		n, found = value, key
+	}
+
+	return found
+}
+
+// checkSchema validates the document against the JSON Schema of prenv.yaml.
+func (v *validator) checkSchema(file string) error {
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft7
+
+	if err := c.AddResource(config.SchemaURL, bytes.NewReader(config.Schema())); err != nil {
+		return fmt.Errorf("unable to load the schema: %w", err)
+	}
+
+	s, err := c.Compile(config.SchemaURL)
+	if err != nil {
+		return fmt.Errorf("unable to compile the schema: %w", err)
+	}
+
+	err = s.Validate(jsonValue(v.roots[file]))
+	if err == nil {
+		return nil
+	}
+
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return fmt.Errorf("unable to validate against the schema: %w", err)
+	}
+
+	seen := map[string]bool{}
+
+	for _, e := range leafErrors(ve) {
+		n, path := v.pointer(file, e.InstanceLocation)
+
+		if strings.HasSuffix(e.KeywordLocation, "/additionalProperties") && n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k := n.Content[i]
+				if strings.Contains(e.Message, "'"+k.Value+"'") {
+					v.add(file, k, joinPath(path, k.Value), "unknown field")
+				}
+			}
+			continue
+		}
+
+		key := e.InstanceLocation + "\x00" + e.Message
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		v.add(file, n, path, "%s", e.Message)
+	}
+
+	return nil
+}
+
+// pointer returns the node at the JSON pointer, like /dedicated/render/files/0,
+// and the path to it, like dedicated.render.files[0].
+func (v *validator) pointer(file, ptr string) (*yaml.Node, string) {
+	n := v.roots[file]
+
+	var path string
+
+	for _, tok := range strings.Split(strings.TrimPrefix(ptr, "/"), "/") {
+		if tok == "" {
+			continue
+		}
+
+		tok = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+
+		switch n.Kind {
+		case yaml.MappingNode:
+			_, value := mappingEntry(n, tok)
+			if value == nil {
+				return n, path
+			}
+			n = value
+			path = joinPath(path, tok)
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i >= len(n.Content) {
+				return n, path
+			}
+			n = n.Content[i]
+			path = fmt.Sprintf("%s[%d]", path, i)
+		default:
+			return n, path
+		}
+	}
+
+	return n, path
+}
+
+// checkTemplates parses the Go templates in the node, which are the values of the fields whose names end with Template,
+// and any other string that contains "{{".
+func (v *validator) checkTemplates(file string, n *yaml.Node, path, engine string, vars map[string]bool) {
+	if s, ok := v.scopes[path]; ok {
+		vars = s
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		if _, e := mappingEntry(n, "engine"); e != nil {
+			engine = e.Value
+		}
+
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, value := n.Content[i], n.Content[i+1]
+			p := joinPath(path, k.Value)
+
+			switch {
+			case path == "" && k.Value == "args":
+				// The args are populated by prenv and sent to the delegated runs, and contain no templates.
+				continue
+			case k.Value == "sources":
+				// The template files are checked by checkComponent.
+				continue
+			case k.Value == "forEach" && value.Kind == yaml.ScalarNode:
+				v.checkTemplate(file, value, p, engine, "{{ "+value.Value+" }}", vars)
+			case strings.HasSuffix(k.Value, "Template") && value.Kind == yaml.ScalarNode:
+				v.checkTemplate(file, value, p, engine, value.Value, vars)
+			default:
+				v.checkTemplates(file, value, p, engine, vars)
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			v.checkTemplates(file, c, fmt.Sprintf("%s[%d]", path, i), engine, vars)
+		}
+	case yaml.ScalarNode:
+		if strings.Contains(n.Value, "{{") {
+			v.checkTemplate(file, n, path, engine, n.Value, vars)
+		}
+	}
+}
+
+// checkTemplate parses the template in the scalar node n, and checks the references to the vars and the outputs in it.
+func (v *validator) checkTemplate(file string, n *yaml.Node, path, engine, text string, vars map[string]bool) {
+	// The content of a block scalar starts at the next line of the indicator.
+	line := n.Line
+	if n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		line++
+	}
+
+	for _, p := range v.parseTemplate(engine, text, vars) {
+		if p.Line > 0 {
+			p.Line += line - 1
+		} else {
+			p.Line = n.Line
+		}
+		p.File = file
+		p.Path = path
+		v.problems = append(v.problems, p)
+	}
+}
+
+// parseTemplate returns the problems in the template, whose lines are relative to the template.
+func (v *validator) parseTemplate(engine, text string, vars map[string]bool) []Problem {
+	if err := render.Parse(engine, "template", text); err != nil {
+		msg := err.Error()
+
+		var line int
+		if m := templateErrorPattern.FindStringSubmatch(msg); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			msg = m[2]
+		}
+
+		return []Problem{{Line: line, Message: "invalid template: " + msg}}
+	}
+
+	var problems []Problem
+
+	for i, l := range strings.Split(text, "\n") {
+		for _, m := range outputsRefPattern.FindAllStringSubmatch(l, -1) {
+			name := m[1] + m[2]
+			if !v.provisioners[name] {
+				problems = append(problems, Problem{Line: i + 1, Message: fmt.Sprintf("no provisioner named %q for the outputs: it must be one of %s", name, sortedKeys(v.provisioners))})
+			}
+		}
+
+		for _, m := range varsRefPattern.FindAllStringSubmatch(l, -1) {
+			name := m[1] + m[2]
+			if !vars[name] {
+				problems = append(problems, Problem{Line: i + 1, Message: fmt.Sprintf("undefined var %q", name)})
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkComponent runs the validations of the provisioners in the component,
+// which would otherwise run only when the provisioners run,
+// and parses the template files loaded by the render provisioner.
+func (v *validator) checkComponent(c validatedComponent, dir string) {
+	comp := c.comp
+
+	check := func(field string, fn func() error) {
+		if err := fn(); err != nil {
+			v.addAt(joinPath(c.path, field), "%v", err)
+		}
+	}
+
+	if r := comp.Render; r != nil {
+		check("render", r.Validate)
+		check("render", r.Delegate.Validate)
+
+		var keys []string
+		for k := range r.Sources {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			for _, p := range v.parseTemplate(r.Engine, r.Sources[k], c.vars) {
+				p.File = filepath.Join(dir, k)
+				p.Path = joinPath(c.path, "render")
+				v.problems = append(v.problems, p)
+			}
+		}
+	}
+
+	if k := comp.Kustomize; k != nil {
+		check("kustomize", k.Validate)
+		check("kustomize", k.Delegate.Validate)
+	}
+
+	if h := comp.Helm; h != nil {
+		check("helm", h.Validate)
+		check("helm", h.Delegate.Validate)
+	}
+
+	if t := comp.Terraform; t != nil {
+		check("terraform", t.Validate)
+		check("terraform", t.Delegate.Validate)
+	}
+
+	if a := comp.AWSResources; a != nil && a.GitOps != nil {
+		check("awsResources.gitOps", a.GitOps.Validate)
+	}
+
+	if k := comp.KubernetesResources; k != nil && k.Delegate != nil {
+		check("kubernetesResources.gitOps", k.Delegate.Validate)
+	}
+
+	if comp.ArgoCD.GitOps != nil {
+		check("argocd.gitOps", comp.ArgoCD.GitOps.Validate)
+	}
+
+	if comp.ArgoCD.App != nil {
+		check("argocd.app", comp.ArgoCD.App.Validate)
+	}
+
+	if comp.Paths != nil {
+		check("paths", comp.Paths.Validate)
+	}
+
+	if comp.Hooks != nil {
+		check("hooks", comp.Hooks.Validate)
+	}
+
+	if len(comp.Components) > 0 && c.path == "shared" {
+		v.addAt("shared.components", "components are supported only in dedicated")
+	}
+}
+
+// validatedComponent is a component in prenv.yaml, along with the names of the vars available to it.
+type validatedComponent struct {
+	// path is the path to the component, like dedicated.components.app.
+	// It is empty for the root of the config, whose vars are available to all the components.
+	path string
+	comp config.Component
+	vars map[string]bool
+}
+
+func validatedComponents(cfg config.Config) []validatedComponent {
+	global := varNames(nil, cfg.Vars)
+
+	components := []validatedComponent{{path: "", vars: global}}
+
+	if cfg.Shared != nil {
+		components = append(components, validatedComponent{path: "shared", comp: *cfg.Shared, vars: varNames(global, cfg.Shared.Vars)})
+	}
+
+	if cfg.Dedicated != nil {
+		dedicated := varNames(global, cfg.Dedicated.Vars)
+
+		components = append(components, validatedComponent{path: "dedicated", comp: *cfg.Dedicated, vars: dedicated})
+
+		var names []string
+		for name := range cfg.Dedicated.Components {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			comp := cfg.Dedicated.Components[name]
+			components = append(components, validatedComponent{path: "dedicated.components." + name, comp: comp, vars: varNames(dedicated, comp.Vars)})
+		}
+	}
+
+	return components
+}
+
+func varNames(parent map[string]bool, vars map[string]string) map[string]bool {
+	names := map[string]bool{}
+
+	for k := range parent {
+		names[k] = true
+	}
+
+	for k := range vars {
+		names[k] = true
+	}
+
+	return names
+}
+
+func sortedKeys(m map[string]bool) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ", ")
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// mappingEntry returns the key and the value nodes of the entry in the mapping node, or nils if not found.
+func mappingEntry(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+
+	return nil, nil
+}
+
+// jsonValue converts the YAML node to the value that the JSON Schema validator accepts.
+func jsonValue(n *yaml.Node) interface{} {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil
+		}
+		return jsonValue(n.Content[0])
+	case yaml.AliasNode:
+		return jsonValue(n.Alias)
+	case yaml.MappingNode:
+		m := map[string]interface{}{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			m[n.Content[i].Value] = jsonValue(n.Content[i+1])
+		}
+		return m
+	case yaml.SequenceNode:
+		s := []interface{}{}
+		for _, c := range n.Content {
+			s = append(s, jsonValue(c))
+		}
+		return s
+	}
+
+	switch n.ShortTag() {
+	case "!!null":
+		return nil
+	case "!!bool", "!!int", "!!float":
+		var v interface{}
+		if err := n.Decode(&v); err == nil {
+			switch v.(type) {
+			case bool, int, int64, uint64, float64:
+				return v
+			}
+		}
+	}
+
+	return n.Value
+}
+
+// leafErrors returns the innermost errors, which point to the offending values.
+func leafErrors(e *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(e.Causes) == 0 {
+		return []*jsonschema.ValidationError{e}
+	}
+
+	var leaves []*jsonschema.ValidationError
+	for _, c := range e.Causes {
+		leaves = append(leaves, leafErrors(c)...)
+	}
+
+	return leaves
+}
@@ -0,0 +1,151 @@
+package provisioner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSchema(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "prenv.yaml")
+
+	require.NoError(t, os.WriteFile(file, []byte(`dedicated:
+  render:
+    git:
+      repo: mumoshu/prenv-target
+      push: maybe
+    files:
+    - name: app.yaml
+      content: foo
+awsResources: {}
+`), 0644))
+
+	problems, err := Validate(file)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		file + ":5: dedicated.render.git.push: expected boolean, but got string",
+		file + ":8: dedicated.render.files[0].content: unknown field",
+		file + ":9: awsResources: unknown field",
+	}, problemStrings(problems))
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "prenv.yaml")
+
+	require.NoError(t, os.WriteFile(file, []byte(`vars:
+  domain: "{{ .Name }}.example.com"
+dedicated:
+  terraform:
+    dir: infra
+  render:
+    pullRequest: {}
+    files:
+    - name: app.yaml
+      contentTemplate: |
+        url: {{ .Vars.domain }}
+        queue: {{ index .Outputs "pr-terraform" "queue" }}
+        db: {{ .Outputs.aws.db }}
+        env: {{ .Vars.missing }}
+    - nameTemplate: "{{ .Name "
+      contentTemplate: |
+        a: b
+        c: {{ if .Name }}
+  components:
+    api:
+      render:
+        repositoryDispatch:
+          owner: mumoshu
+        files:
+        - name: api.yaml
+          templateFile: api.yaml.tmpl
+      hooks:
+        postApply:
+        - exec:
+            command: ["make", "smoke", "URL={{ .Vars.domain }}"]
+          timeout: soon
+policy:
+  maxReplicas: -1
+`), 0644))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "api.yaml.tmpl"), []byte("a: {{ .Vars.domain }}\nb: {{ end }}\n"), 0644))
+
+	problems, err := Validate(file)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		file + ":6: dedicated.render: pullRequest requires git",
+		file + `:13: dedicated.render.files[0].contentTemplate: no provisioner named "aws" for the outputs: it must be one of pr-api-render, pr-render, pr-terraform`,
+		file + `:14: dedicated.render.files[0].contentTemplate: undefined var "missing"`,
+		file + ":15: dedicated.render.files[1].nameTemplate: invalid template: unclosed action",
+		file + ":19: dedicated.render.files[1].contentTemplate: invalid template: unexpected EOF",
+		file + ":21: dedicated.components.api.render: repositoryDispatch.repo is required",
+		file + `:27: dedicated.components.api.hooks: postApply[0]: invalid timeout "soon": time: invalid duration "soon"`,
+		file + ":32: policy: maxReplicas must not be negative: -1",
+		filepath.Join(dir, "api.yaml.tmpl") + ":2: dedicated.components.api.render: invalid template: unexpected {{end}}",
+	}, problemStrings(problems))
+}
+
+func problemStrings(problems []Problem) []string {
+	var s []string
+	for _, p := range problems {
+		s = append(s, p.String())
+	}
+	return s
+}
+
+func TestValidateImports(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFiles(t, dir, map[string]string{
+		"prenv.yaml": `imports:
+- services/*/prenv.yaml
+dedicated:
+  render:
+    files:
+    - name: ns.yaml
+      contentTemplate: ns
+`,
+		"services/api/prenv.yaml": `dedicated:
+  components:
+    api:
+      render:
+        pullRequest: {}
+        files:
+        - name: api.yaml
+          contentTemplate: "{{ .Vars.port }}"
+`,
+		"services/web/prenv.yaml": `dedicated:
+  components:
+    web:
+      helm:
+        charts: web
+`,
+	})
+
+	file := filepath.Join(dir, "prenv.yaml")
+
+	problems, err := Validate(file)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "services/web/prenv.yaml") + ":5: dedicated.components.web.helm.charts: unknown field",
+	}, problemStrings(problems))
+
+	writeFiles(t, dir, map[string]string{
+		"services/web/prenv.yaml": `dedicated:
+  components:
+    web:
+      helm:
+        chart: web
+`,
+	})
+
+	problems, err = Validate(file)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "services/api/prenv.yaml") + ":4: dedicated.components.api.render: pullRequest requires git",
+		filepath.Join(dir, "services/api/prenv.yaml") + `:8: dedicated.components.api.render.files[0].contentTemplate: undefined var "port"`,
+	}, problemStrings(problems))
+}
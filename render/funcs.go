@@ -0,0 +1,558 @@
+package render
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FuncMap returns the functions available to the templates rendered by the text engine.
+//
+// The functions follow the names, the argument orders, and the semantics of Sprig
+// (https://masterminds.github.io/sprig/), so that the templates written for Helm charts
+// and other Sprig-based tools work as-is, with the following exceptions:
+//
+//   - split returns a list instead of a dict, for compatibility with the templates written for older prenv.
+//     It is equivalent to splitList.
+//   - keys returns the keys in the sorted order, so that the rendered files are stable across runs.
+//   - merge merges the dicts recursively, with the values in the earlier dicts taking precedence.
+//   - toJson and toPrettyJson do not escape <, >, and &.
+func FuncMap() template.FuncMap {
+	return template.FuncMap{
+		// Strings
+		"trim":       strings.TrimSpace,
+		"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      title,
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"repeat":     func(n int, s string) string { return strings.Repeat(s, n) },
+		"trunc":      trunc,
+		"nospace":    func(s string) string { return strings.Join(strings.Fields(s), "") },
+		"quote":      quote,
+		"squote":     squote,
+		"toString":   toString,
+		"split":      splitList,
+		"splitList":  splitList,
+		"join":       join,
+		"indent":     indent,
+		"nindent":    func(n int, s string) string { return "\n" + indent(n, s) },
+
+		// Encoding
+		"b64enc":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":       b64dec,
+		"sha256sum":    sha256sum,
+		"toJson":       toJson,
+		"toPrettyJson": toPrettyJson,
+		"fromJson":     fromJson,
+		"toYaml":       toYaml,
+		"fromYaml":     fromYaml,
+
+		// Defaults and flow control
+		"default":  defaultValue,
+		"empty":    empty,
+		"coalesce": coalesce,
+		"ternary":  ternary,
+		"required": required,
+		"fail":     func(msg string) (string, error) { return "", errors.New(msg) },
+
+		// Lists
+		"list":      list,
+		"first":     first,
+		"last":      last,
+		"rest":      rest,
+		"initial":   initial,
+		"append":    push,
+		"prepend":   prepend,
+		"concat":    concat,
+		"has":       has,
+		"uniq":      uniq,
+		"without":   without,
+		"compact":   compact,
+		"reverse":   reverse,
+		"sortAlpha": sortAlpha,
+
+		// Dicts
+		"dict":   dict,
+		"get":    get,
+		"set":    set,
+		"unset":  unset,
+		"hasKey": hasKey,
+		"keys":   keys,
+		"values": values,
+		"pick":   pick,
+		"omit":   omit,
+		"merge":  merge,
+	}
+}
+
+func title(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		r := []rune(w)
+		words[i] = strings.ToUpper(string(r[:1])) + string(r[1:])
+	}
+	return strings.Join(words, " ")
+}
+
+func trunc(n int, s string) string {
+	if n < 0 {
+		if len(s)+n < 0 {
+			return s
+		}
+		return s[len(s)+n:]
+	}
+
+	if n > len(s) {
+		return s
+	}
+
+	return s[:n]
+}
+
+func quote(vs ...interface{}) string {
+	var out []string
+	for _, v := range vs {
+		if v != nil {
+			out = append(out, fmt.Sprintf("%q", toString(v)))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func squote(vs ...interface{}) string {
+	var out []string
+	for _, v := range vs {
+		if v != nil {
+			out = append(out, "'"+toString(v)+"'")
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func splitList(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+func join(sep string, v interface{}) string {
+	var out []string
+	for _, item := range toList(v) {
+		out = append(out, toString(item))
+	}
+	return strings.Join(out, sep)
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// toJson marshals the value to JSON.
+// Unlike json.Marshal, it does not escape <, >, and & so that the output is byte-for-byte what the user expects.
+func toJson(v interface{}) (string, error) {
+	return marshalJSON(v, "")
+}
+
+func toPrettyJson(v interface{}) (string, error) {
+	return marshalJSON(v, "  ")
+}
+
+func marshalJSON(v interface{}, indent string) (string, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func fromJson(s string) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// toYaml marshals the value to YAML without the trailing newline,
+// so that it can be combined with nindent like `{{ .Values | toYaml | nindent 2 }}`.
+func toYaml(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// fromYaml unmarshals the YAML into maps with string keys, so that the result can be used with
+// the dict functions and toJson.
+func fromYaml(s string) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return stringifyKeys(v), nil
+}
+
+func stringifyKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range v {
+			m[toString(k)] = stringifyKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stringifyKeys(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// defaultValue returns d if v is empty, or v otherwise.
+// v is optional so that `{{ .Missing | default "foo" }}` works even when the pipeline yields no value.
+func defaultValue(d interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || empty(v[0]) {
+		return d
+	}
+	return v[0]
+}
+
+// empty returns true if the value is nil, false, zero, or an empty string, list, or dict.
+func empty(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Complex64, reflect.Complex128:
+		return rv.Complex() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	case reflect.Struct:
+		return false
+	}
+
+	return false
+}
+
+func coalesce(vs ...interface{}) interface{} {
+	for _, v := range vs {
+		if !empty(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+func ternary(vt, vf interface{}, cond bool) interface{} {
+	if cond {
+		return vt
+	}
+	return vf
+}
+
+// required fails the rendering with the message if the value is nil or an empty string.
+func required(msg string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, errors.New(msg)
+	}
+
+	if s, ok := v.(string); ok && s == "" {
+		return nil, errors.New(msg)
+	}
+
+	return v, nil
+}
+
+// toList converts any slice or array to []interface{}, so that the list functions work with
+// typed slices like []int and []string in the template data.
+func toList(v interface{}) []interface{} {
+	if l, ok := v.([]interface{}); ok {
+		return l
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		l := make([]interface{}, rv.Len())
+		for i := range l {
+			l[i] = rv.Index(i).Interface()
+		}
+		return l
+	}
+
+	return []interface{}{v}
+}
+
+func list(vs ...interface{}) []interface{} {
+	return vs
+}
+
+func first(v interface{}) interface{} {
+	l := toList(v)
+	if len(l) == 0 {
+		return nil
+	}
+	return l[0]
+}
+
+func last(v interface{}) interface{} {
+	l := toList(v)
+	if len(l) == 0 {
+		return nil
+	}
+	return l[len(l)-1]
+}
+
+func rest(v interface{}) []interface{} {
+	l := toList(v)
+	if len(l) == 0 {
+		return nil
+	}
+	return l[1:]
+}
+
+func initial(v interface{}) []interface{} {
+	l := toList(v)
+	if len(l) == 0 {
+		return nil
+	}
+	return l[:len(l)-1]
+}
+
+func push(v interface{}, item interface{}) []interface{} {
+	l := toList(v)
+	return append(append([]interface{}{}, l...), item)
+}
+
+func prepend(v interface{}, item interface{}) []interface{} {
+	return append([]interface{}{item}, toList(v)...)
+}
+
+func concat(vs ...interface{}) []interface{} {
+	var out []interface{}
+	for _, v := range vs {
+		out = append(out, toList(v)...)
+	}
+	return out
+}
+
+func has(needle interface{}, v interface{}) bool {
+	for _, item := range toList(v) {
+		if reflect.DeepEqual(needle, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func uniq(v interface{}) []interface{} {
+	var out []interface{}
+	for _, item := range toList(v) {
+		if !has(item, out) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func without(v interface{}, omit ...interface{}) []interface{} {
+	var out []interface{}
+	for _, item := range toList(v) {
+		if !has(item, omit) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func compact(v interface{}) []interface{} {
+	var out []interface{}
+	for _, item := range toList(v) {
+		if !empty(item) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func reverse(v interface{}) []interface{} {
+	l := toList(v)
+	out := make([]interface{}, len(l))
+	for i, item := range l {
+		out[len(l)-1-i] = item
+	}
+	return out
+}
+
+func sortAlpha(v interface{}) []string {
+	var out []string
+	for _, item := range toList(v) {
+		out = append(out, toString(item))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func dict(kvs ...interface{}) map[string]interface{} {
+	d := map[string]interface{}{}
+	for i := 0; i < len(kvs); i += 2 {
+		var v interface{}
+		if i+1 < len(kvs) {
+			v = kvs[i+1]
+		}
+		d[toString(kvs[i])] = v
+	}
+	return d
+}
+
+func get(d map[string]interface{}, k string) interface{} {
+	if v, ok := d[k]; ok {
+		return v
+	}
+	return ""
+}
+
+func set(d map[string]interface{}, k string, v interface{}) map[string]interface{} {
+	d[k] = v
+	return d
+}
+
+func unset(d map[string]interface{}, k string) map[string]interface{} {
+	delete(d, k)
+	return d
+}
+
+func hasKey(d map[string]interface{}, k string) bool {
+	_, ok := d[k]
+	return ok
+}
+
+func keys(ds ...map[string]interface{}) []string {
+	var out []string
+	for _, d := range ds {
+		for k := range d {
+			if !has(k, out) {
+				out = append(out, k)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func values(d map[string]interface{}) []interface{} {
+	var out []interface{}
+	for _, k := range keys(d) {
+		out = append(out, d[k])
+	}
+	return out
+}
+
+func pick(d map[string]interface{}, ks ...string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, k := range ks {
+		if v, ok := d[k]; ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func omit(d map[string]interface{}, ks ...string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range d {
+		if !has(k, ks) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// merge merges the srcs into dst recursively.
+// Values already in dst take precedence over the ones in srcs, and earlier srcs take precedence over later ones.
+func merge(dst map[string]interface{}, srcs ...map[string]interface{}) map[string]interface{} {
+	for _, src := range srcs {
+		for k, v := range src {
+			cur, ok := dst[k]
+			if !ok {
+				dst[k] = v
+				continue
+			}
+
+			curMap, curOK := cur.(map[string]interface{})
+			vMap, vOK := v.(map[string]interface{})
+			if curOK && vOK {
+				dst[k] = merge(curMap, vMap)
+			}
+		}
+	}
+	return dst
+}
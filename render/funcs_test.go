@@ -0,0 +1,160 @@
+package render
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type funcsTestData struct {
+	Name    string
+	Empty   string
+	Numbers []int
+	Labels  map[string]interface{}
+	JSON    string
+	YAML    string
+}
+
+var funcsTestCases = []struct {
+	fn       string
+	template string
+}{
+	{"trim", `{{ trim "  a b  " }}`},
+	{"trimAll", `{{ trimAll "$" "$5.00$" }}`},
+	{"trimPrefix", `{{ trimPrefix "pr-" "pr-123" }}`},
+	{"trimSuffix", `{{ trimSuffix ".yaml" "app.yaml" }}`},
+	{"upper", `{{ upper .Name }}`},
+	{"lower", `{{ lower "MyApp" }}`},
+	{"title", `{{ title "hello prenv world" }}`},
+	{"replace", `{{ .Name | replace "-" "_" }}`},
+	{"contains", `{{ contains "env" .Name }} {{ contains "foo" .Name }}`},
+	{"hasPrefix", `{{ hasPrefix "prenv" .Name }}`},
+	{"hasSuffix", `{{ hasSuffix "123" .Name }}`},
+	{"repeat", `{{ repeat 3 "ab" }}`},
+	{"trunc", `{{ trunc 5 .Name }} {{ trunc -3 .Name }}`},
+	{"nospace", `{{ nospace " a b\tc " }}`},
+	{"quote", `{{ quote .Name "a\"b" 1 }}`},
+	{"squote", `{{ squote .Name }}`},
+	{"toString", `{{ toString 123 | printf "%q" }}`},
+	{"split", `{{ split "," "a,b,c" | toJson }}`},
+	{"splitList", `{{ splitList "/" "owner/repo" | last }}`},
+	{"join", `{{ join "," .Numbers }}`},
+	{"indent", `{{ "a: 1\nb: 2" | indent 4 }}`},
+	{"nindent", `spec:{{ "a: 1\nb: 2" | nindent 2 }}`},
+	{"b64enc", `{{ b64enc "a<b&c" }}`},
+	{"b64dec", `{{ b64dec "YTxiJmM=" }}`},
+	{"sha256sum", `{{ sha256sum .Name }}`},
+	{"toJson", `{{ toJson .Labels }} {{ toJson "a<b&c" }}`},
+	{"toPrettyJson", `{{ toPrettyJson .Labels }}`},
+	{"fromJson", `{{ $v := fromJson .JSON }}{{ $v.image.tag }} {{ index $v.ports 1 }}`},
+	{"toYaml", `labels:{{ .Labels | toYaml | nindent 2 }}`},
+	{"fromYaml", `{{ $v := fromYaml .YAML }}{{ $v.image.tag }} {{ $v | toJson }}`},
+	{"default", `{{ .Empty | default "fallback" }} {{ .Name | default "fallback" }}`},
+	{"empty", `{{ empty .Empty }} {{ empty .Numbers }} {{ empty 0 }} {{ empty (list) }}`},
+	{"coalesce", `{{ coalesce .Empty "" "second" "third" }}`},
+	{"ternary", `{{ ternary "yes" "no" true }} {{ ternary "yes" "no" false }}`},
+	{"required", `{{ required "name is required" .Name }}`},
+	{"fail", `{{ if false }}{{ fail "unreachable" }}{{ end }}ok`},
+	{"list", `{{ list 1 "two" 3 | toJson }}`},
+	{"first", `{{ first .Numbers }}`},
+	{"last", `{{ last .Numbers }}`},
+	{"rest", `{{ rest .Numbers | toJson }}`},
+	{"initial", `{{ initial .Numbers | toJson }}`},
+	{"append", `{{ append .Numbers 4 | toJson }}`},
+	{"prepend", `{{ prepend .Numbers 0 | toJson }}`},
+	{"concat", `{{ concat .Numbers (list 4 5) | toJson }}`},
+	{"has", `{{ has 2 .Numbers }} {{ has 5 .Numbers }}`},
+	{"uniq", `{{ list 1 2 2 1 3 | uniq | toJson }}`},
+	{"without", `{{ without .Numbers 2 | toJson }}`},
+	{"compact", `{{ list "a" "" "b" 0 | compact | toJson }}`},
+	{"reverse", `{{ reverse .Numbers | toJson }}`},
+	{"sortAlpha", `{{ list "c" "a" "b" | sortAlpha | toJson }}`},
+	{"dict", `{{ dict "a" 1 "b" "two" | toJson }}`},
+	{"get", `{{ get .Labels "app" }}`},
+	{"set", `{{ $d := dict "a" 1 }}{{ $_ := set $d "b" 2 }}{{ toJson $d }}`},
+	{"unset", `{{ $d := dict "a" 1 "b" 2 }}{{ $_ := unset $d "a" }}{{ toJson $d }}`},
+	{"hasKey", `{{ hasKey .Labels "app" }} {{ hasKey .Labels "missing" }}`},
+	{"keys", `{{ keys .Labels | toJson }}`},
+	{"values", `{{ values .Labels | toJson }}`},
+	{"pick", `{{ pick .Labels "app" | toJson }}`},
+	{"omit", `{{ omit .Labels "app" | toJson }}`},
+	{"merge", `{{ merge (dict "a" 1 "nested" (dict "x" 1)) (dict "a" 2 "b" 2 "nested" (dict "x" 2 "y" 2)) | toJson }}`},
+}
+
+func TestFuncs(t *testing.T) {
+	data := funcsTestData{
+		Name:    "prenv-123",
+		Numbers: []int{1, 2, 3},
+		Labels: map[string]interface{}{
+			"app":  "myapp",
+			"tier": "backend",
+		},
+		JSON: `{"image":{"tag":"v1"},"ports":[80,443]}`,
+		YAML: "image:\n  tag: v2\n",
+	}
+
+	for _, tc := range funcsTestCases {
+		tc := tc
+
+		t.Run(tc.fn, func(t *testing.T) {
+			got, err := ExecuteString(EngineText, tc.fn, tc.template, data)
+			require.NoError(t, err)
+
+			snapshotPath := filepath.Join("testdata", "funcs", tc.fn+".golden")
+			if os.Getenv("PRENV_TEST_TAKE_SNAPSHOT") != "" {
+				t.Logf("Storing snapshot at %s", snapshotPath)
+				require.NoError(t, os.MkdirAll(filepath.Dir(snapshotPath), 0755))
+				require.NoError(t, os.WriteFile(snapshotPath, []byte(got), 0644))
+				return
+			}
+
+			want, err := os.ReadFile(snapshotPath)
+			require.NoError(t, err, "failed to read snapshot. Run `PRENV_TEST_TAKE_SNAPSHOT=1 go test ./...` to update the snapshot")
+			require.Equal(t, string(want), got)
+		})
+	}
+}
+
+func TestFuncsAreAllTested(t *testing.T) {
+	tested := map[string]bool{}
+	for _, tc := range funcsTestCases {
+		tested[tc.fn] = true
+	}
+
+	for fn := range FuncMap() {
+		require.True(t, tested[fn], "function %q has no test case", fn)
+	}
+}
+
+func TestFuncsErrors(t *testing.T) {
+	testcases := []struct {
+		template string
+		err      string
+	}{
+		{`{{ required "name is required" .Empty }}`, "name is required"},
+		{`{{ fail "something went wrong" }}`, "something went wrong"},
+		{`{{ fromJson "{" }}`, "unexpected end of JSON input"},
+	}
+
+	for _, tc := range testcases {
+		_, err := ExecuteString(EngineText, "test", tc.template, funcsTestData{})
+		require.ErrorContains(t, err, tc.err)
+	}
+}
+
+func TestExecuteStringEngines(t *testing.T) {
+	data := map[string]string{"Value": `a<b & "c"`}
+
+	text, err := ExecuteString("", "test", `value: {{ .Value }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, `value: a<b & "c"`, text)
+
+	html, err := ExecuteString(EngineHTML, "test", `value: {{ .Value }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, `value: a&lt;b &amp; &#34;c&#34;`, html)
+
+	_, err = ExecuteString("jinja", "test", `value: {{ .Value }}`, data)
+	require.ErrorContains(t, err, `unsupported template engine "jinja"`)
+}
@@ -5,16 +5,29 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"html/template"
+	htmltemplate "html/template"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"text/template"
 )
 
 const (
 	tempDirPattern = "prenvrender"
 )
 
+const (
+	// EngineText renders the templates with text/template and the functions provided by FuncMap.
+	// This is the default engine.
+	EngineText = "text"
+	// EngineHTML renders the templates with html/template and the functions b64enc, split, and toJson only,
+	// which is how older prenv rendered the templates.
+	// The output is HTML-escaped, so this is only for the configs that rely on the escaping.
+	EngineHTML = "html"
+)
+
 // Template is a template of the rendered file.
 type Template struct {
 	// Name is the name of the Kubernetes application.
@@ -23,6 +36,12 @@ type Template struct {
 	Body string
 	// Data is the data to be used to render the file.
 	Data interface{}
+	// Engine is the template engine to be used to render the file.
+	// Either EngineText or EngineHTML. Defaults to EngineText.
+	Engine string
+	// Partials is the list of Go templates that define named templates via {{ define "name" }},
+	// which the Body can include via {{ template "name" . }}.
+	Partials []string
 }
 
 // File is the rendered file to be written to the filesystem.
@@ -110,8 +129,85 @@ func Execute(t Template) ([]File, error) {
 		return nil, fmt.Errorf("data must not be nil: config=%v", t)
 	}
 
-	m := template.New(t.Name)
-	m = m.Funcs(template.FuncMap{
+	content, err := execute(t.Engine, t.Name, t.Body, t.Partials, t.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []File{
+		{
+			Path:    t.Name,
+			Content: content,
+		},
+	}, nil
+}
+
+// ExecuteString executes the template text with the engine, and returns the rendered string.
+func ExecuteString(engine, name, text string, data interface{}) (string, error) {
+	return execute(engine, name, text, nil, data)
+}
+
+func execute(engine, name, text string, partials []string, data interface{}) (string, error) {
+	var buf bytes.Buffer
+
+	switch engine {
+	case "", EngineText:
+		m := template.New(name).Funcs(FuncMap())
+
+		for i, p := range partials {
+			if _, err := m.New(fmt.Sprintf("partial%d", i)).Parse(p); err != nil {
+				return "", fmt.Errorf("unable to parse partial: %w", err)
+			}
+		}
+
+		if _, err := m.Parse(text); err != nil {
+			return "", err
+		}
+
+		if err := m.Execute(&buf, data); err != nil {
+			return "", err
+		}
+	case EngineHTML:
+		m := htmltemplate.New(name).Funcs(htmlFuncMap())
+
+		for i, p := range partials {
+			if _, err := m.New(fmt.Sprintf("partial%d", i)).Parse(p); err != nil {
+				return "", fmt.Errorf("unable to parse partial: %w", err)
+			}
+		}
+
+		if _, err := m.Parse(text); err != nil {
+			return "", err
+		}
+
+		if err := m.Execute(&buf, data); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported template engine %q: it must be either %q or %q", engine, EngineText, EngineHTML)
+	}
+
+	return buf.String(), nil
+}
+
+// Parse parses the template text with the engine without executing it,
+// so that syntax errors, like unclosed actions and undefined functions, are found before any run.
+func Parse(engine, name, text string) error {
+	switch engine {
+	case "", EngineText:
+		_, err := template.New(name).Funcs(FuncMap()).Parse(text)
+		return err
+	case EngineHTML:
+		_, err := htmltemplate.New(name).Funcs(htmlFuncMap()).Parse(text)
+		return err
+	default:
+		return fmt.Errorf("unsupported template engine %q: it must be either %q or %q", engine, EngineText, EngineHTML)
+	}
+}
+
+// htmlFuncMap returns the functions available to the templates rendered with EngineHTML.
+func htmlFuncMap() htmltemplate.FuncMap {
+	return htmltemplate.FuncMap{
 		"b64enc": func(s string) string {
 			return base64.StdEncoding.EncodeToString([]byte(s))
 		},
@@ -125,22 +221,38 @@ func Execute(t Template) ([]File, error) {
 			}
 			return string(b), nil
 		},
-	})
-	m, err := m.Parse(t.Body)
+	}
+}
+
+// EvaluateList evaluates the template pipeline, like `.PullRequest.Numbers`, against the data,
+// and returns the resulting list.
+// It returns an error if the result is neither a list nor nil.
+func EvaluateList(pipeline string, data interface{}) ([]interface{}, error) {
+	var result interface{}
+
+	funcs := FuncMap()
+	funcs["prenvEvaluateListResult"] = func(v interface{}) string {
+		result = v
+		return ""
+	}
+
+	m, err := template.New("list").Funcs(funcs).Parse("{{ prenvEvaluateListResult (" + pipeline + ") }}")
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to parse %q: %w", pipeline, err)
 	}
 
-	var buf bytes.Buffer
+	if err := m.Execute(io.Discard, data); err != nil {
+		return nil, fmt.Errorf("unable to evaluate %q: %w", pipeline, err)
+	}
 
-	if err := m.Execute(&buf, t.Data); err != nil {
-		return nil, err
+	if result == nil {
+		return nil, nil
 	}
 
-	return []File{
-		{
-			Path:    t.Name,
-			Content: buf.String(),
-		},
-	}, nil
+	switch reflect.ValueOf(result).Kind() {
+	case reflect.Slice, reflect.Array:
+		return toList(result), nil
+	}
+
+	return nil, fmt.Errorf("%q must evaluate to a list, but got %T", pipeline, result)
 }
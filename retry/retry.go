@@ -0,0 +1,201 @@
+// Package retry provides the retry policy shared by the operations that talk to GitHub,
+// like git-push, pull request creation, and repository_dispatch.
+//
+// A single transient failure in one of those operations would otherwise fail the whole
+// provisioner chain, leaving the environment half-applied because the earlier provisioners
+// have already pushed their changes.
+//
+// Errors are classified into retryable and non-retryable ones.
+// Retryable errors are network errors, 5xx responses, and rate limit errors.
+// For rate limit errors, the retry waits for the duration the server asked for via Retry-After
+// or the rate limit reset time, as long as it fits in the retry budget.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/google/go-github/v56/github"
+	"github.com/sirupsen/logrus"
+)
+
+// Policy is a retry policy with exponential backoff and jitter.
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry.
+	// The delay is doubled on each retry, and randomized by the full jitter.
+	BaseDelay time.Duration
+	// MaxDelay is the upper bound of the delay between two attempts,
+	// except for the delay the server asked for via Retry-After.
+	MaxDelay time.Duration
+	// Budget is the upper bound of the total delay across all the retries.
+	// A retry that would exceed the budget is not attempted.
+	Budget time.Duration
+	// Classify returns whether the error is worth retrying, and the minimum duration to wait before the retry.
+	// Defaults to the package-level Classify.
+	// Callers that resolve an error themselves before the next attempt, like a rejected push
+	// that is redone on top of the updated remote branch, override it to retry only that error.
+	Classify func(err error) (bool, time.Duration)
+}
+
+// DefaultPolicy is the retry policy used by prenv unless otherwise specified.
+var DefaultPolicy = Policy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+	Budget:      2 * time.Minute,
+}
+
+// Do runs fn with DefaultPolicy.
+func Do(ctx context.Context, op string, fn func() error) error {
+	return DefaultPolicy.Do(ctx, op, fn)
+}
+
+// Do runs fn until it succeeds, it returns a non-retryable error, or the policy gives up.
+// op is the human-readable name of the operation used in logs and errors.
+func (p Policy) Do(ctx context.Context, op string, fn func() error) error {
+	var waited time.Duration
+
+	classify := p.Classify
+	if classify == nil {
+		classify = Classify
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		retryable, after := classify(err)
+		if !retryable {
+			return err
+		}
+
+		if attempt >= p.MaxAttempts {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", op, attempt, err)
+		}
+
+		delay := p.delay(attempt)
+		if after > delay {
+			delay = after
+		}
+
+		if waited+delay > p.Budget {
+			return fmt.Errorf("%s: giving up as the retry budget of %s is exhausted after %d attempts: %w", op, p.Budget, attempt, err)
+		}
+
+		logrus.Warnf("%s: retrying in %s after attempt %d failed: %v", op, delay, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w: %v", op, ctx.Err(), err)
+		case <-time.After(delay):
+		}
+
+		waited += delay
+	}
+}
+
+// delay returns the exponential backoff delay with the full jitter for the retry after the given attempt.
+func (p Policy) delay(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Classify returns whether the error is worth retrying,
+// and the minimum duration to wait before the retry, if the server asked for one.
+func Classify(err error) (bool, time.Duration) {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		if abuseErr.RetryAfter != nil {
+			return true, *abuseErr.RetryAfter
+		}
+		return true, 0
+	}
+
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		return true, time.Until(rateErr.Rate.Reset.Time)
+	}
+
+	var ghErr *github.ErrorResponse
+	if errors.As(err, &ghErr) {
+		return classifyResponse(ghErr.Response)
+	}
+
+	var gitErr *githttp.Err
+	if errors.As(err, &gitErr) {
+		return classifyResponse(gitErr.Response)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, 0
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true, 0
+	}
+
+	return false, 0
+}
+
+func classifyResponse(r *http.Response) (bool, time.Duration) {
+	if r == nil {
+		return false, 0
+	}
+
+	after := retryAfter(r)
+
+	switch {
+	case r.StatusCode >= 500:
+		return true, after
+	case r.StatusCode == http.StatusTooManyRequests:
+		return true, after
+	case r.StatusCode == http.StatusForbidden && after > 0:
+		// GitHub responds to secondary rate limit violations with 403 and Retry-After.
+		return true, after
+	}
+
+	return false, 0
+}
+
+func retryAfter(r *http.Response) time.Duration {
+	v := r.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
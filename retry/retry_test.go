@@ -0,0 +1,160 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/google/go-github/v56/github"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	retryAfter := 3 * time.Second
+
+	testcases := []struct {
+		name      string
+		err       error
+		retryable bool
+		after     time.Duration
+	}{
+		{
+			name: "canceled",
+			err:  fmt.Errorf("wrapped: %w", context.Canceled),
+		},
+		{
+			name: "unknown",
+			err:  errors.New("unknown"),
+		},
+		{
+			name:      "github 502",
+			err:       &github.ErrorResponse{Response: newResponse(http.StatusBadGateway, "")},
+			retryable: true,
+		},
+		{
+			name: "github 422",
+			err:  &github.ErrorResponse{Response: newResponse(http.StatusUnprocessableEntity, "")},
+		},
+		{
+			name:      "github 403 with retry-after",
+			err:       &github.ErrorResponse{Response: newResponse(http.StatusForbidden, "7")},
+			retryable: true,
+			after:     7 * time.Second,
+		},
+		{
+			name: "github 403 without retry-after",
+			err:  &github.ErrorResponse{Response: newResponse(http.StatusForbidden, "")},
+		},
+		{
+			name:      "github secondary rate limit",
+			err:       fmt.Errorf("wrapped: %w", &github.AbuseRateLimitError{Response: newResponse(http.StatusForbidden, ""), RetryAfter: &retryAfter}),
+			retryable: true,
+			after:     retryAfter,
+		},
+		{
+			name:      "git 503",
+			err:       fmt.Errorf("push: %w", &githttp.Err{Response: newResponse(http.StatusServiceUnavailable, "")}),
+			retryable: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			retryable, after := Classify(tc.err)
+			require.Equal(t, tc.retryable, retryable)
+			require.Equal(t, tc.after, after)
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	p := Policy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    time.Millisecond,
+		Budget:      time.Second,
+	}
+
+	transient := &github.ErrorResponse{Response: newResponse(http.StatusBadGateway, "")}
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		var attempts int
+		err := p.Do(context.Background(), "test", func() error {
+			attempts++
+			if attempts < 3 {
+				return transient
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		var attempts int
+		err := p.Do(context.Background(), "test", func() error {
+			attempts++
+			return transient
+		})
+		require.ErrorIs(t, err, transient)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("does not retry non-retryable errors", func(t *testing.T) {
+		var attempts int
+		err := p.Do(context.Background(), "test", func() error {
+			attempts++
+			return errors.New("permanent")
+		})
+		require.EqualError(t, err, "permanent")
+		require.Equal(t, 1, attempts)
+	})
+
+	t.Run("retries only the errors of the custom classification", func(t *testing.T) {
+		conflict := errors.New("conflict")
+
+		custom := p
+		custom.Classify = func(err error) (bool, time.Duration) {
+			return errors.Is(err, conflict), 0
+		}
+
+		var attempts int
+		err := custom.Do(context.Background(), "test", func() error {
+			attempts++
+			if attempts < 3 {
+				return conflict
+			}
+			return transient
+		})
+		require.ErrorIs(t, err, transient)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("gives up when retry-after exceeds the budget", func(t *testing.T) {
+		var attempts int
+		err := p.Do(context.Background(), "test", func() error {
+			attempts++
+			return &github.ErrorResponse{Response: newResponse(http.StatusTooManyRequests, "60")}
+		})
+		require.ErrorContains(t, err, "retry budget")
+		require.Equal(t, 1, attempts)
+	})
+}
+
+func newResponse(status int, retryAfter string) *http.Response {
+	r := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Request:    &http.Request{Method: http.MethodPost},
+	}
+
+	if retryAfter != "" {
+		r.Header.Set("Retry-After", retryAfter)
+	}
+
+	return r
+}
@@ -0,0 +1,90 @@
+package secretref
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted is the placeholder that replaces the resolved secrets in the logs.
+const Redacted = "***"
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+
+	hookOnce sync.Once
+)
+
+// register records the resolved secret so that it is redacted from the logs.
+//
+// The logrus hook that redacts the secrets is installed on the first secret,
+// and the secret is masked via the add-mask workflow command when prenv runs on GitHub Actions,
+// so that it is redacted from the outputs of the commands run by prenv too.
+func register(v string) {
+	values := []string{v}
+	if strings.Contains(v, "\n") {
+		values = append(values, strings.Split(v, "\n")...)
+	}
+
+	secretsMu.Lock()
+	for _, s := range values {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		secrets = append(secrets, s)
+
+		if os.Getenv("GITHUB_ACTIONS") == "true" && !strings.Contains(s, "\n") {
+			fmt.Fprintf(os.Stdout, "::add-mask::%s\n", s)
+		}
+	}
+	// Longer secrets are replaced first, so that a secret containing another one is redacted as a whole.
+	sort.SliceStable(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	secretsMu.Unlock()
+
+	hookOnce.Do(func() {
+		logrus.AddHook(redactHook{})
+	})
+}
+
+// Redact replaces all the resolved secrets in the string with Redacted.
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+
+	return s
+}
+
+// redactHook is the logrus hook that redacts the resolved secrets from the log messages and fields.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(e *logrus.Entry) error {
+	e.Message = Redact(e.Message)
+
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case string:
+			e.Data[k] = Redact(v)
+		case error:
+			e.Data[k] = errors.New(Redact(v.Error()))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+// Package secretref resolves the secret references in prenv.yaml, like `ref+env://SLACK_WEBHOOK_URL`.
+//
+// A secret reference stays as is in the configuration, including the raw_config sent to other repositories
+// via repository_dispatch, and is resolved only by the run that renders or applies the provisioner.
+// The syntax follows the one of helmfile/vals:
+//
+//	ref+env://NAME
+//	ref+file://path/to/file[#/path/to/key]
+//	ref+awssecrets://path/to/secret[?region=REGION&profile=PROFILE][#/path/to/key]
+//	ref+awsssm://path/to/param[?region=REGION&profile=PROFILE][#/path/to/key]
+//	ref+k8s://v1/Secret/NAMESPACE/NAME/KEY[?kubeContext=CONTEXT][#/path/to/key]
+//
+// The fragment selects a value from the YAML or JSON document the reference points to.
+//
+// Resolved values are redacted from the logs. See Redact.
+package secretref
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/mumoshu/prenv/awsclicompat"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const prefix = "ref+"
+
+// Ref is a parsed secret reference.
+type Ref struct {
+	// Scheme is the kind of the backend, like env, file, awssecrets, awsssm, and k8s.
+	Scheme string
+	// Path is the backend-specific path to the secret.
+	Path string
+	// Query is the backend-specific parameters, like the AWS region.
+	Query url.Values
+	// Fragment is the path to the key in the YAML or JSON document, like `/foo/bar`.
+	Fragment string
+}
+
+// IsRef returns true if the string is a secret reference.
+func IsRef(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// Parse parses the secret reference.
+func Parse(s string) (*Ref, error) {
+	if !IsRef(s) {
+		return nil, fmt.Errorf("secret reference must start with %q", prefix)
+	}
+
+	scheme, rest, ok := strings.Cut(strings.TrimPrefix(s, prefix), "://")
+	if !ok || scheme == "" {
+		return nil, fmt.Errorf("secret reference must be in the form of ref+<scheme>://<path>")
+	}
+
+	r := &Ref{Scheme: scheme}
+
+	rest, r.Fragment, _ = strings.Cut(rest, "#")
+
+	rest, query, _ := strings.Cut(rest, "?")
+
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %w", query, err)
+	}
+	r.Query = q
+
+	if rest == "" {
+		return nil, fmt.Errorf("secret reference must have a path")
+	}
+	r.Path = rest
+
+	return r, nil
+}
+
+type backend func(ctx context.Context, r *Ref) (string, error)
+
+var backends = map[string]backend{
+	"env":        resolveEnv,
+	"file":       resolveFile,
+	"awssecrets": resolveAWSSecrets,
+	"awsssm":     resolveAWSSSM,
+	"k8s":        resolveK8sSecret,
+}
+
+var (
+	mu    sync.Mutex
+	cache = map[string]string{}
+)
+
+// Resolve resolves the secret reference and returns the secret.
+// Each reference is resolved only once per process.
+func Resolve(ctx context.Context, ref string) (string, error) {
+	mu.Lock()
+	v, ok := cache[ref]
+	mu.Unlock()
+
+	if ok {
+		return v, nil
+	}
+
+	r, err := Parse(ref)
+	if err != nil {
+		return "", err
+	}
+
+	b, ok := backends[r.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported secret reference scheme %q", r.Scheme)
+	}
+
+	v, err = b(ctx, r)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %s: %w", ref, err)
+	}
+
+	if r.Fragment != "" {
+		v, err = selectKey(v, r.Fragment)
+		if err != nil {
+			return "", fmt.Errorf("unable to resolve %s: %w", ref, err)
+		}
+	}
+
+	register(v)
+
+	mu.Lock()
+	cache[ref] = v
+	mu.Unlock()
+
+	return v, nil
+}
+
+// ResolveString resolves the string if it is a secret reference, or returns it as is otherwise.
+func ResolveString(ctx context.Context, s string) (string, error) {
+	if !IsRef(s) {
+		return s, nil
+	}
+
+	return Resolve(ctx, s)
+}
+
+// selectKey selects the value at the path like `/foo/0/bar` from the YAML or JSON document.
+func selectKey(doc, path string) (string, error) {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(doc), &v); err != nil {
+		return "", fmt.Errorf("unable to parse the secret as YAML or JSON: %w", err)
+	}
+
+	for _, k := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		switch c := v.(type) {
+		case map[interface{}]interface{}:
+			e, ok := c[k]
+			if !ok {
+				return "", fmt.Errorf("key %q not found", k)
+			}
+			v = e
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(c) {
+				return "", fmt.Errorf("invalid index %q", k)
+			}
+			v = c[i]
+		default:
+			return "", fmt.Errorf("key %q not found", k)
+		}
+	}
+
+	switch v.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return "", fmt.Errorf("value at %s must be a scalar", path)
+	case nil:
+		return "", nil
+	}
+
+	return fmt.Sprintf("%v", v), nil
+}
+
+func resolveEnv(_ context.Context, r *Ref) (string, error) {
+	v, ok := os.LookupEnv(r.Path)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", r.Path)
+	}
+
+	return v, nil
+}
+
+func resolveFile(_ context.Context, r *Ref) (string, error) {
+	b, err := os.ReadFile(r.Path)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func resolveAWSSecrets(ctx context.Context, r *Ref) (string, error) {
+	sess := awsclicompat.NewSession(r.Query.Get("region"), r.Query.Get("profile"), "")
+
+	out, err := secretsmanager.New(sess).GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(r.Path),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if out.SecretString != nil {
+		return *out.SecretString, nil
+	}
+
+	return string(out.SecretBinary), nil
+}
+
+func resolveAWSSSM(ctx context.Context, r *Ref) (string, error) {
+	sess := awsclicompat.NewSession(r.Query.Get("region"), r.Query.Get("profile"), "")
+
+	out, err := ssm.New(sess).GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String("/" + strings.TrimPrefix(r.Path, "/")),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(out.Parameter.Value), nil
+}
+
+func resolveK8sSecret(ctx context.Context, r *Ref) (string, error) {
+	parts := strings.Split(r.Path, "/")
+	if len(parts) != 5 || parts[0] != "v1" || parts[1] != "Secret" {
+		return "", fmt.Errorf("path must be in the form of v1/Secret/NAMESPACE/NAME/KEY")
+	}
+
+	ns, name, key := parts[2], parts[3], parts[4]
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: r.Query.Get("kubeContext")},
+	).ClientConfig()
+	if err != nil {
+		return "", fmt.Errorf("failed to get kubernetes client config: %w", err)
+	}
+
+	c, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	s, err := c.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	v, ok := s.Data[key]
+	if !ok {
+		return "", fmt.Errorf("key %q not found in secret %s/%s", key, ns, name)
+	}
+
+	return string(v), nil
+}
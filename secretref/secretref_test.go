@@ -0,0 +1,153 @@
+package secretref
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	r, err := Parse("ref+awssecrets://myteam/mysecret?region=us-east-2#/foo/bar")
+	require.NoError(t, err)
+	require.Equal(t, &Ref{
+		Scheme:   "awssecrets",
+		Path:     "myteam/mysecret",
+		Query:    url.Values{"region": []string{"us-east-2"}},
+		Fragment: "/foo/bar",
+	}, r)
+
+	_, err = Parse("env://FOO")
+	require.ErrorContains(t, err, `must start with "ref+"`)
+
+	_, err = Parse("ref+env:FOO")
+	require.ErrorContains(t, err, "must be in the form of")
+
+	_, err = Parse("ref+env://")
+	require.ErrorContains(t, err, "must have a path")
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("PRENV_TEST_RESOLVE_TOKEN", "s3cr3t")
+
+	v, err := Resolve(ctx, "ref+env://PRENV_TEST_RESOLVE_TOKEN")
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", v)
+
+	_, err = Resolve(ctx, "ref+env://PRENV_TEST_RESOLVE_UNSET")
+	require.ErrorContains(t, err, "environment variable PRENV_TEST_RESOLVE_UNSET is not set")
+
+	file := filepath.Join(t.TempDir(), "secrets.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("slack:\n  webhookURL: https://hooks.slack.com/services/T0/B0/XXXX\ntokens:\n- a\n- b\n"), 0644))
+
+	v, err = Resolve(ctx, "ref+file://"+file+"#/slack/webhookURL")
+	require.NoError(t, err)
+	require.Equal(t, "https://hooks.slack.com/services/T0/B0/XXXX", v)
+
+	v, err = Resolve(ctx, "ref+file://"+file+"#/tokens/1")
+	require.NoError(t, err)
+	require.Equal(t, "b", v)
+
+	_, err = Resolve(ctx, "ref+file://"+file+"#/slack")
+	require.ErrorContains(t, err, "must be a scalar")
+
+	_, err = Resolve(ctx, "ref+file://"+file+"#/missing")
+	require.ErrorContains(t, err, `key "missing" not found`)
+
+	_, err = Resolve(ctx, "ref+vault://secret/foo")
+	require.ErrorContains(t, err, `unsupported secret reference scheme "vault"`)
+
+	v, err = ResolveString(ctx, "not a reference")
+	require.NoError(t, err)
+	require.Equal(t, "not a reference", v)
+}
+
+type testConfig struct {
+	URL      string
+	Names    []string
+	Env      map[string]string
+	Nested   *testConfig
+	Args     testArgs
+	internal string
+}
+
+type testArgs struct {
+	Title string
+}
+
+func (a testArgs) ResolveSecretRefs(ctx context.Context) (interface{}, error) {
+	return testArgs{Title: "resolved by itself"}, nil
+}
+
+func TestResolveAll(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("PRENV_TEST_RESOLVE_ALL", "s3cr3t")
+
+	ref := "ref+env://PRENV_TEST_RESOLVE_ALL"
+
+	orig := &testConfig{
+		URL:   ref,
+		Names: []string{"foo", ref},
+		Env:   map[string]string{"TOKEN": ref},
+		Nested: &testConfig{
+			URL: ref,
+		},
+		Args:     testArgs{Title: ref},
+		internal: ref,
+	}
+
+	r, err := ResolveAll(ctx, orig)
+	require.NoError(t, err)
+
+	require.Equal(t, &testConfig{
+		URL:   "s3cr3t",
+		Names: []string{"foo", "s3cr3t"},
+		Env:   map[string]string{"TOKEN": "s3cr3t"},
+		Nested: &testConfig{
+			URL:  "s3cr3t",
+			Args: testArgs{Title: "resolved by itself"},
+		},
+		Args:     testArgs{Title: "resolved by itself"},
+		internal: ref,
+	}, r)
+
+	require.Equal(t, &testConfig{
+		URL:   ref,
+		Names: []string{"foo", ref},
+		Env:   map[string]string{"TOKEN": ref},
+		Nested: &testConfig{
+			URL: ref,
+		},
+		Args:     testArgs{Title: ref},
+		internal: ref,
+	}, orig, "the original value must be left untouched")
+}
+
+func TestRedact(t *testing.T) {
+	t.Setenv("PRENV_TEST_REDACT", "hunter2")
+
+	var buf bytes.Buffer
+
+	logger := logrus.StandardLogger()
+	out := logger.Out
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(out)
+
+	_, err := Resolve(context.Background(), "ref+env://PRENV_TEST_REDACT")
+	require.NoError(t, err)
+
+	require.Equal(t, "password is ***", Redact("password is hunter2"))
+
+	logrus.WithField("password", "hunter2").Infof("the password is %s", "hunter2")
+
+	require.NotContains(t, buf.String(), "hunter2")
+	require.Contains(t, buf.String(), "the password is ***")
+}
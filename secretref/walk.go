@@ -0,0 +1,154 @@
+package secretref
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Resolvable is implemented by the types that resolve the secret references in their own fields,
+// instead of having all their string fields resolved by ResolveAll.
+// This is useful for the types that contain untrusted inputs, like the title of a pull request,
+// that must never be resolved.
+type Resolvable interface {
+	// ResolveSecretRefs returns a copy of the value with the secret references resolved.
+	// The returned value must have the same type as the receiver.
+	ResolveSecretRefs(ctx context.Context) (interface{}, error)
+}
+
+var resolvableType = reflect.TypeOf((*Resolvable)(nil)).Elem()
+
+// ResolveAll returns a deep copy of v, which is usually a pointer to a struct,
+// with all the exported string fields, slice elements, and map values that are secret references resolved.
+//
+// v itself is left untouched, so that the secret references are kept as they are in v,
+// like the configuration that is sent to other repositories via repository_dispatch.
+func ResolveAll(ctx context.Context, v interface{}) (interface{}, error) {
+	r, err := resolveValue(ctx, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.IsValid() {
+		return v, nil
+	}
+
+	return r.Interface(), nil
+}
+
+func resolveValue(ctx context.Context, v reflect.Value) (reflect.Value, error) {
+	if !v.IsValid() {
+		return v, nil
+	}
+
+	if v.Kind() != reflect.Interface && v.Kind() != reflect.Pointer && v.Type().Implements(resolvableType) {
+		r, err := v.Interface().(Resolvable).ResolveSecretRefs(ctx)
+		if err != nil {
+			return v, err
+		}
+
+		rv := reflect.ValueOf(r)
+		if rv.Type() != v.Type() {
+			return v, fmt.Errorf("%s.ResolveSecretRefs returned %s", v.Type(), rv.Type())
+		}
+
+		return rv, nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, err := ResolveString(ctx, v.String())
+		if err != nil {
+			return v, err
+		}
+
+		out := reflect.New(v.Type()).Elem()
+		out.SetString(s)
+
+		return out, nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v, nil
+		}
+
+		e, err := resolveValue(ctx, v.Elem())
+		if err != nil {
+			return v, err
+		}
+
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(e)
+
+		return out, nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return v, nil
+		}
+
+		e, err := resolveValue(ctx, v.Elem())
+		if err != nil {
+			return v, err
+		}
+
+		out := reflect.New(v.Type()).Elem()
+		out.Set(e)
+
+		return out, nil
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+
+		for i := 0; i < v.NumField(); i++ {
+			// Unexported fields are copied as they are.
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+
+			f, err := resolveValue(ctx, v.Field(i))
+			if err != nil {
+				return v, err
+			}
+
+			out.Field(i).Set(f)
+		}
+
+		return out, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return v, nil
+		}
+
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+
+		for i := 0; i < v.Len(); i++ {
+			e, err := resolveValue(ctx, v.Index(i))
+			if err != nil {
+				return v, err
+			}
+
+			out.Index(i).Set(e)
+		}
+
+		return out, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return v, nil
+		}
+
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+
+		iter := v.MapRange()
+		for iter.Next() {
+			e, err := resolveValue(ctx, iter.Value())
+			if err != nil {
+				return v, err
+			}
+
+			out.SetMapIndex(iter.Key(), e)
+		}
+
+		return out, nil
+	}
+
+	return v, nil
+}
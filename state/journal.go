@@ -0,0 +1,48 @@
+package state
+
+const (
+	// JournalStatusApplied is the status of the provisioner that has been applied by the run.
+	JournalStatusApplied = "applied"
+	// JournalStatusDispatched is the status of the provisioner that has been delegated via repository_dispatch by the run.
+	JournalStatusDispatched = "dispatched"
+	// JournalStatusFailed is the status of the provisioner that failed the run.
+	JournalStatusFailed = "failed"
+)
+
+// Journal is the record of what each provisioner did during an apply of an environment.
+//
+// It is kept in the state store while the apply is running and after it failed,
+// so that the failed apply can be rolled back, or continued by `prenv apply --resume`.
+type Journal struct {
+	// Entries is the provisioners run by the apply, in the order they ran.
+	Entries []JournalEntry `yaml:"entries,omitempty"`
+
+	// Error is the error that failed the apply, if any.
+	Error string `yaml:"error,omitempty"`
+}
+
+// JournalEntry is what a provisioner did during the apply.
+type JournalEntry struct {
+	// Provisioner is the name of the provisioner.
+	Provisioner string `yaml:"provisioner"`
+
+	// Created is true when the provisioner had not been applied to the environment before the apply,
+	// which means that rolling it back destroys it.
+	Created bool `yaml:"created,omitempty"`
+
+	// Status is either JournalStatusApplied, JournalStatusDispatched, or JournalStatusFailed.
+	Status string `yaml:"status"`
+}
+
+// Completed returns the names of the provisioners that completed in the apply.
+func (j *Journal) Completed() map[string]bool {
+	completed := map[string]bool{}
+
+	for _, e := range j.Entries {
+		if e.Status != JournalStatusFailed {
+			completed[e.Provisioner] = true
+		}
+	}
+
+	return completed
+}
@@ -1,7 +1,22 @@
 package state
 
+import "sort"
+
 type State struct {
 	EnvironmentNames []string `yaml:"environmentNames"`
+
+	// Outputs is the outputs of the provisioners, keyed by the name of the environment and then the name of the provisioner.
+	Outputs map[string]map[string]map[string]interface{} `yaml:"outputs,omitempty"`
+
+	// Applied is the names of the provisioners that have been applied to the environment, keyed by the name of the environment.
+	Applied map[string][]string `yaml:"applied,omitempty"`
+
+	// Journals is the journal of the running or the failed apply, keyed by the name of the environment.
+	Journals map[string]*Journal `yaml:"journals,omitempty"`
+
+	// Configs is the config that the environment was last applied with successfully, keyed by the name of the environment.
+	// It is recorded only when onFailure is rollback, to roll the provisioners back to.
+	Configs map[string]string `yaml:"configs,omitempty"`
 }
 
 func (s *State) AddEnvironmentName(envName string) {
@@ -16,4 +31,89 @@ func (s *State) DeleteEnvironmentName(envName string) {
 		}
 	}
 	s.EnvironmentNames = envs
+
+	delete(s.Outputs, envName)
+	delete(s.Applied, envName)
+	delete(s.Journals, envName)
+	delete(s.Configs, envName)
+}
+
+// SetOutputs records the outputs of the provisioner for the environment.
+// Empty outputs delete the record.
+func (s *State) SetOutputs(envName, provisioner string, outputs map[string]interface{}) {
+	if len(outputs) == 0 {
+		delete(s.Outputs[envName], provisioner)
+
+		if len(s.Outputs[envName]) == 0 {
+			delete(s.Outputs, envName)
+		}
+
+		return
+	}
+
+	if s.Outputs == nil {
+		s.Outputs = map[string]map[string]map[string]interface{}{}
+	}
+
+	if s.Outputs[envName] == nil {
+		s.Outputs[envName] = map[string]map[string]interface{}{}
+	}
+
+	s.Outputs[envName][provisioner] = outputs
+}
+
+// SetApplied records whether the provisioner has been applied to the environment.
+func (s *State) SetApplied(envName, provisioner string, applied bool) {
+	var names []string
+	for _, name := range s.Applied[envName] {
+		if name != provisioner {
+			names = append(names, name)
+		}
+	}
+
+	if applied {
+		names = append(names, provisioner)
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		delete(s.Applied, envName)
+		return
+	}
+
+	if s.Applied == nil {
+		s.Applied = map[string][]string{}
+	}
+
+	s.Applied[envName] = names
+}
+
+// SetJournal records the journal of the apply of the environment.
+// A nil journal deletes the record.
+func (s *State) SetJournal(envName string, journal *Journal) {
+	if journal == nil {
+		delete(s.Journals, envName)
+		return
+	}
+
+	if s.Journals == nil {
+		s.Journals = map[string]*Journal{}
+	}
+
+	s.Journals[envName] = journal
+}
+
+// SetConfig records the config that the environment was last applied with successfully.
+// An empty config deletes the record.
+func (s *State) SetConfig(envName, config string) {
+	if config == "" {
+		delete(s.Configs, envName)
+		return
+	}
+
+	if s.Configs == nil {
+		s.Configs = map[string]string{}
+	}
+
+	s.Configs[envName] = config
 }
@@ -52,6 +52,30 @@ type Store interface {
 	AddEnvironmentName(ctx context.Context, name string) error
 	DeleteEnvironmentName(ctx context.Context, name string) error
 	ListEnvironmentNames(ctx context.Context) ([]string, error)
+
+	// SetOutputs records the outputs of the provisioner for the environment,
+	// so that later runs for the environment can use them.
+	// Empty outputs delete the record.
+	SetOutputs(ctx context.Context, envName, provisioner string, outputs map[string]interface{}) error
+	// GetOutputs returns the outputs of the provisioners for the environment, keyed by the name of the provisioner.
+	GetOutputs(ctx context.Context, envName string) (map[string]map[string]interface{}, error)
+
+	// SetApplied records whether the provisioner has been applied to the environment.
+	SetApplied(ctx context.Context, envName, provisioner string, applied bool) error
+	// GetApplied returns the names of the provisioners that have been applied to the environment.
+	GetApplied(ctx context.Context, envName string) ([]string, error)
+
+	// SetJournal records the journal of the apply of the environment.
+	// A nil journal deletes the record.
+	SetJournal(ctx context.Context, envName string, journal *Journal) error
+	// GetJournal returns the journal of the running or the failed apply of the environment, or nil if there is none.
+	GetJournal(ctx context.Context, envName string) (*Journal, error)
+
+	// SetConfig records the config that the environment was last applied with successfully.
+	// An empty config deletes the record.
+	SetConfig(ctx context.Context, envName, config string) error
+	// GetConfig returns the config that the environment was last applied with successfully, or an empty string if there is none.
+	GetConfig(ctx context.Context, envName string) (string, error)
 }
 
 type datastore interface {
@@ -86,6 +86,118 @@ func (s *ConfigMapStore) ListEnvironmentNames(ctx context.Context) ([]string, er
 	return state.EnvironmentNames, nil
 }
 
+// SetOutputs records the outputs of the provisioner for the environment in the state ConfigMap.
+func (s *ConfigMapStore) SetOutputs(ctx context.Context, envName, provisioner string, outputs map[string]interface{}) error {
+	c, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	cm, err := c.CoreV1().ConfigMaps(s.getNamespace()).Get(ctx, s.getName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.modifyState(ctx, cm, func(s *State) {
+		s.SetOutputs(envName, provisioner, outputs)
+	})
+
+	return err
+}
+
+func (s *ConfigMapStore) GetOutputs(ctx context.Context, envName string) (map[string]map[string]interface{}, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Outputs[envName], nil
+}
+
+// SetApplied records whether the provisioner has been applied to the environment in the state ConfigMap.
+func (s *ConfigMapStore) SetApplied(ctx context.Context, envName, provisioner string, applied bool) error {
+	c, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	cm, err := c.CoreV1().ConfigMaps(s.getNamespace()).Get(ctx, s.getName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.modifyState(ctx, cm, func(s *State) {
+		s.SetApplied(envName, provisioner, applied)
+	})
+
+	return err
+}
+
+func (s *ConfigMapStore) GetApplied(ctx context.Context, envName string) ([]string, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Applied[envName], nil
+}
+
+// SetJournal records the journal of the apply of the environment in the state ConfigMap.
+func (s *ConfigMapStore) SetJournal(ctx context.Context, envName string, journal *Journal) error {
+	c, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	cm, err := c.CoreV1().ConfigMaps(s.getNamespace()).Get(ctx, s.getName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.modifyState(ctx, cm, func(s *State) {
+		s.SetJournal(envName, journal)
+	})
+
+	return err
+}
+
+func (s *ConfigMapStore) GetJournal(ctx context.Context, envName string) (*Journal, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Journals[envName], nil
+}
+
+// SetConfig records the config that the environment was last applied with successfully in the state ConfigMap.
+func (s *ConfigMapStore) SetConfig(ctx context.Context, envName, config string) error {
+	c, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	cm, err := c.CoreV1().ConfigMaps(s.getNamespace()).Get(ctx, s.getName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.modifyState(ctx, cm, func(s *State) {
+		s.SetConfig(envName, config)
+	})
+
+	return err
+}
+
+func (s *ConfigMapStore) GetConfig(ctx context.Context, envName string) (string, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return state.Configs[envName], nil
+}
+
 func (s *ConfigMapStore) getKey() string {
 	if s.Key == "" {
 		return DefaultKey
@@ -91,6 +91,114 @@ func (s *GitStore) ListEnvironmentNames(ctx context.Context) ([]string, error) {
 	return state.EnvironmentNames, nil
 }
 
+func (s *GitStore) SetOutputs(ctx context.Context, envName, provisioner string, outputs map[string]interface{}) error {
+	return s.ds.ModifyFile("set-outputs-"+envName, s.stateFilePath, "Set outputs of "+provisioner+" for "+envName, func(data []byte) ([]byte, error) {
+		ds := &yamlDataStore{}
+		s, err := ds.load(context.Background(), data)
+		if err != nil {
+			return nil, err
+		}
+
+		s.SetOutputs(envName, provisioner, outputs)
+
+		if err := ds.setState(context.Background(), s); err != nil {
+			return nil, err
+		}
+
+		return ds.getData(), nil
+	})
+}
+
+func (s *GitStore) GetOutputs(ctx context.Context, envName string) (map[string]map[string]interface{}, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Outputs[envName], nil
+}
+
+func (s *GitStore) SetApplied(ctx context.Context, envName, provisioner string, applied bool) error {
+	return s.ds.ModifyFile("set-applied-"+envName, s.stateFilePath, "Set applied of "+provisioner+" for "+envName, func(data []byte) ([]byte, error) {
+		ds := &yamlDataStore{}
+		s, err := ds.load(context.Background(), data)
+		if err != nil {
+			return nil, err
+		}
+
+		s.SetApplied(envName, provisioner, applied)
+
+		if err := ds.setState(context.Background(), s); err != nil {
+			return nil, err
+		}
+
+		return ds.getData(), nil
+	})
+}
+
+func (s *GitStore) GetApplied(ctx context.Context, envName string) ([]string, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Applied[envName], nil
+}
+
+func (s *GitStore) SetJournal(ctx context.Context, envName string, journal *Journal) error {
+	return s.ds.ModifyFile("set-journal-"+envName, s.stateFilePath, "Set journal for "+envName, func(data []byte) ([]byte, error) {
+		ds := &yamlDataStore{}
+		s, err := ds.load(context.Background(), data)
+		if err != nil {
+			return nil, err
+		}
+
+		s.SetJournal(envName, journal)
+
+		if err := ds.setState(context.Background(), s); err != nil {
+			return nil, err
+		}
+
+		return ds.getData(), nil
+	})
+}
+
+func (s *GitStore) GetJournal(ctx context.Context, envName string) (*Journal, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Journals[envName], nil
+}
+
+func (s *GitStore) SetConfig(ctx context.Context, envName, config string) error {
+	return s.ds.ModifyFile("set-config-"+envName, s.stateFilePath, "Set config for "+envName, func(data []byte) ([]byte, error) {
+		ds := &yamlDataStore{}
+		s, err := ds.load(context.Background(), data)
+		if err != nil {
+			return nil, err
+		}
+
+		s.SetConfig(envName, config)
+
+		if err := ds.setState(context.Background(), s); err != nil {
+			return nil, err
+		}
+
+		return ds.getData(), nil
+	})
+}
+
+func (s *GitStore) GetConfig(ctx context.Context, envName string) (string, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return state.Configs[envName], nil
+}
+
 func (s *GitStore) getState(ctx context.Context) (*State, error) {
 	yamlData, err := s.ds.GetFileFromBranch("get-envs", s.stateFilePath)
 	if err != nil {
@@ -49,6 +49,86 @@ func (s *YAMLFileStore) ListEnvironmentNames(ctx context.Context) ([]string, err
 	return state.EnvironmentNames, nil
 }
 
+func (s *YAMLFileStore) SetOutputs(ctx context.Context, envName, provisioner string, outputs map[string]interface{}) error {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return err
+	}
+
+	state.SetOutputs(envName, provisioner, outputs)
+
+	return s.setState(ctx, state)
+}
+
+func (s *YAMLFileStore) GetOutputs(ctx context.Context, envName string) (map[string]map[string]interface{}, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Outputs[envName], nil
+}
+
+func (s *YAMLFileStore) SetApplied(ctx context.Context, envName, provisioner string, applied bool) error {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return err
+	}
+
+	state.SetApplied(envName, provisioner, applied)
+
+	return s.setState(ctx, state)
+}
+
+func (s *YAMLFileStore) GetApplied(ctx context.Context, envName string) ([]string, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Applied[envName], nil
+}
+
+func (s *YAMLFileStore) SetJournal(ctx context.Context, envName string, journal *Journal) error {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return err
+	}
+
+	state.SetJournal(envName, journal)
+
+	return s.setState(ctx, state)
+}
+
+func (s *YAMLFileStore) GetJournal(ctx context.Context, envName string) (*Journal, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Journals[envName], nil
+}
+
+func (s *YAMLFileStore) SetConfig(ctx context.Context, envName, config string) error {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return err
+	}
+
+	state.SetConfig(envName, config)
+
+	return s.setState(ctx, state)
+}
+
+func (s *YAMLFileStore) GetConfig(ctx context.Context, envName string) (string, error) {
+	state, err := s.getState(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return state.Configs[envName], nil
+}
+
 func (s *YAMLFileStore) getState(ctx context.Context) (*State, error) {
 	yamlData, err := os.ReadFile(s.Path)
 	if err != nil && !os.IsNotExist(err) {
@@ -23,8 +23,16 @@ import (
 	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/mumoshu/prenv/retry"
 )
 
+// ErrNonFastForward is returned by Commit when the push was rejected
+// because the remote branch has been updated since the clone.
+//
+// The local repository is reset to the remote branch before the error is returned,
+// so that the caller can re-render and re-commit the changes by calling Transact and Commit again.
+var ErrNonFastForward = errors.New("non-fast-forward")
+
 // Git is a key-value-store-like interface for gitops config repository.
 type Git struct {
 	Auth transport.AuthMethod
@@ -66,6 +74,12 @@ type Git struct {
 
 	// Push specifies whether the gitops config is updated via git push.
 	Push bool
+
+	// ForcePush specifies whether the new branch is recreated from the base branch and force-pushed.
+	// If false, the new branch is checked out from the remote new branch if it exists,
+	// so that the changes are appended to it.
+	// This has no effect when NewRefName is nil.
+	ForcePush bool
 }
 
 func newGit(auth transport.AuthMethod, baseBranch, newBranch, gitRepoURL, authorUserName, authorEmail, gitRoot string, push bool) *Git {
@@ -180,9 +194,13 @@ func (g *Git) Commit(ctx context.Context, subject, body string) error {
 		return fmt.Errorf("unable to commit: %w", err)
 	}
 
-	ref := plumbing.NewReferenceFromStrings(string(g.BaseRefName), hash.String())
-	if err := g.repository.Storer.SetReference(ref); err != nil {
-		return fmt.Errorf("unable to set reference %v: %w", ref, err)
+	// The local base branch must not point to the commit on the new branch.
+	// Otherwise the next Transact in the same local clone fails to pull the base branch.
+	if g.NewRefName == nil {
+		ref := plumbing.NewReferenceFromStrings(string(g.BaseRefName), hash.String())
+		if err := g.repository.Storer.SetReference(ref); err != nil {
+			return fmt.Errorf("unable to set reference %v: %w", ref, err)
+		}
 	}
 
 	remote, err := g.repository.Remote("origin")
@@ -194,21 +212,135 @@ func (g *Git) Commit(ctx context.Context, subject, body string) error {
 		return nil
 	}
 
-	var refName plumbing.ReferenceName
+	var (
+		refName plumbing.ReferenceName
+		refSpec config.RefSpec
+	)
 	if g.NewRefName == nil {
 		refName = g.BaseRefName
+		refSpec = config.RefSpec(refName + ":" + refName)
 	} else {
 		refName = *g.NewRefName
+		refSpec = config.RefSpec(refName + ":" + refName)
+		if g.ForcePush {
+			refSpec = "+" + refSpec
+		}
 	}
 
-	if err := remote.Push(&git.PushOptions{
-		Progress: os.Stdout,
-		RefSpecs: []config.RefSpec{
-			config.RefSpec(refName + ":" + refName),
-		},
-		Auth: g.Auth,
+	if err := retry.Do(ctx, fmt.Sprintf("git-push %s", refName), func() error {
+		err := remote.PushContext(ctx, &git.PushOptions{
+			Progress: os.Stdout,
+			RefSpecs: []config.RefSpec{
+				refSpec,
+			},
+			Auth: g.Auth,
+		})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
 	}); err != nil {
-		return fmt.Errorf("unable to push %v to remote origin: %w", *g.NewRefName, err)
+		if isNonFastForward(err) {
+			if resetErr := g.resetToRemote(ctx); resetErr != nil {
+				return fmt.Errorf("unable to push %v to remote origin: %w: %w", refName, ErrNonFastForward, resetErr)
+			}
+			return fmt.Errorf("unable to push %v to remote origin: %w: %v", refName, ErrNonFastForward, err)
+		}
+		return fmt.Errorf("unable to push %v to remote origin: %w", refName, err)
+	}
+
+	return nil
+}
+
+// HasChanges returns true if any change is staged to be committed, like the files added or deleted in Transact.
+func (g *Git) HasChanges() (bool, error) {
+	w, err := g.getWorktree()
+	if err != nil {
+		return false, fmt.Errorf("unable to get worktree: %w", err)
+	}
+
+	status, err := w.Status()
+	if err != nil {
+		return false, fmt.Errorf("unable to get worktree status: %w", err)
+	}
+
+	for _, s := range status {
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isNonFastForward returns true if the push was rejected because the remote branch
+// has commits that the local branch does not have.
+//
+// go-git reports it either as a local check failure before sending the pack,
+// or as the rejection reported by the remote, both only via the error message.
+func isNonFastForward(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "non-fast-forward") || strings.Contains(msg, "fetch first")
+}
+
+// resetToRemote discards the local commit that failed to be pushed,
+// by fetching the base branch and hard-resetting the local base branch to it.
+// The feature branch, if any, is deleted so that the next Transact can recreate it.
+//
+// This is used to start over from the latest remote branch on the next Transact,
+// when the push was rejected due to a concurrent push to the same branch.
+func (g *Git) resetToRemote(ctx context.Context) error {
+	remote, err := g.repository.Remote("origin")
+	if err != nil {
+		return fmt.Errorf("unable to get remote origin: %w", err)
+	}
+
+	remoteRefName := plumbing.NewRemoteReferenceName("origin", g.BaseRefName.Short())
+
+	if err := retry.Do(ctx, fmt.Sprintf("git-fetch %s", g.BaseRefName), func() error {
+		err := remote.FetchContext(ctx, &git.FetchOptions{
+			Auth: g.Auth,
+			RefSpecs: []config.RefSpec{
+				config.RefSpec("+" + g.BaseRefName + ":" + remoteRefName),
+			},
+			Force: true,
+		})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
+	}); err != nil {
+		return fmt.Errorf("unable to fetch %s: %w", g.BaseRefName, err)
+	}
+
+	ref, err := g.repository.Reference(remoteRefName, true)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %s: %w", remoteRefName, err)
+	}
+
+	w, err := g.getWorktree()
+	if err != nil {
+		return fmt.Errorf("unable to get worktree: %w", err)
+	}
+
+	if err := w.Checkout(&git.CheckoutOptions{
+		Branch: g.BaseRefName,
+		Force:  true,
+	}); err != nil {
+		return fmt.Errorf("unable to checkout %s: %w", g.BaseRefName, err)
+	}
+
+	if err := w.Reset(&git.ResetOptions{
+		Commit: ref.Hash(),
+		Mode:   git.HardReset,
+	}); err != nil {
+		return fmt.Errorf("unable to reset %s to %s: %w", g.BaseRefName, ref.Hash(), err)
+	}
+
+	if g.NewRefName != nil {
+		if err := g.repository.Storer.RemoveReference(*g.NewRefName); err != nil {
+			return fmt.Errorf("unable to delete branch %s: %w", *g.NewRefName, err)
+		}
 	}
 
 	return nil
@@ -468,15 +600,32 @@ func (s *Git) createAndCheckoutNewBranch(branch string) (*git.Worktree, error) {
 	}
 
 	if b != nil {
-		// h, err := s.repository.Head()
-		// if err != nil {
-		// 	return nil, fmt.Errorf("unable to resolve revision %q: %w", s.BaseRefName, err)
-		// }
-		if err := w.Checkout(&git.CheckoutOptions{
+		opts := &git.CheckoutOptions{
 			Create: true,
-			// Hash:   h.Hash(),
 			Branch: *b,
-		}); err != nil {
+		}
+
+		if branch == "" {
+			// The new branch is stable across runs for the same environment,
+			// and therefore might be left in the local clone by a previous run.
+			// It is recreated from either the base branch or the remote new branch.
+			if err := s.repository.Storer.RemoveReference(*b); err != nil {
+				return nil, fmt.Errorf("unable to delete local branch %q: %w", *b, err)
+			}
+
+			if !s.ForcePush {
+				h, err := s.fetchBranch(*b)
+				if err != nil {
+					return nil, err
+				}
+
+				if h != nil {
+					opts.Hash = *h
+				}
+			}
+		}
+
+		if err := w.Checkout(opts); err != nil {
 			return nil, fmt.Errorf("unable to checkout branch %q: %w", *b, err)
 		}
 	}
@@ -484,6 +633,39 @@ func (s *Git) createAndCheckoutNewBranch(branch string) (*git.Worktree, error) {
 	return w, nil
 }
 
+// fetchBranch fetches the remote branch and returns the hash of its head.
+// It returns nil if the remote branch does not exist.
+func (s *Git) fetchBranch(name plumbing.ReferenceName) (*plumbing.Hash, error) {
+	remote, err := s.repository.Remote("origin")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get remote origin: %w", err)
+	}
+
+	remoteRefName := plumbing.NewRemoteReferenceName("origin", name.Short())
+
+	if err := remote.Fetch(&git.FetchOptions{
+		Auth: s.Auth,
+		RefSpecs: []config.RefSpec{
+			config.RefSpec("+" + name + ":" + remoteRefName),
+		},
+		Force: true,
+	}); err != nil && err != git.NoErrAlreadyUpToDate {
+		if errors.Is(err, git.NoMatchingRefSpecError{}) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to fetch %s: %w", name, err)
+	}
+
+	ref, err := s.repository.Reference(remoteRefName, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %s: %w", remoteRefName, err)
+	}
+
+	h := ref.Hash()
+
+	return &h, nil
+}
+
 func (s *Git) verify(w *git.Worktree) error {
 	status, err := w.Status()
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
 	"time"
@@ -93,3 +94,76 @@ func TestGit(t *testing.T) {
 		require.Empty(t, r2.AddedOrModifiedFiles)
 	})
 }
+
+func TestGitNonFastForward(t *testing.T) {
+	baseDir := t.TempDir()
+
+	remoteDir := filepath.Join(baseDir, "remote.git")
+	seedDir := filepath.Join(baseDir, "seed")
+	gitRoot := filepath.Join(baseDir, "gitroot")
+
+	runGit(t, baseDir, "init", "--bare", "--initial-branch=main", remoteDir)
+	runGit(t, baseDir, "clone", remoteDir, seedDir)
+	require.NoError(t, os.WriteFile(filepath.Join(seedDir, "README"), []byte("seed"), 0644))
+	runGit(t, seedDir, "add", ".")
+	runGit(t, seedDir, "commit", "-m", "initial commit")
+	runGit(t, seedDir, "push", "origin", "HEAD:main")
+
+	g := newGit(
+		nil,
+		"main",
+		"",
+		"file://"+remoteDir,
+		"test author", "test@example.com",
+		gitRoot,
+		true,
+	)
+
+	write := func(dir string) (*plugin.RenderResult, error) {
+		if err := os.WriteFile(filepath.Join(dir, "rendered"), []byte("rendered"), 0644); err != nil {
+			return nil, err
+		}
+		return &plugin.RenderResult{
+			AddedOrModifiedFiles: []string{"rendered"},
+		}, nil
+	}
+
+	_, err := g.Transact(write)
+	require.NoError(t, err)
+
+	// Someone else pushes to the same branch after we cloned it.
+	require.NoError(t, os.WriteFile(filepath.Join(seedDir, "concurrent"), []byte("concurrent"), 0644))
+	runGit(t, seedDir, "add", ".")
+	runGit(t, seedDir, "commit", "-m", "concurrent commit")
+	runGit(t, seedDir, "push", "origin", "HEAD:main")
+
+	ctx := context.Background()
+
+	err = g.Commit(ctx, "automated commit", "n/a")
+	require.ErrorIs(t, err, ErrNonFastForward)
+
+	_, err = g.Transact(write)
+	require.NoError(t, err)
+	require.NoError(t, g.Commit(ctx, "automated commit", "n/a"))
+
+	require.Equal(t, "concurrent", runGit(t, baseDir, "--git-dir", remoteDir, "show", "main:concurrent"))
+	require.Equal(t, "rendered", runGit(t, baseDir, "--git-dir", remoteDir, "show", "main:rendered"))
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=prenv-test",
+		"GIT_AUTHOR_EMAIL=prenv-test@example.com",
+		"GIT_COMMITTER_NAME=prenv-test",
+		"GIT_COMMITTER_EMAIL=prenv-test@example.com",
+	)
+
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "git %v: %s", args, out)
+
+	return string(out)
+}
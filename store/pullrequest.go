@@ -1,19 +1,44 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"text/template"
 
 	"github.com/google/go-github/v56/github"
 	"github.com/mumoshu/prenv/config"
 	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/mumoshu/prenv/retry"
 )
 
 type PullRequest struct {
 	RepositoryURL string
 	Git           *Git
 	PullRequest   *config.PullRequest
+
+	// Provisioner is the name of the provisioner that updates the gitops config via the pull request.
+	Provisioner string
+	// Action is either "apply" or "destroy".
+	Action string
+	// EnvArgs is the environment the pull request is for.
+	EnvArgs config.EnvArgs
+}
+
+// PullRequestTemplateData is the data available to the title and the body templates of the pull request.
+type PullRequestTemplateData struct {
+	config.EnvArgs
+
+	// Provisioner is the name of the provisioner that updates the gitops config via the pull request.
+	Provisioner string
+	// Action is either "apply" or "destroy".
+	Action string
+	// Subject and Body are the commit message.
+	Subject string
+	Body    string
 }
 
 func (c *PullRequest) Transact(fn func(path string) (*plugin.RenderResult, error)) (*plugin.RenderResult, error) {
@@ -41,12 +66,228 @@ func (c *PullRequest) Commit(ctx context.Context, subject, body string) error {
 		return err
 	}
 
-	return c.createPullRequest(ctx, subject, body)
+	return c.createOrUpdatePullRequest(ctx, subject, body)
 }
 
-func (c *PullRequest) createPullRequest(ctx context.Context, subject, body string) error {
+// ClosesOnDestroy returns true if the open pull request should be closed on destroy,
+// before opening a removal pull request only when the base branch still holds the files of the environment.
+func (c *PullRequest) ClosesOnDestroy() bool {
+	return c.PullRequest.OnDestroy != config.PullRequestOnDestroyPullRequest
+}
+
+// Close closes the open pull request for the environment, and deletes its branch.
+// It returns false if there is no open pull request.
+//
+// Note that closing the pull request does not undo the changes that the earlier pull requests for the environment
+// have merged into the base branch. It is up to the caller to open a removal pull request for them.
+func (c *PullRequest) Close(ctx context.Context) (bool, error) {
 	client := config.NewGitHubClient()
 
+	owner, repo := c.ownerRepo()
+
+	pr, err := c.findOpenPullRequest(ctx, client)
+	if err != nil {
+		return false, err
+	}
+
+	if pr == nil {
+		return false, nil
+	}
+
+	if err := retry.Do(ctx, fmt.Sprintf("close pull request %s/%s#%d", owner, repo, pr.GetNumber()), func() error {
+		_, _, err := client.PullRequests.Edit(ctx, owner, repo, pr.GetNumber(), &github.PullRequest{
+			State: github.String("closed"),
+		})
+		return err
+	}); err != nil {
+		return false, err
+	}
+
+	if err := retry.Do(ctx, fmt.Sprintf("delete branch %s in %s/%s", c.Git.NewRefName.Short(), owner, repo), func() error {
+		_, err := client.Git.DeleteRef(ctx, owner, repo, "heads/"+c.Git.NewRefName.Short())
+		return err
+	}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// createOrUpdatePullRequest updates the title and the body of the open pull request for the environment,
+// or creates a new one if there is none.
+func (c *PullRequest) createOrUpdatePullRequest(ctx context.Context, subject, body string) error {
+	title, body, err := c.renderTitleAndBody(subject, body)
+	if err != nil {
+		return err
+	}
+
+	client := config.NewGitHubClient()
+
+	owner, repo := c.ownerRepo()
+
+	existing, err := c.findOpenPullRequest(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	var pr *github.PullRequest
+
+	if existing == nil {
+		err = retry.Do(ctx, fmt.Sprintf("create pull request in %s/%s", owner, repo), func() error {
+			var err error
+			pr, _, err = client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
+				Title: github.String(title),
+				Head:  github.String(string(*c.Git.NewRefName)),
+				Base:  github.String(string(c.Git.BaseRefName)),
+				Body:  github.String(body),
+			})
+			if !pullRequestAlreadyExists(err) {
+				return err
+			}
+
+			// The previous attempt may have created the pull request before failing, like on a timeout,
+			// or a concurrent run may have created it. Update it instead of failing.
+			existing, err = c.findOpenPullRequest(ctx, client)
+			if err != nil {
+				return err
+			}
+
+			if existing == nil {
+				return fmt.Errorf("pull request for %s already exists in %s/%s, but it is not open", c.Git.NewRefName.Short(), owner, repo)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	created := existing == nil
+
+	if existing != nil {
+		err = retry.Do(ctx, fmt.Sprintf("update pull request %s/%s#%d", owner, repo, existing.GetNumber()), func() error {
+			var err error
+			pr, _, err = client.PullRequests.Edit(ctx, owner, repo, existing.GetNumber(), &github.PullRequest{
+				Title: github.String(title),
+				Body:  github.String(body),
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.decoratePullRequest(ctx, client, pr, created)
+}
+
+// pullRequestAlreadyExists returns true if the pull request could not be created
+// because there is already one for the same head and base.
+func pullRequestAlreadyExists(err error) bool {
+	var ghErr *github.ErrorResponse
+	if !errors.As(err, &ghErr) || ghErr.Response == nil || ghErr.Response.StatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+
+	for _, e := range ghErr.Errors {
+		if strings.Contains(e.Message, "A pull request already exists") {
+			return true
+		}
+	}
+
+	return strings.Contains(ghErr.Message, "A pull request already exists")
+}
+
+// decoratePullRequest adds the labels, requests the reviews, and enables auto-merge, as configured.
+// Reviews are requested only for the newly created pull request, so that reviewers who dismissed
+// the request are not bothered again on every push.
+func (c *PullRequest) decoratePullRequest(ctx context.Context, client *github.Client, pr *github.PullRequest, created bool) error {
+	owner, repo := c.ownerRepo()
+
+	number := pr.GetNumber()
+
+	if len(c.PullRequest.Labels) > 0 {
+		if err := retry.Do(ctx, fmt.Sprintf("add labels to %s/%s#%d", owner, repo, number), func() error {
+			_, _, err := client.Issues.AddLabelsToIssue(ctx, owner, repo, number, c.PullRequest.Labels)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	if created && (len(c.PullRequest.Reviewers) > 0 || len(c.PullRequest.TeamReviewers) > 0) {
+		if err := retry.Do(ctx, fmt.Sprintf("request reviews for %s/%s#%d", owner, repo, number), func() error {
+			_, _, err := client.PullRequests.RequestReviewers(ctx, owner, repo, number, github.ReviewersRequest{
+				Reviewers:     c.PullRequest.Reviewers,
+				TeamReviewers: c.PullRequest.TeamReviewers,
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	if c.PullRequest.AutoMerge != "" {
+		if err := retry.Do(ctx, fmt.Sprintf("enable auto-merge for %s/%s#%d", owner, repo, number), func() error {
+			return enableAutoMerge(ctx, client, pr.GetNodeID(), c.PullRequest.AutoMerge)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *PullRequest) findOpenPullRequest(ctx context.Context, client *github.Client) (*github.PullRequest, error) {
+	owner, repo := c.ownerRepo()
+
+	var prs []*github.PullRequest
+
+	if err := retry.Do(ctx, fmt.Sprintf("list pull requests in %s/%s", owner, repo), func() error {
+		var err error
+		prs, _, err = client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+			State: "open",
+			Head:  owner + ":" + c.Git.NewRefName.Short(),
+			Base:  c.Git.BaseRefName.Short(),
+		})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, pr := range prs {
+		if pr.GetHead().GetRef() == c.Git.NewRefName.Short() {
+			return pr, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *PullRequest) renderTitleAndBody(subject, body string) (string, string, error) {
+	data := PullRequestTemplateData{
+		EnvArgs:     c.EnvArgs,
+		Provisioner: c.Provisioner,
+		Action:      c.Action,
+		Subject:     subject,
+		Body:        body,
+	}
+
+	title, err := executeTemplate("title", c.PullRequest.TitleTemplate, subject, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	body, err = executeTemplate("body", c.PullRequest.BodyTemplate, body, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return title, body, nil
+}
+
+func (c *PullRequest) ownerRepo() (string, string) {
 	split := strings.Split(c.RepositoryURL, "/")
 
 	owner := split[len(split)-2]
@@ -56,15 +297,63 @@ func (c *PullRequest) createPullRequest(ctx context.Context, subject, body strin
 		repo = repo[:len(repo)-len(".git")]
 	}
 
-	_, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
-		Title: github.String(subject),
-		Head:  github.String(string(*c.Git.NewRefName)),
-		Base:  github.String(string(c.Git.BaseRefName)),
-		Body:  github.String(body),
-	})
+	return owner, repo
+}
+
+func executeTemplate(name, text, defaultValue string, data interface{}) (string, error) {
+	if text == "" {
+		return defaultValue, nil
+	}
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse pull request %s template: %w", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to execute pull request %s template: %w", name, err)
+	}
+
+	return buf.String(), nil
+}
+
+// enableAutoMerge enables auto-merge of the pull request.
+// This is available only via the GraphQL API.
+func enableAutoMerge(ctx context.Context, client *github.Client, nodeID, mergeMethod string) error {
+	q := map[string]interface{}{
+		"query": `mutation($id: ID!, $method: PullRequestMergeMethod) {
+  enablePullRequestAutoMerge(input: {pullRequestId: $id, mergeMethod: $method}) {
+    clientMutationId
+  }
+}`,
+		"variables": map[string]interface{}{
+			"id":     nodeID,
+			"method": strings.ToUpper(mergeMethod),
+		},
+	}
+
+	// The GraphQL endpoint is https://api.github.com/graphql for github.com,
+	// and https://HOST/api/graphql for GitHub Enterprise Server whose REST API base URL is https://HOST/api/v3/.
+	// Resolving ../graphql against the REST API base URL gives the right endpoint in both cases.
+	req, err := client.NewRequest("POST", "../graphql", q)
 	if err != nil {
 		return err
 	}
 
+	var res struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	if _, err := client.Do(ctx, req, &res); err != nil {
+		return err
+	}
+
+	if len(res.Errors) > 0 {
+		return fmt.Errorf("unable to enable auto-merge: %s", res.Errors[0].Message)
+	}
+
 	return nil
 }
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/prenv/config"
+	"github.com/mumoshu/prenv/envvar"
+	"github.com/mumoshu/prenv/provisioner/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullRequestUpdatesExistingPullRequest(t *testing.T) {
+	baseDir := t.TempDir()
+
+	remoteDir := filepath.Join(baseDir, "owner", "repo.git")
+	seedDir := filepath.Join(baseDir, "seed")
+
+	runGit(t, baseDir, "init", "--bare", "--initial-branch=main", remoteDir)
+	runGit(t, baseDir, "clone", remoteDir, seedDir)
+	require.NoError(t, os.WriteFile(filepath.Join(seedDir, "README"), []byte("seed"), 0644))
+	runGit(t, seedDir, "add", ".")
+	runGit(t, seedDir, "commit", "-m", "initial commit")
+	runGit(t, seedDir, "push", "origin", "HEAD:main")
+
+	type pull struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		Body   string `json:"body"`
+		State  string `json:"state"`
+		Head   struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+	}
+
+	var pulls []*pull
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/pulls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			var open []*pull
+			for _, p := range pulls {
+				if p.State == "open" {
+					open = append(open, p)
+				}
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(open))
+		case http.MethodPost:
+			var req struct {
+				Title string `json:"title"`
+				Body  string `json:"body"`
+				Head  string `json:"head"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			p := &pull{Number: len(pulls) + 1, Title: req.Title, Body: req.Body, State: "open"}
+			p.Head.Ref = req.Head[len("refs/heads/"):]
+			pulls = append(pulls, p)
+			w.WriteHeader(http.StatusCreated)
+			require.NoError(t, json.NewEncoder(w).Encode(p))
+		}
+	})
+	mux.HandleFunc("/repos/owner/repo/pulls/1", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPatch, r.Method)
+		var req struct {
+			Title *string `json:"title"`
+			Body  *string `json:"body"`
+			State *string `json:"state"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		p := pulls[0]
+		if req.Title != nil {
+			p.Title = *req.Title
+		}
+		if req.Body != nil {
+			p.Body = *req.Body
+		}
+		if req.State != nil {
+			p.State = *req.State
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(p))
+	})
+	mux.HandleFunc("/repos/owner/repo/git/refs/heads/prenv/prenv-123/render", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodDelete, r.Method)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	t.Setenv(envvar.GitHubBaseURL, ts.URL+"/")
+	t.Setenv(envvar.GitRoot, filepath.Join(baseDir, "gitroot"))
+
+	env := config.EnvArgs{
+		Name: "prenv-123",
+		PullRequest: &config.PullRequestEnvArgs{
+			Number: 123,
+		},
+	}
+
+	ctx := context.Background()
+
+	apply := func(content string) {
+		t.Helper()
+
+		s := Init("render", env, "apply", &config.Delegate{
+			Git: &config.Git{
+				Repo:   "file://" + remoteDir,
+				Branch: "main",
+				Push:   true,
+			},
+			PullRequest: &config.PullRequest{
+				TitleTemplate: "Deploy {{ .Name }} via {{ .Provisioner }}",
+				BodyTemplate:  "{{ .Subject }}: {{ .PullRequest.Number }}",
+			},
+		})
+
+		_, err := s.Transact(func(dir string) (*plugin.RenderResult, error) {
+			if err := os.WriteFile(filepath.Join(dir, "rendered"), []byte(content), 0644); err != nil {
+				return nil, err
+			}
+			return &plugin.RenderResult{
+				AddedOrModifiedFiles: []string{"rendered"},
+			}, nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, s.Commit(ctx, "automated commit", "n/a"))
+	}
+
+	apply("first")
+	apply("second")
+
+	require.Len(t, pulls, 1)
+	require.Equal(t, "Deploy prenv-123 via render", pulls[0].Title)
+	require.Equal(t, "automated commit: 123", pulls[0].Body)
+	require.Equal(t, "second", runGit(t, baseDir, "--git-dir", remoteDir, "show", "prenv/prenv-123/render:rendered"))
+
+	s := Init("render", env, "destroy", &config.Delegate{
+		Git: &config.Git{
+			Repo:   "file://" + remoteDir,
+			Branch: "main",
+			Push:   true,
+		},
+		PullRequest: &config.PullRequest{},
+	})
+
+	pr, ok := s.(*PullRequest)
+	require.True(t, ok)
+	require.True(t, pr.ClosesOnDestroy())
+
+	closed, err := pr.Close(ctx)
+	require.NoError(t, err)
+	require.True(t, closed)
+	require.Equal(t, "closed", pulls[0].State)
+}
+
+func TestPullRequestCreateFindsPullRequestCreatedByFailedAttempt(t *testing.T) {
+	baseDir := t.TempDir()
+
+	remoteDir := filepath.Join(baseDir, "owner", "repo.git")
+	seedDir := filepath.Join(baseDir, "seed")
+
+	runGit(t, baseDir, "init", "--bare", "--initial-branch=main", remoteDir)
+	runGit(t, baseDir, "clone", remoteDir, seedDir)
+	require.NoError(t, os.WriteFile(filepath.Join(seedDir, "README"), []byte("seed"), 0644))
+	runGit(t, seedDir, "add", ".")
+	runGit(t, seedDir, "commit", "-m", "initial commit")
+	runGit(t, seedDir, "push", "origin", "HEAD:main")
+
+	type pull struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		State  string `json:"state"`
+		Head   struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+	}
+
+	var (
+		pulls   []*pull
+		creates int
+		edits   int
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/pulls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			require.NoError(t, json.NewEncoder(w).Encode(pulls))
+		case http.MethodPost:
+			creates++
+			if len(pulls) > 0 {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, err := w.Write([]byte(`{"message":"Validation Failed","errors":[{"resource":"PullRequest","code":"custom","message":"A pull request already exists for owner:prenv/prenv-123/render."}]}`))
+				require.NoError(t, err)
+				return
+			}
+			// The pull request is created, but the response is lost.
+			p := &pull{Number: 1, State: "open"}
+			p.Head.Ref = "prenv/prenv-123/render"
+			pulls = append(pulls, p)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	mux.HandleFunc("/repos/owner/repo/pulls/1", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPatch, r.Method)
+		var req struct {
+			Title string `json:"title"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		edits++
+		pulls[0].Title = req.Title
+		require.NoError(t, json.NewEncoder(w).Encode(pulls[0]))
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	t.Setenv(envvar.GitHubBaseURL, ts.URL+"/")
+	t.Setenv(envvar.GitRoot, filepath.Join(baseDir, "gitroot"))
+
+	s := Init("render", config.EnvArgs{Name: "prenv-123"}, "apply", &config.Delegate{
+		Git: &config.Git{
+			Repo:   "file://" + remoteDir,
+			Branch: "main",
+			Push:   true,
+		},
+		PullRequest: &config.PullRequest{
+			TitleTemplate: "Deploy {{ .Name }}",
+		},
+	})
+
+	_, err := s.Transact(func(dir string) (*plugin.RenderResult, error) {
+		if err := os.WriteFile(filepath.Join(dir, "rendered"), []byte("content"), 0644); err != nil {
+			return nil, err
+		}
+		return &plugin.RenderResult{
+			AddedOrModifiedFiles: []string{"rendered"},
+		}, nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Commit(context.Background(), "automated commit", "n/a"))
+
+	require.Equal(t, 2, creates)
+	require.Equal(t, 1, edits, "the pull request created by the failed attempt must be updated")
+	require.Len(t, pulls, 1)
+	require.Equal(t, "Deploy prenv-123", pulls[0].Title)
+}
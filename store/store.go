@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/mumoshu/prenv/config"
@@ -46,8 +45,13 @@ type Store interface {
 }
 
 // Init inits file store based on the given config.Delegate.
-func Init(id string, t time.Time, d *config.Delegate) Store {
-	if d == nil {
+//
+// id is the name of the provisioner that uses the store,
+// and env is the environment the provisioner is run for.
+// op is either "apply" or "destroy", used to generate the title and the body of the pull request.
+func Init(id string, env config.EnvArgs, op string, d *config.Delegate) Store {
+	// Provisioners that embed config.Delegate always have a non-nil one, even when no gitops repository is configured.
+	if d == nil || d.Git == nil {
 		return newLocal(id)
 	}
 
@@ -60,7 +64,7 @@ func Init(id string, t time.Time, d *config.Delegate) Store {
 		repoURL = githubBaseURL + d.Git.Repo + ".git"
 	} else if strings.Count(d.Git.Repo, "/") == 2 {
 		repoURL = "https://" + d.Git.Repo + ".git"
-	} else if strings.HasPrefix(d.Git.Repo, "https://") {
+	} else if strings.HasPrefix(d.Git.Repo, "https://") || strings.HasPrefix(d.Git.Repo, "file://") {
 		repoURL = d.Git.Repo
 	} else {
 		panic(fmt.Sprintf("invalid repo in prenv.yaml: %s", d.Git.Repo))
@@ -79,7 +83,9 @@ func Init(id string, t time.Time, d *config.Delegate) Store {
 	var newBranch string
 
 	if d.PullRequest != nil {
-		newBranch = fmt.Sprintf("prenv/%s-%s", id, t.Format("20060102150405"))
+		// The branch is stable per environment and provisioner,
+		// so that subsequent runs update the existing pull request.
+		newBranch = fmt.Sprintf("prenv/%s/%s", env.Name, id)
 	}
 
 	gitRoot := os.Getenv(envvar.GitRoot)
@@ -99,10 +105,15 @@ func Init(id string, t time.Time, d *config.Delegate) Store {
 	)
 
 	if d.PullRequest != nil {
+		g.ForcePush = d.PullRequest.Update != config.PullRequestUpdateAppend
+
 		return &PullRequest{
 			RepositoryURL: repoURL,
 			Git:           g,
 			PullRequest:   d.PullRequest,
+			Provisioner:   id,
+			Action:        op,
+			EnvArgs:       env,
 		}
 	}
 
@@ -20,57 +20,22 @@ import (
 )
 
 func TestDispatchThenGitOps(t *testing.T) {
-	hooks := testServerRepoHooks{
-		repos: map[string]*testServerHooks{},
-	}
-
-	var (
-		sourceRepo = "mumoshu/prenv-source"
-		targetRepo = "mumoshu/prenv-target"
-
-		testdataDir           = "gitops"
-		testdataSourceRepoDir = filepath.Join(testdataDir, "repositories", "mumoshu", "prenv-source")
-		testdataTargetRepoDir = filepath.Join(testdataDir, "repositories", "mumoshu", "prenv-target")
-	)
-
-	ts, err := newTestServer([]string{
-		sourceRepo,
-		targetRepo,
-	}, &hooks)
-	require.NoError(t, err)
-
-	baseDir := t.TempDir()
-
-	gitServerRoot := filepath.Join(baseDir, "gitserver")
-
-	gts, err := newTestGitServer(gitServerRoot, os.Getenv(envvar.GitHubToken), testdataDir, []string{
-		sourceRepo,
-		targetRepo,
-	})
-	require.NoError(t, err)
-
-	gtsURL := strings.Replace(gts.URL+"/", "127.0.0.1", "localhost", 1)
-
-	sourceRepoDir := createDirFromTestdataDir(t, baseDir, testdataSourceRepoDir)
-	targetRepoDir := createDirFromTestdataDir(t, baseDir, testdataTargetRepoDir)
+	e := newTestEnv(t)
 
 	wd, err := os.Getwd()
 	require.NoError(t, err)
 
 	err = run(args{
 		Command: []string{"apply"},
-		Env: map[string]string{
-			// BaseURL must have a trailing slash, as required by go-github
-			envvar.GitHubBaseURL:       ts.URL + "/",
-			envvar.GitHubEventPath:     filepath.Join(wd, "testdata", testdataDir, "events", "01-pull_request.json"),
-			envvar.GitHubRepository:    sourceRepo,
-			envvar.GitHubEnterpriseURL: gtsURL,
-		},
-		Dir: sourceRepoDir,
+		Env: e.env(map[string]string{
+			envvar.GitHubEventPath:  filepath.Join(wd, "testdata", testdataDir, "events", "01-pull_request.json"),
+			envvar.GitHubRepository: sourceRepo,
+		}),
+		Dir: e.sourceRepoDir,
 	})
 	require.NoError(t, err)
 
-	rawConfig := "dedicated:\n  components:\n    sourceapp:\n      render:\n        git:\n          repo: mumoshu/prenv-source\n          branch: main\n          path: deploy\n          push: true\n        files:\n        - name: kubernetes/test.configmap.yaml\n          contentTemplate: |\n            apiVersion: v1\n            kind: ConfigMap\n            metadata:\n              name: test\n            data:\n              pr_nums.json: |\n                {{ .PullRequest.Numbers | toJson }}\n        - name: terraform/test.auto.tfvars.json\n          contentTemplate: |\n            {\"prenv_pull_request_numbers\": {{ .PullRequest.Numbers | toJson }}}\n    targetapp:\n      render:\n        git:\n          repo: mumoshu/prenv-target\n          branch: main\n          path: apps\n          push: true\n        pullRequest: {}\n        repositoryDispatch:\n          owner: mumoshu\n          repo: prenv-target\n        files:\n        - nameTemplate: app.{{ .PullRequest.Number }}.yaml\n          contentTemplate: |\n            kind: Application\n            apiVersion: argoproj.io/v1alpha1\n            metadata:\n              name: app-{{ .PullRequest.Number }}\n            spec:\n              project: default\n              source:\n                repoURL: https://github.com/mumoshu/prenv-target\n                targetRevision: main\n                path: kustomize\n              destination:\n                server: https://kubernetes.default.svc\n                namespace: default\n              kustomize:\n                namePrefix: app-{{ .PullRequest.Number }}-\n                images:\n                - name: myapp\n                  newTag: {{ .PullRequest.HeadSHA }}\n              syncPolicy:\n                automated:\n                  prune: true\n                  selfHeal: true\n                  allowEmpty: true\n                  apply:\n                    force: true\n              syncWave: 1\n              syncOptions:\n              - CreateNamespace=true\nargs:\n  name: prenv-123\n  appnametemplate: '{{ .Environment.Name }}-{{ .Environment.PullRequestNumber }}-{{\n    .ShortName }}'\n  pullRequest:\n    number: 123\n    repository: mumoshu/prenv-source\n"
+	rawConfig := "dedicated:\n  components:\n    sourceapp:\n      render:\n        git:\n          repo: mumoshu/prenv-source\n          branch: main\n          path: deploy\n          push: true\n        files:\n        - name: kubernetes/test.configmap.yaml\n          contentTemplate: |\n            apiVersion: v1\n            kind: ConfigMap\n            metadata:\n              name: test\n            data:\n              pr_nums.json: |\n                {{ .PullRequest.Numbers | toJson }}\n        - name: terraform/test.auto.tfvars.json\n          contentTemplate: |\n            {\"prenv_pull_request_numbers\": {{ .PullRequest.Numbers | toJson }}}\n    targetapp:\n      render:\n        git:\n          repo: mumoshu/prenv-target\n          branch: main\n          path: apps\n          push: true\n        pullRequest: {}\n        repositoryDispatch:\n          owner: mumoshu\n          repo: prenv-target\n        files:\n        - nameTemplate: app.{{ .PullRequest.Number }}.yaml\n          contentTemplate: |\n            kind: Application\n            apiVersion: argoproj.io/v1alpha1\n            metadata:\n              name: app-{{ .PullRequest.Number }}\n            spec:\n              project: default\n              source:\n                repoURL: https://github.com/mumoshu/prenv-target\n                targetRevision: main\n                path: kustomize\n              destination:\n                server: https://kubernetes.default.svc\n                namespace: default\n              kustomize:\n                namePrefix: app-{{ .PullRequest.Number }}-\n                images:\n                - name: myapp\n                  newTag: {{ .PullRequest.HeadSHA }}\n              syncPolicy:\n                automated:\n                  prune: true\n                  selfHeal: true\n                  allowEmpty: true\n                  apply:\n                    force: true\n              syncWave: 1\n              syncOptions:\n              - CreateNamespace=true\nargs:\n  name: prenv-123\n  appnametemplate: '{{ .Environment.Name }}-{{ .Environment.PullRequestNumber }}-{{\n    .ShortName }}'\n  pullRequest:\n    number: 123\n    repository: mumoshu/prenv-source\n  event:\n    pull_request:\n      number: 123\n"
 
 	wantRepositoryDispatches := []repositoryDispatch{
 		{
@@ -82,27 +47,24 @@ func TestDispatchThenGitOps(t *testing.T) {
 		},
 	}
 
-	require.Equal(t, wantRepositoryDispatches, hooks.repos[targetRepo].RepositoryDispatches)
-	require.Empty(t, hooks.repos[targetRepo].PullRequests)
+	require.Equal(t, wantRepositoryDispatches, e.hooks.repos[targetRepo].RepositoryDispatches)
+	require.Empty(t, e.hooks.repos[targetRepo].PullRequests)
 
-	githubEventPath := filepath.Join(baseDir, "events", "repository_dispatch.json")
+	githubEventPath := filepath.Join(e.baseDir, "events", "repository_dispatch.json")
 	eventDir := filepath.Dir(githubEventPath)
 	require.NoError(t, os.MkdirAll(eventDir, 0755))
 
-	eventData, err := json.Marshal(hooks.repos[targetRepo].RepositoryDispatches[0].ToActionEvent())
+	eventData, err := json.Marshal(e.hooks.repos[targetRepo].RepositoryDispatches[0].ToActionEvent())
 	require.NoError(t, err)
 	require.NoError(t, os.WriteFile(githubEventPath, eventData, 0644))
 
 	err = run(args{
 		Command: []string{"action"},
-		Env: map[string]string{
-			envvar.GitHubEventPath: githubEventPath,
-			// BaseURL must have a trailing slash, as required by go-github
-			envvar.GitHubBaseURL:       ts.URL + "/",
-			envvar.GitHubRepository:    targetRepo,
-			envvar.GitHubEnterpriseURL: gtsURL,
-		},
-		Dir: targetRepoDir,
+		Env: e.env(map[string]string{
+			envvar.GitHubEventPath:  githubEventPath,
+			envvar.GitHubRepository: targetRepo,
+		}),
+		Dir: e.targetRepoDir,
 	})
 	require.NoError(t, err)
 
@@ -114,7 +76,216 @@ func TestDispatchThenGitOps(t *testing.T) {
 			Body: "n/a",
 		},
 	}
-	require.Equal(t, wantPullRequests, hooks.repos[targetRepo].PullRequests)
+	require.Equal(t, wantPullRequests, e.hooks.repos[targetRepo].PullRequests)
+}
+
+func TestSignedDispatchThenGitOps(t *testing.T) {
+	e := newTestEnv(t)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	err = run(args{
+		Command: []string{"apply"},
+		Env: e.env(map[string]string{
+			envvar.GitHubEventPath:  filepath.Join(wd, "testdata", testdataDir, "events", "01-pull_request.json"),
+			envvar.GitHubRepository: sourceRepo,
+			envvar.DispatchHMACKey:  "s3cr3t",
+		}),
+		Dir: e.sourceRepoDir,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, e.hooks.repos[targetRepo].RepositoryDispatches, 1)
+
+	dispatch := e.hooks.repos[targetRepo].RepositoryDispatches[0]
+	require.Equal(t, "prenv-apply", dispatch.ClientPayload["action"])
+	require.Equal(t, sourceRepo, dispatch.ClientPayload["source_repository"])
+	require.Regexp(t, "^hmac-sha256=", dispatch.ClientPayload["signature"])
+
+	writeEvent := func(name string, event repositoryDispatchActionEvent) string {
+		path := filepath.Join(e.baseDir, "events", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+
+		data, err := json.Marshal(event)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data, 0644))
+
+		return path
+	}
+
+	targetEnv := func(eventPath string) map[string]string {
+		return e.env(map[string]string{
+			envvar.GitHubEventPath:             eventPath,
+			envvar.GitHubRepository:            targetRepo,
+			envvar.DispatchHMACKey:             "s3cr3t",
+			envvar.DispatchAllowedRepositories: "mumoshu/*",
+		})
+	}
+
+	tampered := dispatch.ToActionEvent()
+	tampered.ClientPayload = map[string]interface{}{}
+	for k, v := range dispatch.ClientPayload {
+		tampered.ClientPayload[k] = v
+	}
+	tampered.ClientPayload["raw_config"] = strings.Replace(dispatch.ClientPayload["raw_config"].(string), "app-{{", "evil-{{", 1)
+
+	err = run(args{
+		Command: []string{"action"},
+		Env:     targetEnv(writeEvent("tampered.json", tampered)),
+		Dir:     e.targetRepoDir,
+	})
+	require.ErrorContains(t, err, "unable to verify the payload sent from another repository: invalid signature")
+	require.Empty(t, e.hooks.repos[targetRepo].PullRequests)
+
+	err = run(args{
+		Command: []string{"action"},
+		Env:     targetEnv(writeEvent("repository_dispatch.json", dispatch.ToActionEvent())),
+		Dir:     e.targetRepoDir,
+	})
+	require.NoError(t, err)
+	require.Len(t, e.hooks.repos[targetRepo].PullRequests, 1)
+}
+
+func TestApplyWithFlags(t *testing.T) {
+	e := newTestEnv(t)
+
+	// Note that neither GITHUB_EVENT_PATH, GITHUB_SHA, nor GITHUB_REPOSITORY is set,
+	// as if prenv is run outside of GitHub Actions.
+	t.Setenv(envvar.GitHubRepository, "")
+
+	err := run(args{
+		Command: []string{"apply", "--pr", "234", "--sha", "0123abc", "--repo", sourceRepo, "--config", filepath.Join(e.sourceRepoDir, "prenv.yaml")},
+		Env: e.env(map[string]string{
+			envvar.DispatchHMACKey: "s3cr3t",
+		}),
+		Dir: e.sourceRepoDir,
+	})
+	require.NoError(t, err)
+
+	dispatches := e.hooks.repos[targetRepo].RepositoryDispatches
+	require.Len(t, dispatches, 1)
+
+	// The payload is signed as sent from the repository given via --repo.
+	require.Equal(t, sourceRepo, dispatches[0].ClientPayload["source_repository"])
+	require.Regexp(t, "^hmac-sha256=", dispatches[0].ClientPayload["signature"])
+
+	rawConfig, ok := dispatches[0].ClientPayload["raw_config"].(string)
+	require.True(t, ok)
+	require.Contains(t, rawConfig, "  name: prenv-234\n")
+	require.Contains(t, rawConfig, "    number: 234\n    headSHA: 0123abc\n    repository: mumoshu/prenv-source\n")
+}
+
+func TestDestroyDeletesRenderedFiles(t *testing.T) {
+	e := newTestEnv(t)
+
+	listFiles := func() string {
+		t.Helper()
+
+		cmd := exec.Command("git", "--git-dir", filepath.Join(e.gitServerRoot, sourceRepo+".git"), "ls-tree", "-r", "--name-only", "main")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+
+		return string(out)
+	}
+
+	for _, command := range []string{"apply", "destroy"} {
+		err := run(args{
+			Command: []string{command, "--pr", "234", "--sha", "0123abc", "--repo", sourceRepo, "--config", filepath.Join(e.sourceRepoDir, "prenv.yaml")},
+			Env:     e.env(nil),
+			Dir:     e.sourceRepoDir,
+		})
+		require.NoError(t, err)
+
+		if command == "apply" {
+			require.Contains(t, listFiles(), "kubernetes/test.configmap.yaml\n")
+			require.Contains(t, listFiles(), "terraform/test.auto.tfvars.json\n")
+			require.Contains(t, listFiles(), ".prenv-owned.pr-sourceapp-render.prenv-234.yaml\n")
+		}
+	}
+
+	require.NotContains(t, listFiles(), "kubernetes/test.configmap.yaml\n")
+	require.NotContains(t, listFiles(), "terraform/test.auto.tfvars.json\n")
+	require.NotContains(t, listFiles(), ".prenv-owned.pr-sourceapp-render.prenv-234.yaml\n")
+	require.Contains(t, listFiles(), "prenv.yaml\n")
+}
+
+const (
+	sourceRepo = "mumoshu/prenv-source"
+	targetRepo = "mumoshu/prenv-target"
+
+	testdataDir = "gitops"
+)
+
+// testEnv is the fake GitHub API and the git server that serve the source and the target repositories,
+// and the working copies of the repositories that prenv runs in.
+type testEnv struct {
+	hooks testServerRepoHooks
+
+	apiURL        string
+	gitURL        string
+	gitServerRoot string
+
+	baseDir       string
+	sourceRepoDir string
+	targetRepoDir string
+}
+
+// newTestEnv starts the fake GitHub API and the git server for the test.
+// It also sets the GitHub token and the git identity for the test,
+// so that the test depends on neither the environment variables nor the global git config of the machine.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	t.Setenv(envvar.GitHubToken, "test-token")
+
+	for _, k := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(k, "prenv-test")
+	}
+
+	for _, k := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(k, "prenv-test@example.com")
+	}
+
+	e := &testEnv{
+		hooks: testServerRepoHooks{
+			repos: map[string]*testServerHooks{},
+		},
+		baseDir: t.TempDir(),
+	}
+
+	ts, err := newTestServer([]string{sourceRepo, targetRepo}, &e.hooks)
+	require.NoError(t, err)
+	t.Cleanup(ts.Close)
+
+	e.gitServerRoot = filepath.Join(e.baseDir, "gitserver")
+
+	gts, err := newTestGitServer(e.gitServerRoot, os.Getenv(envvar.GitHubToken), testdataDir, []string{sourceRepo, targetRepo})
+	require.NoError(t, err)
+	t.Cleanup(gts.Close)
+
+	// BaseURL must have a trailing slash, as required by go-github
+	e.apiURL = ts.URL + "/"
+	e.gitURL = strings.Replace(gts.URL+"/", "127.0.0.1", "localhost", 1)
+
+	e.sourceRepoDir = createDirFromTestdataDir(t, e.baseDir, filepath.Join(testdataDir, "repositories", sourceRepo))
+	e.targetRepoDir = createDirFromTestdataDir(t, e.baseDir, filepath.Join(testdataDir, "repositories", targetRepo))
+
+	return e
+}
+
+// env returns the environment variables that point prenv to the fake servers, along with the extra ones.
+func (e *testEnv) env(extra map[string]string) map[string]string {
+	env := map[string]string{
+		envvar.GitHubBaseURL:       e.apiURL,
+		envvar.GitHubEnterpriseURL: e.gitURL,
+	}
+
+	for k, v := range extra {
+		env[k] = v
+	}
+
+	return env
 }
 
 func createDirFromTestdataDir(t *testing.T, baseDir, testdataDir string) string {